@@ -0,0 +1,409 @@
+package indexer
+
+import "github.com/cwacek/irengine/scanner/filereader"
+import "container/heap"
+import "math"
+
+/* Boolean operators over posting list iterators. Each operator is
+ * itself a PostingListIterator, so they nest, as in
+ * AndNot(And(a, b), Or(c, d)), and none of them reads further into
+ * a list than it has to.
+ *
+ * A conjunction leapfrogs its lists with SkipTo, which skips whole
+ * blocks of a compressed list and seeks in the others, so a rare
+ * term keeps a common one from being read in full. A disjunction
+ * merges its lists with a heap. The entry for a document which
+ * matches is the combination of the entries of the lists holding
+ * it: their positions if they all have them, and otherwise just
+ * their summed frequencies.
+ *
+ * Score bounds are the sum of the bounds of the lists, which holds
+ * for any scorer that is zero when the frequency is. */
+
+// Documents in every one of its
+func And(its ...PostingListIterator) PostingListIterator {
+	if len(its) == 1 {
+		return its[0]
+	}
+	return &and_iterator{its: its}
+}
+
+// Documents in any of its
+func Or(its ...PostingListIterator) PostingListIterator {
+	if len(its) == 1 {
+		return its[0]
+	}
+	return &or_iterator{its: its}
+}
+
+// Documents in it which aren't in excluded
+func AndNot(it, excluded PostingListIterator) PostingListIterator {
+	return &and_not_iterator{it: it, excluded: excluded}
+}
+
+/* Read every entry from it into a new posting list created by
+ * plInit. Frequencies are kept even if plInit isn't positional. */
+func Collect(it PostingListIterator, plInit PostingListInitializer) PostingList {
+	pl := plInit.Create()
+
+	for it.Next() {
+		entry := it.Value()
+		copied := pl.EntryFactory(entry.DocId())
+
+		if plInit.Positional {
+			for _, pos := range entry.Positions() {
+				copied.AddPosition(pos)
+			}
+		} else {
+			for i := 0; i < entry.Frequency(); i++ {
+				copied.AddPosition(0)
+			}
+		}
+		pl.InsertCompleteEntry(copied)
+	}
+	return pl
+}
+
+// Combine the entries different lists have for the same document
+func mergeEntries(entries []PostingListEntry) PostingListEntry {
+	if len(entries) == 1 {
+		return entries[0]
+	}
+
+	positional := true
+	for _, entry := range entries {
+		if len(entry.Positions()) == 0 {
+			positional = false
+		}
+	}
+
+	var merged PostingListEntry
+	if positional {
+		merged = NewPositionalEntry(entries[0].DocId())
+		for _, entry := range entries {
+			for _, pos := range entry.Positions() {
+				merged.AddPosition(pos)
+			}
+		}
+	} else {
+		merged = NewBasicEntry(entries[0].DocId())
+		for _, entry := range entries {
+			for i := 0; i < entry.Frequency(); i++ {
+				merged.AddPosition(0)
+			}
+		}
+	}
+	return merged
+}
+
+type and_iterator struct {
+	its       []PostingListIterator
+	doc       filereader.DocumentId
+	started   bool
+	exhausted bool
+}
+
+// Move every list to the first document at or after target they all hold
+func (a *and_iterator) align(target filereader.DocumentId) bool {
+	a.started = true
+
+	for i := 0; i < len(a.its); {
+		if !a.its[i].SkipTo(target) {
+			a.exhausted = true
+			return false
+		}
+
+		if doc := a.its[i].Value().DocId(); doc > target {
+			target = doc
+			i = 0
+		} else {
+			i++
+		}
+	}
+
+	a.doc = target
+	return true
+}
+
+func (a *and_iterator) Next() bool {
+	if a.exhausted || !a.its[0].Next() {
+		a.exhausted = true
+		return false
+	}
+	return a.align(a.its[0].Value().DocId())
+}
+
+func (a *and_iterator) SkipTo(id filereader.DocumentId) bool {
+	switch {
+	case a.exhausted:
+		return false
+	case a.started && a.doc >= id:
+		return true
+	}
+	return a.align(id)
+}
+
+func (a *and_iterator) Value() PostingListEntry {
+	entries := make([]PostingListEntry, len(a.its))
+	for i, it := range a.its {
+		entries[i] = it.Value()
+	}
+	return mergeEntries(entries)
+}
+
+func (a *and_iterator) Key() int {
+	return int(a.doc)
+}
+
+func (a *and_iterator) NextShallow(id filereader.DocumentId) {
+	for _, it := range a.its {
+		it.NextShallow(id)
+	}
+}
+
+func (a *and_iterator) BlockEnd() filereader.DocumentId {
+	end := a.its[0].BlockEnd()
+	for _, it := range a.its[1:] {
+		if e := it.BlockEnd(); e < end {
+			end = e
+		}
+	}
+	return end
+}
+
+func (a *and_iterator) BlockMaxScore() float64 {
+	score := 0.0
+	for _, it := range a.its {
+		score += it.BlockMaxScore()
+	}
+	return score
+}
+
+func (a *and_iterator) MaxScore() float64 {
+	score := 0.0
+	for _, it := range a.its {
+		score += it.MaxScore()
+	}
+	return score
+}
+
+func (a *and_iterator) SetScorer(scorer TfScorer) {
+	for _, it := range a.its {
+		it.SetScorer(scorer)
+	}
+}
+
+// Positioned iterators, ordered by their current document
+type iterator_heap []PostingListIterator
+
+func (h iterator_heap) Len() int {
+	return len(h)
+}
+
+func (h iterator_heap) Less(i, j int) bool {
+	return h[i].Value().DocId() < h[j].Value().DocId()
+}
+
+func (h iterator_heap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *iterator_heap) Push(x interface{}) {
+	*h = append(*h, x.(PostingListIterator))
+}
+
+func (h *iterator_heap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+type or_iterator struct {
+	its []PostingListIterator
+
+	// The lists past the current document, and those on it
+	waiting iterator_heap
+	matched []PostingListIterator
+
+	doc       filereader.DocumentId
+	started   bool
+	exhausted bool
+}
+
+// Make the lists on the smallest waiting document the matched ones
+func (o *or_iterator) advance() bool {
+	o.matched = o.matched[:0]
+	if len(o.waiting) == 0 {
+		o.exhausted = true
+		return false
+	}
+
+	o.doc = o.waiting[0].Value().DocId()
+	for len(o.waiting) > 0 && o.waiting[0].Value().DocId() == o.doc {
+		o.matched = append(o.matched, heap.Pop(&o.waiting).(PostingListIterator))
+	}
+	return true
+}
+
+func (o *or_iterator) Next() bool {
+	if o.exhausted {
+		return false
+	}
+
+	if !o.started {
+		o.started = true
+		for _, it := range o.its {
+			if it.Next() {
+				heap.Push(&o.waiting, it)
+			}
+		}
+	} else {
+		for _, it := range o.matched {
+			if it.Next() {
+				heap.Push(&o.waiting, it)
+			}
+		}
+	}
+	return o.advance()
+}
+
+func (o *or_iterator) SkipTo(id filereader.DocumentId) bool {
+	switch {
+	case o.exhausted:
+		return false
+	case o.started && o.doc >= id:
+		return true
+	}
+
+	var behind []PostingListIterator
+	if !o.started {
+		o.started = true
+		behind = o.its
+	} else {
+		behind = o.matched
+		for len(o.waiting) > 0 && o.waiting[0].Value().DocId() < id {
+			behind = append(behind, heap.Pop(&o.waiting).(PostingListIterator))
+		}
+	}
+
+	for _, it := range behind {
+		if it.SkipTo(id) {
+			heap.Push(&o.waiting, it)
+		}
+	}
+	return o.advance()
+}
+
+func (o *or_iterator) Value() PostingListEntry {
+	entries := make([]PostingListEntry, len(o.matched))
+	for i, it := range o.matched {
+		entries[i] = it.Value()
+	}
+	return mergeEntries(entries)
+}
+
+func (o *or_iterator) Key() int {
+	return int(o.doc)
+}
+
+func (o *or_iterator) NextShallow(id filereader.DocumentId) {
+	for _, lists := range [][]PostingListIterator{o.matched, o.waiting} {
+		for _, it := range lists {
+			it.NextShallow(id)
+		}
+	}
+}
+
+/* The current block ends where the first of the positioned lists'
+ * blocks does, since every one of them could hold a document
+ * before that. */
+func (o *or_iterator) BlockEnd() filereader.DocumentId {
+	end := filereader.DocumentId(math.MaxUint32)
+	for _, lists := range [][]PostingListIterator{o.matched, o.waiting} {
+		for _, it := range lists {
+			if e := it.BlockEnd(); e < end {
+				end = e
+			}
+		}
+	}
+	return end
+}
+
+func (o *or_iterator) BlockMaxScore() float64 {
+	score := 0.0
+	for _, lists := range [][]PostingListIterator{o.matched, o.waiting} {
+		for _, it := range lists {
+			score += it.BlockMaxScore()
+		}
+	}
+	return score
+}
+
+func (o *or_iterator) MaxScore() float64 {
+	score := 0.0
+	for _, it := range o.its {
+		score += it.MaxScore()
+	}
+	return score
+}
+
+func (o *or_iterator) SetScorer(scorer TfScorer) {
+	for _, it := range o.its {
+		it.SetScorer(scorer)
+	}
+}
+
+type and_not_iterator struct {
+	it       PostingListIterator
+	excluded PostingListIterator
+}
+
+// Move it forward until it's on a document which isn't excluded
+func (a *and_not_iterator) skipExcluded() bool {
+	for {
+		doc := a.it.Value().DocId()
+		if !a.excluded.SkipTo(doc) || a.excluded.Value().DocId() != doc {
+			return true
+		}
+		if !a.it.Next() {
+			return false
+		}
+	}
+}
+
+func (a *and_not_iterator) Next() bool {
+	return a.it.Next() && a.skipExcluded()
+}
+
+func (a *and_not_iterator) SkipTo(id filereader.DocumentId) bool {
+	return a.it.SkipTo(id) && a.skipExcluded()
+}
+
+func (a *and_not_iterator) Value() PostingListEntry {
+	return a.it.Value()
+}
+
+func (a *and_not_iterator) Key() int {
+	return a.it.Key()
+}
+
+func (a *and_not_iterator) NextShallow(id filereader.DocumentId) {
+	a.it.NextShallow(id)
+}
+
+func (a *and_not_iterator) BlockEnd() filereader.DocumentId {
+	return a.it.BlockEnd()
+}
+
+func (a *and_not_iterator) BlockMaxScore() float64 {
+	return a.it.BlockMaxScore()
+}
+
+func (a *and_not_iterator) MaxScore() float64 {
+	return a.it.MaxScore()
+}
+
+func (a *and_not_iterator) SetScorer(scorer TfScorer) {
+	a.it.SetScorer(scorer)
+}
@@ -0,0 +1,625 @@
+package indexer
+
+import "errors"
+import "fmt"
+import "math"
+import "sort"
+import "strings"
+import "github.com/cwacek/irengine/scanner/filereader"
+import log "github.com/cihub/seelog"
+
+// The number of postings stored in each compressed block
+const CompressedBlockSize = 128
+
+func init() {
+	RegisterPostingListInitializer(BasicPostingListInitializer)
+	RegisterPostingListInitializer(PositionalPostingListInitializer)
+
+	for _, codec := range codecs {
+		RegisterPostingListInitializer(
+			NewCompressedPostingListInitializer(codec, false))
+		RegisterPostingListInitializer(
+			NewCompressedPostingListInitializer(codec, true))
+	}
+}
+
+// Build an initializer for posting lists which are compressed
+// using codec. Positional lists also store position gaps.
+func NewCompressedPostingListInitializer(codec IntCodec,
+	positional bool) PostingListInitializer {
+
+	var name string
+	var factory func(filereader.DocumentId) PostingListEntry
+
+	if positional {
+		name = "compressed-positional-" + codec.Name()
+		factory = NewPositionalEntry
+	} else {
+		name = "compressed-" + codec.Name()
+		factory = NewBasicEntry
+	}
+
+	return PostingListInitializer{
+		Name:       name,
+		Positional: positional,
+		Create: func() PostingList {
+			pl := new(compressed_pl)
+			pl.codec = codec
+			pl.Positional = positional
+			pl.entry_factory = factory
+			pl.pending = make(map[filereader.DocumentId]PostingListEntry)
+			return pl
+		},
+	}
+}
+
+/* A block of compressed postings. Documents are stored as gaps
+ * from the previous document in the block (starting at First),
+ * followed by the frequencies and, for positional lists, the
+ * position gaps within each document. */
+type pl_block struct {
+	First, Last filereader.DocumentId
+	Count       int
+	MaxTf       int
+	data        []byte
+}
+
+type compressed_pl struct {
+	blocks        []*pl_block
+	pending       map[filereader.DocumentId]PostingListEntry
+	Length        int
+	Positional    bool
+	codec         IntCodec
+	entry_factory func(filereader.DocumentId) PostingListEntry
+}
+
+func (pl *compressed_pl) IsPositional() bool {
+	return pl.Positional
+}
+
+func (pl *compressed_pl) Len() int {
+	return pl.Length
+}
+
+func (pl *compressed_pl) EntryFactory(docid filereader.DocumentId) PostingListEntry {
+	return pl.entry_factory(docid)
+}
+
+/* Posting lists which buffer writes. Flush applies them, so that
+ * readers don't have to, and should be called once writing is done.
+ * Reading never flushes, so lists can be read concurrently. */
+type BufferedPostingList interface {
+	Flush()
+}
+
+func (pl *compressed_pl) Flush() {
+	pl.flush()
+}
+
+/* The number of bytes used by the compressed blocks. Entries which
+ * haven't been compressed yet aren't counted, and aren't flushed, so
+ * this is cheap and leaves the list as it is. See Pending. */
+func (pl *compressed_pl) CompressedSize() (size int) {
+	for _, block := range pl.blocks {
+		size += len(block.data)
+	}
+	return
+}
+
+// The entries waiting to be compressed, and their positions
+func (pl *compressed_pl) Pending() (entries, positions int) {
+	for _, entry := range pl.pending {
+		positions += len(entry.Positions())
+	}
+	return len(pl.pending), positions
+}
+
+/* The list with its pending entries merged into the blocks. If any
+ * are pending, this is a copy, and the list itself isn't changed. */
+func (pl *compressed_pl) flushed() *compressed_pl {
+	if len(pl.pending) == 0 {
+		return pl
+	}
+
+	merged := *pl
+	merged.blocks = append([]*pl_block(nil), pl.blocks...)
+	merged.flush()
+	return &merged
+}
+
+func (pl *compressed_pl) encodeBlock(entries []PostingListEntry) *pl_block {
+	block := new(pl_block)
+	block.First = entries[0].DocId()
+	block.Last = entries[len(entries)-1].DocId()
+	block.Count = len(entries)
+
+	gaps := make([]uint32, len(entries))
+	freqs := make([]uint32, len(entries))
+	positions := make([]uint32, 0)
+
+	prev := block.First
+	for i, entry := range entries {
+		gaps[i] = uint32(entry.DocId() - prev)
+		prev = entry.DocId()
+
+		// Frequencies are never zero, so store one less
+		freqs[i] = uint32(entry.Frequency() - 1)
+		if entry.Frequency() > block.MaxTf {
+			block.MaxTf = entry.Frequency()
+		}
+
+		if pl.Positional {
+			last := 0
+			for _, pos := range entry.Positions() {
+				positions = append(positions, uint32(pos-last))
+				last = pos
+			}
+		}
+	}
+
+	block.data = pl.codec.Encode(nil, gaps)
+	block.data = pl.codec.Encode(block.data, freqs)
+	if pl.Positional {
+		block.data = pl.codec.Encode(block.data, positions)
+	}
+	return block
+}
+
+func (pl *compressed_pl) decodeBlock(block *pl_block) []PostingListEntry {
+	var (
+		gaps, freqs, positions []uint32
+		read, n                int
+		err                    error
+	)
+
+	if gaps, n, err = pl.codec.Decode(block.data, block.Count, nil); err != nil {
+		panic(err)
+	}
+	read += n
+
+	if freqs, n, err = pl.codec.Decode(block.data[read:], block.Count, nil); err != nil {
+		panic(err)
+	}
+	read += n
+
+	if pl.Positional {
+		total := 0
+		for _, f := range freqs {
+			total += int(f) + 1
+		}
+		if positions, _, err = pl.codec.Decode(block.data[read:], total, nil); err != nil {
+			panic(err)
+		}
+	}
+
+	entries := make([]PostingListEntry, block.Count)
+	docid := block.First
+	for i := range entries {
+		docid += filereader.DocumentId(gaps[i])
+		entry := pl.entry_factory(docid)
+
+		if pl.Positional {
+			pos := 0
+			for _, gap := range positions[:freqs[i]+1] {
+				pos += int(gap)
+				entry.AddPosition(pos)
+			}
+			positions = positions[freqs[i]+1:]
+		} else {
+			for f := uint32(0); f <= freqs[i]; f++ {
+				entry.AddPosition(0)
+			}
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// Re-encode entries (sorted by document) into blocks
+func (pl *compressed_pl) encodeBlocks(entries []PostingListEntry) []*pl_block {
+	blocks := make([]*pl_block, 0, len(entries)/CompressedBlockSize+1)
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > CompressedBlockSize {
+			n = CompressedBlockSize
+		}
+		blocks = append(blocks, pl.encodeBlock(entries[:n]))
+		entries = entries[n:]
+	}
+	return blocks
+}
+
+/* Merge pending entries into the compressed blocks. Documents
+ * usually arrive in random order, so we buffer them and merge
+ * once the buffer is a reasonable fraction of the list. */
+func (pl *compressed_pl) flush() {
+	if len(pl.pending) == 0 {
+		return
+	}
+
+	pending := make(sortable_docid_entries, 0, len(pl.pending))
+	for _, entry := range pl.pending {
+		pending = append(pending, entry)
+	}
+	sort.Sort(pending)
+
+	// Find the first block that the pending entries touch. Everything
+	// before it can be kept as is.
+	keep := sort.Search(len(pl.blocks), func(i int) bool {
+		return pl.blocks[i].Last >= pending[0].DocId()
+	})
+
+	// Refill a partial last block rather than leaving it behind
+	if keep == len(pl.blocks) && keep > 0 &&
+		pl.blocks[keep-1].Count < CompressedBlockSize {
+		keep--
+	}
+
+	existing := make([]PostingListEntry, 0)
+	for _, block := range pl.blocks[keep:] {
+		existing = append(existing, pl.decodeBlock(block)...)
+	}
+
+	merged := make([]PostingListEntry, 0, len(existing)+len(pending))
+	i, j := 0, 0
+	for i < len(existing) || j < len(pending) {
+		switch {
+		case j == len(pending):
+			merged = append(merged, existing[i])
+			i++
+		case i == len(existing) || pending[j].DocId() < existing[i].DocId():
+			merged = append(merged, pending[j])
+			j++
+		default:
+			merged = append(merged, existing[i])
+			i++
+		}
+	}
+
+	pl.blocks = append(pl.blocks[:keep], pl.encodeBlocks(merged)...)
+	pl.pending = make(map[filereader.DocumentId]PostingListEntry)
+}
+
+func (pl *compressed_pl) findBlock(id filereader.DocumentId) (int, bool) {
+	i := sort.Search(len(pl.blocks), func(i int) bool {
+		return pl.blocks[i].Last >= id
+	})
+	return i, i < len(pl.blocks) && pl.blocks[i].First <= id
+}
+
+func (pl *compressed_pl) GetEntry(id filereader.DocumentId) (PostingListEntry, bool) {
+	if entry, ok := pl.pending[id]; ok {
+		return entry, true
+	}
+
+	if i, ok := pl.findBlock(id); ok {
+		for _, entry := range pl.decodeBlock(pl.blocks[i]) {
+			if entry.DocId() == id {
+				return entry, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Take the entry for id out of the compressed blocks, if it's there
+func (pl *compressed_pl) extract(id filereader.DocumentId) (PostingListEntry, bool) {
+	var found PostingListEntry
+
+	i, ok := pl.findBlock(id)
+	if !ok {
+		return nil, false
+	}
+
+	entries := pl.decodeBlock(pl.blocks[i])
+	kept := make([]PostingListEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.DocId() == id {
+			found = entry
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+
+	if found == nil {
+		return nil, false
+	}
+
+	if len(kept) == 0 {
+		pl.blocks = append(pl.blocks[:i], pl.blocks[i+1:]...)
+	} else {
+		pl.blocks[i] = pl.encodeBlock(kept)
+	}
+	return found, true
+}
+
+func (pl *compressed_pl) addPending(entry PostingListEntry) {
+	// Flush geometrically so that the cost of merging stays
+	// proportional to the number of insertions
+	if len(pl.pending) >= CompressedBlockSize &&
+		len(pl.pending) >= pl.Length/4 {
+		pl.flush()
+	}
+	pl.pending[entry.DocId()] = entry
+}
+
+func (pl *compressed_pl) InsertEntry(token *filereader.Token) bool {
+	log.Debugf("Inserting %s into compressed posting list.", token)
+	return pl.InsertRawEntry(token.Text, token.DocId, token.Position)
+}
+
+func (pl *compressed_pl) InsertRawEntry(text string,
+	docid filereader.DocumentId, position int) bool {
+
+	if entry, ok := pl.pending[docid]; ok {
+		entry.AddPosition(position)
+		return false
+	}
+
+	if entry, ok := pl.extract(docid); ok {
+		entry.AddPosition(position)
+		pl.pending[docid] = entry
+		return false
+	}
+
+	entry := pl.entry_factory(docid)
+	entry.AddPosition(position)
+	pl.addPending(entry)
+	pl.Length++
+	return true
+}
+
+func (pl *compressed_pl) InsertCompleteEntry(entry PostingListEntry) bool {
+	if _, ok := pl.pending[entry.DocId()]; ok {
+		pl.pending[entry.DocId()] = entry
+		return false
+	}
+
+	if _, ok := pl.extract(entry.DocId()); ok {
+		pl.pending[entry.DocId()] = entry
+		return false
+	}
+
+	pl.addPending(entry)
+	pl.Length++
+	return true
+}
+
+func (pl *compressed_pl) Remove(ids ...filereader.DocumentId) (count int) {
+	for _, id := range ids {
+		if _, ok := pl.pending[id]; ok {
+			delete(pl.pending, id)
+		} else if _, ok := pl.extract(id); !ok {
+			panic(fmt.Sprintf(
+				"Requested delete of %d, but it's not in posting list", id))
+		}
+		count++
+	}
+	pl.Length -= count
+	return
+}
+
+func (pl *compressed_pl) FilterSequential(other PostingList, within int) PostingList {
+	filtered := NewCompressedPostingListInitializer(pl.codec, true).Create()
+	return filterSequential(pl, other, within, filtered)
+}
+
+func (pl *compressed_pl) String() string {
+	entries := make([]string, 0, pl.Length)
+
+	for it := pl.Iterator(); it.Next(); {
+		entries = append(entries, it.Value().Serialize())
+	}
+	return strings.Join(entries, " | ")
+}
+
+func (pl *compressed_pl) Iterator() PostingListIterator {
+	iter := new(compressed_pl_iterator)
+	iter.pl = pl.flushed()
+	iter.block = -1
+	return iter
+}
+
+/* Decodes one block at a time. The block headers double as skip
+ * pointers, so SkipTo only decodes the block it lands in, and
+ * NextShallow moves over them without decoding anything. */
+type compressed_pl_iterator struct {
+	pl      *compressed_pl
+	block   int
+	entries []PostingListEntry
+	current PostingListEntry
+	scorer  TfScorer
+
+	// The block BlockEnd and BlockMaxScore describe. Never behind block.
+	shallow int
+}
+
+func (it *compressed_pl_iterator) Next() bool {
+	for len(it.entries) == 0 {
+		it.block++
+		if it.block > it.shallow {
+			it.shallow = it.block
+		}
+		if it.block >= len(it.pl.blocks) {
+			it.current = nil
+			return false
+		}
+		it.entries = it.pl.decodeBlock(it.pl.blocks[it.block])
+	}
+
+	it.current = it.entries[0]
+	it.entries = it.entries[1:]
+	return true
+}
+
+func (it *compressed_pl_iterator) SkipTo(id filereader.DocumentId) bool {
+	if it.current != nil && it.current.DocId() >= id {
+		return true
+	}
+
+	if it.block < 0 || it.block >= len(it.pl.blocks) ||
+		it.pl.blocks[it.block].Last < id {
+
+		// Find the first remaining block which could hold id
+		start := it.block + 1
+		next := start + sort.Search(len(it.pl.blocks)-start, func(i int) bool {
+			return it.pl.blocks[start+i].Last >= id
+		})
+
+		if next > it.shallow {
+			it.shallow = next
+		}
+
+		if next >= len(it.pl.blocks) {
+			it.block = len(it.pl.blocks)
+			it.entries = nil
+			it.current = nil
+			return false
+		}
+
+		it.block = next
+		it.entries = it.pl.decodeBlock(it.pl.blocks[next])
+	}
+
+	for it.Next() {
+		if it.current.DocId() >= id {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *compressed_pl_iterator) NextShallow(id filereader.DocumentId) {
+	start := it.shallow
+	it.shallow = start + sort.Search(len(it.pl.blocks)-start, func(i int) bool {
+		return it.pl.blocks[start+i].Last >= id
+	})
+}
+
+func (it *compressed_pl_iterator) BlockEnd() filereader.DocumentId {
+	if it.shallow >= len(it.pl.blocks) {
+		return math.MaxUint32
+	}
+	return it.pl.blocks[it.shallow].Last
+}
+
+func (it *compressed_pl_iterator) BlockMaxScore() float64 {
+	if it.shallow >= len(it.pl.blocks) {
+		return 0
+	}
+	maxTf := it.pl.blocks[it.shallow].MaxTf
+	if it.scorer != nil {
+		return it.scorer(maxTf)
+	}
+	return float64(maxTf)
+}
+
+func (it *compressed_pl_iterator) MaxScore() float64 {
+	maxTf := 0
+	for _, block := range it.pl.blocks {
+		if block.MaxTf > maxTf {
+			maxTf = block.MaxTf
+		}
+	}
+
+	if it.scorer != nil {
+		return it.scorer(maxTf)
+	}
+	return float64(maxTf)
+}
+
+func (it *compressed_pl_iterator) SetScorer(scorer TfScorer) {
+	it.scorer = scorer
+}
+
+func (it *compressed_pl_iterator) Value() PostingListEntry {
+	return it.current
+}
+
+func (it *compressed_pl_iterator) Key() int {
+	return int(it.current.DocId())
+}
+
+/* Binary serialization. The codec isn't stored; it's implied by
+ * the posting list initializer that's reading the data. */
+func (pl *compressed_pl) MarshalBinary() ([]byte, error) {
+	pl.flush()
+
+	buf := AppendVByte(nil, uint64(pl.Length))
+	buf = AppendVByte(buf, uint64(len(pl.blocks)))
+
+	for _, block := range pl.blocks {
+		buf = AppendVByte(buf, uint64(block.First))
+		buf = AppendVByte(buf, uint64(block.Last-block.First))
+		buf = AppendVByte(buf, uint64(block.Count))
+		buf = AppendVByte(buf, uint64(block.MaxTf))
+		buf = AppendVByte(buf, uint64(len(block.data)))
+		buf = append(buf, block.data...)
+	}
+	return buf, nil
+}
+
+var ErrTruncatedPostingList = errors.New("Truncated compressed posting list")
+
+func (pl *compressed_pl) UnmarshalBinary(data []byte) error {
+	var fields [5]uint64
+	var v uint64
+	var n int
+
+	if v, n = ReadVByte(data); n == 0 {
+		return ErrTruncatedPostingList
+	}
+	pl.Length = int(v)
+	data = data[n:]
+
+	if v, n = ReadVByte(data); n == 0 {
+		return ErrTruncatedPostingList
+	}
+	data = data[n:]
+
+	// Every block takes at least a byte, so a corrupt count is caught
+	// before it's allocated
+	if v > uint64(len(data)) {
+		return ErrTruncatedPostingList
+	}
+	pl.blocks = make([]*pl_block, v)
+	pl.pending = make(map[filereader.DocumentId]PostingListEntry)
+
+	for i := range pl.blocks {
+		for f := range fields {
+			if fields[f], n = ReadVByte(data); n == 0 {
+				return ErrTruncatedPostingList
+			}
+			data = data[n:]
+		}
+
+		if uint64(len(data)) < fields[4] {
+			return ErrTruncatedPostingList
+		}
+
+		block := new(pl_block)
+		block.First = filereader.DocumentId(fields[0])
+		block.Last = block.First + filereader.DocumentId(fields[1])
+		block.Count = int(fields[2])
+		block.MaxTf = int(fields[3])
+		block.data = data[:fields[4]]
+		data = data[fields[4]:]
+
+		pl.blocks[i] = block
+	}
+	return nil
+}
+
+type sortable_docid_entries []PostingListEntry
+
+func (s sortable_docid_entries) Len() int {
+	return len(s)
+}
+
+func (s sortable_docid_entries) Less(i, j int) bool {
+	return s[i].DocId() < s[j].DocId()
+}
+
+func (s sortable_docid_entries) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
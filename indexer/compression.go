@@ -0,0 +1,407 @@
+package indexer
+
+import "errors"
+import "fmt"
+import "io"
+import "sort"
+import "time"
+import "github.com/cwacek/irengine/scanner/filereader"
+
+/* An IntCodec compresses a sequence of small unsigned integers,
+ * such as document or position gaps. */
+type IntCodec interface {
+	Name() string
+
+	// Append the encoding of values to dst
+	Encode(dst []byte, values []uint32) []byte
+
+	// Decode n values from src, appending them to dst. Returns
+	// the extended slice and the number of bytes of src consumed
+	Decode(src []byte, n int, dst []uint32) ([]uint32, int, error)
+}
+
+var ErrCorruptEncoding = errors.New("Corrupt compressed integer sequence")
+
+var codecs = map[string]IntCodec{
+	"vbyte":     VByteCodec{},
+	"simple8b":  Simple8bCodec{},
+	"pfordelta": PForDeltaCodec{},
+}
+
+func GetCodec(name string) (IntCodec, error) {
+	if codec, ok := codecs[name]; ok {
+		return codec, nil
+	}
+	return nil, errors.New("Unknown integer codec: " + name)
+}
+
+// Append v to buf using a variable number of bytes, seven
+// bits at a time. The high bit marks the last byte.
+func AppendVByte(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v&0x7f))
+		v >>= 7
+	}
+	return append(buf, byte(v)|0x80)
+}
+
+// Read a single VByte encoded value from buf, returning the
+// value and the number of bytes read (0 if buf is truncated)
+func ReadVByte(buf []byte) (v uint64, n int) {
+	var shift uint
+
+	for i, b := range buf {
+		if b&0x80 != 0 {
+			return v | uint64(b&0x7f)<<shift, i + 1
+		}
+		v |= uint64(b) << shift
+		shift += 7
+	}
+	return 0, 0
+}
+
+// Read a single VByte encoded value from r
+func ReadVByteFrom(r io.ByteReader) (v uint64, err error) {
+	var shift uint
+	var b byte
+
+	for {
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+		if b&0x80 != 0 {
+			return v | uint64(b&0x7f)<<shift, nil
+		}
+		v |= uint64(b) << shift
+		shift += 7
+	}
+}
+
+type VByteCodec struct{}
+
+func (c VByteCodec) Name() string {
+	return "vbyte"
+}
+
+func (c VByteCodec) Encode(dst []byte, values []uint32) []byte {
+	for _, v := range values {
+		dst = AppendVByte(dst, uint64(v))
+	}
+	return dst
+}
+
+func (c VByteCodec) Decode(src []byte, n int, dst []uint32) ([]uint32, int, error) {
+	read := 0
+	for i := 0; i < n; i++ {
+		v, sz := ReadVByte(src[read:])
+		if sz == 0 {
+			return dst, read, ErrCorruptEncoding
+		}
+		dst = append(dst, uint32(v))
+		read += sz
+	}
+	return dst, read, nil
+}
+
+/* Simple-8b packs as many values as will fit into each 64 bit
+ * word, using a 4 bit selector to say how they're packed. We
+ * don't use the run-length selectors (0 and 1). */
+type Simple8bCodec struct{}
+
+var simple8bLayouts = [16]struct {
+	count int
+	bits  uint
+}{
+	{0, 0}, {0, 0}, {60, 1}, {30, 2}, {20, 3}, {15, 4}, {12, 5}, {10, 6},
+	{8, 7}, {7, 8}, {6, 10}, {5, 12}, {4, 15}, {3, 20}, {2, 30}, {1, 60},
+}
+
+func (c Simple8bCodec) Name() string {
+	return "simple8b"
+}
+
+func (c Simple8bCodec) Encode(dst []byte, values []uint32) []byte {
+	var word uint64
+
+	for len(values) > 0 {
+	Selectors:
+		for selector := 2; selector < 16; selector++ {
+			layout := simple8bLayouts[selector]
+			count := layout.count
+			if count > len(values) {
+				// The decoder knows how many values to expect, so
+				// the last word can be partially filled.
+				count = len(values)
+			}
+
+			for _, v := range values[:count] {
+				if uint64(v)>>layout.bits != 0 {
+					continue Selectors
+				}
+			}
+
+			word = uint64(selector) << 60
+			for i, v := range values[:count] {
+				word |= uint64(v) << (uint(i) * layout.bits)
+			}
+			dst = appendUint64(dst, word)
+			values = values[count:]
+			break
+		}
+	}
+	return dst
+}
+
+func (c Simple8bCodec) Decode(src []byte, n int, dst []uint32) ([]uint32, int, error) {
+	read := 0
+	for decoded := 0; decoded < n; {
+		if len(src)-read < 8 {
+			return dst, read, ErrCorruptEncoding
+		}
+		word := readUint64(src[read:])
+		read += 8
+
+		layout := simple8bLayouts[word>>60]
+		if layout.count == 0 {
+			return dst, read, ErrCorruptEncoding
+		}
+		mask := uint64(1)<<layout.bits - 1
+
+		for i := 0; i < layout.count && decoded < n; i++ {
+			dst = append(dst, uint32((word>>(uint(i)*layout.bits))&mask))
+			decoded++
+		}
+	}
+	return dst, read, nil
+}
+
+func appendUint64(dst []byte, v uint64) []byte {
+	return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+func readUint64(src []byte) uint64 {
+	return uint64(src[0]) | uint64(src[1])<<8 | uint64(src[2])<<16 |
+		uint64(src[3])<<24 | uint64(src[4])<<32 | uint64(src[5])<<40 |
+		uint64(src[6])<<48 | uint64(src[7])<<56
+}
+
+/* PForDelta packs chunks of PForChunk values using the number of
+ * bits needed by most of them. Values that don't fit are
+ * exceptions, whose high bits are stored after the chunk. */
+type PForDeltaCodec struct{}
+
+const PForChunk = 128
+
+func (c PForDeltaCodec) Name() string {
+	return "pfordelta"
+}
+
+func bitsNeeded(v uint32) uint {
+	var bits uint
+	for v != 0 {
+		bits++
+		v >>= 1
+	}
+	return bits
+}
+
+// Choose the smallest width that leaves at most 10% of
+// the values as exceptions.
+func pforWidth(values []uint32) uint {
+	var histogram [33]int
+	for _, v := range values {
+		histogram[bitsNeeded(v)]++
+	}
+
+	allowed := len(values) / 10
+	fits := 0
+	for bits := uint(0); bits <= 32; bits++ {
+		fits += histogram[bits]
+		if len(values)-fits <= allowed {
+			return bits
+		}
+	}
+	return 32
+}
+
+func (c PForDeltaCodec) Encode(dst []byte, values []uint32) []byte {
+	for len(values) > 0 {
+		n := len(values)
+		if n > PForChunk {
+			n = PForChunk
+		}
+		dst = c.encodeChunk(dst, values[:n])
+		values = values[n:]
+	}
+	return dst
+}
+
+func (c PForDeltaCodec) encodeChunk(dst []byte, chunk []uint32) []byte {
+	bits := pforWidth(chunk)
+	exceptions := make([]int, 0)
+	for i, v := range chunk {
+		if bitsNeeded(v) > bits {
+			exceptions = append(exceptions, i)
+		}
+	}
+
+	dst = append(dst, byte(bits), byte(len(exceptions)))
+
+	var acc uint64
+	var accBits uint
+	mask := uint64(1)<<bits - 1
+	for _, v := range chunk {
+		acc |= (uint64(v) & mask) << accBits
+		accBits += bits
+		for accBits >= 8 {
+			dst = append(dst, byte(acc))
+			acc >>= 8
+			accBits -= 8
+		}
+	}
+	if accBits > 0 {
+		dst = append(dst, byte(acc))
+	}
+
+	for _, i := range exceptions {
+		dst = append(dst, byte(i))
+		dst = AppendVByte(dst, uint64(chunk[i])>>bits)
+	}
+	return dst
+}
+
+func (c PForDeltaCodec) Decode(src []byte, n int, dst []uint32) ([]uint32, int, error) {
+	read := 0
+	for n > 0 {
+		chunk := n
+		if chunk > PForChunk {
+			chunk = PForChunk
+		}
+
+		if len(src)-read < 2 {
+			return dst, read, ErrCorruptEncoding
+		}
+		bits := uint(src[read])
+		exceptions := int(src[read+1])
+		read += 2
+
+		packed := (chunk*int(bits) + 7) / 8
+		if bits > 32 || len(src)-read < packed {
+			return dst, read, ErrCorruptEncoding
+		}
+
+		start := len(dst)
+		var acc uint64
+		var accBits uint
+		mask := uint64(1)<<bits - 1
+		pos := read
+		for i := 0; i < chunk; i++ {
+			for accBits < bits {
+				acc |= uint64(src[pos]) << accBits
+				pos++
+				accBits += 8
+			}
+			dst = append(dst, uint32(acc&mask))
+			acc >>= bits
+			accBits -= bits
+		}
+		read += packed
+
+		for e := 0; e < exceptions; e++ {
+			if read >= len(src) {
+				return dst, read, ErrCorruptEncoding
+			}
+			i := int(src[read])
+			high, sz := ReadVByte(src[read+1:])
+			if sz == 0 || i >= chunk {
+				return dst, read, ErrCorruptEncoding
+			}
+			dst[start+i] |= uint32(high << bits)
+			read += 1 + sz
+		}
+		n -= chunk
+	}
+	return dst, read, nil
+}
+
+// The size and speed of a codec over an entire lexicon
+type CompressionStat struct {
+	Codec          string
+	Bytes          int
+	Encode, Decode time.Duration
+}
+
+/* Compare the size of the text posting list format with each of
+ * the integer codecs, and time how long they take to encode and
+ * decode the gaps in every posting list of lex. */
+func MeasureCompression(lex Lexicon) (textBytes int, stats []CompressionStat) {
+	var gaps, freqs, positions []uint32
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats = make([]CompressionStat, len(names))
+	for i, name := range names {
+		stats[i].Codec = name
+	}
+
+	for _, entry := range lex.Walk() {
+		term := entry.(LexiconTerm)
+		gaps, freqs, positions = gaps[:0], freqs[:0], positions[:0]
+
+		prev := filereader.DocumentId(0)
+		for it := term.PostingList().Iterator(); it.Next(); {
+			pl_entry := it.Value()
+			// Mirrors the layout written by PostingListSet.Dump
+			textBytes += len(term.Text()) + len(" # ") +
+				len(pl_entry.Serialize()) + 1
+
+			gaps = append(gaps, uint32(pl_entry.DocId()-prev))
+			prev = pl_entry.DocId()
+			freqs = append(freqs, uint32(pl_entry.Frequency()-1))
+
+			last := 0
+			for _, pos := range pl_entry.Positions() {
+				positions = append(positions, uint32(pos-last))
+				last = pos
+			}
+		}
+
+		for i, name := range names {
+			codec := codecs[name]
+
+			start := time.Now()
+			buf := codec.Encode(nil, gaps)
+			buf = codec.Encode(buf, freqs)
+			buf = codec.Encode(buf, positions)
+			stats[i].Encode += time.Since(start)
+			stats[i].Bytes += len(buf)
+
+			start = time.Now()
+			_, n, _ := codec.Decode(buf, len(gaps), nil)
+			_, m, _ := codec.Decode(buf[n:], len(freqs), nil)
+			codec.Decode(buf[n+m:], len(positions), nil)
+			stats[i].Decode += time.Since(start)
+		}
+	}
+	return
+}
+
+func PrintCompressionStats(w io.Writer, lex Lexicon) {
+	textBytes, stats := MeasureCompression(lex)
+
+	fmt.Fprintf(w, "  Posting list encodings:\n")
+	fmt.Fprintf(w, "    %-10s %10d bytes\n", "text", textBytes)
+	for _, stat := range stats {
+		ratio := 0.0
+		if stat.Bytes > 0 {
+			ratio = float64(textBytes) / float64(stat.Bytes)
+		}
+		fmt.Fprintf(w, "    %-10s %10d bytes (%0.2fx) encode: %s decode: %s\n",
+			stat.Codec, stat.Bytes, ratio, stat.Encode, stat.Decode)
+	}
+}
@@ -0,0 +1,453 @@
+package indexer
+
+import "testing"
+import "math/rand"
+import "math"
+import "sort"
+import "github.com/cwacek/irengine/scanner/filereader"
+import "github.com/cwacek/irengine/logging"
+
+func TestCodecRoundTrip(t *testing.T) {
+	logging.SetupTestLogging()
+
+	inputs := [][]uint32{
+		{},
+		{0},
+		{1, 2, 3, 4, 5},
+		{0xffffffff, 0, 1 << 20, 7},
+	}
+
+	// Mostly small gaps with the occasional large one, which
+	// exercises the PForDelta exceptions.
+	mixed := make([]uint32, 1000)
+	for i := range mixed {
+		if i%37 == 0 {
+			mixed[i] = rand.Uint32()
+		} else {
+			mixed[i] = uint32(rand.Intn(16))
+		}
+	}
+	inputs = append(inputs, mixed)
+
+	for name, codec := range codecs {
+		for _, input := range inputs {
+			encoded := codec.Encode(nil, input)
+			// Trailing data shouldn't be consumed
+			encoded = append(encoded, 0xff, 0xff)
+
+			decoded, n, err := codec.Decode(encoded, len(input), nil)
+			switch {
+			case err != nil:
+				t.Errorf("%s: failed to decode %d values: %v", name, len(input), err)
+			case n != len(encoded)-2:
+				t.Errorf("%s: consumed %d bytes, expected %d", name, n, len(encoded)-2)
+			case len(decoded) != len(input):
+				t.Errorf("%s: decoded %d values, expected %d", name, len(decoded), len(input))
+			default:
+				for i := range input {
+					if decoded[i] != input[i] {
+						t.Errorf("%s: value %d decoded as %d, expected %d",
+							name, i, decoded[i], input[i])
+						break
+					}
+				}
+			}
+		}
+
+		if _, _, err := codec.Decode([]byte{}, 3, nil); err == nil {
+			t.Errorf("%s: expected error decoding truncated input", name)
+		}
+	}
+}
+
+func TestCompressedPostingList(t *testing.T) {
+	logging.SetupTestLogging()
+
+	for _, positional := range []bool{true, false} {
+		for name, codec := range codecs {
+			var reference PostingList
+			if positional {
+				reference = PositionalPostingListInitializer.Create()
+			} else {
+				reference = BasicPostingListInitializer.Create()
+			}
+			compressed := NewCompressedPostingListInitializer(codec, positional).Create()
+
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 2000; i++ {
+				docid := filereader.DocumentId(r.Intn(600) * 1000)
+				position := r.Intn(5000)
+
+				if reference.InsertRawEntry("term", docid, position) !=
+					compressed.InsertRawEntry("term", docid, position) {
+					t.Fatalf("%s: insert of %d disagreed about new entries", name, docid)
+				}
+			}
+
+			removed := make([]filereader.DocumentId, 0)
+			for it := reference.Iterator(); it.Next() && len(removed) < 50; {
+				if it.Value().DocId()%3 == 0 {
+					removed = append(removed, it.Value().DocId())
+				}
+			}
+			reference.Remove(removed...)
+			compressed.Remove(removed...)
+
+			if reference.Len() != compressed.Len() {
+				t.Errorf("%s: compressed list has %d entries, expected %d",
+					name, compressed.Len(), reference.Len())
+			}
+
+			// Readers see pending entries without applying them
+			pending := len(compressed.(*compressed_pl).pending)
+			if reference.String() != compressed.String() {
+				t.Errorf("%s: compressed list differs from reference", name)
+			}
+			if pending == 0 || len(compressed.(*compressed_pl).pending) != pending {
+				t.Errorf("%s: iterating changed the %d pending entries", name, pending)
+			}
+
+			for it := reference.Iterator(); it.Next(); {
+				entry, ok := compressed.GetEntry(it.Value().DocId())
+				if !ok || entry.Serialize() != it.Value().Serialize() {
+					t.Errorf("%s: GetEntry(%d) = %v, expected %s",
+						name, it.Value().DocId(), entry, it.Value().Serialize())
+					break
+				}
+			}
+
+			if _, ok := compressed.GetEntry(removed[0]); ok {
+				t.Errorf("%s: found removed entry %d", name, removed[0])
+			}
+
+			compressed.(BufferedPostingList).Flush()
+			if len(compressed.(*compressed_pl).pending) != 0 ||
+				reference.String() != compressed.String() {
+				t.Errorf("%s: flushed list differs from reference", name)
+			}
+
+			data, err := compressed.(*compressed_pl).MarshalBinary()
+			if err != nil {
+				t.Fatalf("%s: failed to marshal: %v", name, err)
+			}
+
+			restored := NewCompressedPostingListInitializer(codec, positional).Create()
+			if err = restored.(*compressed_pl).UnmarshalBinary(data); err != nil {
+				t.Fatalf("%s: failed to unmarshal: %v", name, err)
+			}
+
+			if restored.String() != reference.String() {
+				t.Errorf("%s: unmarshaled list differs from reference", name)
+			}
+
+			// A block count far past the data isn't allocated
+			corrupt := AppendVByte(AppendVByte(nil, 1), 1<<40)
+			if err = restored.(*compressed_pl).UnmarshalBinary(corrupt); err != ErrTruncatedPostingList {
+				t.Errorf("%s: expected a corrupt block count to be rejected. Got %v", name, err)
+			}
+
+			if _, err = GetPostingListInitializer(
+				NewCompressedPostingListInitializer(codec, positional).Name); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestCompressedFilterSequential(t *testing.T) {
+	logging.SetupTestLogging()
+
+	init := NewCompressedPostingListInitializer(VByteCodec{}, true)
+	first, second := init.Create(), init.Create()
+	ref_first := PositionalPostingListInitializer.Create()
+	ref_second := PositionalPostingListInitializer.Create()
+
+	for doc := 1; doc < 300; doc++ {
+		for pos := doc % 5; pos < 40; pos += 3 {
+			first.InsertRawEntry("a", filereader.DocumentId(doc), pos)
+			ref_first.InsertRawEntry("a", filereader.DocumentId(doc), pos)
+		}
+		for pos := doc % 7; pos < 40; pos += 11 {
+			second.InsertRawEntry("b", filereader.DocumentId(doc), pos)
+			ref_second.InsertRawEntry("b", filereader.DocumentId(doc), pos)
+		}
+	}
+
+	filtered := first.FilterSequential(second, 1)
+	expected := ref_first.FilterSequential(ref_second, 1)
+
+	if filtered.String() != expected.String() {
+		t.Errorf("Filtered compressed list '%s' doesn't match expected '%s'",
+			filtered.String(), expected.String())
+	}
+}
+
+func TestPostingListNextShallow(t *testing.T) {
+	logging.SetupTestLogging()
+
+	inits := []PostingListInitializer{
+		BasicPostingListInitializer,
+		NewCompressedPostingListInitializer(VByteCodec{}, true),
+	}
+
+	for _, init := range inits {
+		pl := init.Create()
+		// Documents 0 to 999 with tf 1, except 700 which has tf 5
+		for doc := 0; doc < 1000; doc++ {
+			pl.InsertRawEntry("t", filereader.DocumentId(doc), 0)
+		}
+		for pos := 1; pos < 5; pos++ {
+			pl.InsertRawEntry("t", 700, pos)
+		}
+		pl.(BufferedPostingList).Flush()
+
+		it := pl.Iterator()
+		it.Next()
+		if it.BlockEnd() >= 700 || it.BlockMaxScore() != 1 {
+			t.Errorf("%s: first block ends at %d with max %0.1f", init.Name,
+				it.BlockEnd(), it.BlockMaxScore())
+		}
+
+		it.NextShallow(700)
+		if it.Value().DocId() != 0 {
+			t.Errorf("%s: NextShallow moved the iterator to %d",
+				init.Name, it.Value().DocId())
+		}
+		if it.BlockEnd() < 700 || it.BlockEnd() >= 999 || it.BlockMaxScore() != 5 {
+			t.Errorf("%s: block for 700 ends at %d with max %0.1f", init.Name,
+				it.BlockEnd(), it.BlockMaxScore())
+		}
+
+		// Moving the iterator keeps the shallow position if it's ahead
+		if it.SkipTo(10); it.BlockMaxScore() != 5 {
+			t.Errorf("%s: SkipTo moved the block back to %d", init.Name, it.BlockEnd())
+		}
+
+		it.NextShallow(1000)
+		if it.BlockEnd() != math.MaxUint32 || it.BlockMaxScore() != 0 {
+			t.Errorf("%s: past the last block, got end %d and max %0.1f",
+				init.Name, it.BlockEnd(), it.BlockMaxScore())
+		}
+	}
+
+	/* An unflushed list is only scanned for its maxima when they're
+	 * asked for, from wherever the iterator has got to */
+	pl := BasicPostingListInitializer.Create()
+	for doc := 0; doc < 1000; doc++ {
+		pl.InsertRawEntry("t", filereader.DocumentId(doc), 0)
+	}
+	pl.InsertRawEntry("t", 700, 1)
+
+	it := pl.Iterator()
+	for it.Next() {
+	}
+	if it.(*pl_iterator).hasBlocks {
+		t.Errorf("Walking an unflushed list scanned it for its block maxima")
+	}
+
+	it = pl.Iterator()
+	it.SkipTo(750)
+	if it.BlockEnd() < 750 || it.BlockMaxScore() != 2 {
+		t.Errorf("Unflushed block for 750 ends at %d with max %0.1f",
+			it.BlockEnd(), it.BlockMaxScore())
+	}
+}
+
+func TestPostingListSkipTo(t *testing.T) {
+	logging.SetupTestLogging()
+
+	inits := []PostingListInitializer{
+		PositionalPostingListInitializer,
+		BasicPostingListInitializer,
+		NewCompressedPostingListInitializer(VByteCodec{}, true),
+		NewCompressedPostingListInitializer(PForDeltaCodec{}, false),
+	}
+
+	for _, init := range inits {
+		pl := init.Create()
+		maxTf := 0
+		// Documents 0, 3, 6 ... with tf 1 + (doc % 7)
+		for doc := 0; doc < 3000; doc += 3 {
+			for tf := 0; tf <= doc%7; tf++ {
+				pl.InsertRawEntry("t", filereader.DocumentId(doc), tf)
+			}
+			if doc%7+1 > maxTf {
+				maxTf = doc%7 + 1
+			}
+		}
+
+		it := pl.Iterator()
+		targets := []filereader.DocumentId{0, 1, 2, 3, 500, 500, 1001, 2997}
+		expected := []filereader.DocumentId{0, 3, 3, 3, 501, 501, 1002, 2997}
+
+		for i, target := range targets {
+			if !it.SkipTo(target) {
+				t.Errorf("%s: SkipTo(%d) failed", init.Name, target)
+				break
+			}
+			if it.Value().DocId() != expected[i] {
+				t.Errorf("%s: SkipTo(%d) landed on %d, expected %d",
+					init.Name, target, it.Value().DocId(), expected[i])
+			}
+			if it.BlockEnd() < it.Value().DocId() {
+				t.Errorf("%s: block ends at %d, before the current entry %d",
+					init.Name, it.BlockEnd(), it.Value().DocId())
+			}
+			if score := it.BlockMaxScore(); score < float64(it.Value().Frequency()) ||
+				score > float64(maxTf) {
+				t.Errorf("%s: block max %0.1f isn't a bound on %d", init.Name,
+					score, it.Value().Frequency())
+			}
+		}
+
+		if it.MaxScore() != float64(maxTf) {
+			t.Errorf("%s: max score %0.1f, expected %d", init.Name, it.MaxScore(), maxTf)
+		}
+
+		// SkipTo never moves backwards
+		if it.SkipTo(10); it.Value().DocId() != 2997 {
+			t.Errorf("%s: SkipTo moved backwards to %d", init.Name, it.Value().DocId())
+		}
+
+		it.SetScorer(func(tf int) float64 { return float64(tf) * 10 })
+		if it.BlockMaxScore() < float64(it.Value().Frequency()*10) {
+			t.Errorf("%s: scorer wasn't used for block max", init.Name)
+		}
+
+		if it.SkipTo(3000) {
+			t.Errorf("%s: SkipTo past the end succeeded", init.Name)
+		}
+		if it.Next() {
+			t.Errorf("%s: Next succeeded after skipping past the end", init.Name)
+		}
+
+		// Next continues after a skip
+		it = pl.Iterator()
+		it.SkipTo(1500)
+		if !it.Next() || it.Value().DocId() != 1503 {
+			t.Errorf("%s: Next after SkipTo(1500) didn't go to 1503", init.Name)
+		}
+	}
+}
+
+func TestBooleanOperators(t *testing.T) {
+	logging.SetupTestLogging()
+
+	inits := []PostingListInitializer{
+		PositionalPostingListInitializer,
+		NewCompressedPostingListInitializer(VByteCodec{}, false),
+		BasicPostingListInitializer,
+	}
+
+	// Multiples of 2, 3 and 5, where each entry's tf is 1 + doc % 3
+	lists := func(offset int) []PostingList {
+		pls := make([]PostingList, 3)
+		for i, step := range []int{2, 3, 5} {
+			pls[i] = inits[(i+offset)%len(inits)].Create()
+			for doc := 0; doc < 600; doc += step {
+				for pos := 0; pos <= doc%3; pos++ {
+					pls[i].InsertRawEntry("t", filereader.DocumentId(doc), pos)
+				}
+			}
+		}
+		return pls
+	}
+
+	in := func(doc, step int) bool {
+		return doc%step == 0
+	}
+
+	type bool_case struct {
+		name    string
+		build   func(pls []PostingList) PostingListIterator
+		matches func(doc int) bool
+		lists   func(doc int) int
+	}
+
+	cases := []bool_case{
+		{"a AND b",
+			func(pls []PostingList) PostingListIterator {
+				return And(pls[0].Iterator(), pls[1].Iterator())
+			},
+			func(doc int) bool { return in(doc, 2) && in(doc, 3) },
+			func(doc int) int { return 2 }},
+		{"a OR c",
+			func(pls []PostingList) PostingListIterator {
+				return Or(pls[0].Iterator(), pls[2].Iterator())
+			},
+			func(doc int) bool { return in(doc, 2) || in(doc, 5) },
+			func(doc int) int {
+				if in(doc, 2) && in(doc, 5) {
+					return 2
+				}
+				return 1
+			}},
+		{"a AND b NOT c",
+			func(pls []PostingList) PostingListIterator {
+				return AndNot(And(pls[0].Iterator(), pls[1].Iterator()), pls[2].Iterator())
+			},
+			func(doc int) bool { return in(doc, 2) && in(doc, 3) && !in(doc, 5) },
+			func(doc int) int { return 2 }},
+		{"(a OR b) AND (c NOT a)",
+			func(pls []PostingList) PostingListIterator {
+				return And(Or(pls[0].Iterator(), pls[1].Iterator()),
+					AndNot(pls[2].Iterator(), pls[0].Iterator()))
+			},
+			func(doc int) bool { return in(doc, 3) && in(doc, 5) && !in(doc, 2) },
+			func(doc int) int { return 2 }},
+	}
+
+	for offset := range inits {
+		for _, test := range cases {
+			pls := lists(offset)
+			iterator := func() PostingListIterator {
+				return test.build(pls)
+			}
+
+			expected := make([]int, 0)
+			for doc := 0; doc < 600; doc++ {
+				if test.matches(doc) {
+					expected = append(expected, doc)
+				}
+			}
+
+			found := 0
+			for it := iterator(); it.Next(); found++ {
+				doc := int(it.Value().DocId())
+				if found >= len(expected) || doc != expected[found] || it.Key() != doc {
+					t.Errorf("%s [%d]: result %d is %d", test.name, offset, found, doc)
+					break
+				}
+				if tf := it.Value().Frequency(); tf != test.lists(doc)*(1+doc%3) {
+					t.Errorf("%s [%d]: document %d has tf %d, expected %d",
+						test.name, offset, doc, tf, test.lists(doc)*(1+doc%3))
+				}
+				if it.BlockEnd() < it.Value().DocId() {
+					t.Errorf("%s [%d]: block ends at %d, before %d",
+						test.name, offset, it.BlockEnd(), doc)
+				}
+			}
+			if found != len(expected) {
+				t.Errorf("%s [%d]: found %d documents, expected %d",
+					test.name, offset, found, len(expected))
+			}
+
+			// SkipTo lands on the first match at or after its target
+			it := iterator()
+			for _, target := range []int{0, 7, 7, 100, 301, 599} {
+				next := sort.SearchInts(expected, target)
+				if ok := it.SkipTo(filereader.DocumentId(target)); ok != (next < len(expected)) {
+					t.Errorf("%s [%d]: SkipTo(%d) returned %v", test.name, offset, target, ok)
+				} else if ok && int(it.Value().DocId()) != expected[next] {
+					t.Errorf("%s [%d]: SkipTo(%d) landed on %d, expected %d",
+						test.name, offset, target, it.Value().DocId(), expected[next])
+				}
+			}
+
+			if pl := Collect(iterator(), BasicPostingListInitializer); pl.Len() != len(expected) {
+				t.Errorf("%s [%d]: collected %d entries, expected %d",
+					test.name, offset, pl.Len(), len(expected))
+			}
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package constrained
+
+import index "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import radix "github.com/cwacek/radix-go"
+import log "github.com/cihub/seelog"
+import "bufio"
+import "bytes"
+import "encoding"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+
+/* A compiled index is written alongside the posting list sets
+ * when a lexicon is saved. It has three files:
+ *
+ *   terms.dict    The sorted term dictionary. A header naming the
+ *                 posting list type, then an index.TermDictionary
+ *                 giving every term's id, df, cf and the offset and
+ *                 length of its posting list in postings.bin. The
+ *                 ids are the ones the lexicon gave its terms.
+ *   postings.bin  The binary encoded (compressed) posting lists.
+ *   docmap.bin    The document map.
+ *
+ * Every integer is VByte encoded. The dictionary is front coded,
+ * and small enough to keep in memory as it is, while postings.bin
+ * is mapped into memory and posting lists are decoded when they're
+ * asked for. */
+const (
+	TermDictFile = "terms.dict"
+	PostingsFile = "postings.bin"
+	DocMapFile   = "docmap.bin"
+)
+
+var (
+	TermDictMagic = []byte("IRDICT\x01\n")
+	PostingsMagic = []byte("IRPOST\x01\n")
+)
+
+/* Posting lists in a compiled index have to marshal themselves.
+ * Uncompressed posting list types are written using VByte. */
+func CompiledInitializer(plInit index.PostingListInitializer) index.PostingListInitializer {
+	if _, ok := plInit.Create().(encoding.BinaryMarshaler); ok {
+		return plInit
+	}
+	return index.NewCompressedPostingListInitializer(index.VByteCodec{},
+		plInit.Positional)
+}
+
+// Write the term dictionary and postings for lex into location
+func WriteCompiledLexicon(location string, lex index.Lexicon,
+	plInit index.PostingListInitializer) {
+
+	terms := lex.Walk()
+	sort.Sort(entriesByKey(terms))
+
+	writer := newCompiledWriter(location+TermDictFile,
+		location+PostingsFile, plInit)
+
+	for _, entry := range terms {
+		term := entry.(index.LexiconTerm)
+		writer.Write(term.(index.TermIdentifier).Id(), term.Text(), term.PostingList())
+	}
+	writer.Close()
+
+	log.Infof("Wrote %d terms and %d bytes of postings to %s",
+		writer.terms, writer.offset, location)
+}
+
+/* Writes a term dictionary and postings file one term at a time.
+ * Terms must be written in sorted order. */
+type compiledWriter struct {
+	plInit                index.PostingListInitializer
+	dictFile, postingFile *os.File
+	dict                  *index.TermDictionary
+	dictWriter, postings  *bufio.Writer
+	header                []byte
+	offset                uint64
+	terms                 int
+}
+
+func newCompiledWriter(dictPath, postingsPath string,
+	plInit index.PostingListInitializer) *compiledWriter {
+
+	var err error
+
+	w := new(compiledWriter)
+	w.plInit = CompiledInitializer(plInit)
+
+	if w.dictFile, err = os.Create(dictPath); err != nil {
+		panic(NewPersistenceError("Failed to create term dictionary: " + err.Error()))
+	}
+
+	if w.postingFile, err = os.Create(postingsPath); err != nil {
+		w.dictFile.Close()
+		panic(NewPersistenceError("Failed to create postings file: " + err.Error()))
+	}
+
+	w.dict = index.NewTermDictionary()
+	w.dictWriter = bufio.NewWriter(w.dictFile)
+	w.postings = bufio.NewWriter(w.postingFile)
+
+	w.dictWriter.Write(TermDictMagic)
+	w.header = index.AppendVByte(w.header[:0], uint64(len(w.plInit.Name)))
+	w.header = append(w.header, w.plInit.Name...)
+	w.dictWriter.Write(w.header)
+
+	w.postings.Write(PostingsMagic)
+	w.offset = uint64(len(PostingsMagic))
+	return w
+}
+
+// Write the posting list for a term, compressing it if necessary
+func (w *compiledWriter) Write(id index.TermId, text string, pl index.PostingList) {
+	cf := 0
+	for it := pl.Iterator(); it.Next(); {
+		cf += it.Value().Frequency()
+	}
+
+	if _, ok := pl.(encoding.BinaryMarshaler); !ok {
+		compressed := w.plInit.Create()
+		for it := pl.Iterator(); it.Next(); {
+			compressed.InsertCompleteEntry(it.Value())
+		}
+		pl = compressed
+	}
+
+	data, err := pl.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(NewPersistenceError("Failed to encode posting list for " +
+			text + ": " + err.Error()))
+	}
+	w.writeRaw(id, text, data, pl.Len(), cf)
+}
+
+// Write an already encoded posting list
+func (w *compiledWriter) writeRaw(id index.TermId, text string, data []byte, df, cf int) {
+	w.postings.Write(data)
+
+	if err := w.dict.Add(text, index.TermInfo{Id: id,
+		Df: df, Cf: cf, Offset: w.offset, Length: uint64(len(data))}); err != nil {
+		panic(NewPersistenceError("Failed to add '" + text + "' to the term dictionary: " +
+			err.Error()))
+	}
+
+	w.offset += uint64(len(data))
+	w.terms++
+}
+
+func (w *compiledWriter) Close() {
+	defer w.dictFile.Close()
+	defer w.postingFile.Close()
+
+	if err := w.postings.Flush(); err != nil {
+		panic(NewPersistenceError("Failed to write postings: " + err.Error()))
+	}
+	if _, err := w.dict.WriteTo(w.dictWriter); err != nil {
+		panic(NewPersistenceError("Failed to write term dictionary: " + err.Error()))
+	}
+	if err := w.dictWriter.Flush(); err != nil {
+		panic(NewPersistenceError("Failed to write term dictionary: " + err.Error()))
+	}
+}
+
+// Whether location contains a compiled index
+func HasCompiledIndex(location string) bool {
+	_, err := os.Stat(location + TermDictFile)
+	return err == nil
+}
+
+/* Write a compiled index for an index at location which only
+ * has posting list sets and a text document map. The document
+ * norms are computed on the way. */
+func MigrateIndex(location string) error {
+	lex := LoadLexiconFromDisk(location).(*lexicon)
+
+	st_index := new(index.SingleTermIndex)
+	st_index.Init(lex)
+	if err := LoadDocumentMap(location, st_index); err != nil {
+		return err
+	}
+
+	WriteCompiledLexicon(lex.Location(), lex, lex.PLInit)
+
+	st_index.Stats().FromDocuments(st_index.DocumentMap)
+	for _, entry := range lex.Walk() {
+		term := entry.(index.LexiconTerm)
+		st_index.Stats().AddPostingList(term.Text(), term.PostingList())
+	}
+	st_index.Finalize()
+
+	file, err := os.Create(lex.Location() + DocMapFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = st_index.DocumentMap.WriteBinary(file); err != nil {
+		return err
+	}
+
+	stats, err := os.Create(lex.Location() + index.CollectionStatsFile)
+	if err != nil {
+		return err
+	}
+	defer stats.Close()
+
+	if _, err = st_index.Stats().WriteTo(stats); err != nil {
+		return err
+	}
+
+	if err = LoadFilters(lex.Location(), st_index); err != nil {
+		return err
+	}
+	return st_index.WriteManifest(lex.Location())
+}
+
+/* A read-only Lexicon backed by a compiled index. Terms are found
+ * in the front coded dictionary, and their posting lists are
+ * decoded from the mapped postings file when requested. Terms are
+ * only made when they're asked for. */
+type compiled_lexicon struct {
+	// Never populated. The methods below take its place.
+	radix.Trie
+
+	PLInit   index.PostingListInitializer
+	dict     *index.TermDictionary
+	postings []byte
+	mapping  *mappedFile
+	location string
+}
+
+type compiled_term struct {
+	id             index.TermId
+	text           string
+	offset, length uint64
+	df, cf         int
+	lex            *compiled_lexicon
+}
+
+func (lex *compiled_lexicon) term(id index.TermId, text string,
+	info index.TermInfo) *compiled_term {
+
+	return &compiled_term{id, text, info.Offset, info.Length, info.Df, info.Cf, lex}
+}
+
+func OpenCompiledLexicon(location string) (index.Lexicon, error) {
+	reader, err := openCompiled(location+TermDictFile, location+PostingsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	lex := reader.lex
+	log.Infof("Opened compiled index at %s with %d terms (%d byte dictionary) and %d bytes of postings",
+		location, lex.dict.Len(), lex.dict.Size(), len(lex.postings))
+	return lex, nil
+}
+
+// Reads a term dictionary one term at a time, in sorted order
+type dictReader struct {
+	file  *os.File
+	lex   *compiled_lexicon
+	terms *index.DictionaryIterator
+	path  string
+}
+
+/* Open a term dictionary and map its postings. The whole
+ * dictionary is read, and its terms can then be read in order
+ * with Next. */
+func openCompiled(dictPath, postingsPath string) (r *dictReader, err error) {
+	r = new(dictReader)
+	r.path = dictPath
+	r.lex = new(compiled_lexicon)
+	r.lex.location = filepath.Dir(dictPath) + "/"
+
+	if r.file, err = os.Open(dictPath); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(r.file)
+
+	magic := make([]byte, len(TermDictMagic))
+	if _, err = io.ReadFull(reader, magic); err != nil ||
+		!bytes.Equal(magic, TermDictMagic) {
+		r.file.Close()
+		return nil, NewPersistenceError(dictPath + " is not a term dictionary")
+	}
+
+	plType, err := readString(reader)
+	if err != nil {
+		r.file.Close()
+		return nil, NewPersistenceError("Truncated term dictionary header in " + dictPath)
+	}
+
+	if r.lex.PLInit, err = index.GetPostingListInitializer(plType); err != nil {
+		r.file.Close()
+		return nil, err
+	}
+
+	r.lex.dict = index.NewTermDictionary()
+	if _, err = r.lex.dict.ReadFrom(reader); err != nil {
+		r.file.Close()
+		return nil, NewPersistenceError("Bad term dictionary " + dictPath + ": " + err.Error())
+	}
+
+	if r.lex.mapping, err = mapFile(postingsPath); err != nil {
+		r.file.Close()
+		return nil, err
+	}
+	r.lex.postings = r.lex.mapping.Data
+
+	if !bytes.HasPrefix(r.lex.postings, PostingsMagic) {
+		r.lex.Close()
+		r.file.Close()
+		return nil, NewPersistenceError(postingsPath + " is not a postings file")
+	}
+
+	r.lex.dict.Each(func(id index.TermId, text string, info index.TermInfo) bool {
+		if info.Offset+info.Length > uint64(len(r.lex.postings)) {
+			err = NewPersistenceError(fmt.Sprintf(
+				"Posting list for '%s' extends past the end of the postings for %s",
+				text, dictPath))
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		r.lex.Close()
+		r.file.Close()
+		return nil, err
+	}
+	r.terms = r.lex.dict.Iterator()
+	return r, nil
+}
+
+// The longest string in a term dictionary's header
+const maxHeaderString = 1 << 10
+
+func readString(reader *bufio.Reader) (string, error) {
+	length, err := index.ReadVByteFrom(reader)
+	if err != nil {
+		return "", err
+	}
+	if length > maxHeaderString {
+		return "", fmt.Errorf("A %d byte string is too long for a header", length)
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(reader, buf)
+	return string(buf), err
+}
+
+// Read the next term, returning io.EOF after the last one
+func (r *dictReader) Next() (*compiled_term, error) {
+	if !r.terms.Next() {
+		return nil, io.EOF
+	}
+	return r.lex.term(r.terms.Term()), nil
+}
+
+// Close the dictionary. The postings stay mapped.
+func (r *dictReader) Close() error {
+	return r.file.Close()
+}
+
+// Release the mapped postings
+func (lex *compiled_lexicon) Close() error {
+	lex.postings = nil
+	return lex.mapping.Close()
+}
+
+func (lex *compiled_lexicon) Init() {}
+
+func (lex *compiled_lexicon) Insert(entry radix.RadixTreeEntry) {
+	panic("Cannot insert into a compiled lexicon")
+}
+
+func (lex *compiled_lexicon) Find(key []byte) (radix.RadixTreeEntry, bool) {
+	if term, ok := lex.FindTerm(key); ok {
+		return term.(radix.RadixTreeEntry), true
+	}
+	return nil, false
+}
+
+func (lex *compiled_lexicon) FindTerm(key []byte) (index.LexiconTerm, bool) {
+	text := string(key)
+	if id, info, ok := lex.dict.Lookup(text); ok {
+		return lex.term(id, text, info), true
+	}
+	return nil, false
+}
+
+// The dictionary maps the ids back to their text
+func (lex *compiled_lexicon) TermTable() index.TermTable {
+	return lex.dict
+}
+
+// The term with id
+func (lex *compiled_lexicon) TermById(id index.TermId) (index.LexiconTerm, bool) {
+	if text, info, ok := lex.dict.Get(id); ok {
+		return lex.term(id, text, info), true
+	}
+	return nil, false
+}
+
+func (lex *compiled_lexicon) Walk() []radix.RadixTreeEntry {
+	entries := make([]radix.RadixTreeEntry, 0, lex.dict.Len())
+	lex.dict.Each(func(id index.TermId, text string, info index.TermInfo) bool {
+		entries = append(entries, lex.term(id, text, info))
+		return true
+	})
+	return entries
+}
+
+func (lex *compiled_lexicon) WalkPrefix(prefix string, visit func(text string) bool) {
+	lex.dict.EachPrefix(prefix, func(id index.TermId, text string, info index.TermInfo) bool {
+		return visit(text)
+	})
+}
+
+func (lex *compiled_lexicon) Len() int {
+	return lex.dict.Len()
+}
+
+func (lex *compiled_lexicon) InsertToken(token *filereader.Token) index.LexiconTerm {
+	panic("Cannot insert into a compiled lexicon")
+}
+
+func (lex *compiled_lexicon) MergePostingList(text string,
+	pl index.PostingList) index.LexiconTerm {
+	panic("Cannot merge into a compiled lexicon")
+}
+
+func (lex *compiled_lexicon) Print(w io.Writer) {
+	index.PrintTerms(w, lex)
+}
+
+func (lex *compiled_lexicon) SetPLInitializer(pl_init index.PostingListInitializer) {
+	if pl_init.Name != lex.PLInit.Name {
+		panic("Cannot change the posting list type of a compiled lexicon")
+	}
+}
+
+func (lex *compiled_lexicon) PLInitializer() index.PostingListInitializer {
+	return lex.PLInit
+}
+
+func (lex *compiled_lexicon) IsPositional() bool {
+	return lex.PLInit.Positional
+}
+
+func (t *compiled_term) Id() index.TermId {
+	return t.id
+}
+
+func (t *compiled_term) Text() string {
+	return t.text
+}
+
+func (t *compiled_term) Tf() int {
+	return t.cf
+}
+
+func (t *compiled_term) Df() int {
+	return t.df
+}
+
+func (t *compiled_term) RadixKey() []byte {
+	return []byte(t.text)
+}
+
+// Decode the posting list from the mapped postings file
+func (t *compiled_term) PostingList() index.PostingList {
+	pl := t.lex.PLInit.Create()
+	data := t.lex.postings[t.offset : t.offset+t.length]
+
+	if err := pl.(encoding.BinaryUnmarshaler).UnmarshalBinary(data); err != nil {
+		panic(NewPersistenceError(fmt.Sprintf(
+			"Failed to decode posting list for '%s': %v", t.text, err)))
+	}
+	return pl
+}
+
+func (t *compiled_term) Register(token *filereader.Token) {
+	panic("Cannot register tokens with a compiled lexicon")
+}
+
+func (t *compiled_term) RegisterEntry(entry index.PostingListEntry) {
+	panic("Cannot register entries with a compiled lexicon")
+}
+
+func (t *compiled_term) String() string {
+	return fmt.Sprintf("[%s %d @%d]", t.text, t.cf, t.offset)
+}
+
+type entriesByKey []radix.RadixTreeEntry
+
+func (e entriesByKey) Len() int {
+	return len(e)
+}
+
+func (e entriesByKey) Less(i, j int) bool {
+	return bytes.Compare(e[i].RadixKey(), e[j].RadixKey()) < 0
+}
+
+func (e entriesByKey) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
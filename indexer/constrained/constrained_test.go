@@ -6,7 +6,11 @@ import "encoding/gob"
 import "os"
 import "bytes"
 import "io"
+import "fmt"
+import "reflect"
 import "strings"
+import "path/filepath"
+import "time"
 import index "github.com/cwacek/irengine/indexer"
 import "github.com/cwacek/irengine/indexer/filters"
 import "github.com/cwacek/irengine/scanner/filereader"
@@ -15,6 +19,24 @@ import "github.com/cwacek/irengine/logging"
 
 var (
 	serialized_pls = `
+    0 # 3 2
+    1 # 3 2 3 4
+    1 # 1 17
+    1 # 5 12
+    2 # 3 1 5
+    3 # 1 15
+    3 # 5 12 15
+    `
+	serialized_basic_pls = `1 # 1 1
+1 # 3 3
+1 # 5 1
+2 # 3 2
+3 # 1 1
+3 # 5 2
+`
+
+	// Sets written before terms were numbered have their text
+	legacy_pls = `
     james bond # 3 2
     that # 3 2 3 4
     that # 1 17
@@ -23,35 +45,31 @@ var (
     which # 1 15
     which # 5 12 15
     `
-	serialized_basic_pls = `that # 1 1
-that # 3 3
-that # 5 1
-there # 3 2
-which # 1 1
-which # 5 2
-`
+	legacy_ids = map[string]index.TermId{
+		"james bond": 0, "that": 1, "there": 2, "which": 3,
+	}
 
-	expected_pl = map[string]string{
-		"james bond": "3 2",
-		"that":       "1 17 | 3 2 3 4 | 5 12",
-		"there":      "3 1 5",
-		"which":      "1 15 | 5 12 15",
+	expected_pl = map[index.TermId]string{
+		0: "3 2",
+		1: "1 17 | 3 2 3 4 | 5 12",
+		2: "3 1 5",
+		3: "1 15 | 5 12 15",
 	}
 
-	expected_basic_pl = map[string]string{
-		"that":  "1 1 | 3 3 | 5 1",
-		"there": "3 2",
-		"which": "1 1 | 5 2",
+	expected_basic_pl = map[index.TermId]string{
+		1: "1 1 | 3 3 | 5 1",
+		2: "3 2",
+		3: "1 1 | 5 2",
 	}
 
 	reserialized_pls = []byte(
-		"james bond # 3 2\n" +
-			"that # 1 17\n" +
-			"that # 3 2 3 4\n" +
-			"that # 5 12\n" +
-			"there # 3 1 5\n" +
-			"which # 1 15\n" +
-			"which # 5 12 15\n")
+		"0 # 3 2\n" +
+			"1 # 1 17\n" +
+			"1 # 3 2 3 4\n" +
+			"1 # 5 12\n" +
+			"2 # 3 1 5\n" +
+			"3 # 1 15\n" +
+			"3 # 5 12 15\n")
 
 	testDocs = []filereader.Document{
 		filters.LoadTestDocument("A01",
@@ -82,6 +100,42 @@ func init() {
 	}
 }
 
+// A temporary directory, removed once t is done
+func testDir(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "irtest")
+	if err != nil {
+		t.Fatalf("Error creating temp dir %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	return tmpDir
+}
+
+// An empty index over lexicon which lower cases what it's given
+func newTestIndex(lexicon index.Lexicon, plInit index.PostingListInitializer) *index.SingleTermIndex {
+	lexicon.SetPLInitializer(plInit)
+	st_index := new(index.SingleTermIndex)
+	st_index.Init(lexicon)
+	st_index.AddFilter(filters.NewLowerCaseFilter())
+	return st_index
+}
+
+func insertTestDocs(st_index *index.SingleTermIndex) {
+	for _, document := range testDocs {
+		st_index.Insert(document)
+	}
+	st_index.WaitInsert()
+}
+
+/* Save an index of testDocs with plInit posting lists to a
+ * temporary directory, returning the index and the directory */
+func buildTestIndex(t *testing.T, plInit index.PostingListInitializer) (*index.SingleTermIndex, string) {
+	location := testDir(t)
+	st_index := newTestIndex(NewLexicon(-1, location), plInit)
+	insertTestDocs(st_index)
+	st_index.Save()
+	return st_index, location
+}
+
 func TestPostingListSetSerialization(t *testing.T) {
 	logging.SetupTestLogging()
 
@@ -96,10 +150,10 @@ func TestPostingListSetSerialization(t *testing.T) {
 		switch {
 
 		case !ok:
-			t.Errorf("PL didn't contain term '%s'", term)
+			t.Errorf("PL didn't contain term %d", term)
 
 		case pl.String() != exp:
-			t.Errorf("PL for '%s': '%s'. did not match expected '%s'", term, pl.String(), exp)
+			t.Errorf("PL for %d: '%s'. did not match expected '%s'", term, pl.String(), exp)
 		}
 	}
 
@@ -113,6 +167,16 @@ Wanted:
 Got:
 %s`, reserialized_pls, buf.String())
 	}
+
+	legacy := NewPostingListSet("testStore", index.PositionalPostingListInitializer)
+	legacy.LoadKeyed(strings.NewReader(legacy_pls), func(text string) (index.TermId, error) {
+		return legacy_ids[text], nil
+	})
+	for term, exp := range expected_pl {
+		if pl, ok := legacy.listMap[term]; !ok || pl.String() != exp {
+			t.Errorf("PL for %d read by text: %v. did not match expected '%s'", term, pl, exp)
+		}
+	}
 	log.Info("Completed")
 }
 
@@ -130,10 +194,10 @@ func TestPostingListSetBasicSerialize(t *testing.T) {
 		switch {
 
 		case !ok:
-			t.Errorf("PL didn't contain term '%s'", term)
+			t.Errorf("PL didn't contain term %d", term)
 
 		case pl.String() != exp:
-			t.Errorf("PL for '%s': '%s'. did not match expected '%s'", term, pl.String(), exp)
+			t.Errorf("PL for %d: '%s'. did not match expected '%s'", term, pl.String(), exp)
 		}
 	}
 
@@ -152,46 +216,216 @@ func TestPostingListSetBasicSerialize(t *testing.T) {
 	log.Info("Completed")
 }
 
-func TestLRU(t *testing.T) {
+func TestPostingListSetBinarySerialize(t *testing.T) {
 	logging.SetupTestLogging()
 
-	lex := new(lexicon)
+	codec, _ := index.GetCodec("vbyte")
+	plInit := index.NewCompressedPostingListInitializer(codec, true)
+
+	// Text stores can still be read with compressed lists
+	pls := NewPostingListSet("testStore", plInit)
+	pls.Load(strings.NewReader(serialized_pls))
+
+	buf := new(bytes.Buffer)
+	pls.Dump(buf)
+
+	if !bytes.HasPrefix(buf.Bytes(), BinaryPLSMagic) {
+		t.Fatalf("Compressed posting list set wasn't dumped in binary")
+	}
+
+	if buf.Len() >= len(reserialized_pls) {
+		t.Errorf("Binary dump (%d bytes) isn't smaller than text (%d bytes)",
+			buf.Len(), len(reserialized_pls))
+	}
 
-	lex.lru_cache = LRUSet{
-		NewPLSContainer(NewPostingListSet("1", index.PositionalPostingListInitializer)),
-		NewPLSContainer(NewPostingListSet("2", index.PositionalPostingListInitializer)),
-		NewPLSContainer(NewPostingListSet("3", index.PositionalPostingListInitializer)),
-		NewPLSContainer(NewPostingListSet("4", index.PositionalPostingListInitializer)),
+	reloaded := NewPostingListSet("testStore", plInit)
+	if size := reloaded.Load(buf); size != pls.Size {
+		t.Errorf("Reloaded %d entries, expected %d", size, pls.Size)
 	}
 
-	if lrutag := lex.lru_cache.LeastRecent().Tag; lrutag != "1" {
-		t.Errorf("LRU was '%s', but expected '1'", lrutag)
+	for term, exp := range expected_pl {
+		pl, ok := reloaded.listMap[term]
+		switch {
+
+		case !ok:
+			t.Errorf("PL didn't contain term %d", term)
+
+		case pl.String() != exp:
+			t.Errorf("PL for %d: '%s'. did not match expected '%s'", term, pl.String(), exp)
+		}
+	}
+}
+
+// The tags of the sets in memory, from the next to be evicted
+func evictionOrder(policy EvictionPolicy) []DatastoreTag {
+	tags := make([]DatastoreTag, 0)
+	for pls := policy.Evict(); pls != nil; pls = policy.Evict() {
+		tags = append(tags, pls.Tag)
+	}
+	return tags
+}
+
+func TestLRU(t *testing.T) {
+	logging.SetupTestLogging()
+
+	sets := make(map[DatastoreTag]*PLSContainer)
+	lru := NewLRUPolicy()
+	for _, tag := range []DatastoreTag{"1", "2", "3", "4"} {
+		sets[tag] = NewPLSContainer(NewPostingListSet(tag, index.PositionalPostingListInitializer))
+		lru.Add(sets[tag])
 	}
 
-	lex.makeRecent(lex.lru_cache[0])
+	lru.Touch(sets["1"])
 
-	if lrutag := lex.lru_cache.LeastRecent().Tag; lrutag != "2" {
+	if lrutag := lru.Evict().Tag; lrutag != "2" {
 		t.Errorf("LRU was '%s', but expected '2'", lrutag)
 	}
 
-	exp_tags := []DatastoreTag{"2", "3", "4", "1"}
+	exp_tags := []DatastoreTag{"3", "4", "1"}
+	if tags := evictionOrder(lru); !reflect.DeepEqual(tags, exp_tags) {
+		t.Errorf("Expected eviction order %v but found %v", exp_tags, tags)
+	}
+
+	if lru.Len() != 0 || lru.Evict() != nil {
+		t.Errorf("Expected nothing left to evict")
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	logging.SetupTestLogging()
+
+	sets := make(map[DatastoreTag]*PLSContainer)
+	set := func(tag DatastoreTag) *PLSContainer {
+		if _, ok := sets[tag]; !ok {
+			sets[tag] = NewPLSContainer(NewPostingListSet(tag, index.BasicPostingListInitializer))
+		}
+		return sets[tag]
+	}
+
+	// 1 is used three times, 2 twice and 3 once
+	lfu, _ := GetEvictionPolicy("lfu")
+	for _, tag := range []DatastoreTag{"1", "2", "3"} {
+		lfu.Add(set(tag))
+	}
+	lfu.Touch(set("1"))
+	lfu.Touch(set("2"))
+	lfu.Touch(set("1"))
+	if tags := evictionOrder(lfu); !reflect.DeepEqual(tags, []DatastoreTag{"3", "2", "1"}) {
+		t.Errorf("Expected LFU to evict 3, 2, 1. Got %v", tags)
+	}
+
+	/* 2Q evicts sets seen once first, until they're down to their
+	 * share, and one read back soon after being evicted is kept
+	 * over them until then */
+	twoQ, _ := GetEvictionPolicy("2q")
+	for _, tag := range []DatastoreTag{"1", "2", "3", "4"} {
+		twoQ.Add(set(tag))
+	}
+	if evicted := twoQ.Evict().Tag; evicted != "1" {
+		t.Errorf("Expected 2Q to evict 1 first. Got %s", evicted)
+	}
+	twoQ.Add(set("1"))
+	twoQ.Add(set("5"))
+	if tags := evictionOrder(twoQ); !reflect.DeepEqual(tags, []DatastoreTag{"2", "3", "4", "1", "5"}) {
+		t.Errorf("Expected 2Q to evict 2, 3, 4, 1, 5. Got %v", tags)
+	}
+
+	// ARC keeps sets used twice over sets used once
+	arc, _ := GetEvictionPolicy("arc")
+	for _, tag := range []DatastoreTag{"1", "2", "3"} {
+		arc.Add(set(tag))
+	}
+	arc.Touch(set("1"))
+	if evicted := arc.Evict().Tag; evicted != "2" {
+		t.Errorf("Expected ARC to evict 2 first. Got %s", evicted)
+	}
+
+	/* Reading 2 back gives sets used once a share of memory, so the
+	 * newest of them is kept over the sets used twice */
+	arc.Add(set("2"))
+	arc.Add(set("4"))
+	if tags := evictionOrder(arc); !reflect.DeepEqual(tags, []DatastoreTag{"3", "1", "2", "4"}) {
+		t.Errorf("Expected ARC to evict 3, 1, 2, 4. Got %v", tags)
+	}
+
+	if _, err := GetEvictionPolicy("random"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
 
-	for i, pls := range lex.lru_cache {
-		if exp_tags[i] != pls.Tag {
-			t.Errorf("Expected '%s' but found '%s'", exp_tags[i], pls.Tag)
+	// A set being made room for isn't evicted, whatever the policy
+	for _, name := range EvictionPolicyNames() {
+		policy, _ := GetEvictionPolicy(name)
+		for _, tag := range []DatastoreTag{"1", "2"} {
+			policy.Add(set(tag))
+		}
+		set("1").pinned, set("2").pinned = true, false
+		if evicted := policy.Evict(); evicted == nil || evicted.Tag != "2" {
+			t.Errorf("Expected %s to evict 2 while 1 is pinned. Got %v", name, evicted)
+		}
+		if evicted := policy.Evict(); evicted != nil || policy.Len() != 1 {
+			t.Errorf("Expected %s to keep 1 while it's pinned. Got %v", name, evicted)
+		}
+		set("1").pinned = false
+		if evicted := policy.Evict(); evicted == nil || evicted.Tag != "1" {
+			t.Errorf("Expected %s to evict 1 once it isn't pinned. Got %v", name, evicted)
 		}
 	}
 
-	t.Log("Test ReplaceOldest functionality")
-	exp_tags = []DatastoreTag{"3", "4", "1"}
+	/* Every policy keeps the same postings as an unlimited lexicon,
+	 * and reports hits and loads. The heap isn't checked, so they're
+	 * replayed against the same budget every time. */
+	defer func(interval time.Duration) { HeapCheckInterval = interval }(HeapCheckInterval)
+	HeapCheckInterval = -1
 
-	t.Log("LRU Before: %v", lex.lru_cache)
-	lex.lru_cache = lex.lru_cache.RemoveOldest()
-	t.Log("LRU After: %v", lex.lru_cache)
+	tmpDir, err := ioutil.TempDir("", "irtest")
+	if err != nil {
+		t.Fatalf("Error creating temp dir %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	documents := make([]filereader.Document, 0)
+	for i := 0; i < 50; i++ {
+		words := make([]string, 0)
+		for j := 0; j < 20; j++ {
+			words = append(words, fmt.Sprintf("w%d", (i*7+j*j)%200))
+		}
+		documents = append(documents, filters.LoadTestDocument(
+			fmt.Sprintf("E%03d", i), strings.Join(words, " ")))
+	}
 
-	for i, pls := range lex.lru_cache {
-		if exp_tags[i] != pls.Tag {
-			t.Errorf("Expected '%s' but found '%s'", exp_tags[i], pls.Tag)
+	insert := func(lex index.Lexicon) {
+		for _, document := range documents {
+			for token := range document.Tokens() {
+				lex.InsertToken(token)
+			}
+		}
+	}
+
+	unlimited := NewLexicon(-1, filepath.Join(tmpDir, "unlimited"))
+	insert(unlimited)
+	expected := new(bytes.Buffer)
+	unlimited.Print(expected)
+
+	for _, name := range EvictionPolicyNames() {
+		location := filepath.Join(tmpDir, name)
+		result, err := ReplayEviction(name, func() index.Lexicon {
+			return NewLexicon(8<<10, location)
+		}, func(lex index.Lexicon) {
+			insert(lex)
+			lex.(index.PersistentLexicon).SaveToDisk()
+		})
+		if err != nil {
+			t.Fatalf("Failed to replay with %s: %v", name, err)
+		}
+
+		if result.Loads == 0 || result.Hits == 0 || result.HitRate() <= 0 || result.HitRate() >= 1 {
+			t.Errorf("Expected %s to hit and load sets. Got %+v", name, result)
+		}
+
+		got := new(bytes.Buffer)
+		LoadLexiconFromDisk(location).Print(got)
+		if got.String() != expected.String() {
+			t.Errorf("%s lost postings:\n%s\nExpected:\n%s", name, got, expected)
 		}
 	}
 }
@@ -339,3 +573,832 @@ func BenchmarkLoadDump(b *testing.B) {
 	}
 
 }
+
+func TestCompiledLexicon(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir := testDir(t)
+	lex := NewLexicon(5, tmpDir)
+	st_index := newTestIndex(lex, index.PositionalPostingListInitializer)
+	insertTestDocs(st_index)
+	st_index.Save()
+
+	if !HasCompiledIndex(tmpDir + "/") {
+		t.Fatalf("Saving didn't write a compiled index")
+	}
+
+	compiled, err := OpenCompiledLexicon(tmpDir + "/")
+	if err != nil {
+		t.Fatalf("Failed to open compiled index: %v", err)
+	}
+	defer compiled.(*compiled_lexicon).Close()
+
+	if !compiled.IsPositional() {
+		t.Errorf("Compiled lexicon should be positional")
+	}
+
+	buf1 := new(bytes.Buffer)
+	buf2 := new(bytes.Buffer)
+	lex.Print(buf1)
+	compiled.Print(buf2)
+
+	if buf1.String() != buf2.String() {
+		t.Errorf("Compiled lexicon differs. Expected:\n%s\nGot:\n%s",
+			buf1.String(), buf2.String())
+	}
+
+	if term, ok := compiled.FindTerm([]byte("dog")); !ok {
+		t.Errorf("Couldn't find 'dog' in compiled lexicon")
+	} else if index.Df(term) != 2 || term.Tf() != 4 {
+		t.Errorf("Expected 'dog' to have df 2 and cf 4. Got %d and %d",
+			index.Df(term), term.Tf())
+	}
+
+	if _, ok := compiled.FindTerm([]byte("cat")); ok {
+		t.Errorf("Found 'cat' in compiled lexicon")
+	}
+}
+
+func TestSPIMILexicon(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir := testDir(t)
+
+	// Small enough that every document gets its own run
+	lex := NewSPIMILexicon(100, tmpDir)
+	var lastDone, lastTotal int64
+	lex.(*spimi_lexicon).SetMergeProgress(func(done, total int64) {
+		lastDone, lastTotal = done, total
+	})
+
+	st_index := newTestIndex(lex, index.PositionalPostingListInitializer)
+	insertTestDocs(st_index)
+	st_index.Save()
+
+	reference := newTestIndex(index.NewTrieLexicon(), index.PositionalPostingListInitializer)
+	insertTestDocs(reference)
+
+	if runs := lex.(*spimi_lexicon).Stat(SPIMIRunsWritten); runs != int64(len(testDocs)) {
+		t.Errorf("Expected %d runs to be written. Got %d", len(testDocs), runs)
+	}
+
+	if lastTotal == 0 || lastDone != lastTotal {
+		t.Errorf("Merge progress ended at %d/%d", lastDone, lastTotal)
+	}
+
+	buf1 := new(bytes.Buffer)
+	buf2 := new(bytes.Buffer)
+	reference.Lexicon().Print(buf1)
+	lex.Print(buf2)
+
+	if buf1.String() != buf2.String() {
+		t.Errorf("Merged lexicon differs. Expected:\n%s\nGot:\n%s",
+			buf1.String(), buf2.String())
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(tmpDir, "run_*")); len(files) > 0 {
+		t.Errorf("Runs weren't removed after merging: %v", files)
+	}
+
+	// The merged index can be opened on its own
+	compiled, err := OpenCompiledLexicon(tmpDir + "/")
+	if err != nil {
+		t.Fatalf("Failed to open merged index: %v", err)
+	}
+	if compiled.Len() != reference.Lexicon().Len() {
+		t.Errorf("Merged index has %d terms, expected %d",
+			compiled.Len(), reference.Lexicon().Len())
+	}
+}
+
+func TestSPIMIPruneOnSave(t *testing.T) {
+	logging.SetupTestLogging()
+
+	lex := NewSPIMILexicon(100, testDir(t))
+	st_index := newTestIndex(lex, index.BasicPostingListInitializer)
+	insertTestDocs(st_index)
+
+	lex.(index.DeferredPruner).PruneOnSave(&index.DocCountPruner{Count: 1})
+	st_index.Save()
+
+	for _, entry := range lex.Walk() {
+		term := entry.(index.LexiconTerm)
+		if df := index.Df(term); df > 1 {
+			t.Errorf("'%s' has %d documents after pruning to 1", term.Text(), df)
+		}
+	}
+
+	if term, ok := lex.FindTerm([]byte("dog")); !ok {
+		t.Errorf("Couldn't find 'dog' after pruning")
+	} else if term.Tf() != 3 {
+		t.Errorf("Expected pruned 'dog' to keep the document with tf 3. Got cf %d",
+			term.Tf())
+	}
+}
+
+func TestDocumentStore(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir, err := ioutil.TempDir("", "irtest")
+	if err != nil {
+		t.Fatalf("Error creating temp dir %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	st_index := new(index.SingleTermIndex)
+	st_index.Init(NewLexicon(-1, tmpDir))
+	st_index.AddFilter(filters.NewLowerCaseFilter())
+
+	if err = st_index.EnableDocumentStore(); err != nil {
+		t.Fatalf("Failed to enable the document store: %v", err)
+	}
+
+	// Enough text to fill several blocks
+	documents := append([]filereader.Document{}, testDocs...)
+	for i := 0; i < 40; i++ {
+		documents = append(documents, filters.LoadTestDocument(
+			"B"+strings.Repeat("0", i), strings.Repeat("all work and no play ", 200+i)))
+	}
+
+	expected := make(map[string]string)
+	for _, document := range documents {
+		expected[document.OrigIdent()] = document.(filereader.TextDocument).Text()
+		st_index.Insert(document)
+	}
+	st_index.WaitInsert()
+	st_index.Save()
+
+	if expected["A03"] != "Here dog Here doggie dog dog" {
+		t.Errorf("Expected the text of A03 to be rebuilt. Got '%s'", expected["A03"])
+	}
+
+	loaded := new(index.SingleTermIndex)
+	loaded.Init(index.NewTrieLexicon())
+
+	if _, err = loaded.GetDocument("A01"); err != index.ErrNoDocumentStore {
+		t.Errorf("Expected ErrNoDocumentStore. Got %v", err)
+	}
+
+	if err = LoadDocumentStore(tmpDir+"/", loaded); err != nil {
+		t.Fatalf("Failed to load the document store: %v", err)
+	}
+
+	for humanId, text := range expected {
+		if stored, err := loaded.GetDocument(humanId); err != nil {
+			t.Errorf("Failed to get %s: %v", humanId, err)
+		} else if stored != text {
+			t.Errorf("Stored text for %s differs. Expected '%s', got '%s'",
+				humanId, text, stored)
+		}
+	}
+
+	if _, err = loaded.GetDocument("missing"); err == nil {
+		t.Errorf("Expected an error getting a missing document")
+	}
+}
+
+func TestCompiledTermIds(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir := testDir(t)
+	lex := NewLexicon(5, tmpDir)
+	st_index := newTestIndex(lex, index.BasicPostingListInitializer)
+	insertTestDocs(st_index)
+	st_index.Save()
+
+	compiled, err := OpenCompiledLexicon(tmpDir + "/")
+	if err != nil {
+		t.Fatalf("Failed to open compiled index: %v", err)
+	}
+
+	// Terms keep the ids they were given when they were inserted
+	table := compiled.(index.NumberedLexicon).TermTable()
+	for _, entry := range compiled.Walk() {
+		term := entry.(index.LexiconTerm)
+		inserted, _ := lex.FindTerm([]byte(term.Text()))
+		expected := inserted.(index.TermIdentifier).Id()
+
+		if id := term.(index.TermIdentifier).Id(); id != expected {
+			t.Errorf("Expected '%s' to have id %d. Got %d", term.Text(), expected, id)
+		}
+		if byId, ok := compiled.(*compiled_lexicon).TermById(expected); !ok ||
+			byId.Text() != term.Text() {
+			t.Errorf("Term %d should be '%s'. Got %v", expected, term.Text(), byId)
+		}
+		if text, ok := table.TermText(expected); !ok || text != term.Text() {
+			t.Errorf("Term table has '%s' for %d, expected '%s'", text, expected, term.Text())
+		}
+	}
+
+	// Prefixes are walked in the dictionary
+	for _, entry := range compiled.Walk() {
+		prefix := entry.(index.LexiconTerm).Text()[:1]
+		expected := make([]string, 0)
+		for _, other := range compiled.Walk() {
+			if text := other.(index.LexiconTerm).Text(); strings.HasPrefix(text, prefix) {
+				expected = append(expected, text)
+			}
+		}
+
+		walked := make([]string, 0)
+		compiled.(index.PrefixLexicon).WalkPrefix(prefix, func(text string) bool {
+			walked = append(walked, text)
+			return true
+		})
+		if fmt.Sprint(walked) != fmt.Sprint(expected) {
+			t.Errorf("Walking '%s' gave %v, expected %v", prefix, walked, expected)
+		}
+	}
+
+	compiled.(*compiled_lexicon).Close()
+}
+
+func TestSegmentedIndex(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir := testDir(t)
+	buffer := newTestIndex(index.NewTrieLexicon(), index.PositionalPostingListInitializer)
+
+	segmented, err := NewSegmentedIndex(tmpDir, buffer, index.PositionalPostingListInitializer)
+	if err != nil {
+		t.Fatalf("Failed to create segmented index: %v", err)
+	}
+	if _, err = NewSegmentedIndex(tmpDir, buffer, index.PositionalPostingListInitializer); err == nil {
+		t.Errorf("Expected an error creating a segmented index over another")
+	}
+
+	// One document per segment, and three segments are merged into one
+	segmented.SegmentDocs = 1
+	segmented.Policy = NewTieredMergePolicy(3)
+
+	for _, document := range testDocs {
+		segmented.Insert(document)
+	}
+	segmented.WaitMerges()
+
+	checkTerm := func(label, text string, df, cf int) {
+		view := segmented.Snapshot()
+		if term, ok := view.Retrieve(text); !ok {
+			if df > 0 {
+				t.Errorf("%s: couldn't find '%s'", label, text)
+			}
+		} else if index.Df(term) != df || term.Tf() != cf {
+			t.Errorf("%s: expected '%s' to have df %d and cf %d. Got %d and %d",
+				label, text, df, cf, index.Df(term), term.Tf())
+		}
+	}
+
+	if manifest, _ := ReadSegmentManifest(tmpDir); len(manifest.Segments) != 1 ||
+		manifest.Segments[0].Documents != 3 {
+		t.Errorf("Expected the segments to be merged into one. Got %+v", manifest.Segments)
+	}
+	if segmented.Len() != 3 {
+		t.Errorf("Expected 3 documents. Got %d", segmented.Len())
+	}
+	checkTerm("Merged", "dog", 2, 4)
+
+	// Deletes are hidden from searches and the statistics
+	if found, err := segmented.DeleteDocument("A02"); !found || err != nil {
+		t.Errorf("Failed to delete A02: %v", err)
+	}
+	if found, _ := segmented.DeleteDocument("missing"); found {
+		t.Errorf("Deleted a document that doesn't exist")
+	}
+	checkTerm("Deleted", "dog", 1, 3)
+	checkTerm("Deleted", "slight", 0, 0)
+	if tokens := segmented.Snapshot().Stats().TotalTokens; tokens != 10 {
+		t.Errorf("Expected 10 tokens after deleting A02. Got %d", tokens)
+	}
+
+	// A new segment is searched alongside the merged one
+	segmented.Insert(filters.LoadTestDocument("A04", "A slight brown cat"))
+	if err = segmented.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	checkTerm("Added", "brown", 2, 2)
+	checkTerm("Added", "slight", 1, 1)
+
+	reopened, err := OpenSegmentedIndex(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen segmented index: %v", err)
+	}
+	if reopened.Len() != 3 {
+		t.Errorf("Expected 3 documents after reopening. Got %d", reopened.Len())
+	}
+
+	// Every segment numbers its terms in the same table
+	if id, ok := reopened.Snapshot().TermId("brown"); !ok {
+		t.Errorf("Couldn't find 'brown' after reopening")
+	} else if text, _ := reopened.Snapshot().TermText(id); text != "brown" {
+		t.Errorf("Expected id %d to be 'brown'. Got '%s'", id, text)
+	}
+
+	buf1 := new(bytes.Buffer)
+	buf2 := new(bytes.Buffer)
+	segmented.Snapshot().Lexicon().Print(buf1)
+	reopened.Snapshot().Lexicon().Print(buf2)
+	if buf1.String() != buf2.String() {
+		t.Errorf("Reopened index differs. Expected:\n%s\nGot:\n%s",
+			buf1.String(), buf2.String())
+	}
+}
+
+func TestIndexManifest(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir := testDir(t)
+	location := tmpDir + "/"
+
+	st_index := newTestIndex(NewLexicon(-1, tmpDir), index.PositionalPostingListInitializer)
+	st_index.Sources = []string{"/docs"}
+	insertTestDocs(st_index)
+	st_index.Save()
+
+	manifest, err := index.ReadManifest(location)
+	if err != nil {
+		t.Fatalf("Failed to read the manifest: %v", err)
+	}
+	if manifest.FormatVersion != index.IndexFormatVersion ||
+		manifest.IndexType != "single-term-positional" ||
+		manifest.PostingList != index.PositionalPostingListInitializer.Name ||
+		manifest.Documents != len(testDocs) || len(manifest.Filters) != 1 {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+	if _, ok := manifest.Files[DocMapFile]; !ok {
+		t.Errorf("The manifest doesn't list %s: %v", DocMapFile, manifest.FileNames())
+	}
+	if errs := manifest.Verify(location); len(errs) > 0 {
+		t.Errorf("Freshly saved index failed verification: %v", errs)
+	}
+
+	loaded, err := SingleTermIndexFromDisk(location)
+	if err != nil {
+		t.Fatalf("Failed to load the index: %v", err)
+	}
+	if loaded.IndexType != manifest.IndexType || len(loaded.Sources) != 1 {
+		t.Errorf("Loaded index has type '%s' and sources %v",
+			loaded.IndexType, loaded.Sources)
+	}
+
+	// A damaged file is caught by its checksum
+	stats := filepath.Join(tmpDir, index.CollectionStatsFile)
+	original, _ := ioutil.ReadFile(stats)
+	damaged := append([]byte{}, original...)
+	damaged[0] ^= 0xff
+	ioutil.WriteFile(stats, damaged, 0644)
+	if errs := manifest.Verify(location); len(errs) != 1 {
+		t.Errorf("Expected one damaged file. Got %v", errs)
+	}
+	ioutil.WriteFile(stats, original, 0644)
+
+	// Indexes from newer builds are refused
+	manifest.FormatVersion = index.IndexFormatVersion + 1
+	if err = manifest.WriteTo(location); err != nil {
+		t.Fatalf("Failed to rewrite the manifest: %v", err)
+	}
+	if _, err = SingleTermIndexFromDisk(location); err == nil ||
+		!strings.Contains(err.Error(), "format version") {
+		t.Errorf("Expected a format version error. Got %v", err)
+	}
+
+	// So are indexes missing files
+	manifest.FormatVersion = index.IndexFormatVersion
+	manifest.WriteTo(location)
+	os.Remove(filepath.Join(tmpDir, index.WildcardIndexFile))
+	if _, err = SingleTermIndexFromDisk(location); err == nil ||
+		!strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected a missing file error. Got %v", err)
+	}
+}
+
+func TestCheckIndex(t *testing.T) {
+	logging.SetupTestLogging()
+
+	st_index, tmpDir := buildTestIndex(t, index.PositionalPostingListInitializer)
+	defer os.RemoveAll(tmpDir + ".damaged")
+	lexicon := st_index.Lexicon()
+
+	if report, err := CheckIndex(tmpDir); err != nil {
+		t.Fatalf("Failed to check the index: %v", err)
+	} else if !report.OK() || report.Documents != 3 || report.Terms != lexicon.Len() ||
+		report.Postings != 11 {
+		t.Errorf("Expected a clean index of 3 documents, %d terms and 11 postings. Got %+v",
+			lexicon.Len(), report)
+	}
+
+	// Lose A02 from the document map, and damage a posting list set
+	docmap := make(index.DocInfoMap)
+	for id, info := range st_index.DocumentMap {
+		if info.HumanId != "A02" {
+			docmap[id] = info
+		}
+	}
+	file, _ := os.Create(filepath.Join(tmpDir, DocMapFile))
+	docmap.WriteBinary(file)
+	file.Close()
+
+	os.Remove(filepath.Join(tmpDir, TermDictFile))
+	sets, _ := filepath.Glob(filepath.Join(tmpDir, "pls_*"))
+	if len(sets) == 0 {
+		t.Fatalf("No posting list sets were written")
+	}
+	file, _ = os.OpenFile(sets[0], os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString("dog # 1 x\n")
+	file.Close()
+
+	report, err := CheckIndex(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to check the damaged index: %v", err)
+	}
+	if _, err = RepairIndex(report); err == nil {
+		t.Errorf("Expected a report without posting lists not to repair")
+	}
+
+	report, err = CheckIndexForRepair(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to check the damaged index: %v", err)
+	}
+	// The document map and posting list set changed, and terms.dict is gone
+	counts := report.Counts()
+	if counts[ProblemChecksum] != 3 || counts[ProblemUnreadable] != 1 ||
+		counts[ProblemUnknownDocument] == 0 {
+		t.Errorf("Unexpected problems: %v", report.Problems)
+	}
+
+	if _, err = RepairIndex(report); err != nil {
+		t.Fatalf("Failed to repair the index: %v", err)
+	}
+	if report, err = CheckIndex(tmpDir); err != nil || !report.OK() {
+		t.Errorf("Repaired index isn't clean: %v %v", err, report.Problems)
+	}
+
+	repaired, err := SingleTermIndexFromDisk(tmpDir + "/")
+	if err != nil {
+		t.Fatalf("Failed to load the repaired index: %v", err)
+	}
+	if len(repaired.DocumentMap) != 2 {
+		t.Errorf("Expected 2 documents in the repaired index. Got %d",
+			len(repaired.DocumentMap))
+	}
+	if _, err = os.Stat(tmpDir + ".damaged"); err != nil {
+		t.Errorf("The damaged index wasn't kept: %v", err)
+	}
+}
+
+func TestMergeIndexes(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir, err := ioutil.TempDir("", "irtest")
+	if err != nil {
+		t.Fatalf("Error creating temp dir %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	build := func(name string, plInit index.PostingListInitializer,
+		documents ...filereader.Document) string {
+
+		location := filepath.Join(tmpDir, name)
+		lexicon := NewLexicon(-1, location)
+		lexicon.SetPLInitializer(plInit)
+
+		st_index := new(index.SingleTermIndex)
+		st_index.Init(lexicon)
+		st_index.AddFilter(filters.NewLowerCaseFilter())
+		st_index.Sources = []string{"/docs/" + name}
+		for _, document := range documents {
+			st_index.Insert(document)
+		}
+		st_index.WaitInsert()
+		st_index.Save()
+		return location
+	}
+
+	positional := index.PositionalPostingListInitializer
+	first := build("first", positional, testDocs[0], testDocs[1])
+	second := build("second", positional, testDocs[2],
+		filters.LoadTestDocument("A04", "A brown dog"))
+	basic := build("basic", index.BasicPostingListInitializer, testDocs[2])
+
+	if _, err = MergeIndexes(filepath.Join(tmpDir, "bad"), []string{first, basic}); err == nil {
+		t.Errorf("Merged indexes with different posting list types")
+	}
+
+	out := filepath.Join(tmpDir, "merged")
+	if _, err = MergeIndexes(out, []string{first, second}); err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+
+	merged, err := SingleTermIndexFromDisk(out + "/")
+	if err != nil {
+		t.Fatalf("Failed to load the merged index: %v", err)
+	}
+	if len(merged.DocumentMap) != 4 || merged.Stats().Documents != 4 ||
+		merged.Stats().TotalTokens != 4+4+6+3 {
+		t.Errorf("Expected 4 documents of 17 tokens. Got %d, %s",
+			len(merged.DocumentMap), merged.Stats())
+	}
+	if len(merged.Sources) != 2 {
+		t.Errorf("Expected both sources to be kept. Got %v", merged.Sources)
+	}
+
+	for text, df := range map[string]int{"dog": 3, "brown": 3, "here": 1, "quick": 1} {
+		if term, ok := merged.Retrieve(text); !ok || index.Df(term) != df {
+			t.Errorf("Expected '%s' to be in %d documents", text, df)
+		}
+	}
+
+	if report, err := CheckIndex(out); err != nil || !report.OK() {
+		t.Errorf("Merged index isn't clean: %v %v", err, report.Problems)
+	}
+
+	if _, err = MergeIndexes(filepath.Join(tmpDir, "self"), []string{first, first}); err == nil {
+		t.Errorf("Merged an index with itself, so with every document twice")
+	}
+
+	// Every document id collides, so the second index's are renumbered
+	clashing := build("clashing", positional,
+		renumbered_doc{filters.LoadTestDocument("B01", "The brown cow"), testDocs[0].Identifier()},
+		renumbered_doc{filters.LoadTestDocument("B02", "A brown hen"), testDocs[1].Identifier()})
+	twice := filepath.Join(tmpDir, "twice")
+	if _, err = MergeIndexes(twice, []string{first, clashing}); err != nil {
+		t.Fatalf("Failed to merge indexes with the same document ids: %v", err)
+	}
+	if merged, err = SingleTermIndexFromDisk(twice + "/"); err != nil {
+		t.Fatalf("Failed to load the merged index: %v", err)
+	}
+	if len(merged.DocumentMap) != 4 {
+		t.Errorf("Expected 4 documents. Got %d", len(merged.DocumentMap))
+	}
+	if term, ok := merged.Retrieve("brown"); !ok || index.Df(term) != 4 || term.Tf() != 4 {
+		t.Errorf("Expected 'brown' to be in all 4 documents")
+	}
+	if term, ok := merged.Retrieve("cow"); !ok || index.Df(term) != 1 {
+		t.Errorf("Expected 'cow' to be in 1 document")
+	} else if it := term.PostingList().Iterator(); !it.Next() ||
+		merged.DocumentMap[it.Value().DocId()].HumanId != "B01" {
+		t.Errorf("Expected 'cow' to be in B01 under its new id")
+	}
+	if report, err := CheckIndex(twice); err != nil || !report.OK() {
+		t.Errorf("Index merged with clashing ids isn't clean: %v %v", err, report.Problems)
+	}
+}
+
+/* A document given another's id, so indexes can be built with
+ * the same document ids */
+type renumbered_doc struct {
+	filereader.Document
+	id filereader.DocumentId
+}
+
+func (d renumbered_doc) Identifier() filereader.DocumentId {
+	return d.id
+}
+
+func (d renumbered_doc) Tokens() <-chan *filereader.Token {
+	tokens := make(chan *filereader.Token)
+	go func() {
+		for token := range d.Document.Tokens() {
+			token.DocId = d.id
+			tokens <- token
+		}
+		close(tokens)
+	}()
+	return tokens
+}
+
+func TestPruneIndex(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir := testDir(t)
+	input := filepath.Join(tmpDir, "input")
+	st_index := newTestIndex(NewLexicon(-1, input), index.PositionalPostingListInitializer)
+	if err := st_index.EnableDocumentStore(); err != nil {
+		t.Fatalf("Failed to enable the document store: %v", err)
+	}
+	insertTestDocs(st_index)
+	st_index.Save()
+
+	// Keep the one document with the most of each term
+	var seen *index.SingleTermIndex
+	output := filepath.Join(tmpDir, "pruned")
+	_, err := PruneIndex(input, output,
+		func(source *index.SingleTermIndex) (index.PostingListPruner, error) {
+			seen = source
+			return &index.DocCountPruner{Count: 1}, nil
+		})
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if seen == nil || seen.Stats().Documents != 3 {
+		t.Fatalf("Expected the pruner to be built for the loaded input")
+	}
+	if term, ok := seen.Retrieve("dog"); !ok || index.Df(term) != 2 {
+		t.Errorf("Expected the input's posting lists to be left as they were")
+	}
+
+	if _, err = PruneIndex(input, output,
+		func(*index.SingleTermIndex) (index.PostingListPruner, error) {
+			return &index.DocCountPruner{Count: 1}, nil
+		}); err == nil {
+		t.Errorf("Pruned into an existing index")
+	}
+
+	pruned, err := SingleTermIndexFromDisk(output + "/")
+	if err != nil {
+		t.Fatalf("Failed to load the pruned index: %v", err)
+	}
+	if len(pruned.DocumentMap) != 3 || pruned.Stats().Documents != 3 {
+		t.Errorf("Expected every document to be kept. Got %d", len(pruned.DocumentMap))
+	}
+
+	for text, df := range map[string]int{"dog": 1, "brown": 1, "the": 1, "fox": 1} {
+		if term, ok := pruned.Retrieve(text); !ok || index.Df(term) != df {
+			t.Errorf("Expected '%s' to be in %d documents", text, df)
+		}
+	}
+	if term, _ := pruned.Retrieve("dog"); term != nil {
+		if it := term.PostingList().Iterator(); it.Next() && it.Value().Frequency() != 3 {
+			t.Errorf("Expected A03 to be kept for 'dog'")
+		}
+	}
+
+	if text, err := pruned.GetDocument("A01"); err != nil || !strings.Contains(text, "fox") {
+		t.Errorf("Expected the document store to be copied. Got %q, %v", text, err)
+	}
+
+	if report, err := CheckIndex(output); err != nil || !report.OK() {
+		t.Errorf("Pruned index isn't clean: %v %v", err, report.Problems)
+	}
+}
+
+func TestDocumentPruningSwapped(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir := testDir(t)
+
+	build := func(lexicon index.Lexicon) *index.SingleTermIndex {
+		st_index := newTestIndex(lexicon, index.PositionalPostingListInitializer)
+		insertTestDocs(st_index)
+		st_index.Prune(index.NewDocumentPruner(index.NewTfIdfScorer(st_index), 50))
+		return st_index
+	}
+
+	postings := func(lexicon index.Lexicon) map[string][]filereader.DocumentId {
+		result := make(map[string][]filereader.DocumentId)
+		for _, entry := range lexicon.Walk() {
+			term := entry.(index.LexiconTerm)
+			for it := term.PostingList().Iterator(); it.Next(); {
+				result[term.Text()] = append(result[term.Text()], it.Value().DocId())
+			}
+		}
+		return result
+	}
+
+	// Swapping posting lists out mustn't change what's kept
+	location := filepath.Join(tmpDir, "swapped")
+	swapped := build(NewLexicon(5, location))
+	expected := postings(build(index.NewTrieLexicon()).Lexicon())
+
+	swapped.Save()
+	loaded, err := SingleTermIndexFromDisk(location + "/")
+	if err != nil {
+		t.Fatalf("Failed to load the pruned index: %v", err)
+	}
+	if kept := postings(loaded.Lexicon()); !reflect.DeepEqual(kept, expected) {
+		t.Errorf("Expected the swapped index to keep %v. Got %v", expected, kept)
+	}
+
+	// Each document keeps two of its three or four terms, even when
+	// some of them tie
+	count := 0
+	for _, ids := range expected {
+		count += len(ids)
+	}
+	if count != 6 {
+		t.Errorf("Expected 6 of the 11 postings to be kept. Got %d: %v", count, expected)
+	}
+
+	if report, err := CheckIndex(location); err != nil || !report.OK() {
+		t.Errorf("Pruned index isn't clean: %v %v", err, report.Problems)
+	}
+
+	// SPIMI lexicons only have complete posting lists once they're saved
+	spimi := build(NewSPIMILexicon(100, filepath.Join(tmpDir, "spimi")))
+	spimi.Save()
+	if kept := postings(spimi.Lexicon()); len(kept["dog"]) != 2 {
+		t.Errorf("Expected the SPIMI index to be left unpruned. Got %v", kept)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	logging.SetupTestLogging()
+
+	tmpDir, err := ioutil.TempDir("", "irtest")
+	if err != nil {
+		t.Fatalf("Error creating temp dir %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 200 documents of 50 tokens, with 'common' repeated in each
+	documents := make([]filereader.Document, 0)
+	for i := 0; i < 200; i++ {
+		words := make([]string, 0)
+		for j := 0; j < 25; j++ {
+			words = append(words, "common", fmt.Sprintf("w%d", (i*25+j)%700))
+		}
+		documents = append(documents, filters.LoadTestDocument(
+			fmt.Sprintf("M%03d", i), strings.Join(words, " ")))
+	}
+
+	build := func(name string, budget int64, plInit index.PostingListInitializer) *lexicon {
+		lex := NewLexicon(budget, filepath.Join(tmpDir, name)).(*lexicon)
+		lex.SetPLInitializer(plInit)
+		for _, document := range documents {
+			for token := range document.Tokens() {
+				lex.InsertToken(token)
+			}
+		}
+		return lex
+	}
+
+	// Every set is in memory, so the load is what they estimate
+	basic := build("basic", -1, index.BasicPostingListInitializer)
+	positional := build("positional", -1, index.PositionalPostingListInitializer)
+	for _, lex := range []*lexicon{basic, positional} {
+		var size int64
+		for _, container := range lex.pl_set_cache {
+			container.PLS.RecalculateSize()
+			size += container.PLS.Size
+		}
+		if size != lex.currentLoad {
+			t.Errorf("Posting lists estimate %d bytes, but the load is %d", size, lex.currentLoad)
+		}
+	}
+
+	// Positional lists also hold 5000 positions
+	if extra := positional.currentLoad - basic.currentLoad; extra != 10000*PositionBytes {
+		t.Errorf("Expected positions to add %d bytes. Got %d", 10000*PositionBytes, extra)
+	}
+
+	/* Compressed lists cost their pending entries until they're
+	 * compressed, and then what they're encoded in, as they're
+	 * inserted into as well as when they're measured */
+	codec, _ := index.GetCodec("vbyte")
+	compressed := build("compressed", -1, index.NewCompressedPostingListInitializer(codec, false))
+	measure := func() (size int64) {
+		for _, container := range compressed.pl_set_cache {
+			container.PLS.RecalculateSize()
+			size += container.PLS.Size
+		}
+		return
+	}
+	unflushed := measure()
+	if unflushed != compressed.currentLoad || unflushed != measure() {
+		t.Errorf("Expected measuring compressed lists to leave them as they were, "+
+			"costing the %d bytes they were charged. Got %d, then %d",
+			compressed.currentLoad, unflushed, measure())
+	}
+	if unflushed >= basic.currentLoad {
+		t.Errorf("Expected compressed lists to cost less than %d bytes. Got %d",
+			basic.currentLoad, unflushed)
+	}
+	for _, container := range compressed.pl_set_cache {
+		container.PLS.flush()
+	}
+	if size := measure(); size >= unflushed || size >= basic.currentLoad/2 {
+		t.Errorf("Expected flushed compressed lists to cost under %d bytes, "+
+			"and less than before. Got %d", basic.currentLoad/2, size)
+	}
+
+	budget := positional.currentLoad / 4
+	swapped := build("swapped", budget, index.PositionalPostingListInitializer)
+	if swapped.currentLoad > budget {
+		t.Errorf("Have %d bytes of posting lists in memory with a %d byte budget",
+			swapped.currentLoad, budget)
+	}
+	if swapped.stats[PLSDumpCount] == 0 {
+		t.Errorf("Expected posting lists to be swapped to disk")
+	}
+	if term, ok := swapped.FindTerm([]byte("common")); !ok || term.Tf() != 5000 ||
+		term.PostingList().Len() != 200 {
+		t.Errorf("Lost postings for 'common' while swapping")
+	}
+
+	// The heap is far over a budget this small
+	defer func(interval time.Duration) { HeapCheckInterval = interval }(HeapCheckInterval)
+	HeapCheckInterval = 0
+
+	tiny := build("tiny", 16<<10, index.BasicPostingListInitializer)
+	if tiny.stats[PLSHeapChecks] == 0 || tiny.budgetScale != MinBudgetScale {
+		t.Errorf("Expected heap checks to shrink the budget to %0.2f. Got %0.2f after %d checks",
+			MinBudgetScale, tiny.budgetScale, tiny.stats[PLSHeapChecks])
+	}
+
+	// Lexicons saved with a limit in entries are given one in bytes
+	legacy := new(lexicon)
+	legacy.Init()
+	legacy.ReadMetadata(strings.NewReader("pl_type basic\nmemlimit 1000\n"))
+	if legacy.maxLoad != 1000*LegacyEntryBytes {
+		t.Errorf("Expected a legacy limit of %d bytes. Got %d", 1000*LegacyEntryBytes, legacy.maxLoad)
+	}
+}
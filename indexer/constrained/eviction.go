@@ -0,0 +1,480 @@
+package constrained
+
+import "container/heap"
+import "container/list"
+import "errors"
+import "sort"
+import "fmt"
+import "time"
+import index "github.com/cwacek/irengine/indexer"
+
+/* Decides which posting list set in memory the lexicon writes to
+ * disk next when it's over its memory budget. The lexicon tells the
+ * policy about every set it brings into memory, and every use of
+ * one that's already there. */
+type EvictionPolicy interface {
+	// A set was created, or read back from disk
+	Add(pls *PLSContainer)
+
+	// A set in memory was used
+	Touch(pls *PLSContainer)
+
+	// Choose a set in memory that isn't pinned to write to disk, and
+	// forget it. Nil if there are no such sets
+	Evict() *PLSContainer
+
+	// The number of sets in memory
+	Len() int
+
+	// Call f with each set in memory until it returns false
+	Each(f func(*PLSContainer) bool)
+}
+
+const DefaultEvictionPolicy = "lru"
+
+var evictionPolicies = map[string]func() EvictionPolicy{
+	"lru": NewLRUPolicy,
+	"lfu": NewLFUPolicy,
+	"2q":  NewTwoQPolicy,
+	"arc": NewARCPolicy,
+}
+
+func GetEvictionPolicy(name string) (EvictionPolicy, error) {
+	if policy, ok := evictionPolicies[name]; ok {
+		return policy(), nil
+	}
+	return nil, errors.New("Unknown eviction policy: " + name)
+}
+
+// The names of the eviction policies, in order
+func EvictionPolicyNames() []string {
+	names := make([]string, 0, len(evictionPolicies))
+	for name := range evictionPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* A list of sets, or the tags of sets which have been evicted,
+ * with the most recent at the front. Entries can be found by tag
+ * in constant time. */
+type tag_list struct {
+	order *list.List
+	at    map[DatastoreTag]*list.Element
+}
+
+type tag_entry struct {
+	tag DatastoreTag
+	pls *PLSContainer
+}
+
+func newTagList() *tag_list {
+	return &tag_list{list.New(), make(map[DatastoreTag]*list.Element)}
+}
+
+func (l *tag_list) Len() int {
+	return l.order.Len()
+}
+
+func (l *tag_list) Contains(tag DatastoreTag) bool {
+	_, ok := l.at[tag]
+	return ok
+}
+
+func (l *tag_list) PushFront(tag DatastoreTag, pls *PLSContainer) {
+	l.at[tag] = l.order.PushFront(tag_entry{tag, pls})
+}
+
+func (l *tag_list) MoveToFront(tag DatastoreTag) bool {
+	if elem, ok := l.at[tag]; ok {
+		l.order.MoveToFront(elem)
+		return true
+	}
+	return false
+}
+
+func (l *tag_list) Remove(tag DatastoreTag) (*PLSContainer, bool) {
+	if elem, ok := l.at[tag]; ok {
+		delete(l.at, tag)
+		return l.order.Remove(elem).(tag_entry).pls, true
+	}
+	return nil, false
+}
+
+// Remove the least recent entry whose set isn't pinned
+func (l *tag_list) PopBack() (tag_entry, bool) {
+	for elem := l.order.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(tag_entry)
+		if entry.pls != nil && entry.pls.pinned {
+			continue
+		}
+		delete(l.at, entry.tag)
+		l.order.Remove(elem)
+		return entry, true
+	}
+	return tag_entry{}, false
+}
+
+func (l *tag_list) Each(f func(*PLSContainer) bool) bool {
+	for elem := l.order.Front(); elem != nil; elem = elem.Next() {
+		if !f(elem.Value.(tag_entry).pls) {
+			return false
+		}
+	}
+	return true
+}
+
+// Evicts the set that was used longest ago
+type lru_policy struct {
+	resident *tag_list
+}
+
+func NewLRUPolicy() EvictionPolicy {
+	return &lru_policy{newTagList()}
+}
+
+func (p *lru_policy) Add(pls *PLSContainer) {
+	p.resident.PushFront(pls.Tag, pls)
+}
+
+func (p *lru_policy) Touch(pls *PLSContainer) {
+	p.resident.MoveToFront(pls.Tag)
+}
+
+func (p *lru_policy) Evict() *PLSContainer {
+	entry, _ := p.resident.PopBack()
+	return entry.pls
+}
+
+func (p *lru_policy) Len() int {
+	return p.resident.Len()
+}
+
+func (p *lru_policy) Each(f func(*PLSContainer) bool) {
+	p.resident.Each(f)
+}
+
+/* Evicts the set used least often since it was last brought into
+ * memory, or of those, the one used longest ago. */
+type lfu_policy struct {
+	entries lfu_heap
+	at      map[DatastoreTag]*lfu_entry
+	clock   int
+}
+
+type lfu_entry struct {
+	pls       *PLSContainer
+	uses      int
+	lastUsed  int
+	heapIndex int
+}
+
+type lfu_heap []*lfu_entry
+
+func (h lfu_heap) Len() int {
+	return len(h)
+}
+
+func (h lfu_heap) Less(i, j int) bool {
+	if h[i].uses != h[j].uses {
+		return h[i].uses < h[j].uses
+	}
+	return h[i].lastUsed < h[j].lastUsed
+}
+
+func (h lfu_heap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *lfu_heap) Push(x interface{}) {
+	entry := x.(*lfu_entry)
+	entry.heapIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfu_heap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func NewLFUPolicy() EvictionPolicy {
+	return &lfu_policy{at: make(map[DatastoreTag]*lfu_entry)}
+}
+
+func (p *lfu_policy) Add(pls *PLSContainer) {
+	p.clock++
+	entry := &lfu_entry{pls: pls, uses: 1, lastUsed: p.clock}
+	p.at[pls.Tag] = entry
+	heap.Push(&p.entries, entry)
+}
+
+func (p *lfu_policy) Touch(pls *PLSContainer) {
+	if entry, ok := p.at[pls.Tag]; ok {
+		p.clock++
+		entry.uses++
+		entry.lastUsed = p.clock
+		heap.Fix(&p.entries, entry.heapIndex)
+	}
+}
+
+func (p *lfu_policy) Evict() *PLSContainer {
+	pinned := make([]*lfu_entry, 0)
+	defer func() {
+		for _, entry := range pinned {
+			heap.Push(&p.entries, entry)
+		}
+	}()
+
+	for len(p.entries) > 0 {
+		entry := heap.Pop(&p.entries).(*lfu_entry)
+		if entry.pls.pinned {
+			pinned = append(pinned, entry)
+			continue
+		}
+		delete(p.at, entry.pls.Tag)
+		return entry.pls
+	}
+	return nil
+}
+
+func (p *lfu_policy) Len() int {
+	return len(p.entries)
+}
+
+func (p *lfu_policy) Each(f func(*PLSContainer) bool) {
+	for _, entry := range p.entries {
+		if !f(entry.pls) {
+			return
+		}
+	}
+}
+
+/* The full 2Q policy of Johnson and Shasha (VLDB 1994). Sets seen
+ * for the first time go in a FIFO queue, and are evicted from it
+ * first while it holds more than a quarter of the sets in memory.
+ * The tags of sets evicted from it are remembered, and a set that's
+ * read back while remembered goes into the main LRU list. Sizes are
+ * in sets, relative to the most there have been in memory. */
+type two_q_policy struct {
+	in, out, main *tag_list
+	peak          int
+}
+
+func NewTwoQPolicy() EvictionPolicy {
+	return &two_q_policy{in: newTagList(), out: newTagList(), main: newTagList()}
+}
+
+func (p *two_q_policy) Add(pls *PLSContainer) {
+	if _, ok := p.out.Remove(pls.Tag); ok {
+		p.main.PushFront(pls.Tag, pls)
+	} else {
+		p.in.PushFront(pls.Tag, pls)
+	}
+	if p.Len() > p.peak {
+		p.peak = p.Len()
+	}
+}
+
+func (p *two_q_policy) Touch(pls *PLSContainer) {
+	// Uses while in the FIFO queue don't count
+	p.main.MoveToFront(pls.Tag)
+}
+
+func (p *two_q_policy) Evict() *PLSContainer {
+	if p.in.Len() > atLeastOne(p.peak/4) || p.main.Len() == 0 {
+		if entry, ok := p.in.PopBack(); ok {
+			p.out.PushFront(entry.tag, nil)
+			for p.out.Len() > atLeastOne(p.peak/2) {
+				p.out.PopBack()
+			}
+			return entry.pls
+		}
+	}
+
+	entry, _ := p.main.PopBack()
+	return entry.pls
+}
+
+func (p *two_q_policy) Len() int {
+	return p.in.Len() + p.main.Len()
+}
+
+func (p *two_q_policy) Each(f func(*PLSContainer) bool) {
+	if p.in.Each(f) {
+		p.main.Each(f)
+	}
+}
+
+/* Megiddo and Modha's Adaptive Replacement Cache (FAST 2003).
+ * Sets used once since being brought into memory are in recent,
+ * and sets used again in frequent, both kept in LRU order. The
+ * tags of sets evicted from each are remembered, and reading back
+ * a remembered set grows the share of memory given to the list it
+ * was evicted from. Sizes are in sets, relative to the most there
+ * have been in memory. */
+type arc_policy struct {
+	recent, frequent       *tag_list
+	recentGhost, freqGhost *tag_list
+	target                 float64
+	peak                   int
+	fromFreqGhost          bool
+}
+
+func NewARCPolicy() EvictionPolicy {
+	return &arc_policy{
+		recent: newTagList(), frequent: newTagList(),
+		recentGhost: newTagList(), freqGhost: newTagList(),
+	}
+}
+
+func (p *arc_policy) Add(pls *PLSContainer) {
+	if p.Len()+1 > p.peak {
+		p.peak = p.Len() + 1
+	}
+
+	switch {
+	case p.recentGhost.Contains(pls.Tag):
+		p.target += float64(atLeastOne(p.freqGhost.Len() / p.recentGhost.Len()))
+		if p.target > float64(p.peak) {
+			p.target = float64(p.peak)
+		}
+		p.recentGhost.Remove(pls.Tag)
+		p.frequent.PushFront(pls.Tag, pls)
+
+	case p.freqGhost.Contains(pls.Tag):
+		p.target -= float64(atLeastOne(p.recentGhost.Len() / p.freqGhost.Len()))
+		if p.target < 0 {
+			p.target = 0
+		}
+		p.freqGhost.Remove(pls.Tag)
+		p.frequent.PushFront(pls.Tag, pls)
+		p.fromFreqGhost = true
+
+	default:
+		p.recent.PushFront(pls.Tag, pls)
+	}
+
+	// Remember at most as many sets as have been in memory
+	for p.recent.Len()+p.recentGhost.Len() > p.peak && p.recentGhost.Len() > 0 {
+		p.recentGhost.PopBack()
+	}
+	for p.Len()+p.recentGhost.Len()+p.freqGhost.Len() > 2*p.peak && p.freqGhost.Len() > 0 {
+		p.freqGhost.PopBack()
+	}
+}
+
+func (p *arc_policy) Touch(pls *PLSContainer) {
+	if _, ok := p.recent.Remove(pls.Tag); ok {
+		p.frequent.PushFront(pls.Tag, pls)
+	} else {
+		p.frequent.MoveToFront(pls.Tag)
+	}
+}
+
+func (p *arc_policy) Evict() *PLSContainer {
+	fromFreqGhost := p.fromFreqGhost
+	p.fromFreqGhost = false
+
+	recent := float64(p.recent.Len())
+	if p.recent.Len() > 0 && (recent > p.target ||
+		(fromFreqGhost && recent == p.target) || p.frequent.Len() == 0) {
+
+		if entry, ok := p.recent.PopBack(); ok {
+			p.recentGhost.PushFront(entry.tag, nil)
+			return entry.pls
+		}
+	}
+
+	if entry, ok := p.frequent.PopBack(); ok {
+		p.freqGhost.PushFront(entry.tag, nil)
+		return entry.pls
+	}
+
+	// Only pinned sets are left in frequent
+	if entry, ok := p.recent.PopBack(); ok {
+		p.recentGhost.PushFront(entry.tag, nil)
+		return entry.pls
+	}
+	return nil
+}
+
+func (p *arc_policy) Len() int {
+	return p.recent.Len() + p.frequent.Len()
+}
+
+func (p *arc_policy) Each(f func(*PLSContainer) bool) {
+	if p.recent.Each(f) {
+		p.frequent.Each(f)
+	}
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+/* What one eviction policy did with a workload. Every posting list
+ * set fetched is either already in memory (a hit), read back from
+ * disk (a load), or created. */
+type EvictionBenchmark struct {
+	Policy  string
+	Fetches int
+	Hits    int
+	Loads   int
+	Creates int
+	Dumps   int
+	Elapsed time.Duration
+}
+
+// The share of fetches for existing sets that didn't go to disk
+func (b *EvictionBenchmark) HitRate() float64 {
+	if b.Hits+b.Loads == 0 {
+		return 0
+	}
+	return float64(b.Hits) / float64(b.Hits+b.Loads)
+}
+
+type evictionReplayer interface {
+	SetEvictionPolicy(policy EvictionPolicy)
+	Stat(stat PLSStat) int
+}
+
+/* Run workload against a lexicon from newLexicon using the named
+ * eviction policy, and count how it went. The lexicon must be a
+ * swapping one, like those from NewLexicon. */
+func ReplayEviction(policy string, newLexicon func() index.Lexicon,
+	workload func(index.Lexicon)) (*EvictionBenchmark, error) {
+
+	evictionPolicy, err := GetEvictionPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	lexicon := newLexicon()
+	replayer, ok := lexicon.(evictionReplayer)
+	if !ok {
+		return nil, fmt.Errorf("%T doesn't use eviction policies", lexicon)
+	}
+	replayer.SetEvictionPolicy(evictionPolicy)
+
+	start := time.Now()
+	workload(lexicon)
+
+	result := &EvictionBenchmark{
+		Policy:  policy,
+		Hits:    replayer.Stat(PLSHits),
+		Loads:   replayer.Stat(PLSLoadCount),
+		Creates: replayer.Stat(PLSCreates),
+		Dumps:   replayer.Stat(PLSDumpCount),
+		Elapsed: time.Since(start),
+	}
+	result.Fetches = result.Hits + result.Loads + result.Creates
+	return result, nil
+}
@@ -0,0 +1,529 @@
+package constrained
+
+import index "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import log "github.com/cihub/seelog"
+import "bufio"
+import "bytes"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// The kinds of problem CheckIndex finds
+const (
+	// A file doesn't match its checksum in the manifest
+	ProblemChecksum = "checksum"
+	// A posting list set, or the compiled postings, can't be read
+	ProblemUnreadable = "unreadable"
+	// A posting is for a document that isn't in the document map
+	ProblemUnknownDocument = "unknown-document"
+	// A posting's positions aren't sorted, or repeat
+	ProblemPositions = "positions"
+	// A term's Tf isn't the sum of its postings' frequencies
+	ProblemTf = "tf"
+	// A document with terms is in no posting list
+	ProblemOrphanDocument = "orphan-document"
+)
+
+type FsckProblem struct {
+	Kind string
+	// The term or file with the problem, if there is one
+	Subject string
+	Detail  string
+}
+
+func (p FsckProblem) String() string {
+	if p.Subject == "" {
+		return fmt.Sprintf("%-16s %s", p.Kind, p.Detail)
+	}
+	return fmt.Sprintf("%-16s '%s': %s", p.Kind, p.Subject, p.Detail)
+}
+
+// What CheckIndex found
+type FsckReport struct {
+	Location  string
+	Terms     int
+	Postings  int
+	Documents int
+	Problems  []FsckProblem
+
+	/* The posting lists which could be read, kept only if the index
+	 * is being checked to be repaired, and the document map */
+	plInit   index.PostingListInitializer
+	lists    map[string]index.PostingList
+	docmap   index.DocInfoMap
+	manifest *index.IndexManifest
+
+	// Every term, and the documents in a posting list
+	texts map[string]bool
+	seen  map[filereader.DocumentId]bool
+}
+
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *FsckReport) problem(kind, subject, format string, args ...interface{}) {
+	r.Problems = append(r.Problems,
+		FsckProblem{Kind: kind, Subject: subject, Detail: fmt.Sprintf(format, args...)})
+}
+
+// The number of problems of each kind
+func (r *FsckReport) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, p := range r.Problems {
+		counts[p.Kind]++
+	}
+	return counts
+}
+
+func (r *FsckReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s: %d terms, %d postings, %d documents\n",
+		r.Location, r.Terms, r.Postings, r.Documents)
+	for _, p := range r.Problems {
+		fmt.Fprintln(w, "  "+p.String())
+	}
+
+	if r.OK() {
+		fmt.Fprintln(w, "No problems found")
+		return
+	}
+
+	counts := r.Counts()
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "%d %s problems\n", counts[kind], kind)
+	}
+}
+
+/* Posting list bytes the lexicon of an index rewritten by fsck,
+ * merge or prune keeps in memory before swapping them to disk. */
+var RewriteMemLimit int64 = 256 << 20
+
+/* Check the index at location without trusting any of it: every
+ * file against the manifest's checksums, every posting list set and
+ * the compiled postings for being readable, and every posting for
+ * belonging to a known document, with sorted unique positions and
+ * adding up to its term's Tf in the term dictionary. Only an
+ * unreadable document map stops the check, since the postings can't
+ * be checked without it. Posting lists are checked as they're read
+ * and then let go. */
+func CheckIndex(location string) (*FsckReport, error) {
+	return checkIndex(location, false)
+}
+
+/* Check the index at location like CheckIndex, keeping what could
+ * be read of its posting lists for RepairIndex. */
+func CheckIndexForRepair(location string) (*FsckReport, error) {
+	return checkIndex(location, true)
+}
+
+func checkIndex(location string, repair bool) (*FsckReport, error) {
+	location = filepath.Clean(location) + "/"
+	report := &FsckReport{
+		Location: location,
+		plInit:   index.BasicPostingListInitializer,
+		texts:    make(map[string]bool),
+		seen:     make(map[filereader.DocumentId]bool),
+	}
+	if repair {
+		report.lists = make(map[string]index.PostingList)
+	}
+
+	manifest, err := index.ReadManifest(location)
+	switch {
+	case err == nil:
+		report.manifest = manifest
+		for _, e := range manifest.Verify(location) {
+			report.problem(ProblemChecksum, "", "%v", e)
+		}
+	case os.IsNotExist(err):
+		log.Warnf("%s has no manifest, so files can't be checksummed", location)
+	default:
+		report.problem(ProblemChecksum, index.IndexManifestFile, "%v", err)
+	}
+
+	docs := new(index.SingleTermIndex)
+	docs.Init(index.NewTrieLexicon())
+	if err = LoadDocumentMap(location, docs); err != nil {
+		return nil, err
+	}
+	report.docmap = docs.DocumentMap
+	report.Documents = len(docs.DocumentMap)
+
+	// Each term's Tf, from the term dictionary
+	tfs := make(map[string]int)
+	if HasCompiledIndex(location) {
+		report.readCompiled(location, tfs)
+	}
+	report.readPostingListSets(location, tfs)
+
+	if manifest != nil {
+		if plInit, err := index.GetPostingListInitializer(manifest.PostingList); err == nil {
+			report.plInit = plInit
+		}
+	}
+	report.Terms = len(report.texts)
+
+	ids := make([]int, 0, len(report.docmap))
+	for id, info := range report.docmap {
+		if !report.seen[id] && info.TermCount > 0 {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		info := report.docmap[filereader.DocumentId(id)]
+		report.problem(ProblemOrphanDocument, info.HumanId,
+			"document %d has %d terms, but is in no posting list", id, info.TermCount)
+	}
+
+	return report, nil
+}
+
+/* Check the postings of one term, returning the sum of their
+ * frequencies */
+func (r *FsckReport) checkList(text string, pl index.PostingList) int {
+	r.texts[text] = true
+
+	sum := 0
+	for it := pl.Iterator(); it.Next(); {
+		entry := it.Value()
+		sum += entry.Frequency()
+		r.Postings++
+		r.seen[entry.DocId()] = true
+
+		if _, ok := r.docmap[entry.DocId()]; !ok {
+			r.problem(ProblemUnknownDocument, text,
+				"document %d isn't in the document map", entry.DocId())
+		}
+
+		positions := entry.Positions()
+		for i := 1; i < len(positions); i++ {
+			if positions[i] <= positions[i-1] {
+				r.problem(ProblemPositions, text,
+					"positions in document %d aren't sorted and unique: %v",
+					entry.DocId(), positions)
+				break
+			}
+		}
+	}
+	return sum
+}
+
+/* Check each term of the compiled index against its stored Tf,
+ * which is noted for checking the posting list sets too. */
+func (r *FsckReport) readCompiled(location string, tfs map[string]int) {
+	lexicon, err := OpenCompiledLexicon(location)
+	if err != nil {
+		r.problem(ProblemUnreadable, TermDictFile, "%v", err)
+		return
+	}
+	if r.lists == nil {
+		// Nothing read from the postings is kept
+		defer lexicon.(*compiled_lexicon).Close()
+	}
+	r.plInit = lexicon.(*compiled_lexicon).PLInit
+
+	for _, entry := range lexicon.Walk() {
+		term := entry.(index.LexiconTerm)
+		tfs[term.Text()] = term.Tf()
+
+		pl, err := readPostingList(term)
+		if err != nil {
+			r.problem(ProblemUnreadable, term.Text(), "%v", err)
+			continue
+		}
+
+		if sum := r.checkList(term.Text(), pl); sum != term.Tf() {
+			r.problem(ProblemTf, term.Text(),
+				"Tf is %d, but its compiled postings add up to %d", term.Tf(), sum)
+		}
+		if r.lists != nil {
+			r.lists[term.Text()] = pl
+		}
+	}
+}
+
+func readPostingList(term index.LexiconTerm) (pl index.PostingList, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("%v", x)
+		}
+	}()
+	return term.PostingList(), nil
+}
+
+/* Read each posting list set on its own, so one which can't be
+ * read doesn't hide the others. Terms missing from the term list
+ * are named by their id. The postings of terms the compiled index
+ * didn't have are checked, and kept when repairing; those it did
+ * have were checked there, so are only added up. Each term's
+ * postings are checked against its Tf in tfs, if it's there. */
+func (r *FsckReport) readPostingListSets(location string, tfs map[string]int) {
+	compiled := make(map[string]bool, len(r.texts))
+	for text := range r.texts {
+		compiled[text] = true
+	}
+	sums := make(map[string]int)
+
+	lex := new(lexicon)
+	lex.Init()
+	lex.PLInit = index.BasicPostingListInitializer
+	lex.Terms = index.NewTermList()
+
+	if err := readLexiconMetadata(location, lex); err != nil {
+		r.problem(ProblemUnreadable, "lexicon.mdt", "%v", err)
+	}
+	r.plInit = lex.PLInit
+
+	termId := ParseTermId
+	if file, err := os.Open(location + index.TermListFile); err == nil {
+		if _, err = lex.Terms.ReadFrom(file); err != nil {
+			r.problem(ProblemUnreadable, index.TermListFile, "%v", err)
+		}
+		file.Close()
+	} else {
+		log.Warnf("%s has no term list, so its posting list sets should have the terms' text",
+			location)
+		termId = lex.legacyTermIds()
+	}
+
+	files, _ := filepath.Glob(location + "pls_*")
+	for _, fname := range files {
+		pls := NewPostingListSet(DatastoreTag(strings.TrimPrefix(filepath.Base(fname), "pls_")),
+			lex.PLInit)
+
+		for _, err := range loadPostingListSet(fname, pls, termId) {
+			r.problem(ProblemUnreadable, filepath.Base(fname), "%v", err)
+		}
+
+		for id, pl := range pls.Terms() {
+			text, ok := lex.Terms.TermText(id)
+			if !ok {
+				r.problem(ProblemUnreadable, filepath.Base(fname),
+					"term %d isn't in the term list", id)
+				text = fmt.Sprintf("#%d", id)
+			}
+			if compiled[text] {
+				for it := pl.Iterator(); it.Next(); {
+					sums[text] += it.Value().Frequency()
+				}
+				continue
+			}
+			sums[text] += r.checkList(text, pl)
+
+			if r.lists == nil {
+				continue
+			}
+			if existing, ok := r.lists[text]; ok {
+				for it := pl.Iterator(); it.Next(); {
+					existing.InsertCompleteEntry(it.Value())
+				}
+			} else {
+				r.lists[text] = pl
+			}
+		}
+	}
+
+	texts := make([]string, 0, len(sums))
+	for text := range sums {
+		texts = append(texts, text)
+	}
+	sort.Strings(texts)
+	for _, text := range texts {
+		if tf, ok := tfs[text]; ok && tf != sums[text] {
+			r.problem(ProblemTf, text,
+				"Tf is %d, but its postings in the posting list sets add up to %d",
+				tf, sums[text])
+		}
+	}
+}
+
+func readLexiconMetadata(location string, lex *lexicon) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("%v", x)
+		}
+	}()
+
+	file, err := os.Open(location + "lexicon.mdt")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	lex.ReadMetadata(file)
+	return nil
+}
+
+/* Read a posting list set, returning what's wrong with it. Text
+ * sets are read a line at a time, so a bad line only loses its
+ * own posting. Binary sets can't be resynchronized after an error,
+ * so the rest of one is lost. */
+func loadPostingListSet(fname string, pls *PostingListSet,
+	termId func(key string) (index.TermId, error)) (errs []error) {
+
+	file, err := os.Open(fname)
+	if err != nil {
+		return []error{err}
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if magic, _ := reader.Peek(len(BinaryPLSMagic)); bytes.Equal(magic, BinaryPLSMagic) {
+		defer func() {
+			if x := recover(); x != nil {
+				errs = append(errs, fmt.Errorf("%v", x))
+			}
+		}()
+		pls.LoadKeyed(reader, termId)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		parts := strings.SplitN(scanner.Text(), "#", 2)
+		text := strings.TrimSpace(parts[0])
+		if text == "" {
+			continue
+		}
+
+		id, err := termId(text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d has a bad term: '%s'", line, scanner.Text()))
+			continue
+		}
+
+		entry := pls.pl_entry_init(0)
+		if len(parts) < 2 {
+			errs = append(errs, fmt.Errorf("line %d has no postings: '%s'", line, scanner.Text()))
+			continue
+		} else if _, err = fmt.Sscanln(parts[1], entry); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v: '%s'", line, err, scanner.Text()))
+			continue
+		}
+
+		pl, ok := pls.listMap[id]
+		if !ok {
+			pl = pls.pl_init.Create()
+			pls.listMap[id] = pl
+		}
+		pl.InsertCompleteEntry(entry)
+	}
+
+	if err = scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+/* Rewrite the index at location from what CheckIndexForRepair
+ * could read of it. Postings for unknown documents are dropped,
+ * positions are sorted with repeats removed, Tfs are recounted, and
+ * documents in no posting list are dropped. Posting lists which
+ * couldn't be read are lost, and the report's lists are let go as
+ * they're rewritten. The damaged index is kept in location.damaged,
+ * and its document store carried over, but the forward index is
+ * rebuilt only if the index is saved with one again. */
+func RepairIndex(report *FsckReport) (string, error) {
+	if report.lists == nil {
+		return "", fmt.Errorf("%s was checked without keeping its posting lists. "+
+			"Use CheckIndexForRepair", report.Location)
+	}
+
+	location := strings.TrimSuffix(report.Location, "/")
+	damaged := location + ".damaged"
+	repaired := location + ".repairing"
+
+	if _, err := os.Stat(damaged); err == nil {
+		return "", fmt.Errorf("%s already exists. Move it out of the way first", damaged)
+	}
+
+	lexicon := NewLexicon(RewriteMemLimit, repaired)
+	lexicon.SetPLInitializer(report.plInit)
+
+	st_index := new(index.SingleTermIndex)
+	st_index.Init(lexicon)
+	if report.manifest != nil {
+		st_index.IndexType = report.manifest.IndexType
+		st_index.Sources = report.manifest.Sources
+	}
+
+	if err := LoadFilters(report.Location, st_index); err != nil {
+		return "", err
+	}
+
+	texts := make([]string, 0, len(report.lists))
+	for text := range report.lists {
+		texts = append(texts, text)
+	}
+	sort.Strings(texts)
+
+	seen := make(map[filereader.DocumentId]bool)
+	for _, text := range texts {
+		pl := report.lists[text]
+		delete(report.lists, text)
+
+		clean := report.plInit.Create()
+		for it := pl.Iterator(); it.Next(); {
+			entry := it.Value()
+			if _, ok := report.docmap[entry.DocId()]; !ok {
+				continue
+			}
+			seen[entry.DocId()] = true
+
+			if positions := entry.Positions(); clean.IsPositional() && len(positions) > 0 {
+				sorted := append([]int(nil), positions...)
+				sort.Ints(sorted)
+				for i, pos := range sorted {
+					if i == 0 || pos != sorted[i-1] {
+						clean.InsertRawEntry(text, entry.DocId(), pos)
+					}
+				}
+			} else {
+				for i := 0; i < entry.Frequency(); i++ {
+					clean.InsertRawEntry(text, entry.DocId(), 0)
+				}
+			}
+		}
+
+		if clean.Len() > 0 {
+			lexicon.MergePostingList(text, clean)
+			st_index.Stats().AddPostingList(text, clean)
+		}
+	}
+
+	for id, info := range report.docmap {
+		if seen[id] || info.TermCount == 0 {
+			st_index.DocumentMap[id] = info.Clone()
+		}
+	}
+	st_index.DocumentCount = len(st_index.DocumentMap)
+	st_index.Stats().FromDocuments(st_index.DocumentMap)
+
+	for _, name := range []string{index.DocumentStoreFile, index.DocumentIndexFile} {
+		if data, err := ioutil.ReadFile(report.Location + name); err == nil {
+			if err = ioutil.WriteFile(repaired+"/"+name, data, 0644); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	st_index.Save()
+
+	if err := os.Rename(location, damaged); err != nil {
+		return "", err
+	}
+	if err := os.Rename(repaired, location); err != nil {
+		return "", err
+	}
+	return damaged, nil
+}
@@ -16,7 +16,9 @@ import "strings"
 import "fmt"
 import "strconv"
 import "path/filepath"
+import "math"
 import "math/rand"
+import "time"
 
 type PLSStat int
 
@@ -26,6 +28,7 @@ const (
 	PLSHits
 	PLSCreates
 	PLSFetches
+	PLSHeapChecks
 )
 
 func (T PLSStat) String() string {
@@ -40,6 +43,8 @@ func (T PLSStat) String() string {
 		return "PLS Fetches"
 	case PLSCreates:
 		return "PLS Creates"
+	case PLSHeapChecks:
+		return "Heap Checks"
 	default:
 		panic("Unknown stat type")
 	}
@@ -60,11 +65,14 @@ func (l LRUSet) RemoveOldest() LRUSet {
 
 type PLSContainer struct {
 	Tag   DatastoreTag
-	Size  int
+	Size  int64
 	Hits  int
 	Dumps int
 	Loads int
 	PLS   *PostingListSet
+
+	// Set while the lexicon is making room for it, so it isn't evicted
+	pinned bool
 }
 
 func NewPLSContainer(newPLS *PostingListSet) *PLSContainer {
@@ -94,8 +102,11 @@ func generateTag() string {
 	return string(tmpBytes[:12])
 }
 
-func NewTerm(tok *filereader.Token, lex *lexicon, tag DatastoreTag) index.LexiconTerm {
+func NewTerm(id index.TermId, tok *filereader.Token, lex *lexicon,
+	tag DatastoreTag) index.LexiconTerm {
+
 	term := new(persistent_term)
+	term.Id_ = id
 	term.Text_ = tok.Text
 	term.Tf_ = 0 // because we increment with Register
 	term.Pl = nil
@@ -110,24 +121,38 @@ func NewTerm(tok *filereader.Token, lex *lexicon, tag DatastoreTag) index.Lexico
 	return term
 }
 
-func (lex *lexicon) IncrementPLSSize(tag DatastoreTag) {
+func NewEmptyTerm(id index.TermId, text string, lex *lexicon,
+	tag DatastoreTag) index.LexiconTerm {
+
+	term := new(persistent_term)
+	term.Id_ = id
+	term.Text_ = text
+	term.Tf_ = 0
+	term.Pl = nil
+
+	term.lex = lex
+	term.DataTag = tag
+	return term
+}
 
+/* Count bytes the posting list set tagged tag has grown by
+ * against the lexicon's memory */
+func (lex *lexicon) chargePLS(tag DatastoreTag, bytes int64) {
 	if container, ok := lex.pl_set_cache[tag]; ok {
-		container.Size++
+		container.Size += bytes
 	}
-
+	lex.currentLoad += bytes
 }
 
 func (t *persistent_term) Register(token *filereader.Token) {
 	pls := t.lex.RetrievePLS(t)
-	pl := pls.Get(t.Text_)
+	before := pls.Size
+	pl := pls.Get(t.Id_)
 	log.Debugf("Registering %s in posting list for %s", token, t.Text_)
-	if pl.InsertEntry(token) {
-		t.lex.IncrementPLSSize(pls.Tag)
-		pls.Size++
-		t.lex.currentLoad++
-		/*log.Infof("Added term, incrementing current load to %d", t.lex.currentLoad)*/
-	}
+	pls.Size += insertBytes(pl, 1, func() bool {
+		return pl.InsertEntry(token)
+	})
+	t.lex.chargePLS(pls.Tag, pls.Size-before)
 
 	log.Tracef("After registering, pls is %s.", pls.String())
 
@@ -135,6 +160,18 @@ func (t *persistent_term) Register(token *filereader.Token) {
 
 }
 
+func (t *persistent_term) RegisterEntry(entry index.PostingListEntry) {
+	pls := t.lex.RetrievePLS(t)
+	before := pls.Size
+	pl := pls.Get(t.Id_)
+	pls.Size += insertBytes(pl, len(entry.Positions()), func() bool {
+		return pl.InsertCompleteEntry(entry)
+	})
+	t.lex.chargePLS(pls.Tag, pls.Size-before)
+
+	t.Tf_ += entry.Frequency()
+}
+
 func (t *persistent_term) PostingList() index.PostingList {
 	log.Debugf("Looking for posting list for %s", t.String())
 	return t.lex.RetrievePostingList(t)
@@ -148,17 +185,26 @@ func (t *persistent_term) Df() int {
 	return t.PostingList().Len()
 }
 
-// Implements a Lexicon
+/* Implements a Lexicon which keeps its posting lists in sets, and
+ * writes the least recently used sets to disk when their estimated
+ * size goes over its memory budget. */
 type lexicon struct {
 	index.TrieLexicon
 
-	maxLoad, currentLoad, perPLSLoad int
+	// In bytes. A negative maxLoad means there's no budget
+	maxLoad, currentLoad, perPLSLoad int64
+
+	// What share of maxLoad can be used, from checkHeap
+	budgetScale   float64
+	lastHeapCheck time.Time
+	// The heap's size with no posting lists in memory
+	heapBaseline int64
 
 	pl_set_cache  map[DatastoreTag]*PLSContainer
-	lru_cache     LRUSet
+	policy        EvictionPolicy
 	swapped_cache LRUSet
 
-	swapped_worker_q chan *PLSContainer
+	swapped_worker_q chan swap_request
 	swapped_lock     *sync.RWMutex
 	lru_lock         *sync.RWMutex
 
@@ -171,16 +217,16 @@ var load_factor_called int64
 
 func (lex *lexicon) load_factor() float64 {
 	log.Trace("checking loadfactor")
-	if lex.maxLoad < 0 {
+	if lex.maxLoad <= 0 {
 		return 0.0
 	}
 
-	if len(lex.lru_cache) == 0 {
+	if lex.policy.Len() == 0 {
 		/*log.Infof("LRU is empty, so setting currentLoad from %d to 0", lex.currentLoad)*/
 		lex.currentLoad = 0
 	}
 
-	load := float64(lex.currentLoad) / float64(lex.maxLoad)
+	load := float64(lex.currentLoad) / (float64(lex.maxLoad) * lex.budgetScale)
 
 	if load > 10.0 {
 		log.Criticalf("Exceeded max allowed load")
@@ -198,7 +244,10 @@ func LoadLexiconFromDisk(dataDir string) index.Lexicon {
 	return lex
 }
 
-func NewLexicon(maxMem int, dataDir string) index.Lexicon {
+/* Make a lexicon in dataDir, removing anything already there,
+ * which keeps about maxMem bytes of posting lists in memory. If
+ * maxMem is negative they're all kept in memory. */
+func NewLexicon(maxMem int64, dataDir string) index.Lexicon {
 	var lex *lexicon
 	lex = new(lexicon)
 
@@ -215,13 +264,19 @@ func NewLexicon(maxMem int, dataDir string) index.Lexicon {
 	lex.DataDirectory = dataDir
 
 	// Wrap args
+	lex.Terms = index.NewTermList()
 	lex.TermInit =
-		func(tok *filereader.Token,
+		func(id index.TermId, tok *filereader.Token,
 			p index.PostingListInitializer) index.LexiconTerm {
-			term := NewTerm(tok, lex, lex.LeastUsedPLS())
+			term := NewTerm(id, tok, lex, lex.LeastUsedPLS())
 			log.Debugf("Creating new term: %v", term)
 			return term
 		}
+	lex.TextTermInit =
+		func(id index.TermId, text string,
+			p index.PostingListInitializer) index.LexiconTerm {
+			return NewEmptyTerm(id, text, lex, lex.LeastUsedPLS())
+		}
 
 	lex.PLInit = index.BasicPostingListInitializer
 	lex.setMaxLoad(maxMem)
@@ -229,23 +284,27 @@ func NewLexicon(maxMem int, dataDir string) index.Lexicon {
 	return lex
 }
 
-func (lex *lexicon) setMaxLoad(maxMem int) {
+// Sets of posting lists grow to at most this many bytes
+const MaxPLSBytes = 1 << 20
+
+func (lex *lexicon) setMaxLoad(maxMem int64) {
 	lex.maxLoad = maxMem
 
 	if lex.maxLoad > 0 {
+		lex.heapBaseline = heapAlloc()
 		switch {
-		case maxMem > 20000:
-			lex.perPLSLoad = 5000 //maxMem / 10
+		case maxMem > 5*MaxPLSBytes:
+			lex.perPLSLoad = MaxPLSBytes
 		default:
 			lex.perPLSLoad = maxMem / 5
 		}
 	} else {
-		// This is int max
-		lex.perPLSLoad = int(^uint(0) >> 1)
+		lex.perPLSLoad = math.MaxInt64
 	}
 
-	if lex.perPLSLoad <= 10 {
-		log.Criticalf("Warning. PLS Load is set very low (< 10) terms per PLS")
+	if lex.perPLSLoad <= 10*(TermBytes+EntryBytes) {
+		log.Criticalf("Warning. PLS Load is set very low (%d bytes, < 10 terms per PLS)",
+			lex.perPLSLoad)
 	}
 
 }
@@ -254,8 +313,9 @@ func (lex *lexicon) Init() {
 	lex.Trie.Init()
 
 	lex.currentLoad = 0
+	lex.budgetScale = 1
 	lex.pl_set_cache = make(map[DatastoreTag]*PLSContainer)
-	lex.lru_cache = make(LRUSet, 0)
+	lex.policy = NewLRUPolicy()
 	lex.swapped_cache = make(LRUSet, 0)
 
 	lex.stats = make(map[PLSStat]int)
@@ -263,7 +323,7 @@ func (lex *lexicon) Init() {
 	lex.swapped_lock = new(sync.RWMutex)
 	lex.lru_lock = new(sync.RWMutex)
 
-	lex.swapped_worker_q = make(chan *PLSContainer)
+	lex.swapped_worker_q = make(chan swap_request)
 	go lex.SwappedWorker()
 
 }
@@ -276,32 +336,42 @@ func (lex *lexicon) DSPath(tag DatastoreTag) string {
 	return lex.DataDirectory + "/pls_" + string(tag)
 }
 
-func (lex *lexicon) makeRecent(pls *PLSContainer) {
-	if len(lex.lru_cache) == 1 {
-		return
-	}
-	for i, set := range lex.lru_cache {
-		if set == pls {
-			copy(lex.lru_cache[i:], lex.lru_cache[i+1:])
-			log.Tracef("Rearranged at %d: %v", i, lex.lru_cache)
-			lex.lru_cache[len(lex.lru_cache)-1] = set
-			break
-		}
+/* Use policy to choose which posting list sets to evict. The sets
+ * already in memory are handed over to it. */
+func (lex *lexicon) SetEvictionPolicy(policy EvictionPolicy) {
+	resident := make([]*PLSContainer, 0, lex.policy.Len())
+	lex.policy.Each(func(pls *PLSContainer) bool {
+		resident = append(resident, pls)
+		return true
+	})
+
+	lex.policy = policy
+	for _, pls := range resident {
+		policy.Add(pls)
 	}
 }
 
+// The value of one of the PLS statistics
+func (lex *lexicon) Stat(stat PLSStat) int {
+	return lex.stats[stat]
+}
+
 // Find a PLS that's available
 func (lex *lexicon) LeastUsedPLS() DatastoreTag {
 	var bestPls *PLSContainer
 	var pls *PLSContainer
 
-	for i := 0; i < len(lex.lru_cache); i++ {
-		//iterate over in memory ones (from back for most recently used)
-		if pls = lex.lru_cache[i]; pls.Size < lex.perPLSLoad {
-			log.Debugf("Choosing existing PLS %s because its load is only %d/%d", pls.Tag, pls.Size, lex.perPLSLoad)
+	lex.policy.Each(func(resident *PLSContainer) bool {
+		if resident.Size < lex.perPLSLoad {
+			log.Debugf("Choosing existing PLS %s because its load is only %d/%d", resident.Tag, resident.Size, lex.perPLSLoad)
 			// This is in memory, and has space, use it.
-			return pls.Tag
+			bestPls = resident
+			return false
 		}
+		return true
+	})
+	if bestPls != nil {
+		return bestPls.Tag
 	}
 
 	lex.swapped_lock.RLock()
@@ -332,7 +402,7 @@ func (lex *lexicon) AddPLS(newPLS *PostingListSet) {
 	container := NewPLSContainer(newPLS)
 
 	lex.pl_set_cache[newPLS.Tag] = container
-	lex.lru_cache = append(lex.lru_cache, container)
+	lex.policy.Add(container)
 	lex.currentLoad += newPLS.Size
 	log.Debugf("Added a PLS of size %d. Load is now %d", newPLS.Size, lex.currentLoad)
 }
@@ -353,8 +423,8 @@ StartAgain:
 		//We've never seen this one. Make a new one
 		log.Debugf("Creating new PLS for %s", term)
 		newPLS := NewPostingListSet(term.DataTag, lex.PLInit)
-		lex.evict()
 		lex.AddPLS(newPLS)
+		lex.evict(lex.pl_set_cache[newPLS.Tag])
 		lex.stats[PLSCreates]++
 		return newPLS
 
@@ -371,22 +441,20 @@ StartAgain:
 			/*log.Infof("Container sz: %d PLS sz: %d", pls.Size, pls.PLS.Size)*/
 			newPLS := NewPostingListSet(term.DataTag, lex.PLInit)
 
-			moved := TransferPL(pls.PLS, newPLS, term.Text_)
+			moved := TransferPL(pls.PLS, newPLS, term.Id_)
 			/*log.Infof("Transfered %d entries", moved )*/
 			pls.Size -= moved
 			lex.currentLoad -= moved
 			/*log.Infof("Reduced currentLoad by %d of offset add. Now %d", moved, lex.currentLoad)*/
 
 			lex.AddPLS(newPLS)
-			lex.evict()
+			lex.evict(lex.pl_set_cache[newPLS.Tag])
 			lex.stats[PLSCreates]++
 			/*log.Criticalf("Moving %s TO A NEW PLS", term.Text_)*/
 			goto StartAgain
 		}
 
-		//Reorder the LRU entries to put this one first
-		// (in the background)
-		lex.makeRecent(pls)
+		lex.policy.Touch(pls)
 
 		return pls.PLS
 
@@ -403,7 +471,7 @@ StartAgain:
 			log.Debugf("Read %s from %s", pls.Tag,
 				lex.DSPath(term.DataTag))
 
-			lex.swapped_worker_q <- pls
+			lex.swapped_worker_q <- swap_request{pls, false}
 
 			file.Close()
 
@@ -411,51 +479,41 @@ StartAgain:
 			panic(err)
 		}
 
-		lex.evict()
+		/* The policy sees it's back before choosing what to evict to
+		 * make room for it, which mustn't be itself */
+		lex.currentLoad += pls.Size
+		lex.policy.Add(pls)
+		lex.evict(pls)
 		return pls.PLS
 	}
 	return nil
 
 }
 
+/* Asks the swapped worker to add a set to the swapped cache, or
+ * remove it. The set may have changed again by the time the worker
+ * gets to it, so it's told which rather than looking. */
+type swap_request struct {
+	pls     *PLSContainer
+	swapped bool
+}
+
 //Remove the element from the swapped cache. No harm if we're slow, since
 // ALl that can happen is we choose a loaded PLS
 func (lex *lexicon) SwappedWorker() {
-	var pls, target *PLSContainer
-	var i int
-
-	for target = range lex.swapped_worker_q {
+	for request := range lex.swapped_worker_q {
 
 		lex.swapped_lock.Lock()
-		switch target.PLS {
-		case nil:
-			//We're supposed to add it  beause it's swapped
-			/*log.Infof("asked to swap %p. Swap cache is %v, LRU is %v", target, lex.swapped_cache, lex.lru_cache)*/
-			lex.swapped_cache = append(lex.swapped_cache, target)
-
-		default:
-			//remove it
-			/*log.Debugf("asked to mark %p as not swapped with swapped cache %v", target, lex.swapped_cache)*/
-			for i, pls = range lex.swapped_cache {
-				if pls == target {
-					switch {
-					case len(lex.swapped_cache) == 1:
-						lex.swapped_cache = make([]*PLSContainer, 0)
-
-					case i == 0:
-						//WE're first
-						lex.swapped_cache = lex.swapped_cache[i+1:]
-
-					case i < len(lex.swapped_cache)-1:
-						// We're in the middle
-						lex.swapped_cache = append(lex.swapped_cache[:i-1], lex.swapped_cache[i+1:]...)
-					default:
-						// WE're last
-						lex.swapped_cache = lex.swapped_cache[:i-1]
-					}
-				}
+		cache := lex.swapped_cache[:0]
+		for _, pls := range lex.swapped_cache {
+			if pls != request.pls {
+				cache = append(cache, pls)
 			}
 		}
+		if request.swapped {
+			cache = append(cache, request.pls)
+		}
+		lex.swapped_cache = cache
 		lex.swapped_lock.Unlock()
 	}
 }
@@ -465,7 +523,10 @@ func (lex *lexicon) SwappedWorker() {
 func (lex *lexicon) RetrievePostingList(term *persistent_term) index.PostingList {
 
 	pls := lex.RetrievePLS(term)
-	return pls.Get(term.Text_)
+	before := pls.Size
+	pl := pls.Get(term.Id_)
+	lex.chargePLS(pls.Tag, pls.Size-before)
+	return pl
 }
 
 func Pause() error {
@@ -495,6 +556,16 @@ func (lex *lexicon) SaveToDisk() {
 		panic(&PersistenceError{"Failed to create metadata files:" + err.Error()})
 	}
 
+	if termfile, err := os.Create(lex.Location() + index.TermListFile); err == nil {
+		_, err = lex.Terms.WriteTo(termfile)
+		termfile.Close()
+		if err != nil {
+			panic(&PersistenceError{"Failed to write term list: " + err.Error()})
+		}
+	} else {
+		panic(&PersistenceError{"Failed to create term list: " + err.Error()})
+	}
+
 	for tag, pls = range lex.pl_set_cache {
 		log.Debugf("Writing PLS %d", tag)
 		if pls.PLS == nil {
@@ -503,16 +574,18 @@ func (lex *lexicon) SaveToDisk() {
 				pls.PLS.Load(file)
 				file.Close()
 			}
-			lex.evict()
+			lex.evict(nil)
 		}
 		lex.dump_pls(pls)
 	}
+
+	WriteCompiledLexicon(lex.Location(), lex, lex.PLInit)
 }
 
 func (lex *lexicon) WriteMetadata(w io.Writer) {
 	fmt.Fprintf(w, "pls_count %d\n", len(lex.pl_set_cache))
 	fmt.Fprintf(w, "pl_type %s\n", lex.PLInit.Name)
-	fmt.Fprintf(w, "memlimit %d\n", lex.maxLoad)
+	fmt.Fprintf(w, "membytes %d\n", lex.maxLoad)
 }
 
 func (lex *lexicon) ReadMetadata(r io.Reader) {
@@ -528,8 +601,21 @@ func (lex *lexicon) ReadMetadata(r io.Reader) {
 		fields = strings.SplitN(scanner.Text(), " ", 2)
 		switch fields[0] {
 
+		case "membytes":
+			if field, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				lex.setMaxLoad(field)
+				have_memlimit = true
+			} else {
+				panic(&PersistenceError{
+					"Failed to convert memory limit from metadata: " + err.Error()})
+			}
+
 		case "memlimit":
-			if field, err := strconv.Atoi(fields[1]); err == nil {
+			// Counted in posting list entries
+			if field, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				if field > 0 {
+					field *= LegacyEntryBytes
+				}
 				lex.setMaxLoad(field)
 				have_memlimit = true
 			} else {
@@ -539,16 +625,10 @@ func (lex *lexicon) ReadMetadata(r io.Reader) {
 
 		case "pl_type":
 			have_pltype = true
-			switch string(fields[1]) {
-
-			case "basic":
-				lex.SetPLInitializer(index.BasicPostingListInitializer)
-				log.Infof("Set PLInit to %p", lex.PLInit)
-
-			case "positional":
-				lex.SetPLInitializer(index.PositionalPostingListInitializer)
-				log.Infof("Set PLInit to %p", lex.PLInit)
-			default:
+			if plInit, err := index.GetPostingListInitializer(fields[1]); err == nil {
+				lex.SetPLInitializer(plInit)
+				log.Infof("Set PLInit to %s", lex.PLInit.Name)
+			} else {
 				panic("Found unrecognized pl_type: " + fields[1])
 			}
 
@@ -568,8 +648,8 @@ func (lex *lexicon) LoadFromDisk(dataDir string) {
 		tag       DatastoreTag
 		files     []string
 		parsedTag string
-		file      io.Reader
-		term_s    string
+		file      *os.File
+		term_id   index.TermId
 		term      *persistent_term
 		e         error
 	)
@@ -581,20 +661,40 @@ func (lex *lexicon) LoadFromDisk(dataDir string) {
 	lex.DataDirectory = dataDir
 	lex.Init()
 
+	lex.Terms = index.NewTermList()
 	lex.TermInit =
-		func(tok *filereader.Token,
+		func(id index.TermId, tok *filereader.Token,
 			p index.PostingListInitializer) index.LexiconTerm {
-			term := NewTerm(tok, lex, lex.LeastUsedPLS())
+			term := NewTerm(id, tok, lex, lex.LeastUsedPLS())
 			log.Debugf("Creating new term: %v", term)
 			return term
 		}
+	lex.TextTermInit =
+		func(id index.TermId, text string,
+			p index.PostingListInitializer) index.LexiconTerm {
+			return NewEmptyTerm(id, text, lex, lex.LeastUsedPLS())
+		}
 
 	if file, e = os.Open(lex.Location() + "lexicon.mdt"); e == nil {
 		lex.ReadMetadata(file)
+		file.Close()
 	} else {
 		panic(&PersistenceError{"Failed to read metadata file: " + e.Error()})
 	}
 
+	termId := ParseTermId
+	if file, e = os.Open(lex.Location() + index.TermListFile); e == nil {
+		_, e = lex.Terms.ReadFrom(file)
+		file.Close()
+		if e != nil {
+			panic(&PersistenceError{"Failed to read term list: " + e.Error()})
+		}
+	} else {
+		log.Warnf("%s has no term list, so its posting list sets have the "+
+			"terms' text. Numbering them as they're read", dataDir)
+		termId = lex.legacyTermIds()
+	}
+
 	if files, e = filepath.Glob(lex.Location() + "pls_*"); e != nil {
 		panic(&PersistenceError{e.Error()})
 	}
@@ -611,17 +711,22 @@ func (lex *lexicon) LoadFromDisk(dataDir string) {
 
 		var pl index.PostingList
 		var pli index.PostingListIterator
+		var ok bool
 
 		pls = NewPostingListSet(tag, lex.PLInit)
 		if file, e := os.Open(fname); e == nil {
-			pls.Load(file)
+			pls.LoadKeyed(file, termId)
 			log.Debugf("Loaded PLS: %v", pls)
 
 			/* Make sure the terms are in the radix */
-			for term_s, pl = range pls.Terms() {
+			for term_id, pl = range pls.Terms() {
 
 				term = new(persistent_term)
-				term.Text_ = term_s
+				term.Id_ = term_id
+				if term.Text_, ok = lex.Terms.TermText(term_id); !ok {
+					panic(NewPersistenceError(fmt.Sprintf(
+						"%s has term %d, which isn't in the term list", fname, term_id)))
+				}
 				term.Tf_ = 0
 				for pli = pl.Iterator(); pli.Next(); {
 					term.Tf_ += pli.Value().Frequency()
@@ -637,21 +742,39 @@ func (lex *lexicon) LoadFromDisk(dataDir string) {
 			file.Close()
 			log.Debugf("Loaded %s. Lexicon now has %d terms", fname, lex.Len())
 		}
-		lex.evict()
+		lex.evict(nil)
 	}
 }
 
-//Evict the least recent PostingListSet from the Lexicon if
-//necessary
-func (lex *lexicon) evict() {
+/* Number the terms of posting list sets written with their text,
+ * in the order they're read */
+func (lex *lexicon) legacyTermIds() func(text string) (index.TermId, error) {
+	ids := make(map[string]index.TermId)
+	return func(text string) (index.TermId, error) {
+		id, ok := ids[text]
+		if !ok {
+			id = lex.Terms.Add(text)
+			ids[text] = id
+		}
+		return id, nil
+	}
+}
+
+// Evict the PostingListSets the eviction policy chooses until the
+// Lexicon is back under its budget, keeping keep if it isn't nil
+func (lex *lexicon) evict(keep *PLSContainer) {
 
 	var oldest *PLSContainer
 	evicted := 0
 
-	for lex.load_factor() > 0.8 {
-		/*log.Tracef("Evicting oldest from LRUSet %v", lex.lru_cache)*/
+	if keep != nil {
+		keep.pinned = true
+		defer func() { keep.pinned = false }()
+	}
 
-		oldest = lex.lru_cache.LeastRecent()
+	lex.checkHeap()
+	for lex.load_factor() > 0.8 {
+		oldest = lex.policy.Evict()
 		if oldest == nil {
 			return
 		}
@@ -663,7 +786,7 @@ func (lex *lexicon) evict() {
 		lex.dump_pls(oldest)
 		if oldest.Size != oldest.PLS.Size {
 			prev := oldest.PLS.Size
-			oldest.PLS.RecalculateLen()
+			oldest.PLS.RecalculateSize()
 			panic(fmt.Sprintf("Container has %d, while pls has %d (corrected: %d)", oldest.Size, prev, oldest.PLS.Size))
 		}
 		oldest.Size = oldest.PLS.Size
@@ -673,12 +796,9 @@ func (lex *lexicon) evict() {
 		lex.currentLoad -= oldest.Size
 
 		//Ask the worker to add it to the swapped cache
-		lex.swapped_worker_q <- oldest
+		lex.swapped_worker_q <- swap_request{oldest, true}
 
-		// We only need to remove. The new one will be added
-		lex.lru_cache = lex.lru_cache.RemoveOldest()
 		log.Debugf("Evicting %p", oldest)
-		/*log.Tracef("After eviction, LRUSet: %v", lex.lru_cache)*/
 		evicted++
 		lex.stats[PLSDumpCount]++
 	}
@@ -708,64 +828,257 @@ func (lex *lexicon) PrintDiskStats(w io.Writer) {
 	}
 }
 
-func SingleTermIndexFromDisk(location string) (st_index *index.SingleTermIndex, e error) {
-
-	/*defer func() {*/
-	/*if err := recover(); err != nil {*/
-	/*st_index = nil*/
-	/*e = err.(error)*/
-	/*}*/
-	/*}()*/
+/* Read the document map for the index at location. Indexes
+ * written before the binary format have a JSON docmap.txt */
+func LoadDocumentMap(location string, st_index *index.SingleTermIndex) error {
 
-	lexicon := LoadLexiconFromDisk(location)
-	st_index = new(index.SingleTermIndex)
-	st_index.Init(lexicon)
+	if file, e := os.Open(location + DocMapFile); e == nil {
+		defer file.Close()
+		if e = st_index.DocumentMap.ReadBinary(file); e != nil {
+			log.Criticalf("Error reading document map: %v", e)
+			return e
+		}
+		st_index.DocumentCount = len(st_index.DocumentMap)
+		return nil
+	}
 
 	if file, e := os.Open(location + "docmap.txt"); e != nil {
 		log.Criticalf("Error opening document map file: %v", e)
-		return nil, e
+		return e
 	} else {
 
 		raw_bytes := new(bytes.Buffer)
 
 		if n, e := raw_bytes.ReadFrom(file); e != nil {
 			log.Criticalf("Error reading from document map file: %v", e)
-			return nil, e
+			return e
 		} else {
 			log.Debugf("Read %d bytes from document map.", n)
 		}
 
 		if e = json.Unmarshal(raw_bytes.Bytes(), &st_index.DocumentMap); e != nil {
 			log.Criticalf("Error unmarshalling document map: %v", e)
-			return nil, e
+			return e
 		} else {
 			st_index.DocumentCount = len(st_index.DocumentMap)
 			log.Debugf("Successfully unmarshaled document map")
 		}
 		file.Close()
 	}
+	return nil
+}
 
-	if file, e := os.Open(location + "filters.mdt"); e != nil {
-		log.Criticalf("Error opening filter metadata file: %v", e)
+/* Read the collection statistics for the index at location.
+ * Indexes saved without them get them from the document map. */
+func LoadCollectionStats(location string, st_index *index.SingleTermIndex) error {
+	file, e := os.Open(location + index.CollectionStatsFile)
+	if e != nil {
+		log.Warnf("%s has no collection statistics. Using the document map", location)
+		st_index.Stats().FromDocuments(st_index.DocumentMap)
+		return nil
+	}
+	defer file.Close()
+
+	if _, e = st_index.Stats().ReadFrom(file); e != nil {
+		log.Criticalf("Error reading collection statistics: %v", e)
+		return e
+	}
+
+	if st_index.Stats().Documents != st_index.DocumentCount {
+		return NewPersistenceError(fmt.Sprintf(
+			"Collection statistics count %d documents, but the document map has %d",
+			st_index.Stats().Documents, st_index.DocumentCount))
+	}
+	return nil
+}
+
+/* Read the forward index for the index at location, if it was
+ * saved with one. */
+func LoadForwardIndex(location string, st_index *index.SingleTermIndex) error {
+	file, e := os.Open(location + index.ForwardIndexFile)
+	if e != nil {
+		log.Debugf("%s has no forward index", location)
+		return nil
+	}
+	defer file.Close()
+
+	forward := index.NewForwardIndex()
+	if _, e = forward.ReadFrom(file); e != nil {
+		log.Criticalf("Error reading forward index: %v", e)
+		return e
+	}
+
+	if forward.Len() > st_index.DocumentCount {
+		return NewPersistenceError(fmt.Sprintf(
+			"Forward index has %d documents, but the document map has %d",
+			forward.Len(), st_index.DocumentCount))
+	}
+
+	st_index.SetForwardIndex(forward)
+	return nil
+}
+
+/* Read the wildcard index for the index at location. Without
+ * one, it's built the first time a wildcard is expanded. */
+func LoadWildcardIndex(location string, st_index *index.SingleTermIndex) error {
+	file, e := os.Open(location + index.WildcardIndexFile)
+	if e != nil {
+		log.Warnf("%s has no wildcard index", location)
+		return nil
+	}
+	defer file.Close()
+
+	wildcards := index.NewWildcardIndex()
+	if _, e = wildcards.ReadFrom(file); e != nil {
+		log.Criticalf("Error reading wildcard index: %v", e)
+		return e
+	}
+
+	if wildcards.Len() != st_index.TermCount() {
+		return NewPersistenceError(fmt.Sprintf(
+			"Wildcard index has %d terms, but the lexicon has %d",
+			wildcards.Len(), st_index.TermCount()))
+	}
+
+	st_index.SetWildcardIndex(wildcards)
+	return nil
+}
+
+/* Open the document store for the index at location, if it was
+ * saved with one. */
+func LoadDocumentStore(location string, st_index *index.SingleTermIndex) error {
+	if _, e := os.Stat(location + index.DocumentIndexFile); e != nil {
+		log.Debugf("%s has no document store", location)
+		return nil
+	}
+
+	store, e := index.OpenDocumentStore(location)
+	if e != nil {
+		log.Criticalf("Error opening document store: %v", e)
+		return e
+	}
+
+	if store.Len() != st_index.DocumentCount {
+		log.Warnf("Document store has %d documents, but the document map has %d",
+			store.Len(), st_index.DocumentCount)
+	}
+
+	st_index.SetDocumentStore(store)
+	return nil
+}
+
+func SingleTermIndexFromDisk(location string) (st_index *index.SingleTermIndex, e error) {
+
+	/*defer func() {*/
+	/*if err := recover(); err != nil {*/
+	/*st_index = nil*/
+	/*e = err.(error)*/
+	/*}*/
+	/*}()*/
+
+	var lexicon index.Lexicon
+
+	// Check the index can be read before reading any of it
+	manifest, e := index.ReadManifest(location)
+	switch {
+	case os.IsNotExist(e):
+		log.Warnf("%s has no manifest, so was saved by an older build. "+
+			"Loading it without checking its format", location)
+		manifest = nil
+	case e != nil:
 		return nil, e
+	default:
+		if e = manifest.Check(location); e != nil {
+			return nil, e
+		}
+	}
+
+	if HasCompiledIndex(location) {
+		if lexicon, e = OpenCompiledLexicon(location); e != nil {
+			log.Criticalf("Error opening compiled index: %v", e)
+			return nil, e
+		}
 	} else {
-		scanner := bufio.NewScanner(file)
-		var fields []string
+		log.Warnf("%s has no compiled index. Loading posting list sets instead", location)
+		lexicon = LoadLexiconFromDisk(location)
+	}
 
-		for scanner.Scan() {
-			log.Debugf("Read %s from file.", scanner.Text())
-			fields = strings.SplitN(scanner.Text(), " ", 2)
+	if typed, ok := lexicon.(index.PostingListTyped); ok && manifest != nil {
+		// Checked by manifest.Check
+		expected, _ := index.GetPostingListInitializer(manifest.PostingList)
+		if HasCompiledIndex(location) {
+			expected = CompiledInitializer(expected)
+		}
 
-			if filterFactory, err := filters.GetFactory(fields[0]); err != nil {
-				return nil, errors.New(fmt.Sprintf("Asked to load filter '%s' with args '%s', but don't know how.",
-					fields[0], fields[1]))
-			} else {
-				filterFactory.Deserialize(fields[1])
-				log.Debugf("Adding filter %s", fields[1])
-				st_index.AddFilter(filterFactory.Instantiate())
-			}
+		if typed.PLInitializer().Name != expected.Name {
+			return nil, fmt.Errorf("The index in %s has %s posting lists, but its manifest says %s",
+				location, typed.PLInitializer().Name, expected.Name)
 		}
 	}
 
+	st_index = new(index.SingleTermIndex)
+	st_index.Init(lexicon)
+	if manifest != nil {
+		st_index.IndexType = manifest.IndexType
+		st_index.Sources = manifest.Sources
+	}
+
+	if e = LoadDocumentMap(location, st_index); e != nil {
+		return nil, e
+	}
+
+	if e = LoadCollectionStats(location, st_index); e != nil {
+		return nil, e
+	}
+
+	if !st_index.IsFinalized() {
+		log.Warnf("%s has no document norms. Computing them now", location)
+		st_index.Finalize()
+	}
+
+	if e = LoadWildcardIndex(location, st_index); e != nil {
+		return nil, e
+	}
+
+	if e = LoadForwardIndex(location, st_index); e != nil {
+		return nil, e
+	}
+
+	if e = LoadDocumentStore(location, st_index); e != nil {
+		return nil, e
+	}
+
+	if e = LoadFilters(location, st_index); e != nil {
+		return nil, e
+	}
+
 	return st_index, nil
 }
+
+// Add the filters listed in location's filters.mdt to st_index
+func LoadFilters(location string, st_index *index.SingleTermIndex) error {
+	file, e := os.Open(location + "filters.mdt")
+	if e != nil {
+		log.Criticalf("Error opening filter metadata file: %v", e)
+		return e
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var fields []string
+
+	for scanner.Scan() {
+		log.Debugf("Read %s from file.", scanner.Text())
+		fields = strings.SplitN(scanner.Text(), " ", 2)
+
+		if filterFactory, err := filters.GetFactory(fields[0]); err != nil {
+			return errors.New(fmt.Sprintf("Asked to load filter '%s' with args '%s', but don't know how.",
+				fields[0], fields[1]))
+		} else {
+			filterFactory.Deserialize(fields[1])
+			log.Debugf("Adding filter %s", fields[1])
+			st_index.AddFilter(filterFactory.Instantiate())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package constrained
+
+import index "github.com/cwacek/irengine/indexer"
+import log "github.com/cihub/seelog"
+import "runtime"
+import "time"
+
+/* Rough sizes of the in-memory structures, used to decide when
+ * posting lists should be written to disk. They don't need to be
+ * exact, but they should err on the large side. */
+const (
+	TermBytes     = 96
+	EntryBytes    = 64
+	PositionBytes = 8
+)
+
+/* Lexicons saved before their memory limit was in bytes recorded
+ * it in posting list entries. Each is taken to cost this much. */
+const LegacyEntryBytes = EntryBytes + 4*PositionBytes
+
+/* How often the estimated memory use is checked against the heap.
+ * Reading the heap statistics stops the world, so not often. If
+ * it's negative, the heap isn't checked, and only the estimates
+ * count. */
+var HeapCheckInterval = time.Second
+
+/* The estimates are scaled up when the heap is over budget, but
+ * never so that less than this much of the budget is used. */
+const MinBudgetScale = 0.25
+
+/* Posting lists kept encoded, whose compressed blocks are what they
+ * cost, along with the entries not compressed yet. */
+type compressed_list interface {
+	CompressedSize() int
+	Pending() (entries, positions int)
+}
+
+/* The estimated size in memory of a term's posting list. Compressed
+ * lists are neither decoded nor flushed to be measured. */
+func postingListBytes(pl index.PostingList) int64 {
+	size := int64(TermBytes)
+	positional := pl.IsPositional()
+
+	if compressed, ok := pl.(compressed_list); ok {
+		entries, positions := compressed.Pending()
+		size += int64(compressed.CompressedSize()) + EntryBytes*int64(entries)
+		if positional {
+			size += PositionBytes * int64(positions)
+		}
+		return size
+	}
+
+	for it := pl.Iterator(); it.Next(); {
+		size += EntryBytes
+		if positional {
+			size += PositionBytes * int64(len(it.Value().Positions()))
+		}
+	}
+	return size
+}
+
+// The bytes allocated on the heap
+func heapAlloc() int64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return int64(mem.HeapAlloc)
+}
+
+/* The estimated bytes pl grows by as insert adds a posting with
+ * positions positions to it, returning whether it made a new entry.
+ * Compressed lists are measured before and after, since inserting
+ * may compress their pending entries, so they cost the same as they
+ * will once they're read back. */
+func insertBytes(pl index.PostingList, positions int, insert func() bool) int64 {
+	if _, ok := pl.(compressed_list); ok {
+		before := postingListBytes(pl)
+		insert()
+		return postingListBytes(pl) - before
+	}
+
+	var size int64
+	if insert() {
+		size += EntryBytes
+	}
+	if pl.IsPositional() {
+		size += PositionBytes * int64(positions)
+	}
+	return size
+}
+
+/* Compare what the heap has grown by since the lexicon held no
+ * posting lists, taken to be their share of it, with the budget
+ * every HeapCheckInterval. While it's over budget the estimates are
+ * taken to be low, and the lexicon evicts earlier; once it's well
+ * under they're trusted again. The growth holds more than the
+ * posting lists, so this only corrects the estimates, and never
+ * evicts by itself. */
+func (lex *lexicon) checkHeap() {
+	if lex.maxLoad <= 0 || HeapCheckInterval < 0 ||
+		time.Since(lex.lastHeapCheck) < HeapCheckInterval {
+		return
+	}
+	lex.lastHeapCheck = time.Now()
+
+	allocated := heapAlloc()
+	if lex.policy.Len() == 0 || allocated < lex.heapBaseline {
+		lex.heapBaseline = allocated
+	}
+	heap := allocated - lex.heapBaseline
+	lex.stats[PLSHeapChecks]++
+
+	switch {
+	case heap > lex.maxLoad && lex.budgetScale > MinBudgetScale:
+		lex.budgetScale *= 0.9
+		if lex.budgetScale < MinBudgetScale {
+			lex.budgetScale = MinBudgetScale
+		}
+		log.Warnf("Heap has grown by %d bytes, over the %d byte budget, with ~%d "+
+			"bytes of posting lists in memory. Evicting at %0.0f%% of the budget",
+			heap, lex.maxLoad, lex.currentLoad, 100*lex.budgetScale)
+
+	case heap < lex.maxLoad/2 && lex.budgetScale < 1:
+		lex.budgetScale /= 0.9
+		if lex.budgetScale > 1 {
+			lex.budgetScale = 1
+		}
+	}
+}
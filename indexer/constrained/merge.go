@@ -0,0 +1,264 @@
+package constrained
+
+import index "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import log "github.com/cihub/seelog"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+
+/* Merge the indexes saved in inputs into a new index saved in
+ * output, which mustn't exist yet. The inputs must have the same
+ * filter chain and posting list type, and no document may be in
+ * more than one of them. Documents keep their ids unless an earlier
+ * input has already used one, in which case they're given an unused
+ * one. The posting lists are merged a term at a time, in order, so
+ * only RewriteMemLimit bytes of them are kept in memory. The merged
+ * index has a forward index or a document store only if every input
+ * has one. */
+func MergeIndexes(output string, inputs []string) (*index.SingleTermIndex, error) {
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("Nothing to merge")
+	}
+
+	output = filepath.Clean(output) + "/"
+	if _, err := os.Stat(output); err == nil {
+		return nil, fmt.Errorf("%s already exists", output)
+	}
+
+	inputs = append([]string(nil), inputs...)
+	indexes := make([]*index.SingleTermIndex, len(inputs))
+	var (
+		plInit  index.PostingListInitializer
+		filters string
+	)
+
+	for i, input := range inputs {
+		input = filepath.Clean(input) + "/"
+		inputs[i] = input
+
+		st_index, err := SingleTermIndexFromDisk(input)
+		if err != nil {
+			return nil, fmt.Errorf("Can't load %s: %v", input, err)
+		}
+		indexes[i] = st_index
+
+		inputPL, err := postingListType(input, st_index)
+		if err != nil {
+			return nil, err
+		}
+
+		chain, err := ioutil.ReadFile(input + "filters.mdt")
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			plInit, filters = inputPL, string(chain)
+			continue
+		}
+
+		if inputPL.Name != plInit.Name {
+			return nil, fmt.Errorf("%s has %s posting lists, but %s has %s",
+				input, inputPL.Name, inputs[0], plInit.Name)
+		}
+		if string(chain) != filters {
+			return nil, fmt.Errorf("%s was built with filters\n%s\nbut %s with\n%s",
+				input, chain, inputs[0], filters)
+		}
+	}
+
+	// Check every document can be merged before writing anything
+	humanIds := make(map[string]string)
+	used := make(map[filereader.DocumentId]bool)
+	remapped := make([]map[filereader.DocumentId]filereader.DocumentId, len(indexes))
+	for i, st_index := range indexes {
+		for _, info := range st_index.DocumentMap {
+			if first, ok := humanIds[info.HumanId]; ok {
+				return nil, fmt.Errorf("%s is in both %s and %s",
+					info.HumanId, first, inputs[i])
+			}
+			humanIds[info.HumanId] = inputs[i]
+		}
+		remapped[i] = remapDocuments(used, st_index.DocumentMap)
+	}
+
+	lexicon := NewLexicon(RewriteMemLimit, output)
+	lexicon.SetPLInitializer(plInit)
+
+	merged := new(index.SingleTermIndex)
+	merged.Init(lexicon)
+	merged.IndexType = indexes[0].IndexType
+	if err := LoadFilters(inputs[0], merged); err != nil {
+		return nil, err
+	}
+
+	forward, documents := true, true
+	for _, st_index := range indexes {
+		forward = forward && st_index.ForwardIndex() != nil
+		documents = documents && st_index.HasDocumentStore()
+	}
+	if forward {
+		merged.EnableForwardIndex()
+	}
+	if documents {
+		if err := merged.EnableDocumentStore(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, st_index := range indexes {
+		ids := remapped[i]
+		log.Infof("Merging %s: %d documents, %d given new ids",
+			inputs[i], len(st_index.DocumentMap), len(ids))
+
+		for id, info := range st_index.DocumentMap {
+			copied := info.Clone()
+			if newId, ok := ids[id]; ok {
+				copied.Id = newId
+			}
+			merged.DocumentMap[copied.Id] = copied
+
+			if documents {
+				if text, err := st_index.GetDocument(info.HumanId); err != nil {
+					return nil, err
+				} else if err = merged.StoreText(info.HumanId, text); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		merged.Stats().Merge(st_index.Stats())
+		merged.Sources = append(merged.Sources, st_index.Sources...)
+	}
+	merged.DocumentCount = len(merged.DocumentMap)
+
+	mergeTerms(lexicon, indexes, remapped, plInit)
+
+	merged.Save()
+	return merged, nil
+}
+
+/* The posting list type an index was built with. Indexes without
+ * a manifest give the type of their lexicon's lists, which for a
+ * compiled index may be the type they're stored in instead. */
+func postingListType(location string, st_index *index.SingleTermIndex) (index.PostingListInitializer, error) {
+	if manifest, err := index.ReadManifest(location); err == nil {
+		return index.GetPostingListInitializer(manifest.PostingList)
+	}
+
+	if typed, ok := st_index.Lexicon().(index.PostingListTyped); ok {
+		return typed.PLInitializer(), nil
+	}
+	return index.PostingListInitializer{}, fmt.Errorf(
+		"Can't tell what type of posting lists %s has", location)
+}
+
+/* Merge the posting lists of each term in the inputs into lexicon,
+ * one term after another in order. The documents of input i are
+ * renumbered by remapped[i]. */
+func mergeTerms(lexicon index.Lexicon, inputs []*index.SingleTermIndex,
+	remapped []map[filereader.DocumentId]filereader.DocumentId,
+	plInit index.PostingListInitializer) {
+
+	walks := make([]entriesByKey, len(inputs))
+	for i, st_index := range inputs {
+		walks[i] = entriesByKey(st_index.Lexicon().Walk())
+		sort.Sort(walks[i])
+	}
+
+	for {
+		// The least term any input has left
+		var text string
+		found := false
+		for _, walk := range walks {
+			if len(walk) == 0 {
+				continue
+			}
+			if next := walk[0].(index.LexiconTerm).Text(); !found || next < text {
+				text, found = next, true
+			}
+		}
+		if !found {
+			return
+		}
+
+		for i, walk := range walks {
+			if len(walk) == 0 {
+				continue
+			}
+			if term := walk[0].(index.LexiconTerm); term.Text() == text {
+				lexicon.MergePostingList(text, remapPostingList(term, remapped[i], plInit))
+				walks[i] = walk[1:]
+			}
+		}
+	}
+}
+
+/* New ids for the documents in docs whose ids are in used, which
+ * holds every id of the documents merged so far. The ids of docs,
+ * and those given out, are added to it. */
+func remapDocuments(used map[filereader.DocumentId]bool,
+	docs index.DocInfoMap) map[filereader.DocumentId]filereader.DocumentId {
+
+	clashing := make([]int, 0)
+	for id := range docs {
+		if used[id] {
+			clashing = append(clashing, int(id))
+		}
+	}
+	for id := range docs {
+		used[id] = true
+	}
+	sort.Ints(clashing)
+
+	// Ids are looked for upwards from the last given out, so each is
+	// only ever tried once
+	ids := make(map[filereader.DocumentId]filereader.DocumentId, len(clashing))
+	var next filereader.DocumentId
+	for _, clash := range clashing {
+		id := filereader.DocumentId(clash)
+		if next <= id {
+			next = id + 1
+		}
+		for used[next] {
+			next++
+		}
+		ids[id] = next
+		used[next] = true
+	}
+	return ids
+}
+
+// A copy of term's posting list with the documents in ids renumbered
+func remapPostingList(term index.LexiconTerm,
+	ids map[filereader.DocumentId]filereader.DocumentId,
+	plInit index.PostingListInitializer) index.PostingList {
+
+	if len(ids) == 0 {
+		return term.PostingList()
+	}
+
+	pl := plInit.Create()
+	for it := term.PostingList().Iterator(); it.Next(); {
+		entry := it.Value()
+		id, ok := ids[entry.DocId()]
+		if !ok {
+			pl.InsertCompleteEntry(entry)
+			continue
+		}
+
+		if positions := entry.Positions(); pl.IsPositional() && len(positions) > 0 {
+			for _, pos := range positions {
+				pl.InsertRawEntry(term.Text(), id, pos)
+			}
+		} else {
+			for i := 0; i < entry.Frequency(); i++ {
+				pl.InsertRawEntry(term.Text(), id, 0)
+			}
+		}
+	}
+	return pl
+}
@@ -0,0 +1,23 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package constrained
+
+import "io/ioutil"
+
+// Without mmap, just read the whole file into memory
+type mappedFile struct {
+	Data []byte
+}
+
+func mapFile(path string) (*mappedFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data}, nil
+}
+
+func (m *mappedFile) Close() error {
+	m.Data = nil
+	return nil
+}
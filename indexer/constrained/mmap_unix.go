@@ -0,0 +1,45 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package constrained
+
+import "os"
+import "syscall"
+
+// A read-only memory mapping of a file
+type mappedFile struct {
+	Data []byte
+}
+
+func mapFile(path string) (*mappedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := new(mappedFile)
+	if info.Size() == 0 {
+		return mapped, nil
+	}
+
+	mapped.Data, err = syscall.Mmap(int(file.Fd()), 0, int(info.Size()),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return mapped, nil
+}
+
+func (m *mappedFile) Close() error {
+	if m.Data == nil {
+		return nil
+	}
+	data := m.Data
+	m.Data = nil
+	return syscall.Munmap(data)
+}
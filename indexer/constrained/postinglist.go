@@ -5,9 +5,11 @@ import "github.com/cwacek/irengine/scanner/filereader"
 import "fmt"
 import "strings"
 import "io"
+import "strconv"
 import log "github.com/cihub/seelog"
 import "bufio"
 import "bytes"
+import "encoding"
 
 type DatastoreTag string
 
@@ -17,18 +19,19 @@ func (t DatastoreTag) String() string {
 
 type PostingListSet struct {
 	Tag           DatastoreTag
-	listMap       map[string]index.PostingList
+	listMap       map[index.TermId]index.PostingList
 	pl_init       index.PostingListInitializer
 	pl_entry_init func(id filereader.DocumentId) index.PostingListEntry
 
-	Size               int
+	// The estimated bytes used by the posting lists
+	Size               int64
 	size_needs_refresh bool
 }
 
 func NewPostingListSet(tag DatastoreTag,
 	init index.PostingListInitializer) *PostingListSet {
 	pls := new(PostingListSet)
-	pls.listMap = make(map[string]index.PostingList)
+	pls.listMap = make(map[index.TermId]index.PostingList)
 	pls.Tag = tag
 	pls.pl_init = init
 	pls.pl_entry_init = init.Create().EntryFactory
@@ -38,20 +41,21 @@ func NewPostingListSet(tag DatastoreTag,
 func (pls PostingListSet) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(pls.Tag.String())
-	buf.WriteString(fmt.Sprintf(" [%d entries, %d terms]", pls.Size,
+	buf.WriteString(fmt.Sprintf(" [~%d bytes, %d terms]", pls.Size,
 		len(pls.listMap)))
 
 	return buf.String()
 }
 
-func TransferPL(src, dst *PostingListSet, term string) (sz int) {
+// Move the posting list for term, returning its estimated size
+func TransferPL(src, dst *PostingListSet, term index.TermId) (sz int64) {
 
 	var pl index.PostingList
 	var ok bool
 
 	if pl, ok = src.listMap[term]; ok {
 		dst.listMap[term] = pl
-		sz = pl.Len()
+		sz = postingListBytes(pl)
 		dst.Size += sz
 		src.Size -= sz
 		delete(src.listMap, term)
@@ -62,37 +66,61 @@ func TransferPL(src, dst *PostingListSet, term string) (sz int) {
 	return
 }
 
-func (pls *PostingListSet) Terms() map[string]index.PostingList {
+// The posting lists in the set, by term id
+func (pls *PostingListSet) Terms() map[index.TermId]index.PostingList {
 	return pls.listMap
 }
 
 //Get and return the PostingList for a particular term
-func (pls *PostingListSet) Get(term string) index.PostingList {
+func (pls *PostingListSet) Get(term index.TermId) index.PostingList {
 	pls.size_needs_refresh = true
 
 	if pl, ok := pls.listMap[term]; ok {
-		log.Debugf("Have posting list for %s.", term)
+		log.Debugf("Have posting list for %d.", term)
 		return pl
 	} else {
 		pl = pls.pl_init.Create()
 		pls.listMap[term] = pl
-		log.Debugf("Don't have posting list for %s. ", term)
+		pls.Size += TermBytes
+		log.Debugf("Don't have posting list for %d. ", term)
 		return pl
 	}
 }
 
+/* Posting list sets are written with each term's id, and the
+ * lexicon saves the table of their text once. Text sets have one
+ * posting per line, after the term id and a '#'. Sets whose lists
+ * can marshal themselves are written in a binary format starting
+ * with this header. Every term is then written as its VByte id,
+ * followed by a VByte length and the marshaled posting list. */
+var BinaryPLSMagic = []byte("IRPLS\x01\n")
+
+// Parse a term id in a text posting list set
+func ParseTermId(key string) (index.TermId, error) {
+	id, err := strconv.ParseUint(key, 10, 32)
+	return index.TermId(id), err
+}
+
 func (pls *PostingListSet) Dump(w io.Writer) {
 	var (
 		pl   index.PostingList
 		it   index.PostingListIterator
-		term string
+		term index.TermId
+		key  string
 	)
 	writer := bufio.NewWriter(w)
 
+	if _, ok := pls.pl_init.Create().(encoding.BinaryMarshaler); ok {
+		pls.dumpBinary(writer)
+		writer.Flush()
+		return
+	}
+
 	for term, pl = range pls.listMap {
 
+		key = strconv.FormatUint(uint64(term), 10)
 		for it = pl.Iterator(); it.Next(); {
-			writer.WriteString(term)
+			writer.WriteString(key)
 			writer.WriteString(" # ")
 			writer.WriteString(it.Value().Serialize())
 			/*it.Value().SerializeTo(writer)*/
@@ -102,27 +130,120 @@ func (pls *PostingListSet) Dump(w io.Writer) {
 	writer.Flush()
 }
 
-func (pls *PostingListSet) Load(r io.Reader) int {
+func (pls *PostingListSet) dumpBinary(writer *bufio.Writer) {
+	var header []byte
+
+	writer.Write(BinaryPLSMagic)
+	for term, pl := range pls.listMap {
+		data, err := pl.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			panic(NewPersistenceError(fmt.Sprintf(
+				"Failed to encode posting list for term %d: %v", term, err)))
+		}
+
+		header = index.AppendVByte(header[:0], uint64(term))
+		header = index.AppendVByte(header, uint64(len(data)))
+		writer.Write(header)
+		writer.Write(data)
+	}
+}
+
+func (pls *PostingListSet) loadBinary(reader *bufio.Reader) int64 {
 	var (
-		pl                index.PostingList
-		pl_entry          index.PostingListEntry
-		ok                bool
-		term, parsed_term string
-		parsed            int
+		length uint64
+		err    error
+	)
+
+	readBlob := func() []byte {
+		if length, err = index.ReadVByteFrom(reader); err != nil {
+			return nil
+		}
+		blob := make([]byte, length)
+		if _, err = io.ReadFull(reader, blob); err != nil {
+			panic(NewPersistenceError("Truncated posting list set " +
+				pls.Tag.String()))
+		}
+		return blob
+	}
+
+	reader.Discard(len(BinaryPLSMagic))
+	for {
+		id, e := index.ReadVByteFrom(reader)
+		term := index.TermId(id)
+		if err = e; err == io.EOF {
+			break
+		} else if err != nil {
+			panic(NewPersistenceError("Failed to read posting list set " +
+				pls.Tag.String() + ": " + err.Error()))
+		}
+
+		data := readBlob()
+		if err != nil {
+			panic(NewPersistenceError("Truncated posting list set " +
+				pls.Tag.String()))
+		}
+
+		pl := pls.pl_init.Create()
+		if err = pl.(encoding.BinaryUnmarshaler).UnmarshalBinary(data); err != nil {
+			panic(NewPersistenceError(fmt.Sprintf(
+				"Failed to decode posting list for term %d: %v", term, err)))
+		}
+
+		if existing, ok := pls.listMap[term]; ok {
+			for it := pl.Iterator(); it.Next(); {
+				existing.InsertCompleteEntry(it.Value())
+			}
+		} else {
+			pls.listMap[term] = pl
+		}
+	}
+	pls.flush()
+	pls.RecalculateSize()
+	return pls.Size
+}
+
+/* Read the posting lists in r, returning their estimated size in
+ * bytes */
+func (pls *PostingListSet) Load(r io.Reader) int64 {
+	return pls.LoadKeyed(r, ParseTermId)
+}
+
+/* Read the posting lists in r, finding the id of the term on each
+ * line of a text set with termId. Sets written before terms were
+ * numbered have the term's text there instead. */
+func (pls *PostingListSet) LoadKeyed(r io.Reader,
+	termId func(key string) (index.TermId, error)) int64 {
+
+	var (
+		pl              index.PostingList
+		pl_entry        index.PostingListEntry
+		ok              bool
+		term            index.TermId
+		key, parsed_key string
+		parsed          int
 		/*docId int64*/
 		parts []string
 		e     error
 	)
-	term = "#" // Just make sure it's not a term
+	key = "#" // Just make sure it's not a term
 
-	scanner := bufio.NewScanner(r)
+	reader := bufio.NewReader(r)
+	if magic, _ := reader.Peek(len(BinaryPLSMagic)); bytes.Equal(magic, BinaryPLSMagic) {
+		if _, ok := pls.pl_init.Create().(encoding.BinaryUnmarshaler); !ok {
+			panic(NewPersistenceError("Posting list set " + pls.Tag.String() +
+				" is binary, but " + pls.pl_init.Name + " lists can't read it"))
+		}
+		return pls.loadBinary(reader)
+	}
+
+	scanner := bufio.NewScanner(reader)
 	scanner.Split(bufio.ScanLines)
 	for scanner.Scan() {
 
 		parts = strings.Split(scanner.Text(), "#")
-		parsed_term = strings.TrimSpace(parts[0])
-		/*log.Debugf("Parsed term as %s", parsed_term)*/
-		if len(parsed_term) == 0 {
+		parsed_key = strings.TrimSpace(parts[0])
+		/*log.Debugf("Parsed term as %s", parsed_key)*/
+		if len(parsed_key) == 0 {
 			continue
 		}
 
@@ -142,9 +263,13 @@ func (pls *PostingListSet) Load(r io.Reader) int {
 		}
 
 		// Lookup PL, otherwise save the cost
-		if term != parsed_term {
+		if key != parsed_key {
 
-			term = parsed_term
+			key = parsed_key
+			if term, e = termId(key); e != nil {
+				panic(NewPersistenceError(fmt.Sprintf("Bad term in %s: %v",
+					scanner.Text(), e)))
+			}
 			if pl, ok = pls.listMap[term]; !ok {
 				pl = pls.pl_init.Create()
 				pls.listMap[term] = pl
@@ -152,21 +277,29 @@ func (pls *PostingListSet) Load(r io.Reader) int {
 		}
 
 		pl.InsertCompleteEntry(pl_entry)
-		pls.Size++
 	}
+	pls.flush()
+	pls.RecalculateSize()
 	return pls.Size
 }
 
+// Let lists that buffer work finish it once they've been read
+func (pls *PostingListSet) flush() {
+	for _, pl := range pls.listMap {
+		if buffered, ok := pl.(index.BufferedPostingList); ok {
+			buffered.Flush()
+		}
+	}
+}
+
 func (pls *PostingListSet) DocCount() int {
 	return len(pls.listMap)
 }
 
-func (pls *PostingListSet) RecalculateLen() {
-	var pl index.PostingList
-
-	entries := 0
-	for _, pl = range pls.listMap {
-		entries += pl.Len()
+func (pls *PostingListSet) RecalculateSize() {
+	var size int64
+	for _, pl := range pls.listMap {
+		size += postingListBytes(pl)
 	}
-	pls.Size = entries
+	pls.Size = size
 }
@@ -0,0 +1,94 @@
+package constrained
+
+import index "github.com/cwacek/irengine/indexer"
+import log "github.com/cihub/seelog"
+import "fmt"
+import "os"
+import "path/filepath"
+
+// Build a pruner for the index it's going to prune
+type PrunerFunc func(source *index.SingleTermIndex) (index.PostingListPruner, error)
+
+/* Write a pruned copy of the index saved in input to output, which
+ * mustn't exist yet. The pruner is built for the loaded input, so
+ * score-based pruners see its statistics, and sees a copy of each
+ * term's posting list. Terms left with no postings are dropped.
+ * The pruned index keeps the source's collection statistics, so
+ * the postings that are left score as they did before. Only
+ * RewriteMemLimit bytes of its posting lists are kept in memory. */
+func PruneIndex(input, output string, newPruner PrunerFunc) (*index.SingleTermIndex, error) {
+	input = filepath.Clean(input) + "/"
+	output = filepath.Clean(output) + "/"
+	if _, err := os.Stat(output); err == nil {
+		return nil, fmt.Errorf("%s already exists", output)
+	}
+
+	source, err := SingleTermIndexFromDisk(input)
+	if err != nil {
+		return nil, err
+	}
+
+	plInit, err := postingListType(input, source)
+	if err != nil {
+		return nil, err
+	}
+
+	pruner, err := newPruner(source)
+	if err != nil {
+		return nil, err
+	}
+
+	lexicon := NewLexicon(RewriteMemLimit, output)
+	lexicon.SetPLInitializer(plInit)
+
+	pruned := new(index.SingleTermIndex)
+	pruned.Init(lexicon)
+	pruned.IndexType = source.IndexType
+	pruned.Sources = source.Sources
+	if err = LoadFilters(input, pruned); err != nil {
+		return nil, err
+	}
+
+	if source.ForwardIndex() != nil {
+		pruned.EnableForwardIndex()
+	}
+	if source.HasDocumentStore() {
+		if err = pruned.EnableDocumentStore(); err != nil {
+			return nil, err
+		}
+	}
+
+	for id, info := range source.DocumentMap {
+		pruned.DocumentMap[id] = info.Clone()
+		if source.HasDocumentStore() {
+			if text, err := source.GetDocument(info.HumanId); err != nil {
+				return nil, err
+			} else if err = pruned.StoreText(info.HumanId, text); err != nil {
+				return nil, err
+			}
+		}
+	}
+	pruned.DocumentCount = source.DocumentCount
+	pruned.Stats().Merge(source.Stats())
+
+	index.PreparePruner(pruner, source.Lexicon())
+
+	dropped := 0
+	for _, entry := range source.Lexicon().Walk() {
+		term := entry.(index.LexiconTerm)
+		copied := &index.Term{Text_: term.Text(), Tf_: term.Tf(),
+			Pl: index.Collect(term.PostingList().Iterator(), plInit)}
+
+		pruner.Prune(copied)
+		if copied.Pl.Len() > 0 {
+			lexicon.MergePostingList(copied.Text_, copied.Pl)
+		} else {
+			pruned.Stats().RemoveTerm(copied.Text_)
+			dropped++
+		}
+	}
+	log.Infof("Pruned %s into %s. %d terms lost every posting", input, output, dropped)
+
+	pruned.Save()
+	return pruned, nil
+}
@@ -0,0 +1,710 @@
+package constrained
+
+import index "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/indexer/filters"
+import "github.com/cwacek/irengine/scanner/filereader"
+import log "github.com/cihub/seelog"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+
+/* A segmented index is a directory of immutable segments, each a
+ * compiled index of its own with a term dictionary, postings and a
+ * document map, and a manifest listing the live ones:
+ *
+ *   segments.json  The manifest. The posting list type, the number
+ *                  of segments ever written, and each live segment
+ *                  with its document count and the documents that
+ *                  have been deleted from it since.
+ *   filters.mdt    The filter chain, as a single-term index has it.
+ *   seg_000001/    A segment, named for the generation it was
+ *                  written in.
+ *
+ * Adding documents writes a new segment, and deleting one only adds
+ * a tombstone to the manifest, so no segment is ever rewritten. A
+ * merge policy picks segments to merge in the background, dropping
+ * their deleted documents, and the manifest is switched over to the
+ * merged segment once it's written. */
+const SegmentManifestFile = "segments.json"
+
+// A segment listed in the manifest
+type SegmentInfo struct {
+	Name      string
+	Documents int
+	// Documents deleted from the segment since it was written
+	Deleted []filereader.DocumentId `json:",omitempty"`
+
+	/* Deleted as a set, which views of the index search with. It's
+	 * replaced rather than changed, since they can be reading it. */
+	deleted map[filereader.DocumentId]bool
+}
+
+// The number of documents in the segment which aren't deleted
+func (info *SegmentInfo) Live() int {
+	return info.Documents - len(info.Deleted)
+}
+
+func (info *SegmentInfo) IsDeleted(id filereader.DocumentId) bool {
+	return info.deleted[id]
+}
+
+// Add tombstones for ids, which are in the segment
+func (info *SegmentInfo) delete(ids ...filereader.DocumentId) {
+	info.Deleted = append(info.Deleted, ids...)
+
+	deleted := make(map[filereader.DocumentId]bool, len(info.Deleted))
+	for _, id := range info.Deleted {
+		deleted[id] = true
+	}
+	info.deleted = deleted
+}
+
+type SegmentManifest struct {
+	PostingList string
+	// The number of segments written, which names the next one
+	Generation int
+	Segments   []*SegmentInfo
+}
+
+// Whether location holds a segmented index
+func IsSegmentedIndex(location string) bool {
+	_, err := os.Stat(filepath.Join(location, SegmentManifestFile))
+	return err == nil
+}
+
+func ReadSegmentManifest(location string) (*SegmentManifest, error) {
+	file, err := os.Open(filepath.Join(location, SegmentManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := new(SegmentManifest)
+	if err = json.NewDecoder(file).Decode(manifest); err != nil {
+		return nil, NewPersistenceError("Bad segment manifest in " + location + ": " + err.Error())
+	}
+
+	// Index the tombstones read from the file
+	for _, info := range manifest.Segments {
+		info.delete()
+	}
+	return manifest, nil
+}
+
+/* Write the manifest to a temporary file and rename it over the
+ * old one, so a crash leaves one or the other. */
+func (m *SegmentManifest) WriteTo(location string) error {
+	path := filepath.Join(location, SegmentManifestFile)
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err = json.NewEncoder(file).Encode(m); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Chooses segments to merge
+type MergePolicy interface {
+	// Groups of segments which should each be merged into one
+	FindMerges(segments []*SegmentInfo) [][]*SegmentInfo
+}
+
+/* Merges segments of about the same size. A segment's tier is the
+ * log of its live document count in base SegmentsPerTier, and once
+ * a tier has SegmentsPerTier segments they're merged into one,
+ * which is in the tier above. Each document is merged about once
+ * per tier, so the cost of merging grows with the log of the index
+ * size, and there are at most SegmentsPerTier segments per tier. */
+const DefaultSegmentsPerTier = 10
+
+type TieredMergePolicy struct {
+	SegmentsPerTier int
+}
+
+func NewTieredMergePolicy(segmentsPerTier int) *TieredMergePolicy {
+	if segmentsPerTier < 2 {
+		segmentsPerTier = 2
+	}
+	return &TieredMergePolicy{SegmentsPerTier: segmentsPerTier}
+}
+
+func (p *TieredMergePolicy) FindMerges(segments []*SegmentInfo) [][]*SegmentInfo {
+	tiers := make(map[int][]*SegmentInfo)
+	for _, info := range segments {
+		tier := 0
+		for live := info.Live(); live >= p.SegmentsPerTier; live /= p.SegmentsPerTier {
+			tier++
+		}
+		tiers[tier] = append(tiers[tier], info)
+	}
+
+	levels := make([]int, 0, len(tiers))
+	for tier := range tiers {
+		levels = append(levels, tier)
+	}
+	sort.Ints(levels)
+
+	merges := make([][]*SegmentInfo, 0)
+	for _, tier := range levels {
+		if len(tiers[tier]) >= p.SegmentsPerTier {
+			merges = append(merges, tiers[tier][:p.SegmentsPerTier])
+		}
+	}
+	return merges
+}
+
+// An open segment
+type segment struct {
+	index *index.SingleTermIndex
+
+	// The id of each document, by its name
+	byName map[string]filereader.DocumentId
+
+	// The segment as views search it, less its deleted documents
+	reader *index.SingleTermIndex
+}
+
+func openSegment(location string) (*segment, error) {
+	lexicon, err := OpenCompiledLexicon(location)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(location + DocMapFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	seg := &segment{index: new(index.SingleTermIndex)}
+	seg.index.Init(lexicon)
+	if err = seg.index.DocumentMap.ReadBinary(file); err != nil {
+		return nil, err
+	}
+	seg.index.DocumentCount = len(seg.index.DocumentMap)
+	seg.index.Stats().FromDocuments(seg.index.DocumentMap)
+
+	// Readers share the wildcard index, so build it once
+	seg.index.WildcardIndex()
+
+	seg.byName = make(map[string]filereader.DocumentId, len(seg.index.DocumentMap))
+	for id, doc := range seg.index.DocumentMap {
+		seg.byName[doc.HumanId] = id
+	}
+	return seg, nil
+}
+
+// Search the segment without the documents deleted from it
+func (seg *segment) open(info *SegmentInfo) {
+	seg.reader = seg.index.WithDeleted(info.deleted)
+}
+
+/* A SegmentedIndex adds documents to a segmented index, and can
+ * be searched while it does. Documents are inserted into an
+ * in-memory buffer, which is written out as a segment when it's
+ * full or flushed. Searches see the segments as one index, with
+ * collection statistics for all of them, less the deleted
+ * documents. Each segment is searched as it's stored, and its
+ * deleted documents left out as it's read, so publishing a new
+ * view of the index copies nothing out of the segments. */
+type SegmentedIndex struct {
+	// Flush after this many documents. 0 only flushes when asked.
+	SegmentDocs int
+
+	// Picks segments to merge after each change. nil never merges.
+	Policy MergePolicy
+
+	// The WildcardLimit of every view. See SetWildcardLimit.
+	WildcardLimit int
+
+	location string
+	plInit   index.PostingListInitializer
+	buffer   *index.SingleTermIndex
+	buffered int
+
+	// Every segment numbers its terms in this table
+	terms *index.TermList
+
+	// Held while the manifest or the open segments change
+	lock     *sync.Mutex
+	manifest *SegmentManifest
+	segments map[string]*segment
+
+	viewLock *sync.RWMutex
+	view     *index.SingleTermIndex
+
+	merging bool
+	merges  *sync.WaitGroup
+}
+
+func newSegmentedIndex(location string, manifest *SegmentManifest,
+	plInit index.PostingListInitializer) *SegmentedIndex {
+
+	s := new(SegmentedIndex)
+	s.WildcardLimit = index.DefaultWildcardLimit
+	s.location = filepath.Clean(location) + "/"
+	s.plInit = plInit
+	s.terms = index.NewTermList()
+	s.manifest = manifest
+	s.segments = make(map[string]*segment)
+	s.lock = new(sync.Mutex)
+	s.viewLock = new(sync.RWMutex)
+	s.merges = new(sync.WaitGroup)
+	return s
+}
+
+/* Start a segmented index in location, which mustn't have one
+ * already. Documents are filtered by buffer's filters, and buffer
+ * holds them until they're flushed, so it should be empty and kept
+ * in memory. */
+func NewSegmentedIndex(location string, buffer *index.SingleTermIndex,
+	plInit index.PostingListInitializer) (*SegmentedIndex, error) {
+
+	if IsSegmentedIndex(location) {
+		return nil, NewPersistenceError(location + " already has a segmented index")
+	}
+	if err := os.MkdirAll(location, 0755); err != nil {
+		return nil, err
+	}
+
+	s := newSegmentedIndex(location, &SegmentManifest{PostingList: plInit.Name}, plInit)
+	s.buffer = buffer
+	if err := s.writeManifest(); err != nil {
+		return nil, err
+	}
+
+	s.publishView()
+	return s, nil
+}
+
+// Open the segmented index in location to search or add to it
+func OpenSegmentedIndex(location string) (*SegmentedIndex, error) {
+	manifest, err := ReadSegmentManifest(location)
+	if err != nil {
+		return nil, err
+	}
+
+	plInit, err := index.GetPostingListInitializer(manifest.PostingList)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSegmentedIndex(location, manifest, plInit)
+	s.buffer = new(index.SingleTermIndex)
+	s.buffer.Init(s.newLexicon())
+	if err = LoadFilters(s.location, s.buffer); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(s.location + index.TermListFile)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.terms.ReadFrom(file)
+	file.Close()
+	if err != nil {
+		return nil, NewPersistenceError("Bad term list in " + location + ": " + err.Error())
+	}
+
+	for _, info := range manifest.Segments {
+		seg, err := openSegment(s.location + info.Name + "/")
+		if err != nil {
+			return nil, err
+		}
+		seg.open(info)
+		s.segments[info.Name] = seg
+	}
+
+	s.publishView()
+	log.Infof("Opened %s", s)
+	return s, nil
+}
+
+func (s *SegmentedIndex) newLexicon() index.Lexicon {
+	lexicon := index.NewTrieLexicon()
+	lexicon.SetPLInitializer(s.plInit)
+	return lexicon
+}
+
+// The segments have their own lexicons
+func (s *SegmentedIndex) Init(lexicon index.Lexicon) error {
+	return errors.New("Segmented indexes can't be given a lexicon")
+}
+
+func (s *SegmentedIndex) AddFilter(f filters.Filter) {
+	s.buffer.AddFilter(f)
+}
+
+func (s *SegmentedIndex) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return fmt.Sprintf("{SegmentedIndex segments:%d %s}",
+		len(s.manifest.Segments), s.Snapshot())
+}
+
+func (s *SegmentedIndex) PrintLexicon(w io.Writer) {
+	s.Snapshot().PrintLexicon(w)
+}
+
+func (s *SegmentedIndex) Insert(d filereader.Document) {
+	s.buffer.Insert(d)
+	s.buffered++
+
+	if s.SegmentDocs > 0 && s.buffered >= s.SegmentDocs {
+		if err := s.Flush(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Segments are never changed, so they can't be pruned in place
+func (s *SegmentedIndex) Prune(pruner index.PostingListPruner) {
+	if pruner != nil {
+		log.Warnf("Can't prune segmented index %s", s.location)
+	}
+}
+
+// The number of searchable documents
+func (s *SegmentedIndex) Len() int {
+	return s.Snapshot().Len()
+}
+
+func (s *SegmentedIndex) WaitInsert() {
+	s.buffer.WaitInsert()
+}
+
+func (s *SegmentedIndex) Delete() {
+	s.WaitMerges()
+	if err := os.RemoveAll(s.location); err != nil {
+		panic(err)
+	}
+}
+
+// Flush the buffer, and wait for any merges to finish
+func (s *SegmentedIndex) Save() {
+	if err := s.Flush(); err != nil {
+		panic(err)
+	}
+	s.WaitMerges()
+}
+
+// Set the WildcardLimit, and publish a view which uses it
+func (s *SegmentedIndex) SetWildcardLimit(limit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.WildcardLimit = limit
+	s.publishView()
+}
+
+// The view searches run against
+func (s *SegmentedIndex) Snapshot() *index.SingleTermIndex {
+	s.viewLock.RLock()
+	defer s.viewLock.RUnlock()
+	return s.view
+}
+
+func (s *SegmentedIndex) FilterTokens(input, output chan *filereader.Token) {
+	s.buffer.CopyFilters().FilterTokens(input, output)
+}
+
+/* Write the buffered documents out as a new segment and make them
+ * searchable. Inserts carry on into a fresh buffer meanwhile. */
+func (s *SegmentedIndex) Flush() error {
+	buffered := s.buffer.Detach(s.newLexicon())
+	s.buffered = 0
+	if buffered.Len() == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	s.manifest.Generation++
+	info := &SegmentInfo{
+		Name:      fmt.Sprintf("seg_%06d", s.manifest.Generation),
+		Documents: buffered.Len(),
+	}
+	readers := append(s.readers(), buffered)
+	s.lock.Unlock()
+
+	// Norms use the statistics of the index with the new documents in it
+	buffered.FinalizeIn(index.NewSegmentView(s.terms, readers...))
+
+	if err := s.writeSegment(s.location+info.Name+"/", buffered.Lexicon(),
+		buffered.DocumentMap); err != nil {
+		return err
+	}
+
+	if file, err := os.Create(s.location + "filters.mdt"); err != nil {
+		return err
+	} else {
+		s.buffer.WriteFilters(file)
+		file.Close()
+	}
+
+	return s.addSegment(info, nil, nil)
+}
+
+/* Write the terms of lexicon which are in any documents, and the
+ * documents in docmap, as a compiled index in location. Terms are
+ * numbered in the index's term table. */
+func (s *SegmentedIndex) writeSegment(location string, lexicon index.Lexicon,
+	docmap index.DocInfoMap) (err error) {
+
+	defer func() {
+		if x := recover(); x != nil {
+			if perr, ok := x.(*PersistenceError); ok {
+				err = perr
+			} else {
+				panic(x)
+			}
+		}
+	}()
+
+	if err = os.MkdirAll(location, 0755); err != nil {
+		return err
+	}
+
+	terms := lexicon.Walk()
+	sort.Sort(entriesByKey(terms))
+
+	writer := newCompiledWriter(location+TermDictFile, location+PostingsFile, s.plInit)
+	for i, entry := range terms {
+		term := entry.(index.LexiconTerm)
+		if pl := term.PostingList(); pl.Len() > 0 {
+			writer.Write(s.terms.Number(term.Text()), term.Text(), pl)
+		}
+		// Let the posting list go once it's written
+		terms[i] = nil
+	}
+	writer.Close()
+
+	file, err := os.Create(location + DocMapFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return docmap.WriteBinary(file)
+}
+
+/* Swap the segments in replaced for the one described by info,
+ * which has been written, and publish a new view. seen has how
+ * many of each replaced segment's documents had been deleted when
+ * info was written. Any deleted since are carried over to info, in
+ * the same critical section as the swap, so none are lost. */
+func (s *SegmentedIndex) addSegment(info *SegmentInfo, replaced []*SegmentInfo,
+	seen map[string]int) error {
+
+	seg, err := openSegment(s.location + info.Name + "/")
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	gone := make(map[string]bool)
+	for _, old := range replaced {
+		gone[old.Name] = true
+		info.delete(old.Deleted[seen[old.Name]:]...)
+	}
+
+	live := []*SegmentInfo{info}
+	for _, old := range s.manifest.Segments {
+		if !gone[old.Name] {
+			live = append(live, old)
+		}
+	}
+
+	previous := s.manifest.Segments
+	s.manifest.Segments = live
+	if err = s.writeManifest(); err != nil {
+		s.manifest.Segments = previous
+		return err
+	}
+
+	seg.open(info)
+	s.segments[info.Name] = seg
+	s.publishView()
+
+	/* Searches of an older view can still be reading the replaced
+	 * segments. Their postings stay mapped, so they can carry on. */
+	for _, old := range replaced {
+		delete(s.segments, old.Name)
+		if err = os.RemoveAll(s.location + old.Name); err != nil {
+			log.Warnf("Failed to remove merged segment %s: %v", old.Name, err)
+		}
+	}
+
+	s.maybeMerge()
+	return nil
+}
+
+/* Save the term table, then the manifest, so every term id the
+ * manifest's segments use is in the table. Called with the lock
+ * held, or before the index is shared. */
+func (s *SegmentedIndex) writeManifest() error {
+	path := s.location + index.TermListFile
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = s.terms.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	return s.manifest.WriteTo(s.location)
+}
+
+/* Delete the document named humanId, returning whether it was
+ * found. Buffered documents are flushed first, so they can be
+ * deleted too. */
+func (s *SegmentedIndex) DeleteDocument(humanId string) (bool, error) {
+	if err := s.Flush(); err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, info := range s.manifest.Segments {
+		seg := s.segments[info.Name]
+		id, ok := seg.byName[humanId]
+		if !ok || info.IsDeleted(id) {
+			continue
+		}
+
+		previous, set := info.Deleted, info.deleted
+		info.delete(id)
+		if err := s.manifest.WriteTo(s.location); err != nil {
+			info.Deleted, info.deleted = previous, set
+			return false, err
+		}
+
+		seg.open(info)
+		s.publishView()
+		s.maybeMerge()
+		return true, nil
+	}
+	return false, nil
+}
+
+// Each live segment as views search it. Called with the lock held.
+func (s *SegmentedIndex) readers() []*index.SingleTermIndex {
+	readers := make([]*index.SingleTermIndex, len(s.manifest.Segments), len(s.manifest.Segments)+1)
+	for i, info := range s.manifest.Segments {
+		readers[i] = s.segments[info.Name].reader
+	}
+	return readers
+}
+
+/* Publish a view of the live segments. Nothing is merged or
+ * finalized: each segment leaves out its own deleted documents as
+ * it's searched. Called with the lock held. */
+func (s *SegmentedIndex) publishView() {
+	view := index.NewSegmentView(s.terms, s.readers()...)
+	view.WildcardLimit = s.WildcardLimit
+
+	s.viewLock.Lock()
+	s.view = view
+	s.viewLock.Unlock()
+}
+
+/* Start merging the segments the policy picks, unless a merge is
+ * already running. Called with the lock held. */
+func (s *SegmentedIndex) maybeMerge() {
+	if s.Policy == nil || s.merging {
+		return
+	}
+
+	groups := s.Policy.FindMerges(s.manifest.Segments)
+	if len(groups) == 0 {
+		return
+	}
+
+	s.merging = true
+	s.merges.Add(1)
+	go s.runMerges(groups)
+}
+
+func (s *SegmentedIndex) runMerges(groups [][]*SegmentInfo) {
+	defer s.merges.Done()
+
+	failed := false
+	for _, group := range groups {
+		if err := s.mergeSegments(group); err != nil {
+			log.Criticalf("Failed to merge segments in %s: %v", s.location, err)
+			failed = true
+			break
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.merging = false
+	if !failed {
+		s.maybeMerge()
+	}
+}
+
+// Block until background merges are done
+func (s *SegmentedIndex) WaitMerges() {
+	s.merges.Wait()
+}
+
+/* Merge group into a new segment, leaving out deleted documents.
+ * The documents keep the norms they were given. Documents deleted
+ * while the merge runs are carried over to the new segment as
+ * tombstones. */
+func (s *SegmentedIndex) mergeSegments(group []*SegmentInfo) error {
+	readers := make([]*index.SingleTermIndex, len(group))
+	seen := make(map[string]int)
+
+	s.lock.Lock()
+	s.manifest.Generation++
+	info := &SegmentInfo{Name: fmt.Sprintf("seg_%06d", s.manifest.Generation)}
+	for i, old := range group {
+		readers[i] = s.segments[old.Name].reader
+		seen[old.Name] = len(old.Deleted)
+	}
+	s.lock.Unlock()
+
+	// The readers leave out what was deleted when they were taken
+	merged := index.NewSegmentView(s.terms, readers...)
+	docmap := make(index.DocInfoMap)
+	for _, reader := range readers {
+		for id := range reader.DocumentMap {
+			if doc := reader.DocInfo(id); doc != nil {
+				docmap[id] = doc.Clone()
+			}
+		}
+	}
+
+	info.Documents = len(docmap)
+	log.Infof("Merging %d segments into %s with %d documents",
+		len(group), info.Name, info.Documents)
+
+	if err := s.writeSegment(s.location+info.Name+"/", merged.Lexicon(), docmap); err != nil {
+		return err
+	}
+	return s.addSegment(info, group, seen)
+}
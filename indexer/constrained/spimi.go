@@ -0,0 +1,439 @@
+package constrained
+
+import index "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import radix "github.com/cwacek/radix-go"
+import log "github.com/cihub/seelog"
+import "container/heap"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+
+// The sizes used to decide when a run should be flushed
+const (
+	SPIMITermBytes     = TermBytes
+	SPIMIEntryBytes    = EntryBytes
+	SPIMIPositionBytes = PositionBytes
+)
+
+type SPIMIStat int
+
+const (
+	SPIMIRunsWritten SPIMIStat = iota
+	SPIMIBytesFlushed
+	SPIMIPeakBytes
+)
+
+func (T SPIMIStat) String() string {
+	switch T {
+	case SPIMIRunsWritten:
+		return "Runs Written"
+	case SPIMIBytesFlushed:
+		return "Bytes Flushed"
+	case SPIMIPeakBytes:
+		return "Peak Bytes"
+	default:
+		panic("Unknown stat type")
+	}
+}
+
+/* Called during the final merge with the number of bytes of
+ * run postings merged so far and the total. */
+type MergeProgressFunc func(done, total int64)
+
+/* A lexicon which builds the index in a single pass using
+ * SPIMI. Postings are accumulated in memory until their estimated
+ * size reaches the budget, at which point the terms are written
+ * to disk as a sorted run. Saving the lexicon merges the runs into
+ * a compiled index.
+ *
+ * Runs are only flushed between documents, so the budget can be
+ * exceeded by the size of one document's postings. Once the runs
+ * have been merged the lexicon is read-only. Reading the whole
+ * lexicon (with Walk) before then also forces the merge, since
+ * the terms in memory are only a part of it.
+ *
+ * Flushing forgets the terms, but not their ids, so a term seen
+ * again in a later run keeps the id it had in the earlier ones. */
+type spimi_lexicon struct {
+	index.TrieLexicon
+
+	ids map[string]index.TermId
+
+	budget, used  int64
+	lastDoc       filereader.DocumentId
+	runs          []string
+	merged        index.Lexicon
+	pruner        index.PostingListPruner
+	DataDirectory string
+
+	Progress MergeProgressFunc
+
+	stats map[SPIMIStat]int64
+}
+
+func NewSPIMILexicon(budget int64, dataDir string) index.Lexicon {
+	lex := new(spimi_lexicon)
+
+	if err := os.RemoveAll(dataDir); err != nil {
+		panic(err)
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		panic(err)
+	}
+
+	lex.Init()
+	lex.PLInit = index.BasicPostingListInitializer
+	lex.TermInit = index.NewTermFromToken
+	lex.TextTermInit = index.NewTermFromText
+	lex.Terms = index.NewTermList()
+	lex.ids = make(map[string]index.TermId)
+	lex.TermIds = lex.termId
+
+	lex.budget = budget
+	lex.DataDirectory = dataDir
+	lex.runs = make([]string, 0)
+	lex.stats = make(map[SPIMIStat]int64)
+	lex.Progress = func(done, total int64) {
+		log.Infof("Merged %d of %d bytes of postings", done, total)
+	}
+	return lex
+}
+
+// The id text had in an earlier run, or a new one
+func (lex *spimi_lexicon) termId(text string) index.TermId {
+	id, ok := lex.ids[text]
+	if !ok {
+		id = lex.Terms.Add(text)
+		lex.ids[text] = id
+	}
+	return id
+}
+
+// Once the runs are merged, their dictionary maps the ids to text
+func (lex *spimi_lexicon) TermTable() index.TermTable {
+	if lex.merged != nil {
+		return lex.merged.(index.NumberedLexicon).TermTable()
+	}
+	return lex.TrieLexicon.TermTable()
+}
+
+// Set the function which reports the progress of the final merge
+func (lex *spimi_lexicon) SetMergeProgress(progress MergeProgressFunc) {
+	lex.Progress = progress
+}
+
+func (lex *spimi_lexicon) Location() string {
+	return lex.DataDirectory + "/"
+}
+
+func (lex *spimi_lexicon) charge(bytes int64) {
+	lex.used += bytes
+	if lex.used > lex.stats[SPIMIPeakBytes] {
+		lex.stats[SPIMIPeakBytes] = lex.used
+	}
+}
+
+func (lex *spimi_lexicon) checkWritable() {
+	if lex.merged != nil {
+		panic("Cannot add to a SPIMI lexicon after its runs are merged")
+	}
+}
+
+func (lex *spimi_lexicon) InsertToken(token *filereader.Token) index.LexiconTerm {
+	if token.Type == filereader.NullToken {
+		return nil
+	}
+	lex.checkWritable()
+
+	if token.DocId != lex.lastDoc {
+		if lex.used >= lex.budget {
+			lex.flush()
+		}
+		lex.lastDoc = token.DocId
+	}
+
+	before := 0
+	if term, ok := lex.TrieLexicon.FindTerm([]byte(token.Text)); ok {
+		before = term.PostingList().Len()
+	} else {
+		lex.charge(SPIMITermBytes + int64(len(token.Text)))
+	}
+
+	term := lex.TrieLexicon.InsertToken(token)
+
+	lex.charge(SPIMIPositionBytes)
+	if term.PostingList().Len() > before {
+		lex.charge(SPIMIEntryBytes)
+	}
+	return term
+}
+
+/* Merged posting lists are complete for the documents they
+ * contain, so a run can be flushed between any two of them. */
+func (lex *spimi_lexicon) MergePostingList(text string,
+	pl index.PostingList) index.LexiconTerm {
+
+	lex.checkWritable()
+	if lex.used >= lex.budget {
+		lex.flush()
+	}
+
+	if _, ok := lex.TrieLexicon.FindTerm([]byte(text)); !ok {
+		lex.charge(SPIMITermBytes + int64(len(text)))
+	}
+
+	for it := pl.Iterator(); it.Next(); {
+		lex.charge(SPIMIEntryBytes +
+			SPIMIPositionBytes*int64(it.Value().Frequency()))
+	}
+	return lex.TrieLexicon.MergePostingList(text, pl)
+}
+
+func (lex *spimi_lexicon) runPath(run int) string {
+	return filepath.Join(lex.DataDirectory, fmt.Sprintf("run_%04d", run))
+}
+
+// Write the terms in memory to disk as a sorted run
+func (lex *spimi_lexicon) flush() {
+	if lex.TrieLexicon.Len() == 0 {
+		return
+	}
+
+	path := lex.runPath(len(lex.runs))
+	log.Infof("Flushing %d terms (~%d bytes) to run %s",
+		lex.TrieLexicon.Len(), lex.used, path)
+
+	terms := lex.TrieLexicon.Walk()
+	sort.Sort(entriesByKey(terms))
+	writer := newCompiledWriter(path+".dict", path+".postings", lex.PLInit)
+	for _, entry := range terms {
+		term := entry.(index.LexiconTerm)
+		writer.Write(term.(index.TermIdentifier).Id(), term.Text(), term.PostingList())
+	}
+	writer.Close()
+
+	lex.runs = append(lex.runs, path)
+	lex.stats[SPIMIRunsWritten]++
+	lex.stats[SPIMIBytesFlushed] += lex.used
+
+	lex.TrieLexicon.Init()
+	lex.used = 0
+}
+
+/* Apply pruner to each posting list as the runs are merged,
+ * since none of the lists are complete before then. */
+func (lex *spimi_lexicon) PruneOnSave(pruner index.PostingListPruner) {
+	lex.pruner = pruner
+}
+
+// Flush whatever is in memory and merge the runs
+func (lex *spimi_lexicon) finish() {
+	if lex.merged != nil {
+		return
+	}
+	lex.flush()
+
+	lex.mergeRuns(lex.Location()+TermDictFile, lex.Location()+PostingsFile)
+
+	for _, run := range lex.runs {
+		os.Remove(run + ".dict")
+		os.Remove(run + ".postings")
+	}
+	lex.runs = lex.runs[:0]
+	lex.ids = nil
+	lex.Terms = nil
+
+	var err error
+	if lex.merged, err = OpenCompiledLexicon(lex.Location()); err != nil {
+		panic(err)
+	}
+}
+
+type run_cursor struct {
+	reader *dictReader
+	term   *compiled_term
+}
+
+type run_heap []*run_cursor
+
+func (h run_heap) Len() int {
+	return len(h)
+}
+
+func (h run_heap) Less(i, j int) bool {
+	return h[i].term.text < h[j].term.text
+}
+
+func (h run_heap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *run_heap) Push(x interface{}) {
+	*h = append(*h, x.(*run_cursor))
+}
+
+func (h *run_heap) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+func (c *run_cursor) advance() bool {
+	var err error
+	if c.term, err = c.reader.Next(); err == io.EOF {
+		c.term = nil
+		return false
+	} else if err != nil {
+		panic(err)
+	}
+	return true
+}
+
+/* Merge the sorted runs into a single term dictionary and
+ * postings file, using a heap to find the next smallest term. The
+ * documents in each run are disjoint, so merging a term's posting
+ * lists just means combining their entries. */
+func (lex *spimi_lexicon) mergeRuns(dictPath, postingsPath string) {
+	var total, done, reported int64
+
+	cursors := make(run_heap, 0, len(lex.runs))
+	for _, run := range lex.runs {
+		reader, err := openCompiled(run+".dict", run+".postings")
+		if err != nil {
+			panic(err)
+		}
+		defer reader.lex.Close()
+		defer reader.Close()
+
+		total += int64(len(reader.lex.postings) - len(PostingsMagic))
+		cursor := &run_cursor{reader: reader}
+		if cursor.advance() {
+			cursors = append(cursors, cursor)
+		}
+	}
+	heap.Init(&cursors)
+
+	log.Infof("Merging %d runs with %d bytes of postings", len(lex.runs), total)
+	writer := newCompiledWriter(dictPath, postingsPath, lex.PLInit)
+
+	matching := make([]*run_cursor, 0, len(lex.runs))
+	for cursors.Len() > 0 {
+		matching = append(matching[:0], heap.Pop(&cursors).(*run_cursor))
+		text := matching[0].term.text
+		for cursors.Len() > 0 && cursors[0].term.text == text {
+			matching = append(matching, heap.Pop(&cursors).(*run_cursor))
+		}
+
+		if len(matching) == 1 && lex.pruner == nil {
+			// Nothing to combine, so copy the encoded list
+			term := matching[0].term
+			writer.writeRaw(term.id, text,
+				term.lex.postings[term.offset:term.offset+term.length], term.df, term.cf)
+		} else {
+			pl := lex.PLInit.Create()
+			cf := 0
+			for _, cursor := range matching {
+				for it := cursor.term.PostingList().Iterator(); it.Next(); {
+					pl.InsertCompleteEntry(it.Value())
+				}
+				cf += cursor.term.cf
+			}
+
+			if lex.pruner != nil {
+				lex.pruner.Prune(&index.Term{Id_: matching[0].term.id,
+					Text_: text, Tf_: cf, Pl: pl})
+			}
+
+			if pl.Len() > 0 {
+				writer.Write(matching[0].term.id, text, pl)
+			}
+		}
+
+		for _, cursor := range matching {
+			done += int64(cursor.term.length)
+			if cursor.advance() {
+				heap.Push(&cursors, cursor)
+			}
+		}
+
+		// Report roughly every percent
+		if lex.Progress != nil && (done-reported)*100 >= total {
+			lex.Progress(done, total)
+			reported = done
+		}
+	}
+	writer.Close()
+
+	if lex.Progress != nil && reported != done {
+		lex.Progress(done, total)
+	}
+	log.Infof("Merged %d runs into %d terms", len(lex.runs), writer.terms)
+}
+
+func (lex *spimi_lexicon) SaveToDisk() {
+	lex.finish()
+}
+
+func (lex *spimi_lexicon) LoadFromDisk(dataDir string) {
+	var err error
+
+	lex.DataDirectory = dataDir
+	if lex.merged, err = OpenCompiledLexicon(lex.Location()); err != nil {
+		panic(err)
+	}
+}
+
+func (lex *spimi_lexicon) PrintDiskStats(w io.Writer) {
+	for stat, val := range lex.stats {
+		log.Debugf("# %s: %d\n", stat, val)
+	}
+}
+
+// The value of one of the SPIMI statistics
+func (lex *spimi_lexicon) Stat(stat SPIMIStat) int64 {
+	return lex.stats[stat]
+}
+
+/* Reading the lexicon returns the merged terms once the runs
+ * have been merged. Until then, Find only sees the terms in
+ * memory, which is what indexing needs. */
+func (lex *spimi_lexicon) Walk() []radix.RadixTreeEntry {
+	if lex.merged == nil && len(lex.runs) > 0 {
+		lex.finish()
+	}
+
+	if lex.merged != nil {
+		return lex.merged.Walk()
+	}
+	return lex.TrieLexicon.Walk()
+}
+
+func (lex *spimi_lexicon) Len() int {
+	if lex.merged != nil {
+		return lex.merged.Len()
+	}
+	return lex.TrieLexicon.Len()
+}
+
+func (lex *spimi_lexicon) Find(key []byte) (radix.RadixTreeEntry, bool) {
+	if lex.merged != nil {
+		return lex.merged.Find(key)
+	}
+	return lex.TrieLexicon.Find(key)
+}
+
+func (lex *spimi_lexicon) FindTerm(key []byte) (index.LexiconTerm, bool) {
+	if lex.merged != nil {
+		return lex.merged.FindTerm(key)
+	}
+	return lex.TrieLexicon.FindTerm(key)
+}
+
+func (lex *spimi_lexicon) Print(w io.Writer) {
+	index.PrintTerms(w, lex)
+}
@@ -0,0 +1,378 @@
+package indexer
+
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "sort"
+
+/* Terms are numbered by the lexicon when they're first inserted,
+ * and keep their id from then on, whatever else is added. The
+ * compiled dictionary, the posting list sets, the forward index and
+ * the wildcard index all use the same ones. */
+type TermId uint32
+
+// Terms which know their id
+type TermIdentifier interface {
+	Id() TermId
+}
+
+/* Maps term ids back to their text. A lexicon's table is shared by
+ * everything which refers to its terms by id, rather than each
+ * keeping a copy of the terms. Ids of terms which have since been
+ * dropped, by pruning say, aren't found. */
+type TermTable interface {
+	TermText(id TermId) (string, bool)
+}
+
+// What the dictionary stores about a term
+type TermInfo struct {
+	Id     TermId
+	Df, Cf int
+
+	// Where the term's posting list is in the postings file
+	Offset, Length uint64
+}
+
+// The number of terms in each front-coded dictionary block
+const DictionaryBlockSize = 16
+
+var ErrUnsortedDictionary = errors.New("Terms added to the dictionary out of order")
+
+/* A sorted term dictionary, front coded in blocks. The first term
+ * in each block is stored in full, and the rest as the length of
+ * the prefix they share with the term before them and the rest of
+ * their text. Each term is followed by its id, df, cf and posting
+ * list offset and length. Every integer is VByte encoded.
+ *
+ * Only the start of each block and the position of each term id
+ * are kept apart from the encoded data, so a lookup binary searches
+ * the first terms of the blocks and then decodes one block. */
+type TermDictionary struct {
+	data   []byte
+	blocks []int
+	count  int
+
+	// The position of the term with each id, or noPosition
+	positions []uint32
+
+	// The last term added, for front coding the next one
+	last []byte
+}
+
+func NewTermDictionary() *TermDictionary {
+	return new(TermDictionary)
+}
+
+// Ids with no term in the dictionary
+const noPosition = math.MaxUint32
+
+/* Add a term, with its id in info. Terms must be added in sorted
+ * order, but their ids can be in any. */
+func (d *TermDictionary) Add(text string, info TermInfo) error {
+	if d.count > 0 && text <= string(d.last) {
+		return ErrUnsortedDictionary
+	}
+	if d.position(info.Id) != noPosition {
+		return fmt.Errorf("Term id %d is already in the dictionary", info.Id)
+	}
+
+	if d.count%DictionaryBlockSize == 0 {
+		d.blocks = append(d.blocks, len(d.data))
+		d.data = AppendVByte(d.data, uint64(len(text)))
+		d.data = append(d.data, text...)
+	} else {
+		shared := 0
+		for shared < len(d.last) && shared < len(text) && d.last[shared] == text[shared] {
+			shared++
+		}
+		d.data = AppendVByte(d.data, uint64(shared))
+		d.data = AppendVByte(d.data, uint64(len(text)-shared))
+		d.data = append(d.data, text[shared:]...)
+	}
+
+	d.data = AppendVByte(d.data, uint64(info.Id))
+	d.data = AppendVByte(d.data, uint64(info.Df))
+	d.data = AppendVByte(d.data, uint64(info.Cf))
+	d.data = AppendVByte(d.data, info.Offset)
+	d.data = AppendVByte(d.data, info.Length)
+
+	d.setPosition(info.Id, d.count)
+	d.last = append(d.last[:0], text...)
+	d.count++
+	return nil
+}
+
+// The position of the term with id, or noPosition
+func (d *TermDictionary) position(id TermId) uint32 {
+	if int(id) < len(d.positions) {
+		return d.positions[id]
+	}
+	return noPosition
+}
+
+func (d *TermDictionary) setPosition(id TermId, position int) {
+	for len(d.positions) <= int(id) {
+		d.positions = append(d.positions, noPosition)
+	}
+	d.positions[id] = uint32(position)
+}
+
+func (d *TermDictionary) Len() int {
+	return d.count
+}
+
+// The number of bytes the encoded terms take
+func (d *TermDictionary) Size() int {
+	return len(d.data)
+}
+
+/* Decodes the terms of a dictionary in order, from a block start.
+ * n counts the terms decoded, from the start of the dictionary. */
+type dict_cursor struct {
+	dict *TermDictionary
+	pos  int
+	n    int
+	text []byte
+	info TermInfo
+}
+
+func (d *TermDictionary) cursorAt(block int) *dict_cursor {
+	return &dict_cursor{dict: d, pos: d.blocks[block], n: block * DictionaryBlockSize}
+}
+
+func (c *dict_cursor) readInt() uint64 {
+	v, n := ReadVByte(c.dict.data[c.pos:])
+	c.pos += n
+	return v
+}
+
+// Decode the next term. Returns false after the last one
+func (c *dict_cursor) next() bool {
+	if c.pos >= len(c.dict.data) {
+		return false
+	}
+
+	if c.n%DictionaryBlockSize == 0 {
+		length := int(c.readInt())
+		c.text = append(c.text[:0], c.dict.data[c.pos:c.pos+length]...)
+		c.pos += length
+	} else {
+		shared := int(c.readInt())
+		length := int(c.readInt())
+		c.text = append(c.text[:shared], c.dict.data[c.pos:c.pos+length]...)
+		c.pos += length
+	}
+
+	c.info.Id = TermId(c.readInt())
+	c.info.Df = int(c.readInt())
+	c.info.Cf = int(c.readInt())
+	c.info.Offset = c.readInt()
+	c.info.Length = c.readInt()
+	c.n++
+	return true
+}
+
+// The first term in a block
+func (d *TermDictionary) blockTerm(block int) string {
+	pos := d.blocks[block]
+	length, n := ReadVByte(d.data[pos:])
+	return string(d.data[pos+n : pos+n+int(length)])
+}
+
+// Find the id and information for text
+func (d *TermDictionary) Lookup(text string) (TermId, TermInfo, bool) {
+	block := sort.Search(len(d.blocks), func(i int) bool {
+		return d.blockTerm(i) > text
+	}) - 1
+
+	if block < 0 {
+		return 0, TermInfo{}, false
+	}
+
+	c := d.cursorAt(block)
+	for i := 0; i < DictionaryBlockSize && c.next(); i++ {
+		switch bytes.Compare(c.text, []byte(text)) {
+		case 0:
+			return c.info.Id, c.info, true
+		case 1:
+			return 0, TermInfo{}, false
+		}
+	}
+	return 0, TermInfo{}, false
+}
+
+// The text and information for the term with id
+func (d *TermDictionary) Get(id TermId) (string, TermInfo, bool) {
+	position := d.position(id)
+	if position == noPosition {
+		return "", TermInfo{}, false
+	}
+
+	c := d.cursorAt(int(position) / DictionaryBlockSize)
+	for c.n <= int(position) {
+		c.next()
+	}
+	return string(c.text), c.info, true
+}
+
+// The dictionary is the term table of the lexicon it's compiled from
+func (d *TermDictionary) TermText(id TermId) (string, bool) {
+	text, _, ok := d.Get(id)
+	return text, ok
+}
+
+// Decodes the terms of a dictionary in sorted order, one at a time
+type DictionaryIterator struct {
+	c *dict_cursor
+}
+
+func (d *TermDictionary) Iterator() *DictionaryIterator {
+	return &DictionaryIterator{&dict_cursor{dict: d}}
+}
+
+// Move to the next term. Returns false after the last one
+func (it *DictionaryIterator) Next() bool {
+	return it.c.next()
+}
+
+func (it *DictionaryIterator) Term() (TermId, string, TermInfo) {
+	return it.c.info.Id, string(it.c.text), it.c.info
+}
+
+/* Call fn for every term in order, stopping early if it returns
+ * false. */
+func (d *TermDictionary) Each(fn func(id TermId, text string, info TermInfo) bool) {
+	if len(d.blocks) == 0 {
+		return
+	}
+
+	for c := d.cursorAt(0); c.next(); {
+		if !fn(c.info.Id, string(c.text), c.info) {
+			return
+		}
+	}
+}
+
+/* Call fn for every term starting with prefix, in order, stopping
+ * early if it returns false. Only the blocks holding them are
+ * decoded. */
+func (d *TermDictionary) EachPrefix(prefix string,
+	fn func(id TermId, text string, info TermInfo) bool) {
+
+	if len(d.blocks) == 0 {
+		return
+	}
+
+	// The last block starting before prefix could hold it too
+	block := sort.Search(len(d.blocks), func(i int) bool {
+		return d.blockTerm(i) >= prefix
+	}) - 1
+	if block < 0 {
+		block = 0
+	}
+
+	for c := d.cursorAt(block); c.next(); {
+		if bytes.HasPrefix(c.text, []byte(prefix)) {
+			if !fn(c.info.Id, string(c.text), c.info) {
+				return
+			}
+		} else if string(c.text) > prefix {
+			return
+		}
+	}
+}
+
+// Write the number of terms, then the encoded terms
+func (d *TermDictionary) WriteTo(w io.Writer) (int64, error) {
+	var header []byte
+	header = AppendVByte(header, uint64(d.count))
+	header = AppendVByte(header, uint64(len(d.data)))
+
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+
+	m, err := w.Write(d.data)
+	return int64(n + m), err
+}
+
+/* Read a dictionary written by WriteTo. The block starts are found
+ * by decoding it once, which also checks that it's sorted. */
+func (d *TermDictionary) ReadFrom(r io.Reader) (int64, error) {
+	reader := &countingReader{r: r}
+	byteReader := &singleByteReader{r: reader}
+
+	count, err := ReadVByteFrom(byteReader)
+	if err != nil {
+		return reader.n, err
+	}
+	size, err := ReadVByteFrom(byteReader)
+	if err != nil {
+		return reader.n, err
+	}
+
+	d.data = make([]byte, size)
+	if _, err = io.ReadFull(reader, d.data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return reader.n, err
+	}
+
+	d.count = int(count)
+	d.blocks = make([]int, 0, (d.count+DictionaryBlockSize-1)/DictionaryBlockSize)
+	d.positions = make([]uint32, 0, d.count)
+	return reader.n, d.index()
+}
+
+/* Find the block starts and term positions in d.data, checking
+ * the terms are sorted and their ids unique */
+func (d *TermDictionary) index() (err error) {
+	defer func() {
+		// Decoding a corrupt dictionary can run off the end
+		if x := recover(); x != nil {
+			err = fmt.Errorf("Corrupt term dictionary: %v", x)
+		}
+	}()
+
+	c := &dict_cursor{dict: d}
+	var prev []byte
+
+	for i := 0; i < d.count; i++ {
+		if i%DictionaryBlockSize == 0 {
+			d.blocks = append(d.blocks, c.pos)
+		}
+		if !c.next() {
+			return fmt.Errorf("Term dictionary has %d of %d terms", i, d.count)
+		}
+		if i > 0 && bytes.Compare(prev, c.text) >= 0 {
+			return fmt.Errorf("Term dictionary isn't sorted at '%s'", c.text)
+		}
+		if d.position(c.info.Id) != noPosition {
+			return fmt.Errorf("Term dictionary repeats id %d at '%s'", c.info.Id, c.text)
+		}
+		d.setPosition(c.info.Id, i)
+		prev = append(prev[:0], c.text...)
+	}
+
+	if c.pos != len(d.data) {
+		return fmt.Errorf("Term dictionary has %d bytes after the last term",
+			len(d.data)-c.pos)
+	}
+	d.last = prev
+	return nil
+}
+
+// Reads one byte at a time, so nothing is read past the header
+type singleByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(s.r, s.buf[:])
+	return s.buf[0], err
+}
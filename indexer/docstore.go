@@ -0,0 +1,319 @@
+package indexer
+
+import "bufio"
+import "bytes"
+import "compress/flate"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "sync"
+
+/* The document store keeps the text of every document, so that
+ * results can be shown without going back to the source files.
+ * It has two files:
+ *
+ *   documents.bin  Blocks of document text, each compressed
+ *                  with DEFLATE. Documents are packed into a
+ *                  block until it holds DocumentBlockSize bytes.
+ *   documents.idx  The offset table. The file offset and length
+ *                  of every block, then for every document its
+ *                  human id, its block, and its offset and length
+ *                  in the uncompressed block.
+ *
+ * Every integer in the offset table is VByte encoded. */
+const (
+	DocumentStoreFile = "documents.bin"
+	DocumentIndexFile = "documents.idx"
+
+	DocumentBlockSize = 64 << 10
+)
+
+var (
+	DocumentStoreMagic = []byte("IRTEXT\x01\n")
+	DocumentIndexMagic = []byte("IRTIDX\x01\n")
+
+	ErrNotDocumentStore = errors.New("Not a document store")
+	ErrNoDocumentStore  = errors.New("Index has no document store")
+)
+
+type stored_block struct {
+	offset int64
+	length int
+}
+
+type stored_document struct {
+	block  int
+	offset int
+	length int
+}
+
+// Writes documents to a document store as they're indexed
+type DocumentStoreWriter struct {
+	file   *os.File
+	index  string
+	offset int64
+
+	blocks    []stored_block
+	documents []string
+	locations []stored_document
+
+	block      *bytes.Buffer
+	compressed *bytes.Buffer
+	deflater   *flate.Writer
+
+	lock *sync.Mutex
+}
+
+/* Start a document store in location. The offset table isn't
+ * written until the writer is closed. */
+func NewDocumentStoreWriter(location string) (*DocumentStoreWriter, error) {
+	var err error
+
+	w := new(DocumentStoreWriter)
+	w.index = location + DocumentIndexFile
+	w.block = new(bytes.Buffer)
+	w.compressed = new(bytes.Buffer)
+	w.lock = new(sync.Mutex)
+
+	if w.deflater, err = flate.NewWriter(w.compressed, flate.DefaultCompression); err != nil {
+		return nil, err
+	}
+
+	if w.file, err = os.Create(location + DocumentStoreFile); err != nil {
+		return nil, err
+	}
+
+	if _, err = w.file.Write(DocumentStoreMagic); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	w.offset = int64(len(DocumentStoreMagic))
+
+	return w, nil
+}
+
+// Add the text of the document with humanId to the store
+func (w *DocumentStoreWriter) Add(humanId, text string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.documents = append(w.documents, humanId)
+	w.locations = append(w.locations,
+		stored_document{len(w.blocks), w.block.Len(), len(text)})
+	w.block.WriteString(text)
+
+	if w.block.Len() >= DocumentBlockSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// Compress the current block and write it out
+func (w *DocumentStoreWriter) flush() error {
+	if w.block.Len() == 0 {
+		return nil
+	}
+
+	w.compressed.Reset()
+	w.deflater.Reset(w.compressed)
+	w.deflater.Write(w.block.Bytes())
+	if err := w.deflater.Close(); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Write(w.compressed.Bytes()); err != nil {
+		return err
+	}
+
+	w.blocks = append(w.blocks, stored_block{w.offset, w.compressed.Len()})
+	w.offset += int64(w.compressed.Len())
+	w.block.Reset()
+	return nil
+}
+
+// The number of documents added so far
+func (w *DocumentStoreWriter) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.documents)
+}
+
+// Write the last block and the offset table
+func (w *DocumentStoreWriter) Close() error {
+	var buf []byte
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(w.index)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writer.Write(DocumentIndexMagic)
+
+	buf = AppendVByte(buf, uint64(len(w.blocks)))
+	for _, block := range w.blocks {
+		buf = AppendVByte(buf, uint64(block.offset))
+		buf = AppendVByte(buf, uint64(block.length))
+	}
+
+	buf = AppendVByte(buf, uint64(len(w.documents)))
+	writer.Write(buf)
+
+	for i, humanId := range w.documents {
+		location := w.locations[i]
+
+		buf = AppendVByte(buf[:0], uint64(len(humanId)))
+		buf = append(buf, humanId...)
+		buf = AppendVByte(buf, uint64(location.block))
+		buf = AppendVByte(buf, uint64(location.offset))
+		buf = AppendVByte(buf, uint64(location.length))
+
+		if _, err = writer.Write(buf); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+/* Reads documents from a document store. Blocks are read and
+ * decompressed when they're asked for, and the last one read is
+ * kept, since documents are usually fetched for a page of results
+ * that were indexed together. */
+type DocumentStore struct {
+	file *os.File
+
+	blocks    []stored_block
+	documents map[string]stored_document
+
+	cachedId    int
+	cachedBlock []byte
+	lock        *sync.Mutex
+}
+
+// Open the document store in location
+func OpenDocumentStore(location string) (*DocumentStore, error) {
+	var err error
+
+	s := new(DocumentStore)
+	s.cachedId = -1
+	s.lock = new(sync.Mutex)
+
+	index, err := os.Open(location + DocumentIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	if err = s.readIndex(bufio.NewReader(index)); err != nil {
+		return nil, err
+	}
+
+	if s.file, err = os.Open(location + DocumentStoreFile); err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(DocumentStoreMagic))
+	if _, err = io.ReadFull(s.file, magic); err != nil ||
+		!bytes.Equal(magic, DocumentStoreMagic) {
+		s.file.Close()
+		return nil, ErrNotDocumentStore
+	}
+
+	return s, nil
+}
+
+func (s *DocumentStore) readIndex(reader *bufio.Reader) error {
+	var err error
+
+	magic := make([]byte, len(DocumentIndexMagic))
+	if _, err = io.ReadFull(reader, magic); err != nil ||
+		!bytes.Equal(magic, DocumentIndexMagic) {
+		return ErrNotDocumentStore
+	}
+
+	readInt := func() int {
+		var v uint64
+		if err == nil {
+			v, err = ReadVByteFrom(reader)
+		}
+		return int(v)
+	}
+
+	s.blocks = make([]stored_block, readInt())
+	for i := range s.blocks {
+		s.blocks[i].offset = int64(readInt())
+		s.blocks[i].length = readInt()
+	}
+
+	count := readInt()
+	s.documents = make(map[string]stored_document, count)
+	for i := 0; i < count && err == nil; i++ {
+		humanId := make([]byte, readInt())
+		if err == nil {
+			_, err = io.ReadFull(reader, humanId)
+		}
+		s.documents[string(humanId)] = stored_document{readInt(), readInt(), readInt()}
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// The number of documents in the store
+func (s *DocumentStore) Len() int {
+	return len(s.documents)
+}
+
+// Return the text of the document with humanId
+func (s *DocumentStore) Get(humanId string) (string, error) {
+	location, ok := s.documents[humanId]
+	if !ok {
+		return "", fmt.Errorf("No stored document '%s'", humanId)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.cachedId != location.block {
+		block := s.blocks[location.block]
+		compressed := make([]byte, block.length)
+		if _, err := s.file.ReadAt(compressed, block.offset); err != nil {
+			return "", err
+		}
+
+		inflater := flate.NewReader(bytes.NewReader(compressed))
+		text, err := ioutil.ReadAll(inflater)
+		inflater.Close()
+		if err != nil {
+			return "", err
+		}
+
+		s.cachedId = location.block
+		s.cachedBlock = text
+	}
+
+	if location.offset+location.length > len(s.cachedBlock) {
+		return "", fmt.Errorf("Stored document '%s' runs past the end of block %d",
+			humanId, location.block)
+	}
+	return string(s.cachedBlock[location.offset : location.offset+location.length]), nil
+}
+
+func (s *DocumentStore) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,185 @@
+package indexer
+
+import "math"
+import "sort"
+import log "github.com/cihub/seelog"
+import "github.com/cwacek/irengine/scanner/filereader"
+
+/* Pruners which need to see every posting list before they prune
+ * any of them, like those deciding what to keep per document. */
+type TwoPassPruner interface {
+	PostingListPruner
+
+	// Called for every term before any of them are pruned
+	Observe(term LexiconTerm)
+}
+
+/* Give pruner its first pass over lexicon, if it needs one. The
+ * lexicon's posting lists are only read, so this works with
+ * lexicons which swap them to disk. */
+func PreparePruner(pruner PostingListPruner, lexicon Lexicon) {
+	if !needsObserving(pruner) {
+		return
+	}
+	twoPass := unwrapPruner(pruner).(TwoPassPruner)
+
+	log.Info("Scoring postings before pruning")
+	for _, entry := range lexicon.Walk() {
+		twoPass.Observe(entry.(LexiconTerm))
+	}
+}
+
+func needsObserving(pruner PostingListPruner) bool {
+	_, ok := unwrapPruner(pruner).(TwoPassPruner)
+	return ok
+}
+
+// The pruner doing the work, when pruner wraps another
+func unwrapPruner(pruner PostingListPruner) PostingListPruner {
+	if reporting, ok := pruner.(*ReportingPruner); ok {
+		return reporting.Pruner
+	}
+	return pruner
+}
+
+type tf_idf_scorer struct {
+	index *SingleTermIndex
+}
+
+/* Score postings with their term's weight in the document vector,
+ * (1 + log tf) * idf, as Finalize does for the document norms. */
+func NewTfIdfScorer(index *SingleTermIndex) PostingScorer {
+	return &tf_idf_scorer{index}
+}
+
+func (s *tf_idf_scorer) Score(term LexiconTerm, entry PostingListEntry) float64 {
+	return (1 + math.Log(float64(entry.Frequency()))) * s.index.Stats().Idf(term)
+}
+
+type kl_scorer struct {
+	index *SingleTermIndex
+}
+
+/* Score postings with their term's contribution to the KL
+ * divergence of the document's language model from the
+ * collection's, P(t|D) log(P(t|D) / P(t|C)), as in Büttcher and
+ * Clarke, "A Document-Centric Approach to Static Index Pruning"
+ * (CIKM 2006). */
+func NewKLScorer(index *SingleTermIndex) PostingScorer {
+	return &kl_scorer{index}
+}
+
+func (s *kl_scorer) Score(term LexiconTerm, entry PostingListEntry) float64 {
+	info := s.index.DocInfo(entry.DocId())
+	background := s.index.Stats().Prob(term)
+	if info == nil || info.TermCount == 0 || background == 0 {
+		return 0
+	}
+
+	prob := float64(entry.Frequency()) / float64(info.TermCount)
+	return prob * math.Log(prob/background)
+}
+
+/* Keeps the Percent of each document's terms which score best, and
+ * removes its postings for the rest. Each document keeps at least
+ * one term, though terms may lose all of their postings.
+ *
+ * The first pass scores every posting, keeping just the scores
+ * for each document, and the cutoff score for each document is
+ * worked out when the first term is pruned. Terms tied at the
+ * cutoff are kept in the order they're pruned, which is the order
+ * they were observed in, so documents keep exactly their share.
+ * Postings in documents that weren't observed are kept. */
+type DocumentPruner struct {
+	Scorer  PostingScorer
+	Percent float64
+
+	scores  map[filereader.DocumentId][]float32
+	cutoffs map[filereader.DocumentId]*document_cutoff
+}
+
+type document_cutoff struct {
+	score float32
+
+	// How many more terms scoring exactly score to keep
+	ties int
+}
+
+func NewDocumentPruner(scorer PostingScorer, percent float64) *DocumentPruner {
+	return &DocumentPruner{
+		Scorer:  scorer,
+		Percent: percent,
+		scores:  make(map[filereader.DocumentId][]float32),
+	}
+}
+
+func (p *DocumentPruner) Observe(term LexiconTerm) {
+	for it := term.PostingList().Iterator(); it.Next(); {
+		id := it.Value().DocId()
+		p.scores[id] = append(p.scores[id], float32(p.Scorer.Score(term, it.Value())))
+	}
+}
+
+func (p *DocumentPruner) Prune(term LexiconTerm) {
+	if p.cutoffs == nil {
+		p.findCutoffs()
+	}
+
+	pl := term.PostingList()
+	remove := make([]filereader.DocumentId, 0)
+	for it := pl.Iterator(); it.Next(); {
+		cutoff, ok := p.cutoffs[it.Value().DocId()]
+		if !ok {
+			continue
+		}
+
+		switch score := float32(p.Scorer.Score(term, it.Value())); {
+		case score > cutoff.score:
+		case score == cutoff.score && cutoff.ties > 0:
+			cutoff.ties--
+		default:
+			remove = append(remove, it.Value().DocId())
+		}
+	}
+
+	log.Debugf("Pruning %d of %d postings for '%s'", len(remove), pl.Len(), term.Text())
+	pl.Remove(remove...)
+}
+
+// The lowest score each document keeps a term with
+func (p *DocumentPruner) findCutoffs() {
+	p.cutoffs = make(map[filereader.DocumentId]*document_cutoff, len(p.scores))
+
+	for id, scores := range p.scores {
+		keep := int(math.Ceil(float64(len(scores)) * p.Percent / 100))
+		if keep < 1 {
+			keep = 1
+		} else if keep > len(scores) {
+			keep = len(scores)
+		}
+
+		sort.Sort(sort.Reverse(float32s(scores)))
+		cutoff := &document_cutoff{score: scores[keep-1]}
+		for i := keep - 1; i >= 0 && scores[i] == cutoff.score; i-- {
+			cutoff.ties++
+		}
+		p.cutoffs[id] = cutoff
+	}
+
+	log.Infof("Found pruning cutoffs for %d documents", len(p.cutoffs))
+	p.scores = nil
+}
+
+type float32s []float32
+
+func (s float32s) Len() int {
+	return len(s)
+}
+
+func (s float32s) Less(i, j int) bool {
+	return s[i] < s[j]
+}
+
+func (s float32s) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
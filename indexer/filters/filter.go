@@ -40,6 +40,26 @@ func Instantiate(filterName string) Filter {
 	}
 }
 
+// Build a fresh filter chain from a list of filter ids, such as
+// the one returned by Filter.Ids(). Returns the bottom of the chain,
+// or nil if ids is empty.
+func InstantiateChain(ids []string) (chain Filter, e error) {
+	var generator FilterFactory
+
+	for _, id := range ids {
+		if generator, e = GetFactory(id); e != nil {
+			return nil, e
+		}
+
+		if chain == nil {
+			chain = generator.Instantiate()
+		} else {
+			chain = chain.Connect(generator.Instantiate(), false)
+		}
+	}
+	return chain, nil
+}
+
 func init() {
 	if logger, err := log.LoggerFromConfigAsBytes(
 		[]byte(`<seelog minlevel="info"></seelog>`)); err == nil {
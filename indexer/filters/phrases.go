@@ -56,6 +56,7 @@ const (
 	DiffPhraseId TerminateReason = iota
 	StopWord
 	MaxLen
+	DiffSentence
 )
 
 type PhraseFilter struct {
@@ -104,6 +105,9 @@ func (f *PhraseFilter) endsPhrase(phrase []*filereader.Token,
 	case len(phrase) == 0:
 		return NonTerminal
 
+	case phrase[0].Sentence != token.Sentence:
+		return DiffSentence
+
 	case phrase[0].PhraseId != token.PhraseId:
 		return DiffPhraseId
 
@@ -156,8 +160,8 @@ func (f *PhraseFilter) NotifyDocComplete() {
 			start_idx = i + 1
 			end_idx = start_idx
 
-		case DiffPhraseId:
-			log.Tracef("Found new phraseid %s", token.Text)
+		case DiffSentence, DiffPhraseId:
+			log.Tracef("Found new phrase or sentence at %s", token.Text)
 			phrase = makePhrase(phrase_terms, position_counter)
 			if phrase != nil {
 				f.Send(phrase)
@@ -212,6 +216,8 @@ func makePhrase(tokens []*filereader.Token, position int) *filereader.Token {
 	phrase := filereader.NewToken(buf.String(),
 		filereader.TextToken)
 	phrase.DocId = tokens[0].DocId
+	phrase.Sentence = tokens[0].Sentence
+	phrase.Paragraph = tokens[0].Paragraph
 	phrase.Final = true
 	phrase.Position = position
 
@@ -0,0 +1,513 @@
+package indexer
+
+import "github.com/cwacek/irengine/scanner/filereader"
+import "bufio"
+import "bytes"
+import "container/heap"
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "sort"
+
+const ForwardIndexFile = "forward.idx"
+
+var (
+	ForwardIndexMagic = []byte("IRFWD\x01\n")
+
+	ErrNotForwardIndex = errors.New("Not a forward index")
+)
+
+// A term in a document vector
+type DocumentTerm struct {
+	Id        TermId
+	Text      string
+	Tf        int
+	Positions []int
+}
+
+/* A forward index maps each document to the terms it contains,
+ * which is what relevance feedback and snippets need. Terms are
+ * identified by their TermId, and their text is found in the
+ * lexicon's term table. Each document's vector is kept VByte
+ * encoded: the number of terms, then for each term the gap from
+ * the previous term id and its tf, followed by its gap encoded
+ * positions if the index is positional. */
+type ForwardIndex struct {
+	Positional bool
+
+	terms TermTable
+	docs  map[filereader.DocumentId][]byte
+}
+
+func NewForwardIndex() *ForwardIndex {
+	return &ForwardIndex{docs: make(map[filereader.DocumentId][]byte)}
+}
+
+type termsByText []LexiconTerm
+
+func (t termsByText) Len() int {
+	return len(t)
+}
+
+func (t termsByText) Less(i, j int) bool {
+	return t[i].Text() < t[j].Text()
+}
+
+func (t termsByText) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// Every term in lexicon, in sorted order
+func sortedTerms(lexicon Lexicon) []LexiconTerm {
+	terms := make(termsByText, 0, lexicon.Len())
+	for _, entry := range lexicon.Walk() {
+		terms = append(terms, entry.(LexiconTerm))
+	}
+	sort.Sort(terms)
+	return terms
+}
+
+/* Build holds at most this many postings in memory at once.
+ * Beyond that, they're sorted by document and spilled to runs on
+ * disk, which are merged into the vectors at the end. */
+var ForwardRunPostings = 1 << 18
+
+// A posting of a term in a document, while the vectors are built
+type forward_posting struct {
+	doc  filereader.DocumentId
+	term DocumentTerm
+}
+
+type postingsByDoc []forward_posting
+
+func (p postingsByDoc) Len() int {
+	return len(p)
+}
+
+func (p postingsByDoc) Less(i, j int) bool {
+	return p[i].doc < p[j].doc
+}
+
+func (p postingsByDoc) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+/* Rebuild the forward index from the posting lists in lexicon,
+ * whose text is in terms. Runs are sorted by document, and each
+ * document's postings are put in term id order when its vector is
+ * encoded. */
+func (f *ForwardIndex) Build(lexicon Lexicon, terms TermTable) error {
+	var (
+		pl_entry  PostingListEntry
+		positions []int
+		runs      forward_runs
+		dir       string
+		err       error
+	)
+
+	f.terms = terms
+	f.Positional = lexicon.IsPositional()
+	f.docs = make(map[filereader.DocumentId][]byte)
+
+	defer func() {
+		for _, run := range runs {
+			run.file.Close()
+		}
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	postings := make([]forward_posting, 0)
+	for i, term := range sortedTerms(lexicon) {
+		id := lexiconTermId(term, i)
+
+		for it := term.PostingList().Iterator(); it.Next(); {
+			pl_entry = it.Value()
+			positions = nil
+			if f.Positional {
+				positions = pl_entry.Positions()
+			}
+
+			postings = append(postings, forward_posting{pl_entry.DocId(),
+				DocumentTerm{id, "", pl_entry.Frequency(), positions}})
+
+			if len(postings) < ForwardRunPostings {
+				continue
+			}
+			if dir == "" {
+				if dir, err = ioutil.TempDir("", "forward"); err != nil {
+					return err
+				}
+			}
+			if err = runs.spill(dir, postings, f.Positional); err != nil {
+				return err
+			}
+			postings = postings[:0]
+		}
+	}
+
+	if len(runs) == 0 {
+		sort.Sort(postingsByDoc(postings))
+		f.addSorted(func() (forward_posting, bool) {
+			if len(postings) == 0 {
+				return forward_posting{}, false
+			}
+			posting := postings[0]
+			postings = postings[1:]
+			return posting, true
+		})
+		return nil
+	}
+
+	if err = runs.spill(dir, postings, f.Positional); err != nil {
+		return err
+	}
+	postings = nil
+	return runs.merge(f)
+}
+
+type vectorById []DocumentTerm
+
+func (v vectorById) Len() int {
+	return len(v)
+}
+
+func (v vectorById) Less(i, j int) bool {
+	return v[i].Id < v[j].Id
+}
+
+func (v vectorById) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+}
+
+// Encode the vectors of postings read in document order from next
+func (f *ForwardIndex) addSorted(next func() (forward_posting, bool)) {
+	var (
+		vector []DocumentTerm
+		buf    []byte
+	)
+
+	posting, ok := next()
+	for ok {
+		doc := posting.doc
+		vector = vector[:0]
+		for ok && posting.doc == doc {
+			vector = append(vector, posting.term)
+			posting, ok = next()
+		}
+		sort.Sort(vectorById(vector))
+
+		buf = f.encode(buf[:0], vector)
+		f.docs[doc] = append([]byte(nil), buf...)
+	}
+}
+
+// A run of postings spilled to disk in document order
+type forward_run struct {
+	file       *os.File
+	reader     *bufio.Reader
+	positional bool
+	order      int
+	head       forward_posting
+}
+
+// Read the next posting into head, returning io.EOF after the last
+func (r *forward_run) next() error {
+	var err error
+	readInt := func() int {
+		var v uint64
+		if err == nil {
+			v, err = ReadVByteFrom(r.reader)
+		}
+		return int(v)
+	}
+
+	r.head.doc = filereader.DocumentId(readInt())
+	if err != nil {
+		return err
+	}
+	r.head.term = DocumentTerm{Id: TermId(readInt()), Tf: readInt()}
+	if r.positional {
+		r.head.term.Positions = make([]int, readInt())
+		pos := 0
+		for i := range r.head.term.Positions {
+			pos += readInt()
+			r.head.term.Positions[i] = pos
+		}
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// The runs being merged, ordered by their next posting
+type forward_runs []*forward_run
+
+func (r forward_runs) Len() int {
+	return len(r)
+}
+
+func (r forward_runs) Less(i, j int) bool {
+	if r[i].head.doc != r[j].head.doc {
+		return r[i].head.doc < r[j].head.doc
+	}
+	return r[i].order < r[j].order
+}
+
+func (r forward_runs) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+func (r *forward_runs) Push(x interface{}) {
+	*r = append(*r, x.(*forward_run))
+}
+
+func (r *forward_runs) Pop() interface{} {
+	old := *r
+	run := old[len(old)-1]
+	*r = old[:len(old)-1]
+	return run
+}
+
+// Sort postings by document and write them to a new run in dir
+func (r *forward_runs) spill(dir string, postings []forward_posting,
+	positional bool) error {
+
+	var buf []byte
+
+	file, err := ioutil.TempFile(dir, "run")
+	if err != nil {
+		return err
+	}
+	run := &forward_run{file: file, positional: positional, order: len(*r)}
+	*r = append(*r, run)
+
+	sort.Sort(postingsByDoc(postings))
+	writer := bufio.NewWriter(file)
+	for _, posting := range postings {
+		buf = AppendVByte(buf[:0], uint64(posting.doc))
+		buf = AppendVByte(buf, uint64(posting.term.Id))
+		buf = AppendVByte(buf, uint64(posting.term.Tf))
+		if positional {
+			buf = AppendVByte(buf, uint64(len(posting.term.Positions)))
+			prev := 0
+			for _, pos := range posting.term.Positions {
+				buf = AppendVByte(buf, uint64(pos-prev))
+				prev = pos
+			}
+		}
+		writer.Write(buf)
+	}
+
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if _, err = file.Seek(0, 0); err != nil {
+		return err
+	}
+	run.reader = bufio.NewReader(file)
+	return nil
+}
+
+// Merge every run into f's vectors
+func (r forward_runs) merge(f *ForwardIndex) error {
+	var err error
+
+	merging := make(forward_runs, 0, len(r))
+	for _, run := range r {
+		if err = run.next(); err == nil {
+			merging = append(merging, run)
+		} else if err != io.EOF {
+			return err
+		}
+	}
+	heap.Init(&merging)
+	err = nil
+
+	f.addSorted(func() (forward_posting, bool) {
+		if len(merging) == 0 || err != nil {
+			return forward_posting{}, false
+		}
+
+		run := merging[0]
+		posting := run.head
+		if e := run.next(); e == nil {
+			heap.Fix(&merging, 0)
+		} else {
+			if e != io.EOF {
+				err = e
+			}
+			heap.Pop(&merging)
+		}
+		return posting, true
+	})
+	return err
+}
+
+func (f *ForwardIndex) encode(buf []byte, vector []DocumentTerm) []byte {
+	buf = AppendVByte(buf, uint64(len(vector)))
+
+	last := TermId(0)
+	for _, term := range vector {
+		buf = AppendVByte(buf, uint64(term.Id-last))
+		buf = AppendVByte(buf, uint64(term.Tf))
+		last = term.Id
+
+		if f.Positional {
+			buf = AppendVByte(buf, uint64(len(term.Positions)))
+			prev := 0
+			for _, pos := range term.Positions {
+				buf = AppendVByte(buf, uint64(pos-prev))
+				prev = pos
+			}
+		}
+	}
+	return buf
+}
+
+// Use terms to find the text of the terms in a forward index read from disk
+func (f *ForwardIndex) SetTermTable(terms TermTable) {
+	f.terms = terms
+}
+
+// The number of documents with a vector
+func (f *ForwardIndex) Len() int {
+	return len(f.docs)
+}
+
+// Decode the vector for document id
+func (f *ForwardIndex) Vector(id filereader.DocumentId) ([]DocumentTerm, bool) {
+	buf, ok := f.docs[id]
+	if !ok {
+		return nil, false
+	}
+
+	next := func() int {
+		v, n := ReadVByte(buf)
+		buf = buf[n:]
+		return int(v)
+	}
+
+	vector := make([]DocumentTerm, next())
+	termId := TermId(0)
+	for i := range vector {
+		termId += TermId(next())
+		vector[i].Id = termId
+		vector[i].Text, _ = f.terms.TermText(termId)
+		vector[i].Tf = next()
+
+		if f.Positional {
+			vector[i].Positions = make([]int, next())
+			pos := 0
+			for j := range vector[i].Positions {
+				pos += next()
+				vector[i].Positions[j] = pos
+			}
+		}
+	}
+	return vector, true
+}
+
+/* Write the forward index. After the magic comes a flag byte
+ * for positions, then every document's id and encoded vector in
+ * DocumentId order. The terms' text is saved with the lexicon's
+ * term table. */
+func (f *ForwardIndex) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+
+	writer := bufio.NewWriter(w)
+	buf = append(buf, ForwardIndexMagic...)
+	if f.Positional {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
+	ids := make([]int, 0, len(f.docs))
+	for id := range f.docs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	buf = AppendVByte(buf, uint64(len(ids)))
+	written, err := writer.Write(buf)
+	total := int64(written)
+
+	for _, id := range ids {
+		if err != nil {
+			return total, err
+		}
+		vector := f.docs[filereader.DocumentId(id)]
+
+		buf = AppendVByte(buf[:0], uint64(id))
+		buf = AppendVByte(buf, uint64(len(vector)))
+		buf = append(buf, vector...)
+
+		written, err = writer.Write(buf)
+		total += int64(written)
+	}
+
+	if err != nil {
+		return total, err
+	}
+	return total, writer.Flush()
+}
+
+/* Read a forward index written by WriteTo, replacing f's contents.
+ * Its vectors have no text until it's given the lexicon's term
+ * table. */
+func (f *ForwardIndex) ReadFrom(r io.Reader) (int64, error) {
+	var err error
+
+	counter := &countingReader{r: r}
+	reader := bufio.NewReader(counter)
+
+	magic := make([]byte, len(ForwardIndexMagic)+1)
+	if _, err = io.ReadFull(reader, magic); err != nil ||
+		!bytes.Equal(magic[:len(ForwardIndexMagic)], ForwardIndexMagic) {
+		return counter.n, ErrNotForwardIndex
+	}
+	f.Positional = magic[len(ForwardIndexMagic)] == 1
+
+	readInt := func() uint64 {
+		var v uint64
+		if err == nil {
+			v, err = ReadVByteFrom(reader)
+		}
+		return v
+	}
+	readBytes := func() []byte {
+		buf := make([]byte, readInt())
+		if err == nil {
+			_, err = io.ReadFull(reader, buf)
+		}
+		return buf
+	}
+
+	count := readInt()
+	f.docs = make(map[filereader.DocumentId][]byte, count)
+	for i := uint64(0); i < count && err == nil; i++ {
+		id := filereader.DocumentId(readInt())
+		f.docs[id] = readBytes()
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return counter.n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,147 @@
+package indexer
+
+import "sort"
+import "strconv"
+import "strings"
+
+/* Fuzzy lookups find the terms within a small edit distance of
+ * some text. The sorted terms of the wildcard index are walked
+ * as if they were a trie: the rows of the Levenshtein table are
+ * shared by terms with a common prefix, and once every entry in a
+ * row is over the distance no term with that prefix can match,
+ * so they're all skipped. */
+const MaxFuzzyDistance = 2
+
+// A term within some edit distance of the text looked up
+type FuzzyMatch struct {
+	Text     string
+	Distance int
+	Df       int
+}
+
+/* Split a fuzzy query term like 'term~1' into the term and the
+ * distance. A bare '~' means a distance of one. */
+func ParseFuzzy(text string) (term string, distance int, ok bool) {
+	i := strings.LastIndex(text, "~")
+	if i <= 0 {
+		return text, 0, false
+	}
+
+	if text[i+1:] == "" {
+		return text[:i], 1, true
+	}
+
+	distance, err := strconv.Atoi(text[i+1:])
+	if err != nil || distance < 0 {
+		return text, 0, false
+	}
+
+	if distance > MaxFuzzyDistance {
+		distance = MaxFuzzyDistance
+	}
+	return text[:i], distance, true
+}
+
+// Whether text is a fuzzy query term
+func IsFuzzy(text string) bool {
+	_, _, ok := ParseFuzzy(text)
+	return ok
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// The terms within distance edits of text, in sorted order
+func (w *WildcardIndex) Fuzzy(text string, distance int) []FuzzyMatch {
+	var (
+		query   = []rune(text)
+		matches = make([]FuzzyMatch, 0)
+		prefix  []rune
+	)
+
+	// rows[j] is the edit distance from each prefix of the query
+	// to the first j characters of the current term
+	rows := make([][]int, 1, 16)
+	rows[0] = make([]int, len(query)+1)
+	for i := range rows[0] {
+		rows[0][i] = i
+	}
+
+	for i := 0; i < len(w.sorted); {
+		term := []rune(w.sortedText(i))
+
+		// Keep the rows for the prefix shared with the last term
+		common := 0
+		for common < len(prefix) && common < len(term) && prefix[common] == term[common] {
+			common++
+		}
+		rows = rows[:common+1]
+
+		pruned := false
+		for j := common; j < len(term); j++ {
+			last := rows[j]
+			row := make([]int, len(query)+1)
+			row[0] = last[0] + 1
+
+			for k := 1; k <= len(query); k++ {
+				cost := 1
+				if query[k-1] == term[j] {
+					cost = 0
+				}
+				row[k] = minInt(last[k]+1, row[k-1]+1, last[k-1]+cost)
+			}
+			rows = append(rows, row)
+
+			if minInt(row...) > distance {
+				// Nothing starting with term[:j+1] can match
+				stem := string(term[:j+1])
+				i += sort.Search(len(w.sorted)-i, func(k int) bool {
+					return !strings.HasPrefix(w.sortedText(i+k), stem)
+				})
+				prefix = term[:j+1]
+				pruned = true
+				break
+			}
+		}
+
+		if pruned {
+			continue
+		}
+
+		if d := rows[len(term)][len(query)]; d <= distance {
+			matches = append(matches, FuzzyMatch{string(term), d, 0})
+		}
+		prefix = term
+		i++
+	}
+	return matches
+}
+
+type fuzzyMatches []FuzzyMatch
+
+func (m fuzzyMatches) Len() int {
+	return len(m)
+}
+
+// Closest first, then the ones in the most documents
+func (m fuzzyMatches) Less(i, j int) bool {
+	switch {
+	case m[i].Distance != m[j].Distance:
+		return m[i].Distance < m[j].Distance
+	case m[i].Df != m[j].Df:
+		return m[i].Df > m[j].Df
+	default:
+		return m[i].Text < m[j].Text
+	}
+}
+
+func (m fuzzyMatches) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
@@ -3,10 +3,13 @@ package indexer
 import "bytes"
 import "bufio"
 import "math"
+import "reflect"
 import "encoding/json"
+import "sort"
 import "strings"
 import "fmt"
 import "testing"
+import "time"
 import "math/rand"
 import "github.com/cwacek/irengine/scanner/filereader"
 import "github.com/cwacek/irengine/logging"
@@ -32,6 +35,15 @@ func init() {
 	RandInts[0] = TestDocuments[0].Identifier()
 	RandInts[1] = TestDocuments[1].Identifier()
 
+	/* Documents get random ids, and postings are listed in id order,
+	 * so terms in both come out in the order the ids did */
+	since := []string{fmt.Sprintf("%d 1", RandInts[1]), fmt.Sprintf("%d 1", RandInts[0])}
+	the := []string{fmt.Sprintf("%d 12 15", RandInts[1]), fmt.Sprintf("%d 9", RandInts[0])}
+	if RandInts[0] < RandInts[1] {
+		since[0], since[1] = since[1], since[0]
+		the[0], the[1] = the[1], the[0]
+	}
+
 	basicOutput = [][]byte{
 		[]byte(fmt.Sprintf("1. 'a' [1]: %d 4", RandInts[0])),
 		[]byte(fmt.Sprintf("2. 'ball' [1]: %d 11", RandInts[0])),
@@ -51,8 +63,8 @@ func init() {
 		[]byte(fmt.Sprintf("16. 'played' [1]: %d 8", RandInts[0])),
 		[]byte(fmt.Sprintf("17. 'project' [1]: %d 17", RandInts[1])),
 		[]byte(fmt.Sprintf("18. 'silver' [1]: %d 10", RandInts[0])),
-		[]byte(fmt.Sprintf("19. 'since' [2]: %d 1 | %d 1", RandInts[1], RandInts[0])),
-		[]byte(fmt.Sprintf("20. 'the' [3]: %d 12 15 | %d 9", RandInts[1], RandInts[0])),
+		[]byte("19. 'since' [2]: " + strings.Join(since, " | ")),
+		[]byte("20. 'the' [3]: " + strings.Join(the, " | ")),
 		[]byte(fmt.Sprintf("21. 'they' [1]: %d 8", RandInts[1])),
 		[]byte(fmt.Sprintf("22. 'was' [1]: %d 3", RandInts[0])),
 		[]byte(fmt.Sprintf("23. 'work' [1]: %d 10", RandInts[1])),
@@ -113,7 +125,7 @@ func TestSingleTermIndex(t *testing.T) {
 	if term, ok := index.Retrieve("since"); !ok {
 		t.Errorf("Failed to find expected term 'since' in index")
 	} else {
-		expected := math.Log(0.5 / 2.5)
+		expected := math.Log(1 + 0.5/2.5)
 		if idf := Idf(term, index.DocumentCount); idf != expected {
 			t.Errorf("Failed to compute IDF. Expected %0.6f. Got %0.6f",
 				expected, idf)
@@ -128,7 +140,7 @@ func TestSingleTermIndex(t *testing.T) {
 	if term, ok := index.Retrieve("jets"); !ok {
 		t.Errorf("Failed to find expected term 'since' in index")
 	} else {
-		expected := math.Log(1.5 / 1.5)
+		expected := math.Log(1 + 1.5/1.5)
 		if idf := Idf(term, index.DocumentCount); idf != expected {
 			t.Errorf("Failed to compute IDF. Expected %0.6f. Got %0.6f",
 				expected, idf)
@@ -143,6 +155,111 @@ func TestSingleTermIndex(t *testing.T) {
 	index.Delete()
 }
 
+func TestParallelIndexer(t *testing.T) {
+	logging.SetupTestLogging()
+
+	var target *SingleTermIndex
+	var parallel *ParallelIndexer
+
+	target = new(SingleTermIndex)
+	target.Init(NewTrieLexicon())
+
+	filterChain := filters.NewAcronymFilter()
+	filterChain = filterChain.Connect(filters.NewHyphenFilter(), false)
+	filterChain = filterChain.Connect(filters.NewLowerCaseFilter(), false)
+	target.AddFilter(filterChain)
+
+	parallel = NewParallelIndexer(target, 2, func(worker int) Lexicon {
+		return NewTrieLexicon()
+	})
+
+	for _, document := range TestDocuments {
+		parallel.Insert(document)
+	}
+	parallel.WaitInsert()
+
+	if parallel.Len() != len(TestDocuments) {
+		t.Errorf("Expected %d documents after merge. Got %d",
+			len(TestDocuments), parallel.Len())
+	}
+
+	if len(target.DocumentMap) != len(TestDocuments) {
+		t.Errorf("Expected %d documents in merged document map. Got %d",
+			len(TestDocuments), len(target.DocumentMap))
+	}
+
+	output := new(bytes.Buffer)
+	parallel.PrintLexicon(output)
+
+	for i, expected := range basicOutput {
+		if line, err := output.ReadBytes('\n'); err != nil {
+			t.Errorf("Error reading lexicon output at line %d. Expected '%s'", i+1, expected)
+			break
+		} else if trimmed := bytes.TrimSpace(line); !bytes.Equal(trimmed, expected) {
+			t.Errorf("Mismatched lexicon output at line %d: Expected '%s'. Got '%s'",
+				i+1, expected, trimmed)
+		}
+	}
+
+	if term, ok := target.Retrieve("cdc"); !ok {
+		t.Errorf("Failed to find expected term 'cdc' in merged index")
+	} else if tf := term.Tf(); tf != 2 {
+		t.Errorf("Failed to merge TF. Expected %d. Got %d", 2, tf)
+	}
+
+	expected := CollectionStats{}
+	expected.FromDocuments(target.DocumentMap)
+	if stats := target.Stats(); stats.Documents != expected.Documents ||
+		stats.TotalTokens != expected.TotalTokens {
+
+		t.Errorf("Merged collection stats %s don't match the documents %s",
+			target.Stats(), &expected)
+	}
+
+	// Term statistics are merged too, and agree with the posting lists
+	for _, entry := range target.lexicon.Walk() {
+		term := entry.(LexiconTerm)
+		counted, ok := target.Stats().Term(term.Text())
+		if !ok || counted.Df != Df(term) || counted.Cf != term.Tf() {
+			t.Errorf("Merged stats for '%s' are %v. Expected df %d, cf %d",
+				term.Text(), counted, Df(term), term.Tf())
+		}
+	}
+}
+
+func TestMergeSeveral(t *testing.T) {
+	logging.SetupTestLogging()
+
+	target := new(SingleTermIndex)
+	target.Init(NewTrieLexicon())
+
+	texts := []string{"since a b", "since c", "since a"}
+	partials := make([]*SingleTermIndex, len(texts))
+	for i, text := range texts {
+		partials[i] = new(SingleTermIndex)
+		partials[i].Init(NewTrieLexicon())
+		partials[i].AddFilter(filters.NewLowerCaseFilter())
+		partials[i].Insert(filters.LoadTestDocument(fmt.Sprintf("M%02d", i), text))
+		partials[i].WaitInsert()
+	}
+
+	target.Merge(partials...)
+
+	for text, df := range map[string]int{"since": 3, "a": 2, "b": 1, "c": 1} {
+		if term, ok := target.Retrieve(text); !ok {
+			t.Errorf("Expected '%s' in the merged index", text)
+		} else if term.PostingList().Len() != df {
+			t.Errorf("Expected '%s' in %d documents. Got %d", text, df,
+				term.PostingList().Len())
+		}
+	}
+
+	if len(target.DocumentMap) != len(texts) {
+		t.Errorf("Expected %d merged documents. Got %d", len(texts),
+			len(target.DocumentMap))
+	}
+}
+
 func TestPostingListSerialize(t *testing.T) {
 	var index *SingleTermIndex
 	var lexicon Lexicon
@@ -215,24 +332,57 @@ func TestPostingListSerialize(t *testing.T) {
 
 }
 
+func TestDocMapBinary(t *testing.T) {
+	logging.SetupTestLogging()
+
+	docmap := make(DocInfoMap)
+	docmap[10] = &StoredDocInfo{Id: 10, HumanId: "Fred", TermCount: 64, MaxTf: 1, Norm: 2.42,
+		Sentences: []int{12, 30}, Paragraphs: []int{30}}
+	docmap[11] = &StoredDocInfo{Id: 11, HumanId: "James", TermCount: 3, MaxTf: 2}
+
+	buf := new(bytes.Buffer)
+	if err := docmap.WriteBinary(buf); err != nil {
+		t.Fatalf("Failed to write document map: %v", err)
+	}
+
+	loaded := make(DocInfoMap)
+	if err := loaded.ReadBinary(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to read document map: %v", err)
+	}
+
+	for id, expected := range docmap {
+		info, ok := loaded[id]
+		switch {
+		case !ok:
+			t.Errorf("Document %d is missing", id)
+		case !reflect.DeepEqual(info, expected):
+			t.Errorf("Document %d read as %#v. Expected %#v", id, info, expected)
+		}
+	}
+
+	truncated := buf.Bytes()[:buf.Len()-3]
+	if err := make(DocInfoMap).ReadBinary(bytes.NewReader(truncated)); err == nil {
+		t.Errorf("Expected error reading truncated document map")
+	}
+}
+
 func TestDocMapSerialize(t *testing.T) {
 	logging.SetupTestLogging()
 
 	var info1 = &StoredDocInfo{
-		filereader.DocumentId(10),
-		"Fred",
-		64,
-		1,
-		map[string]float64{"test": 2.42},
+		Id:        filereader.DocumentId(10),
+		HumanId:   "Fred",
+		TermCount: 64,
+		MaxTf:     1,
+		Norm:      2.42,
 	}
-	var expected1 = `{"Id":10,"HumanId":"Fred","TermCount":64,"MaxTf":1,"TermTfIdf":{"test":2.42}}`
+	var expected1 = `{"Id":10,"HumanId":"Fred","TermCount":64,"MaxTf":1,"Norm":2.42}`
 
 	var info2 = &StoredDocInfo{
-		filereader.DocumentId(11),
-		"James",
-		64,
-		1,
-		make(map[string]float64),
+		Id:        filereader.DocumentId(11),
+		HumanId:   "James",
+		TermCount: 64,
+		MaxTf:     1,
 	}
 
 	var buf = new(bytes.Buffer)
@@ -244,7 +394,7 @@ func TestDocMapSerialize(t *testing.T) {
 	var docmap = make(DocInfoMap)
 	docmap[info1.Id] = info1
 	docmap[info2.Id] = info2
-	expectedmap := fmt.Sprintf(`[%s,{"Id":11,"HumanId":"James","TermCount":64,"MaxTf":1,"TermTfIdf":{}}]`, expected1)
+	expectedmap := fmt.Sprintf(`[%s,{"Id":11,"HumanId":"James","TermCount":64,"MaxTf":1,"Norm":0}]`, expected1)
 
 	if bytes, err := json.Marshal(docmap); err != nil {
 		t.Errorf("error marshalling: %v", err)
@@ -356,3 +506,830 @@ func TestCanLoad(t *testing.T) {
 	}
 
 }
+
+func TestCollectionStats(t *testing.T) {
+	logging.SetupTestLogging()
+
+	index := new(SingleTermIndex)
+	index.Init(NewTrieLexicon())
+	index.AddFilter(filters.NewLowerCaseFilter())
+
+	for _, document := range TestDocuments {
+		index.Insert(document)
+	}
+	index.WaitInsert()
+
+	stats := index.Stats()
+	length := 0
+	for _, info := range index.DocumentMap {
+		length += info.TermCount
+	}
+
+	// The first document has 11 tokens
+	if info := index.DocumentMap[RandInts[0]]; info.TermCount != 11 {
+		t.Errorf("Expected 11 tokens in %s. Got %d", info.HumanId, info.TermCount)
+	}
+
+	if stats.Documents != 2 || stats.TotalTokens != int64(length) {
+		t.Errorf("Expected 2 documents and %d tokens. Got %s", length, stats)
+	}
+
+	if stats.AvgDocLen() != float64(length)/2 {
+		t.Errorf("Expected average length %0.2f. Got %0.2f",
+			float64(length)/2, stats.AvgDocLen())
+	}
+
+	term, _ := index.Retrieve("the")
+	if stats.Df(term) != 2 || stats.Cf(term) != 3 {
+		t.Errorf("Expected df 2 and cf 3 for 'the'. Got %d and %d",
+			stats.Df(term), stats.Cf(term))
+	}
+
+	if expected := 3 / float64(length); stats.Prob(term) != expected {
+		t.Errorf("Expected P('the') %f. Got %f", expected, stats.Prob(term))
+	}
+
+	// 'the' is in every document, but its IDF shouldn't be negative
+	if idf := stats.Idf(term); idf != math.Log(1+0.5/2.5) {
+		t.Errorf("Expected IDF %f for 'the'. Got %f", math.Log(1+0.5/2.5), idf)
+	}
+
+	// Terms made while querying count their collection frequency
+	phrase := &Term{Text_: "<phrase>", Tf_: -1, Pl: term.PostingList()}
+	if stats.Cf(phrase) != 3 {
+		t.Errorf("Expected cf 3 for a phrase term. Got %d", stats.Cf(phrase))
+	}
+
+	// Lexicon terms' frequencies are kept without their posting lists
+	if counted, ok := stats.Term("the"); !ok || counted != (TermStats{Df: 2, Cf: 3}) {
+		t.Errorf("Expected df 2 and cf 3 kept for 'the'. Got %v", counted)
+	}
+	stats.AddTerm("new york", 2)
+	stats.AddTerm("new york", 1)
+	if counted, _ := stats.Term("new york"); counted != (TermStats{Df: 2, Cf: 3}) {
+		t.Errorf("Expected df 2 and cf 3 for 'new york'. Got %v", counted)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := stats.WriteTo(buf); err != nil {
+		t.Fatalf("Failed to write stats: %v", err)
+	}
+
+	var loaded CollectionStats
+	if _, err := loaded.ReadFrom(buf); err != nil {
+		t.Errorf("Failed to read stats: %v", err)
+	} else if !reflect.DeepEqual(loaded, *stats) {
+		t.Errorf("Read stats %s, expected %s", &loaded, stats)
+	}
+
+	if _, err := loaded.ReadFrom(strings.NewReader("words 12\n")); err == nil {
+		t.Errorf("Expected an error reading an unknown statistic")
+	}
+}
+
+func TestForwardIndex(t *testing.T) {
+	logging.SetupTestLogging()
+
+	lexicon := NewTrieLexicon()
+	lexicon.SetPLInitializer(PositionalPostingListInitializer)
+
+	index := new(SingleTermIndex)
+	index.Init(lexicon)
+	index.AddFilter(filters.NewLowerCaseFilter())
+	index.EnableForwardIndex()
+
+	// Terms keep the ids they're given as more are inserted
+	index.Insert(TestDocuments[0])
+	index.WaitInsert()
+	ids := make(map[string]TermId)
+	for _, entry := range index.lexicon.Walk() {
+		text := entry.(LexiconTerm).Text()
+		ids[text], _ = index.TermId(text)
+	}
+
+	for _, document := range TestDocuments[1:] {
+		index.Insert(document)
+	}
+	index.WaitInsert()
+	index.Finalize()
+
+	for text, id := range ids {
+		if found, ok := index.TermId(text); !ok || found != id {
+			t.Errorf("'%s' had id %d, but has %d now", text, id, found)
+		}
+		if found, ok := index.TermText(id); !ok || found != text {
+			t.Errorf("Term %d is '%s', expected '%s'", id, found, text)
+		}
+	}
+
+	vector, ok := index.DocumentVector(RandInts[1])
+	if !ok {
+		t.Fatalf("No document vector for %d", RandInts[1])
+	}
+
+	// Every term in the document, with the posting list's tf and positions
+	expected := make(map[string]string)
+	for _, entry := range index.lexicon.Walk() {
+		term := entry.(LexiconTerm)
+		for it := term.PostingList().Iterator(); it.Next(); {
+			if it.Value().DocId() == RandInts[1] {
+				expected[term.Text()] = fmt.Sprint(it.Value().Frequency(),
+					it.Value().Positions())
+			}
+		}
+	}
+
+	if len(vector) != len(expected) {
+		t.Errorf("Expected %d distinct terms in %d. Got %d", len(expected),
+			RandInts[1], len(vector))
+	}
+
+	tokens := 0
+	for i, term := range vector {
+		tokens += term.Tf
+
+		if i > 0 && term.Id <= vector[i-1].Id {
+			t.Errorf("Terms out of order: %v before %v", vector[i-1], term)
+		}
+
+		if actual := fmt.Sprint(term.Tf, term.Positions); actual != expected[term.Text] {
+			t.Errorf("Expected '%s' to be %s. Got %s", term.Text,
+				expected[term.Text], actual)
+		}
+	}
+
+	if tokens != index.DocumentMap[RandInts[1]].TermCount {
+		t.Errorf("Vector has %d tokens, expected %d", tokens,
+			index.DocumentMap[RandInts[1]].TermCount)
+	}
+
+	if _, ok := index.DocumentVector(filereader.DocumentId(0)); ok {
+		t.Errorf("Expected no vector for an unknown document")
+	}
+
+	// Spilling the postings to runs on disk builds the same vectors
+	defer func(size int) { ForwardRunPostings = size }(ForwardRunPostings)
+	ForwardRunPostings = 3
+
+	spilled := NewForwardIndex()
+	if err := spilled.Build(index.lexicon, index.TermTable()); err != nil {
+		t.Fatalf("Failed to build forward index from runs: %v", err)
+	}
+	for _, id := range RandInts {
+		expected, _ := index.DocumentVector(id)
+		if actual, ok := spilled.Vector(id); !ok {
+			t.Errorf("Forward index built from runs has no vector for %d", id)
+		} else if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("Vector built from runs %v, expected %v", actual, expected)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := index.ForwardIndex().WriteTo(buf); err != nil {
+		t.Fatalf("Failed to write forward index: %v", err)
+	}
+
+	loaded := NewForwardIndex()
+	if _, err := loaded.ReadFrom(buf); err != nil {
+		t.Fatalf("Failed to read forward index: %v", err)
+	}
+	loaded.SetTermTable(index.TermTable())
+
+	for _, id := range RandInts {
+		expected, _ := index.DocumentVector(id)
+		if actual, ok := loaded.Vector(id); !ok {
+			t.Errorf("Loaded forward index has no vector for %d", id)
+		} else if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("Loaded vector %v, expected %v", actual, expected)
+		}
+	}
+
+	if _, err := NewForwardIndex().ReadFrom(strings.NewReader("IRDOCS")); err != ErrNotForwardIndex {
+		t.Errorf("Expected ErrNotForwardIndex. Got %v", err)
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	logging.SetupTestLogging()
+
+	for pattern, matches := range map[string]map[string]bool{
+		"environ*":  {"environ": true, "environment": true, "enviro": false},
+		"*ization":  {"organization": true, "ization": true, "organizations": false},
+		"c*t":       {"cat": true, "ct": true, "cats": false, "act": false},
+		"*a*a*":     {"banana": true, "aa": true, "cat": false},
+		"anything*": {"anything": true, "": false},
+	} {
+		for text, expected := range matches {
+			if MatchWildcard(pattern, text) != expected {
+				t.Errorf("Expected MatchWildcard('%s', '%s') to be %v",
+					pattern, text, expected)
+			}
+		}
+	}
+
+	index := new(SingleTermIndex)
+	index.Init(NewTrieLexicon())
+	index.AddFilter(filters.NewLowerCaseFilter())
+
+	for _, document := range TestDocuments {
+		index.Insert(document)
+	}
+	index.WaitInsert()
+	index.Finalize()
+
+	// The k-gram index has to find everything a scan would
+	for _, pattern := range []string{"s*", "*er", "*o*", "p*d", "th*y", "*", "*ce", "cdc*", "zz*"} {
+		expected := make([]string, 0)
+		for _, entry := range index.lexicon.Walk() {
+			if text := entry.(LexiconTerm).Text(); MatchWildcard(pattern, text) {
+				expected = append(expected, text)
+			}
+		}
+
+		if actual := index.WildcardIndex().Expand(pattern); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("Expected '%s' to expand to %v. Got %v", pattern, expected, actual)
+		}
+	}
+
+	// 'the' is in both documents, so it's kept over 'they'
+	if terms := index.ExpandWildcard("th*", 1); len(terms) != 1 || terms[0].Text() != "the" {
+		t.Errorf("Expected 'th*' capped at 1 to keep 'the'. Got %v", terms)
+	}
+
+	// 'since' and 'silver' are combined into one term
+	term, ok := index.Retrieve("si*")
+	if !ok {
+		t.Fatalf("Couldn't retrieve 'si*'")
+	}
+
+	if Df(term) != 2 || term.Tf() != 3 {
+		t.Errorf("Expected 'si*' to have df 2 and cf 3. Got %d and %d", Df(term), term.Tf())
+	}
+
+	if entry, ok := term.PostingList().GetEntry(RandInts[0]); !ok || entry.Frequency() != 2 {
+		t.Errorf("Expected 'si*' twice in %d. Got %v", RandInts[0], entry)
+	}
+
+	if _, ok := index.Retrieve("zz*"); ok {
+		t.Errorf("Expected nothing for 'zz*'")
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := index.WildcardIndex().WriteTo(buf); err != nil {
+		t.Fatalf("Failed to write wildcard index: %v", err)
+	}
+
+	loaded := NewWildcardIndex()
+	if _, err := loaded.ReadFrom(buf); err != nil {
+		t.Fatalf("Failed to read wildcard index: %v", err)
+	}
+	loaded.SetTermTable(index.TermTable())
+
+	for _, pattern := range []string{"*o*", "p*d", "*ce"} {
+		if actual, expected := loaded.Expand(pattern), index.WildcardIndex().Expand(pattern); fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("Loaded index expands '%s' to %v, expected %v", pattern, actual, expected)
+		}
+	}
+}
+
+// The Levenshtein distance between a and b, the slow way
+func editDistance(a, b string) int {
+	if a == "" || b == "" {
+		return len(a) + len(b)
+	}
+
+	cost := 1
+	if a[len(a)-1] == b[len(b)-1] {
+		cost = 0
+	}
+	return minInt(editDistance(a[:len(a)-1], b)+1,
+		editDistance(a, b[:len(b)-1])+1,
+		editDistance(a[:len(a)-1], b[:len(b)-1])+cost)
+}
+
+func TestFuzzy(t *testing.T) {
+	logging.SetupTestLogging()
+
+	for text, expected := range map[string][]interface{}{
+		"colour~1": {"colour", 1, true},
+		"colour~":  {"colour", 1, true},
+		"colour~5": {"colour", MaxFuzzyDistance, true},
+		"colour":   {"colour", 0, false},
+		"~1":       {"~1", 0, false},
+		"a~b":      {"a~b", 0, false},
+	} {
+		term, distance, ok := ParseFuzzy(text)
+		if fmt.Sprint(term, distance, ok) != fmt.Sprint(expected...) {
+			t.Errorf("ParseFuzzy('%s') gave %s %d %v. Expected %v", text,
+				term, distance, ok, expected)
+		}
+	}
+
+	index := new(SingleTermIndex)
+	index.Init(NewTrieLexicon())
+	index.AddFilter(filters.NewLowerCaseFilter())
+
+	for _, document := range TestDocuments {
+		index.Insert(document)
+	}
+	index.WaitInsert()
+	index.Finalize()
+
+	for _, text := range []string{"the", "silvr", "cdc", "boys", "xyz", "phd", "i", ""} {
+		for distance := 0; distance <= MaxFuzzyDistance; distance++ {
+			expected := make(map[string]int)
+			for _, entry := range index.lexicon.Walk() {
+				term := entry.(LexiconTerm).Text()
+				if d := editDistance(text, term); d <= distance {
+					expected[term] = d
+				}
+			}
+
+			matches := index.FuzzyLookup(text, distance)
+			if len(matches) != len(expected) {
+				t.Errorf("Expected %d terms within %d of '%s'. Got %v",
+					len(expected), distance, text, matches)
+			}
+
+			for i, match := range matches {
+				if d, ok := expected[match.Text]; !ok || d != match.Distance {
+					t.Errorf("'%s' is %d from '%s', not %d", match.Text, d, text, match.Distance)
+				}
+				if i > 0 && match.Distance < matches[i-1].Distance {
+					t.Errorf("Matches for '%s' aren't closest first: %v", text, matches)
+				}
+			}
+		}
+	}
+
+	// 'the' and 'they' are within one of 'thy', and 'the' is in more documents
+	if matches := index.FuzzyLookup("thy", 1); len(matches) != 2 ||
+		matches[0].Text != "the" || matches[0].Df != 2 {
+		t.Errorf("Expected 'the' then 'they' for 'thy'. Got %v", matches)
+	}
+
+	if term, ok := index.Retrieve("silvr~1"); !ok || Df(term) != 1 || term.Tf() != 1 {
+		t.Errorf("Expected 'silvr~1' to find 'silver'. Got %v", term)
+	}
+
+	if _, ok := index.Retrieve("silvr~0"); ok {
+		t.Errorf("Expected nothing for 'silvr~0'")
+	}
+}
+
+func TestTermDictionary(t *testing.T) {
+	logging.SetupTestLogging()
+
+	terms := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		terms = append(terms, fmt.Sprintf("term%03d", i*3))
+	}
+	terms = append(terms, "termination", "terms", "z")
+
+	// Ids are given by the lexicon, so they needn't follow the terms' order
+	idOf := func(i int) TermId {
+		return TermId((i * 7) % len(terms))
+	}
+
+	dict := NewTermDictionary()
+	for i, text := range terms {
+		info := TermInfo{Id: idOf(i), Df: i, Cf: 2 * i, Offset: uint64(10 * i), Length: 10}
+		if err := dict.Add(text, info); err != nil {
+			t.Fatalf("Adding '%s' gave error %v", text, err)
+		}
+	}
+
+	if err := dict.Add("aardvark", TermInfo{}); err != ErrUnsortedDictionary {
+		t.Errorf("Expected ErrUnsortedDictionary adding a term out of order. Got %v", err)
+	}
+	if err := dict.Add("zz", TermInfo{Id: idOf(3)}); err == nil {
+		t.Errorf("Expected an error adding a term with an id that's taken")
+	}
+
+	check := func(label string, dict *TermDictionary) {
+		if dict.Len() != len(terms) {
+			t.Errorf("%s: expected %d terms. Got %d", label, len(terms), dict.Len())
+		}
+
+		for i, text := range terms {
+			if id, info, ok := dict.Lookup(text); !ok || id != idOf(i) ||
+				info.Cf != 2*i || info.Offset != uint64(10*i) {
+				t.Errorf("%s: looking up '%s' gave %d %v %v", label, text, id, info, ok)
+			}
+
+			if found, info, ok := dict.Get(idOf(i)); !ok || found != text || info.Df != i {
+				t.Errorf("%s: term %d is '%s' %v, expected '%s'", label, idOf(i), found, info, text)
+			}
+		}
+
+		for _, missing := range []string{"", "a", "term001", "term", "termz", "zz"} {
+			if _, _, ok := dict.Lookup(missing); ok {
+				t.Errorf("%s: found '%s'", label, missing)
+			}
+		}
+
+		if _, _, ok := dict.Get(TermId(len(terms))); ok {
+			t.Errorf("%s: found a term past the end", label)
+		}
+
+		walked := make([]string, 0)
+		dict.Each(func(id TermId, text string, info TermInfo) bool {
+			walked = append(walked, text)
+			return true
+		})
+		if fmt.Sprint(walked) != fmt.Sprint(terms) {
+			t.Errorf("%s: walked %v", label, walked)
+		}
+
+		for _, prefix := range []string{"", "term1", "term29", "termi", "terms", "x", "zz"} {
+			expected := make([]string, 0)
+			for _, text := range terms {
+				if strings.HasPrefix(text, prefix) {
+					expected = append(expected, text)
+				}
+			}
+
+			walked = walked[:0]
+			dict.EachPrefix(prefix, func(id TermId, text string, info TermInfo) bool {
+				walked = append(walked, text)
+				return true
+			})
+			if fmt.Sprint(walked) != fmt.Sprint(expected) {
+				t.Errorf("%s: walking '%s' gave %v, expected %v", label, prefix,
+					walked, expected)
+			}
+		}
+	}
+	check("built", dict)
+
+	// Front coding should make it much smaller than the terms
+	size := 0
+	for _, text := range terms {
+		size += len(text)
+	}
+	if dict.Size() >= size+4*len(terms) {
+		t.Errorf("Dictionary takes %d bytes for %d bytes of terms", dict.Size(), size)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := dict.WriteTo(buf); err != nil {
+		t.Fatalf("Failed to write dictionary: %v", err)
+	}
+	raw := buf.Bytes()
+
+	loaded := NewTermDictionary()
+	if _, err := loaded.ReadFrom(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("Failed to read dictionary: %v", err)
+	}
+	check("loaded", loaded)
+
+	if _, err := NewTermDictionary().ReadFrom(bytes.NewReader(raw[:len(raw)-3])); err == nil {
+		t.Errorf("Expected an error reading a truncated dictionary")
+	}
+}
+
+func TestProximity(t *testing.T) {
+	logging.SetupTestLogging()
+
+	for text, expected := range map[string]string{
+		"#od:2(a b)":                 "#od:2(a b)",
+		"#uw:8( a  b c )":            "#uw:8(a b c)",
+		"a NEAR/3 b":                 "#uw:4(a b)",
+		"a NEAR/2 b NEAR/3 c":        "#uw:6(a b c)",
+		"#od:0(a b)":                 "",
+		"#od:2()":                    "",
+		"#xx:2(a b)":                 "",
+		"a NEAR b":                   "",
+		"a NEAR/2":                   "",
+		"#uw:3(a b) NEAR/2 #od:1(c)": "",
+		"#od:1/sent(a b)":            "#od:1/sent(a b)",
+		"#uw:4/para(a b)":            "#uw:4/para(a b)",
+		"#sent( a b )":               "#sent(a b)",
+		"#para(a)":                   "#para(a)",
+		"#sent()":                    "",
+		"#od:1/word(a b)":            "",
+	} {
+		p, ok := ParseProximity(text)
+		switch {
+		case ok != (expected != ""):
+			t.Errorf("Parsing '%s' returned %v", text, ok)
+		case ok && p.String() != expected:
+			t.Errorf("Parsed '%s' as '%s', expected '%s'", text, p.String(), expected)
+		}
+	}
+
+	// The positions of a, b and c in each document
+	documents := [][3][]int{
+		{{1}, {2}, {3}},
+		{{1}, {2, 3}, {5}},
+		{{1, 5}, {2, 6}, {9}},
+		{{1, 2}, {3}, {20}},
+		{{3}, {1}, {8}},
+		{{1}, {}, {2}},
+	}
+
+	pls := make([]PostingList, 3)
+	for term := range pls {
+		pls[term] = PositionalPostingListInitializer.Create()
+		for doc, positions := range documents {
+			for _, pos := range positions[term] {
+				pls[term].InsertRawEntry("t", filereader.DocumentId(doc), pos)
+			}
+		}
+	}
+
+	// Where sentences and paragraphs start in documents 0 and 2
+	bounds := func(doc filereader.DocumentId, scope filereader.Boundary) []int {
+		sentences := map[filereader.DocumentId][]int{0: {3}, 2: {5, 9}}
+		paragraphs := map[filereader.DocumentId][]int{2: {9}}
+		if scope == filereader.ParagraphBoundary {
+			return paragraphs[doc]
+		}
+		return sentences[doc]
+	}
+
+	for _, test := range []struct {
+		op      string
+		matches map[int][]int
+	}{
+		{"#od:1(a b)", map[int][]int{0: {1}, 1: {1}, 2: {1, 5}, 3: {2}}},
+		{"#od:1(a b c)", map[int][]int{0: {1}}},
+		{"#od:2(a b c)", map[int][]int{0: {1}, 1: {1}}},
+		{"#od:2(a b)", map[int][]int{0: {1}, 1: {1}, 2: {1, 5}, 3: {1}}},
+		{"#uw:3(a b)", map[int][]int{0: {1}, 1: {1}, 2: {1, 5}, 3: {2}, 4: {1}}},
+		{"#uw:2(a b)", map[int][]int{0: {1}, 1: {1}, 2: {1, 5}, 3: {2}}},
+		{"a NEAR/1 c", map[int][]int{5: {1}}},
+		{"#uw:9(a b c)", map[int][]int{0: {1}, 1: {1}, 2: {5}, 4: {1}}},
+		{"#sent(a b)", map[int][]int{0: {1}, 1: {1}, 2: {1, 5}, 3: {2}, 4: {1}}},
+		{"#sent(a c)", map[int][]int{1: {1}, 3: {2}, 4: {3}, 5: {1}}},
+		{"#para(a c)", map[int][]int{0: {1}, 1: {1}, 3: {2}, 4: {3}, 5: {1}}},
+		{"#od:2/sent(a b c)", map[int][]int{1: {1}}},
+	} {
+		p, _ := ParseProximity(test.op)
+		operands := make([]PostingList, len(p.Terms))
+		for i, term := range p.Terms {
+			operands[i] = pls[term[0]-'a']
+		}
+
+		matched, err := p.MatchWithin(bounds, operands...)
+		if err != nil {
+			t.Fatalf("Matching '%s' failed: %v", test.op, err)
+		}
+
+		if matched.Len() != len(test.matches) {
+			t.Errorf("'%s' matched %d documents, expected %d: %s",
+				test.op, matched.Len(), len(test.matches), matched)
+		}
+		for doc, starts := range test.matches {
+			entry, ok := matched.GetEntry(filereader.DocumentId(doc))
+			if !ok {
+				t.Errorf("'%s' didn't match document %d", test.op, doc)
+			} else if entry.Frequency() != len(starts) ||
+				fmt.Sprint(entry.Positions()) != fmt.Sprint(starts) {
+				t.Errorf("'%s' matched document %d at %v, expected %v",
+					test.op, doc, entry.Positions(), starts)
+			}
+		}
+	}
+
+	if _, err := OrderedWindow(1, BasicPostingListInitializer.Create(), pls[0]); err != ErrNotPositional {
+		t.Errorf("Expected an error matching a basic posting list. Got %v", err)
+	}
+	sentence, _ := ParseProximity("#sent(a b)")
+	if _, err := sentence.Match(pls[0], pls[1]); err != ErrNoBoundaries {
+		t.Errorf("Expected an error matching a sentence without boundaries. Got %v", err)
+	}
+}
+
+func TestRealtimeIndex(t *testing.T) {
+	logging.SetupTestLogging()
+
+	index := NewRealtimeIndex(func() Lexicon {
+		lexicon := NewTrieLexicon()
+		lexicon.SetPLInitializer(PositionalPostingListInitializer)
+		return lexicon
+	})
+	filterChain := filters.NewAcronymFilter()
+	filterChain = filterChain.Connect(filters.NewHyphenFilter(), false)
+	filterChain = filterChain.Connect(filters.NewLowerCaseFilter(), false)
+	index.AddFilter(filterChain)
+
+	empty := index.Snapshot()
+	index.Insert(TestDocuments[0])
+	if empty.Len() != 0 || index.Len() != 0 {
+		t.Errorf("Inserted document is searchable before a refresh")
+	}
+
+	if !index.Refresh() {
+		t.Fatalf("Refreshing after an insert published nothing")
+	}
+	first := index.Snapshot()
+	if first.Len() != 1 || !first.IsFinalized() {
+		t.Errorf("Expected a finalized snapshot with 1 document. Got %s", first)
+	}
+	if index.Refresh() {
+		t.Errorf("Refreshing without inserts published a snapshot")
+	}
+	norm := first.DocInfo(TestDocuments[0].Identifier()).Norm
+
+	index.Insert(TestDocuments[1])
+	if _, ok := index.Snapshot().Retrieve("cdc"); ok {
+		t.Errorf("Found 'cdc' before it was refreshed")
+	}
+
+	index.Refresh()
+	second := index.Snapshot()
+	if term, ok := second.Retrieve("the"); !ok || term.Tf() != 3 || Df(term) != 2 {
+		t.Errorf("Expected 'the' in 2 documents, 3 times. Got %v", term)
+	}
+	if second.Stats().Documents != 2 || second.DocInfo(TestDocuments[1].Identifier()) == nil {
+		t.Errorf("Expected 2 documents in the second snapshot. Got %s", second.Stats())
+	}
+
+	// Older snapshots don't change
+	if term, ok := first.Retrieve("the"); !ok || term.Tf() != 1 {
+		t.Errorf("First snapshot changed: 'the' is %v", term)
+	}
+	if first.DocInfo(TestDocuments[1].Identifier()) != nil {
+		t.Errorf("First snapshot has a document from the second")
+	}
+	if info := first.DocInfo(TestDocuments[0].Identifier()); info.Norm != norm {
+		t.Errorf("First snapshot's norm changed from %f to %f", norm, info.Norm)
+	}
+
+	// Readers only ever see whole documents
+	index.RefreshInterval = time.Millisecond
+	index.SegmentsPerTier = 3
+	index.Start()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			index.Insert(filters.LoadTestDocument(fmt.Sprintf("B%02d", i), "the silver ball"))
+		}
+		index.Stop()
+		close(done)
+	}()
+
+	for searching := true; searching; {
+		select {
+		case <-done:
+			searching = false
+		default:
+		}
+
+		snapshot := index.Snapshot()
+		if term, ok := snapshot.Retrieve("silver"); ok && Df(term) != snapshot.Len()-1 {
+			t.Fatalf("Snapshot of %d documents has 'silver' in %d", snapshot.Len(), Df(term))
+		}
+	}
+
+	if index.Len() != 22 {
+		t.Errorf("Expected 22 documents after stopping. Got %d", index.Len())
+	}
+
+	// Segments are merged, so there are a few per tier at most
+	snapshot := index.Snapshot()
+	if len(snapshot.segments) > 6 || !snapshot.IsFinalized() {
+		t.Errorf("Expected at most 6 finalized segments. Got %d", len(snapshot.segments))
+	}
+	if term, ok := snapshot.Retrieve("silv*"); !ok || Df(term) != 21 {
+		t.Errorf("Expected 'silv*' in 21 documents. Got %v", term)
+	}
+	if term, ok := snapshot.Retrieve("silvr~1"); !ok || Df(term) != 21 {
+		t.Errorf("Expected 'silvr~1' in 21 documents. Got %v", term)
+	}
+	if id, ok := snapshot.TermId("silver"); !ok || id != index.buffer.Lexicon().(*TrieLexicon).Terms.Number("silver") {
+		t.Errorf("Expected 'silver' to have the same id in every segment")
+	}
+}
+
+// Scores postings by their frequency
+type frequency_scorer struct{}
+
+func (s frequency_scorer) Score(term LexiconTerm, entry PostingListEntry) float64 {
+	return float64(entry.Frequency())
+}
+
+func TestPruners(t *testing.T) {
+	logging.SetupTestLogging()
+
+	// Four documents mention 'pruned' once, and the fifth ten times
+	makeTerm := func() *Term {
+		pl := BasicPostingListInitializer.Create()
+		for id := filereader.DocumentId(1); id <= 5; id++ {
+			pl.InsertRawEntry("pruned", id, 0)
+		}
+		for i := 1; i < 10; i++ {
+			pl.InsertRawEntry("pruned", 5, 0)
+		}
+		return &Term{Text_: "pruned", Tf_: 14, Pl: pl}
+	}
+
+	remaining := func(term *Term) []filereader.DocumentId {
+		ids := make([]filereader.DocumentId, 0)
+		for it := term.Pl.Iterator(); it.Next(); {
+			ids = append(ids, it.Value().DocId())
+		}
+		return ids
+	}
+
+	only5 := []filereader.DocumentId{5}
+	var tests = []struct {
+		name     string
+		pruner   PostingListPruner
+		expected []filereader.DocumentId
+	}{
+		// The mean is 2.8, and every posting below it is removed
+		{"soft 0", &TFPruner{Multiplier: 0}, only5},
+		{"soft 10", &TFPruner{Multiplier: 10}, only5},
+		{"uniform 5", NewUniformScorePruner(frequency_scorer{}, 5), only5},
+		{"uniform 100", NewUniformScorePruner(frequency_scorer{}, 100), only5},
+		{"uniform 1", NewUniformScorePruner(frequency_scorer{}, 1),
+			[]filereader.DocumentId{1, 2, 3, 4, 5}},
+		{"term 1 0.5", NewTermCentricScorePruner(frequency_scorer{}, 1, 0.5), only5},
+		{"term 2 1", NewTermCentricScorePruner(frequency_scorer{}, 2, 1),
+			[]filereader.DocumentId{1, 2, 3, 4, 5}},
+		{"term 5 1", NewTermCentricScorePruner(frequency_scorer{}, 5, 1),
+			[]filereader.DocumentId{1, 2, 3, 4, 5}},
+	}
+
+	for _, test := range tests {
+		term := makeTerm()
+		test.pruner.Prune(term)
+		if ids := remaining(term); !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%s: expected %v to remain. Got %v", test.name, test.expected, ids)
+		}
+	}
+
+	reporter := NewReportingPruner(&TFPruner{Multiplier: 0})
+	reporter.Prune(makeTerm())
+	reporter.Prune(&Term{Text_: "kept", Tf_: 1, Pl: BasicPostingListInitializer.Create()})
+
+	report := reporter.Report
+	if report.PostingsBefore != 5 || report.PostingsAfter != 1 || len(report.Terms) != 2 {
+		t.Errorf("Expected 5 postings pruned to 1 over 2 terms. Got %d to %d over %d",
+			report.PostingsBefore, report.PostingsAfter, len(report.Terms))
+	}
+	if report.BytesAfter >= report.BytesBefore {
+		t.Errorf("Expected pruning to shrink the posting lists. Went from %d to %d bytes",
+			report.BytesBefore, report.BytesAfter)
+	}
+
+	buf := new(bytes.Buffer)
+	report.Print(buf, 1)
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 ||
+		!strings.Contains(lines[2], "pruned") {
+		t.Errorf("Expected a summary and the most pruned term. Got\n%s", buf)
+	}
+}
+
+func TestDocumentPruner(t *testing.T) {
+	logging.SetupTestLogging()
+
+	/* The idfs are x 0.98, y 0.47 and z 0.13, so keeping 34% of
+	 * their terms D1 loses z, D2 loses z and D3 keeps it. */
+	index := new(SingleTermIndex)
+	index.Init(NewTrieLexicon())
+	index.AddFilter(filters.NewLowerCaseFilter())
+	for i, text := range []string{"x x x y z", "y z", "z"} {
+		index.Insert(filters.LoadTestDocument(fmt.Sprintf("D%d", i+1), text))
+	}
+	index.WaitInsert()
+
+	humanIds := func(text string) []string {
+		ids := make([]string, 0)
+		if term, ok := index.Retrieve(text); ok {
+			for it := term.PostingList().Iterator(); it.Next(); {
+				ids = append(ids, index.DocumentMap[it.Value().DocId()].HumanId)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// P(x|D1) = 3/5 and P(x|C) = 3/8
+	kl := NewKLScorer(index)
+	term, _ := index.Retrieve("x")
+	if it := term.PostingList().Iterator(); it.Next() {
+		if expected := 0.6 * math.Log(0.6*8/3); math.Abs(kl.Score(term, it.Value())-expected) > 1e-9 {
+			t.Errorf("Expected KL contribution %f for x in D1. Got %f",
+				expected, kl.Score(term, it.Value()))
+		}
+	}
+
+	reporter := NewReportingPruner(NewDocumentPruner(NewTfIdfScorer(index), 34))
+	index.Prune(reporter)
+
+	for text, expected := range map[string][]string{
+		"x": {"D1"}, "y": {"D1", "D2"}, "z": {"D3"}} {
+
+		if ids := humanIds(text); !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Expected '%s' to be kept in %v. Got %v", text, expected, ids)
+		}
+	}
+
+	if report := reporter.Report; report.PostingsBefore != 6 || report.PostingsAfter != 4 {
+		t.Errorf("Expected 6 postings pruned to 4. Got %d to %d",
+			report.PostingsBefore, report.PostingsAfter)
+	}
+}
@@ -4,6 +4,7 @@ import "github.com/cwacek/irengine/indexer/filters"
 import "github.com/cwacek/irengine/scanner/filereader"
 import "io"
 import "fmt"
+import "errors"
 import radix "github.com/cwacek/radix-go"
 
 type LexiconInitializer func(datadir string, memLimit int) PostingList
@@ -15,6 +16,30 @@ type Lexicon interface {
 	Print(io.Writer)
 	SetPLInitializer(PostingListInitializer)
 	IsPositional() bool
+
+	// Add every entry in the posting list to the term with the
+	// given text, creating the term if necessary. Used to merge
+	// lexicons that were built independently.
+	MergePostingList(text string, pl PostingList) LexiconTerm
+}
+
+/* Lexicons which can visit the terms starting with a prefix, in
+ * order, without going through the rest. Visiting stops early if
+ * visit returns false. */
+type PrefixLexicon interface {
+	WalkPrefix(prefix string, visit func(text string) bool)
+}
+
+/* Lexicons which number their terms as they're inserted, and keep
+ * the table mapping the ids back to their text. */
+type NumberedLexicon interface {
+	TermTable() TermTable
+}
+
+/* Lexicons which only have complete posting lists when they're
+ * saved prune them then, rather than in place. */
+type DeferredPruner interface {
+	PruneOnSave(pruner PostingListPruner)
 }
 
 type PersistentLexicon interface {
@@ -24,13 +49,21 @@ type PersistentLexicon interface {
 	Location() string // Obtain the on disk location
 }
 
-type TermFromTokenFunc func(*filereader.Token, PostingListInitializer) LexiconTerm
+// Create a term with the id the lexicon has given it
+type TermFromTokenFunc func(TermId, *filereader.Token, PostingListInitializer) LexiconTerm
+
+// Create an empty term, without registering any occurrences
+type TermFromTextFunc func(TermId, string, PostingListInitializer) LexiconTerm
 
 type LexiconTerm interface {
 	Text() string
 	Tf() int
 	PostingList() PostingList
 	Register(token *filereader.Token)
+
+	// Register a complete posting list entry for a document
+	// which this term does not yet contain.
+	RegisterEntry(entry PostingListEntry)
 	String() string
 }
 
@@ -52,6 +85,24 @@ type PostingListInitializer struct {
 	Positional bool
 }
 
+var plInitializers map[string]PostingListInitializer
+
+func RegisterPostingListInitializer(init PostingListInitializer) {
+	if plInitializers == nil {
+		plInitializers = make(map[string]PostingListInitializer)
+	}
+
+	plInitializers[init.Name] = init
+}
+
+func GetPostingListInitializer(name string) (PostingListInitializer, error) {
+	if init, ok := plInitializers[name]; ok {
+		return init, nil
+	}
+	return PostingListInitializer{},
+		errors.New("Unknown posting list type: " + name)
+}
+
 type PostingList interface {
 	GetEntry(id filereader.DocumentId) (PostingListEntry, bool)
 
@@ -80,10 +131,37 @@ type PostingList interface {
 	FilterSequential(p PostingList, within int) PostingList
 }
 
+/* Turns a term frequency into a score. Must not decrease as
+ * the term frequency increases. */
+type TfScorer func(tf int) float64
+
 type PostingListIterator interface {
 	Next() bool
 	Value() PostingListEntry
 	Key() int
+
+	/* Move forward to the first entry for a document at or after
+	 * id. Does nothing if the current entry is already there.
+	 * Returns false if there is no such entry. */
+	SkipTo(id filereader.DocumentId) bool
+
+	/* Move the current block forward to the one which would hold
+	 * id, without reading its entries. Next and SkipTo move it to
+	 * the block of the entry they land on. */
+	NextShallow(id filereader.DocumentId)
+
+	/* The last document in the current block. Past the last block,
+	 * this is the largest possible DocumentId. */
+	BlockEnd() filereader.DocumentId
+
+	/* An upper bound on the score of any entry in the current
+	 * block. This is the largest term frequency in the block, or
+	 * its score if a scorer has been set. */
+	BlockMaxScore() float64
+
+	// An upper bound on the score of any entry in the list
+	MaxScore() float64
+	SetScorer(scorer TfScorer)
 }
 
 type Indexer interface {
@@ -115,4 +193,7 @@ type Indexer interface {
 
 	// Delete the index from disk
 	Delete()
+
+	// Write the index to disk
+	Save()
 }
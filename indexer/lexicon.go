@@ -12,8 +12,35 @@ import log "github.com/cihub/seelog"
 // Implements a Lexicon
 type TrieLexicon struct {
 	radix.Trie
-	PLInit   PostingListInitializer
-	TermInit TermFromTokenFunc
+	PLInit       PostingListInitializer
+	TermInit     TermFromTokenFunc
+	TextTermInit TermFromTextFunc
+
+	// The text of every term, by id
+	Terms *TermList
+
+	/* Gives a new term its id. By default terms are added to Terms,
+	 * but lexicons which drop terms from the trie and see them again
+	 * use this to give them back the ids they had. */
+	TermIds func(text string) TermId
+}
+
+func (t *TrieLexicon) TermTable() TermTable {
+	return t.termList()
+}
+
+func (t *TrieLexicon) termList() *TermList {
+	if t.Terms == nil {
+		t.Terms = NewTermList()
+	}
+	return t.Terms
+}
+
+func (t *TrieLexicon) newTermId(text string) TermId {
+	if t.TermIds != nil {
+		return t.TermIds(text)
+	}
+	return t.termList().Add(text)
 }
 
 func (t *TrieLexicon) FindTerm(key []byte) (LexiconTerm, bool) {
@@ -29,6 +56,10 @@ func (t *TrieLexicon) IsPositional() bool {
 	return t.PLInit.Positional
 }
 
+func (t *TrieLexicon) PLInitializer() PostingListInitializer {
+	return t.PLInit
+}
+
 func (t *TrieLexicon) SetPLInitializer(pl_init PostingListInitializer) {
 	if t.Len() > 0 {
 		panic("Cannot set PL initializer after terms are inserted")
@@ -57,7 +88,7 @@ func (t *TrieLexicon) InsertToken(token *filereader.Token) (term LexiconTerm) {
 	} else {
 
 		log.Tracef("Creating new term via %v", t.TermInit)
-		term = t.TermInit(token, t.PLInit)
+		term = t.TermInit(t.newTermId(token.Text), token, t.PLInit)
 
 		log.Debugf("Created new term: %s. Inserting into lexicon", term.String())
 		// Insert the new term
@@ -66,12 +97,35 @@ func (t *TrieLexicon) InsertToken(token *filereader.Token) (term LexiconTerm) {
 	return term
 }
 
+/* Merge the entries of pl into the posting list for text. The
+ * documents in pl must not already be in the term's posting list */
+func (t *TrieLexicon) MergePostingList(text string, pl PostingList) (term LexiconTerm) {
+
+	var ok bool
+	if term, ok = t.FindTerm([]byte(text)); !ok {
+		term = t.TextTermInit(t.newTermId(text), text, t.PLInit)
+		log.Debugf("Created new term for merge: %s", term.String())
+		t.Insert(term.(radix.RadixTreeEntry))
+	}
+
+	for it := pl.Iterator(); it.Next(); {
+		term.RegisterEntry(it.Value())
+	}
+	return term
+}
+
 func (t *TrieLexicon) Print(w io.Writer) {
+	PrintTerms(w, t)
+}
 
-	df_array := make([]int, 0, t.Len())
+/* Print every term in lex along with its posting list, followed
+ * by some document frequency statistics. */
+func PrintTerms(w io.Writer, lex Lexicon) {
+
+	df_array := make([]int, 0, lex.Len())
 	dfSum := 0
 
-	for i, entry := range t.Walk() {
+	for i, entry := range lex.Walk() {
 		var term LexiconTerm
 
 		defer func() {
@@ -111,7 +165,7 @@ func (t *TrieLexicon) Print(w io.Writer) {
   `
 
 	io.WriteString(w, fmt.Sprintf(statsFmt,
-		t.Len(),
+		lex.Len(),
 		df_array[len(df_array)-1],
 		df_array[0],
 		float64(dfSum)/float64(len(df_array)),
@@ -122,20 +176,24 @@ func (t *TrieLexicon) Print(w io.Writer) {
 func NewTrieLexicon() Lexicon {
 	lex := new(TrieLexicon)
 	lex.Init()
+	lex.Terms = NewTermList()
 	lex.PLInit = PositionalPostingListInitializer
 	lex.TermInit = NewTermFromToken
+	lex.TextTermInit = NewTermFromText
 	return lex
 }
 
 // Implements LexiconTerm
 type Term struct {
+	Id_   TermId
 	Text_ string
 	Tf_   int
 	Pl    PostingList
 }
 
-func NewTermFromToken(t *filereader.Token, p PostingListInitializer) LexiconTerm {
+func NewTermFromToken(id TermId, t *filereader.Token, p PostingListInitializer) LexiconTerm {
 	term := new(Term)
+	term.Id_ = id
 	term.Text_ = t.Text
 	term.Tf_ = 0         // because we increment with Register
 	term.Pl = p.Create() // THis allows passing differnt types of posting lists.
@@ -145,11 +203,24 @@ func NewTermFromToken(t *filereader.Token, p PostingListInitializer) LexiconTerm
 	return term
 }
 
+func NewTermFromText(id TermId, text string, p PostingListInitializer) LexiconTerm {
+	term := new(Term)
+	term.Id_ = id
+	term.Text_ = text
+	term.Tf_ = 0
+	term.Pl = p.Create()
+	return term
+}
+
 // Fulfill the RadixTreeEntry interface
 func (t *Term) RadixKey() []byte {
 	return []byte(t.Text_)
 }
 
+func (t *Term) Id() TermId {
+	return t.Id_
+}
+
 func (t *Term) Text() string {
 	return t.Text_
 }
@@ -161,6 +232,11 @@ func (t *Term) Register(token *filereader.Token) {
 	log.Debug("Registered")
 }
 
+func (t *Term) RegisterEntry(entry PostingListEntry) {
+	t.PostingList().InsertCompleteEntry(entry)
+	t.Tf_ += entry.Frequency()
+}
+
 func (t *Term) PostingList() PostingList {
 	return t.Pl
 }
@@ -0,0 +1,247 @@
+package indexer
+
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "time"
+import "github.com/cwacek/irengine/indexer/filters"
+
+const (
+	IndexManifestFile = "manifest.json"
+
+	/* The version of the files a saved index is made of. Their
+	 * headers only say what kind of file each one is, so this is
+	 * the one version for all of them. It goes up whenever a change
+	 * to them would stop an older build reading them, and
+	 * MinIndexFormatVersion goes up when this build stops reading an
+	 * old version. */
+	IndexFormatVersion    = 1
+	MinIndexFormatVersion = 1
+
+	// The tokenizer documents are read with
+	DefaultTokenizer = "BadXMLTokenizer"
+)
+
+// Lexicons which can say what type of posting lists they hold
+type PostingListTyped interface {
+	PLInitializer() PostingListInitializer
+}
+
+// A filter in the chain, with its serialized arguments
+type ManifestFilter struct {
+	Id   string
+	Args string
+}
+
+type FileChecksum struct {
+	Size   int64
+	SHA256 string
+}
+
+/* A description of a saved index, written as manifest.json next to
+ * it: what format its files are in, how it was built, and the size
+ * and checksum of each file so damage can be found. */
+type IndexManifest struct {
+	FormatVersion int
+	IndexType     string
+	PostingList   string
+	Filters       []ManifestFilter
+	Tokenizer     string
+	Documents     int
+	Built         time.Time
+	Sources       []string `json:",omitempty"`
+	Files         map[string]FileChecksum
+}
+
+func ReadManifest(location string) (*IndexManifest, error) {
+	file, err := os.Open(filepath.Join(location, IndexManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := new(IndexManifest)
+	if err = json.NewDecoder(file).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("Bad index manifest in %s: %v", location, err)
+	}
+	return manifest, nil
+}
+
+/* Check that this build can read the index in location. The
+ * files the manifest lists must all be there at the right size,
+ * but aren't checksummed. See Verify. */
+func (m *IndexManifest) Check(location string) error {
+	switch {
+	case m.FormatVersion > IndexFormatVersion:
+		return fmt.Errorf("The index in %s has format version %d, but this build "+
+			"only reads up to version %d. Use a newer build.",
+			location, m.FormatVersion, IndexFormatVersion)
+	case m.FormatVersion < MinIndexFormatVersion:
+		return fmt.Errorf("The index in %s has format version %d, but this build "+
+			"only reads version %d and up. Rebuild the index.",
+			location, m.FormatVersion, MinIndexFormatVersion)
+	}
+
+	if _, err := GetPostingListInitializer(m.PostingList); err != nil {
+		return fmt.Errorf("The index in %s has unknown posting list type '%s'",
+			location, m.PostingList)
+	}
+
+	if m.Tokenizer != DefaultTokenizer {
+		return fmt.Errorf("The index in %s was tokenized with %s, but this build uses %s",
+			location, m.Tokenizer, DefaultTokenizer)
+	}
+
+	for _, filter := range m.Filters {
+		if _, err := filters.GetFactory(filter.Id); err != nil {
+			return fmt.Errorf("The index in %s uses unknown filter '%s'",
+				location, filter.Id)
+		}
+	}
+
+	for _, name := range m.FileNames() {
+		info, err := os.Stat(filepath.Join(location, name))
+		switch {
+		case err != nil:
+			return fmt.Errorf("The index in %s is missing %s", location, name)
+		case info.Size() != m.Files[name].Size:
+			return fmt.Errorf("%s in %s is %d bytes, but the manifest says %d",
+				name, location, info.Size(), m.Files[name].Size)
+		}
+	}
+	return nil
+}
+
+/* Checksum every file the manifest lists, returning an error for
+ * each one which is missing or doesn't match. */
+func (m *IndexManifest) Verify(location string) []error {
+	errs := make([]error, 0)
+	for _, name := range m.FileNames() {
+		sum, err := checksumFile(filepath.Join(location, name))
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case sum != m.Files[name]:
+			errs = append(errs, fmt.Errorf("%s has checksum %s (%d bytes), expected %s (%d bytes)",
+				name, sum.SHA256, sum.Size, m.Files[name].SHA256, m.Files[name].Size))
+		}
+	}
+	return errs
+}
+
+// The files listed, sorted
+func (m *IndexManifest) FileNames() []string {
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* Checksum every file in location but the manifest, and write the
+ * manifest there. It's written to a temporary file and renamed, so
+ * a crash leaves the old one. */
+func (m *IndexManifest) WriteTo(location string) error {
+	entries, err := ioutil.ReadDir(location)
+	if err != nil {
+		return err
+	}
+
+	m.Files = make(map[string]FileChecksum)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || name == IndexManifestFile ||
+			name == IndexManifestFile+".tmp" {
+			continue
+		}
+		if m.Files[name], err = checksumFile(filepath.Join(location, name)); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(location, IndexManifestFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		_, err = file.Write(append(encoded, '\n'))
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func checksumFile(path string) (FileChecksum, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return FileChecksum{}, err
+	}
+	return FileChecksum{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+/* A manifest describing this index, without the files. IndexType
+ * and Sources are whatever the builder set, and the type is named
+ * for the posting lists if it wasn't. */
+func (t *SingleTermIndex) Manifest() *IndexManifest {
+	manifest := &IndexManifest{
+		FormatVersion: IndexFormatVersion,
+		IndexType:     t.IndexType,
+		Filters:       make([]ManifestFilter, 0),
+		Tokenizer:     DefaultTokenizer,
+		Documents:     t.DocumentCount,
+		Built:         time.Now().UTC(),
+		Sources:       t.Sources,
+	}
+
+	plInit := BasicPostingListInitializer
+	if typed, ok := t.lexicon.(PostingListTyped); ok {
+		plInit = typed.PLInitializer()
+	} else if t.IsPositional() {
+		plInit = PositionalPostingListInitializer
+	}
+	manifest.PostingList = plInit.Name
+
+	if manifest.IndexType == "" {
+		manifest.IndexType = "single-term"
+		if plInit.Positional {
+			manifest.IndexType = "single-term-positional"
+		}
+	}
+
+	if t.filterChain != nil {
+		for _, id := range t.filterChain.Ids() {
+			if factory, err := filters.GetFactory(id); err == nil {
+				manifest.Filters = append(manifest.Filters,
+					ManifestFilter{Id: id, Args: factory.Serialize()})
+			}
+		}
+	}
+	return manifest
+}
+
+// Write a manifest for the index saved in location
+func (t *SingleTermIndex) WriteManifest(location string) error {
+	return t.Manifest().WriteTo(location)
+}
@@ -0,0 +1,156 @@
+package indexer
+
+import "fmt"
+import "io"
+import "sync"
+import "github.com/cwacek/irengine/indexer/filters"
+import "github.com/cwacek/irengine/scanner/filereader"
+import log "github.com/cihub/seelog"
+
+// Build the lexicon for a single indexing worker
+type WorkerLexiconFunc func(worker int) Lexicon
+
+/* A ParallelIndexer spreads documents across a number of
+ * worker indexes, each of which has a private lexicon and
+ * filter chain. When insertion is complete, the partial indexes
+ * are merged into the target index. */
+type ParallelIndexer struct {
+	target      *SingleTermIndex
+	workerCount int
+	newLexicon  WorkerLexiconFunc
+
+	workers []*SingleTermIndex
+	queue   chan filereader.Document
+	running *sync.WaitGroup
+}
+
+func NewParallelIndexer(target *SingleTermIndex, workers int,
+	newLexicon WorkerLexiconFunc) *ParallelIndexer {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := new(ParallelIndexer)
+	p.target = target
+	p.workerCount = workers
+	p.newLexicon = newLexicon
+	p.running = new(sync.WaitGroup)
+	return p
+}
+
+func (p *ParallelIndexer) Init(lexicon Lexicon) error {
+	return p.target.Init(lexicon)
+}
+
+func (p *ParallelIndexer) AddFilter(f filters.Filter) {
+	if p.queue != nil {
+		panic("Tried to add a filter with indexing workers running")
+	}
+	p.target.AddFilter(f)
+}
+
+func (p *ParallelIndexer) String() string {
+	return fmt.Sprintf("{ParallelIndexer workers:%d %s}",
+		p.workerCount, p.target.String())
+}
+
+func (p *ParallelIndexer) PrintLexicon(w io.Writer) {
+	p.target.PrintLexicon(w)
+}
+
+// Start the workers, giving each a copy of the target's
+// filter chain.
+func (p *ParallelIndexer) start() {
+	var ids []string
+
+	if p.target.filterChain != nil {
+		ids = p.target.filterChain.Ids()
+	}
+
+	p.queue = make(chan filereader.Document, p.workerCount)
+	p.workers = make([]*SingleTermIndex, p.workerCount)
+
+	for i := range p.workers {
+		worker := new(SingleTermIndex)
+		worker.Init(p.newLexicon(i))
+
+		if chain, err := filters.InstantiateChain(ids); err != nil {
+			panic(err)
+		} else if chain != nil {
+			worker.AddFilter(chain)
+		}
+
+		p.workers[i] = worker
+		p.running.Add(1)
+		go p.work(i, worker)
+	}
+	log.Infof("Started %d indexing workers with filters %v",
+		p.workerCount, ids)
+}
+
+func (p *ParallelIndexer) work(id int, worker *SingleTermIndex) {
+	for doc := range p.queue {
+		worker.Insert(doc)
+	}
+	worker.WaitInsert()
+	log.Infof("Indexing worker %d finished: %s", id, worker)
+	p.running.Done()
+}
+
+func (p *ParallelIndexer) Insert(d filereader.Document) {
+	if p.queue == nil {
+		p.start()
+	}
+	p.target.storeDocument(d)
+	p.queue <- d
+}
+
+// Wait for the workers to finish, then merge their partial
+// indexes into the target index.
+func (p *ParallelIndexer) WaitInsert() {
+	if p.queue == nil {
+		p.target.WaitInsert()
+		return
+	}
+
+	close(p.queue)
+	p.running.Wait()
+
+	log.Infof("Merging %d workers", len(p.workers))
+	p.target.Merge(p.workers...)
+	for _, worker := range p.workers {
+		worker.Delete()
+	}
+
+	p.queue = nil
+	p.workers = nil
+}
+
+func (p *ParallelIndexer) Prune(pruner PostingListPruner) {
+	p.WaitInsert()
+	p.target.Prune(pruner)
+}
+
+func (p *ParallelIndexer) Len() int {
+	count := p.target.Len()
+	for _, worker := range p.workers {
+		count += worker.Len()
+	}
+	return count
+}
+
+func (p *ParallelIndexer) Delete() {
+	p.WaitInsert()
+	p.target.Delete()
+}
+
+func (p *ParallelIndexer) Save() {
+	p.WaitInsert()
+	p.target.Save()
+}
+
+// The target index that workers are merged into
+func (p *ParallelIndexer) Target() *SingleTermIndex {
+	return p.target
+}
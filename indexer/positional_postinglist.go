@@ -1,6 +1,7 @@
 package indexer
 
 import "sort"
+import "math"
 import "errors"
 import "fmt"
 import "unicode"
@@ -40,8 +41,47 @@ var (
 	}
 )
 
+// The number of postings in each block of an uncompressed list
+const PostingBlockSize = 128
+
+// The last document and largest term frequency in a block
+type block_max struct {
+	Last  filereader.DocumentId
+	MaxTf int
+}
+
+/* The skip list provides the skip pointers. Block maxima for every
+ * PostingBlockSize postings are kept by the list once it's flushed;
+ * lists that have changed since are scanned for them the first time
+ * they're asked for, so iterators that only walk the list don't. */
 type pl_iterator struct {
-	sk_iter skiplist.Iterator
+	sk_iter   skiplist.Iterator
+	pl        *positional_pl
+	exhausted bool
+	scorer    TfScorer
+	blocks    []block_max
+	hasBlocks bool
+
+	// The block BlockEnd and BlockMaxScore describe
+	block int
+}
+
+// The block maxima, scanning the list for them if it wasn't flushed
+func (it *pl_iterator) maxima() []block_max {
+	if !it.hasBlocks {
+		it.blocks, it.hasBlocks = it.pl.blockMaxima(), true
+		if key := it.sk_iter.Key(); key != nil {
+			it.advanceBlock(key.(filereader.DocumentId))
+		}
+	}
+	return it.blocks
+}
+
+// Move to the block holding id, if the maxima are known yet
+func (it *pl_iterator) advanceBlock(id filereader.DocumentId) {
+	for it.block < len(it.blocks) && it.blocks[it.block].Last < id {
+		it.block++
+	}
 }
 
 func (it *pl_iterator) Value() PostingListEntry {
@@ -50,14 +90,78 @@ func (it *pl_iterator) Value() PostingListEntry {
 
 func (it *pl_iterator) Next() bool {
 	log.Trace("Calling Next()")
+	if it.exhausted {
+		return false
+	}
 	cont := it.sk_iter.Next()
 	log.Tracef("returned %v", cont)
+	it.exhausted = !cont
 
+	if cont {
+		it.advanceBlock(it.Value().DocId())
+	}
 	return cont
 }
 
 func (it *pl_iterator) Key() int {
-	return it.sk_iter.Key().(int)
+	return int(it.sk_iter.Key().(filereader.DocumentId))
+}
+
+func (it *pl_iterator) SkipTo(id filereader.DocumentId) bool {
+	if it.exhausted {
+		return false
+	}
+
+	if key := it.sk_iter.Key(); key != nil && key.(filereader.DocumentId) >= id {
+		return true
+	}
+
+	if !it.sk_iter.Seek(id) {
+		it.exhausted = true
+		return false
+	}
+	it.advanceBlock(it.Value().DocId())
+	return true
+}
+
+func (it *pl_iterator) NextShallow(id filereader.DocumentId) {
+	it.maxima()
+	it.advanceBlock(id)
+}
+
+func (it *pl_iterator) BlockEnd() filereader.DocumentId {
+	if it.block >= len(it.maxima()) {
+		return math.MaxUint32
+	}
+	return it.blocks[it.block].Last
+}
+
+func (it *pl_iterator) BlockMaxScore() float64 {
+	if it.block >= len(it.maxima()) {
+		return 0
+	}
+	return it.score(it.blocks[it.block].MaxTf)
+}
+
+func (it *pl_iterator) MaxScore() float64 {
+	maxTf := 0
+	for _, block := range it.maxima() {
+		if block.MaxTf > maxTf {
+			maxTf = block.MaxTf
+		}
+	}
+	return it.score(maxTf)
+}
+
+func (it *pl_iterator) score(tf int) float64 {
+	if it.scorer != nil {
+		return it.scorer(tf)
+	}
+	return float64(tf)
+}
+
+func (it *pl_iterator) SetScorer(scorer TfScorer) {
+	it.scorer = scorer
 }
 
 type positional_pl struct {
@@ -65,9 +169,36 @@ type positional_pl struct {
 	Length        int
 	Positional    bool
 	entry_factory func(filereader.DocumentId) PostingListEntry
+
+	// Set by Flush, and dropped when the list changes
+	blocks []block_max
+}
+
+// Keep the block maxima, now that writing is done
+func (pl *positional_pl) Flush() {
+	pl.blocks = pl.blockMaxima()
+}
+
+func (pl *positional_pl) blockMaxima() []block_max {
+	blocks := make([]block_max, 0, pl.Length/PostingBlockSize+1)
+	count := 0
+	for sk_iter := pl.list.Iterator(); sk_iter.Next(); count++ {
+		entry := sk_iter.Value().(PostingListEntry)
+		if count%PostingBlockSize == 0 {
+			blocks = append(blocks, block_max{})
+		}
+
+		block := &blocks[len(blocks)-1]
+		block.Last = entry.DocId()
+		if entry.Frequency() > block.MaxTf {
+			block.MaxTf = entry.Frequency()
+		}
+	}
+	return blocks
 }
 
 func (pl *positional_pl) Remove(ids ...filereader.DocumentId) (count int) {
+	pl.blocks = nil
 	for _, id := range ids {
 		if _, deleted := pl.list.Delete(id); !deleted {
 			panic(fmt.Sprintf(
@@ -87,29 +218,46 @@ func (pl *positional_pl) IsPositional() bool {
 func (pl *positional_pl) FilterSequential(other PostingList,
 	within int) PostingList {
 
-	if !pl.Positional || !other.IsPositional() {
-		panic(errors.New("FilterSequential requires positional posting lists"))
-	}
-
 	filtered := new(positional_pl)
 	filtered.entry_factory = pl.entry_factory
 	filtered.Length = 0
 	filtered.Positional = true
 	filtered.list = skiplist.NewCustomMap(DocumentIdLessThan)
 
+	return filterSequential(pl, other, within, filtered)
+}
+
+/* Fill filtered with the positions in other which occur within
+ * 'within' positions after those in pl. Shared by the posting
+ * list implementations. */
+func filterSequential(pl, other PostingList, within int,
+	filtered PostingList) PostingList {
+
+	if !pl.IsPositional() || !other.IsPositional() {
+		panic(errors.New("FilterSequential requires positional posting lists"))
+	}
+
 	var plEntry, otherEntry, newEntry PostingListEntry
-	var found bool
 
-	for pl_iter := pl.Iterator(); pl_iter.Next(); {
+	pl_iter := pl.Iterator()
+	other_iter := other.Iterator()
+
+	ok := pl_iter.Next() && other_iter.Next()
+	for ok {
 		plEntry = pl_iter.Value()
+		otherEntry = other_iter.Value()
 
-		if otherEntry, found = other.GetEntry(plEntry.DocId()); !found {
-			// if the document isn't even in our filtering list,
-			// then just drop it.
+		// Leapfrog the two lists until they're on the same
+		// document. Documents which aren't in both are dropped.
+		if plEntry.DocId() < otherEntry.DocId() {
+			ok = pl_iter.SkipTo(otherEntry.DocId())
+			continue
+		} else if plEntry.DocId() > otherEntry.DocId() {
+			ok = other_iter.SkipTo(plEntry.DocId())
 			continue
 		}
 
-		newEntry = filtered.entry_factory(plEntry.DocId())
+		newEntry = filtered.EntryFactory(plEntry.DocId())
 
 		plPos := plEntry.Positions()
 		filterPos := otherEntry.Positions()
@@ -144,6 +292,7 @@ func (pl *positional_pl) FilterSequential(other PostingList,
 		if newEntry.Frequency() > 0 {
 			filtered.InsertCompleteEntry(newEntry)
 		}
+		ok = pl_iter.Next() && other_iter.Next()
 	}
 
 	return filtered
@@ -161,6 +310,8 @@ func (pl *positional_pl) Iterator() PostingListIterator {
 	iter := new(pl_iterator)
 	log.Trace("Creating new iterator")
 	iter.sk_iter = pl.list.Iterator()
+	iter.pl = pl
+	iter.blocks, iter.hasBlocks = pl.blocks, pl.blocks != nil
 	return iter
 }
 
@@ -181,6 +332,7 @@ func (pl *positional_pl) GetEntry(id filereader.DocumentId) (PostingListEntry,
 }
 
 func (pl *positional_pl) InsertCompleteEntry(entry PostingListEntry) bool {
+	pl.blocks = nil
 	pl.list.Set(entry.DocId(), entry)
 	pl.Length++
 	return true
@@ -199,6 +351,7 @@ func (pl *positional_pl) InsertRawEntry(text string,
 		//position
 		log.Debugf("%s exists. Adding position %d", docid, position)
 		entry.AddPosition(position)
+		pl.blocks = nil
 		return false
 	}
 
@@ -0,0 +1,347 @@
+package indexer
+
+import "github.com/cwacek/irengine/scanner/filereader"
+import "errors"
+import "fmt"
+import "math"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+
+/* Proximity operators match terms near each other in a document:
+ *
+ *   #od:k(a b c)  the terms in order, each at most k positions
+ *                 after the one before it, so #od:1 is a phrase
+ *   #uw:k(a b c)  the terms in any order, inside a window of k
+ *                 positions
+ *   a NEAR/k b    a and b at most k positions apart, in either
+ *                 order, which is #uw:k+1(a b). A chain like
+ *                 'a NEAR/2 b NEAR/3 c' is one window holding all
+ *                 of the terms, as wide as the two put together.
+ *   #sent(a b c)  the terms in any order, in the same sentence
+ *   #para(a b c)  the terms in any order, in the same paragraph
+ *
+ * A window can be kept inside a sentence or paragraph too, so
+ * '#od:1/sent(a b)' is a phrase that doesn't cross a full stop.
+ *
+ * The matches of an operator make a positional posting list, with
+ * an entry for each document holding the start of every match, so
+ * its frequency is the number of matches. Matches don't overlap.
+ * The index retrieves an operator as a term with that posting
+ * list, so every ranker can score it like any other term. */
+type Proximity struct {
+	Ordered bool
+	// The widest a match can be. 0 when only the scope limits it.
+	Window int
+	Terms  []string
+	// The unit a match has to fit in. NoBoundary is the document.
+	Scope filereader.Boundary
+}
+
+/* The starts of the units of doc after the first, so a position is
+ * in the unit after the last start at or before it. */
+type BoundaryFunc func(doc filereader.DocumentId, scope filereader.Boundary) []int
+
+var (
+	ErrNotPositional = errors.New("Proximity operators need positional posting lists")
+	ErrNoBoundaries  = errors.New("Sentence and paragraph operators need document boundaries")
+
+	windowOperator = regexp.MustCompile(`^#(od|uw):(\d+)(?:/(sent|para))?\(([^()]*)\)$`)
+	scopeOperator  = regexp.MustCompile(`^#(sent|para)\(([^()]*)\)$`)
+	nearOperator   = regexp.MustCompile(`^\S+( NEAR/\d+ \S+)+$`)
+
+	scopeNames = map[string]filereader.Boundary{
+		"sent": filereader.SentenceBoundary,
+		"para": filereader.ParagraphBoundary,
+	}
+)
+
+// Parse a proximity operator like '#od:2(a b)' or 'a NEAR/3 b'
+func ParseProximity(text string) (*Proximity, bool) {
+	text = strings.Join(strings.Fields(text), " ")
+
+	if m := windowOperator.FindStringSubmatch(text); m != nil {
+		window, err := strconv.Atoi(m[2])
+		terms := strings.Fields(m[4])
+		if err != nil || window < 1 || len(terms) == 0 {
+			return nil, false
+		}
+		return &Proximity{Ordered: m[1] == "od", Window: window, Terms: terms,
+			Scope: scopeNames[m[3]]}, true
+	}
+
+	if m := scopeOperator.FindStringSubmatch(text); m != nil {
+		terms := strings.Fields(m[2])
+		if len(terms) == 0 {
+			return nil, false
+		}
+		return &Proximity{Terms: terms, Scope: scopeNames[m[1]]}, true
+	}
+
+	if nearOperator.MatchString(text) {
+		words := strings.Fields(text)
+		p := &Proximity{Window: 1, Terms: []string{words[0]}}
+		for i := 1; i < len(words); i += 2 {
+			distance, err := strconv.Atoi(strings.TrimPrefix(words[i], "NEAR/"))
+			if err != nil {
+				return nil, false
+			}
+			p.Window += distance
+			p.Terms = append(p.Terms, words[i+1])
+		}
+		return p, true
+	}
+	return nil, false
+}
+
+// Whether text is a proximity operator
+func IsProximity(text string) bool {
+	_, ok := ParseProximity(text)
+	return ok
+}
+
+/* The operator in #od, #uw, #sent or #para form, which
+ * ParseProximity reads back */
+func (p *Proximity) String() string {
+	terms := strings.Join(p.Terms, " ")
+	scope := ""
+	for name, boundary := range scopeNames {
+		if boundary == p.Scope {
+			scope = name
+		}
+	}
+
+	if p.Window == 0 {
+		return fmt.Sprintf("#%s(%s)", scope, terms)
+	}
+	op := "uw"
+	if p.Ordered {
+		op = "od"
+	}
+	if scope != "" {
+		return fmt.Sprintf("#%s:%d/%s(%s)", op, p.Window, scope, terms)
+	}
+	return fmt.Sprintf("#%s:%d(%s)", op, p.Window, terms)
+}
+
+/* Find the matches of the operator, given the posting lists of
+ * its terms in order. */
+func (p *Proximity) Match(pls ...PostingList) (PostingList, error) {
+	return p.MatchWithin(nil, pls...)
+}
+
+/* Find the matches of the operator, using bounds to split the
+ * documents into sentences or paragraphs when it has a scope. */
+func (p *Proximity) MatchWithin(bounds BoundaryFunc, pls ...PostingList) (PostingList, error) {
+	var units func(filereader.DocumentId) []int
+	if p.Scope != filereader.NoBoundary {
+		if bounds == nil {
+			return nil, ErrNoBoundaries
+		}
+		units = func(doc filereader.DocumentId) []int {
+			return bounds(doc, p.Scope)
+		}
+	}
+
+	k := p.Window
+	if k == 0 {
+		k = math.MaxInt32
+	}
+	if p.Ordered {
+		return matchWindows(pls, units, func(positions [][]int) []int {
+			return orderedMatches(k, positions)
+		})
+	}
+	return matchWindows(pls, units, func(positions [][]int) []int {
+		return unorderedMatches(k, positions)
+	})
+}
+
+// Matches of the terms in pls in order, each within k of the last
+func OrderedWindow(k int, pls ...PostingList) (PostingList, error) {
+	return (&Proximity{Ordered: true, Window: k}).Match(pls...)
+}
+
+// Matches of the terms in pls in any order, inside k positions
+func UnorderedWindow(k int, pls ...PostingList) (PostingList, error) {
+	return (&Proximity{Window: k}).Match(pls...)
+}
+
+/* Run match over the positions of the lists in each document they
+ * all hold, keeping the documents where it finds something. If
+ * units is set, match only sees one unit of a document at a time. */
+func matchWindows(pls []PostingList, units func(filereader.DocumentId) []int,
+	match func(positions [][]int) []int) (PostingList, error) {
+
+	its := make([]PostingListIterator, len(pls))
+	for i, pl := range pls {
+		if !pl.IsPositional() {
+			return nil, ErrNotPositional
+		}
+		its[i] = pl.Iterator()
+	}
+
+	matched := PositionalPostingListInitializer.Create()
+	positions := make([][]int, len(its))
+
+	// And leaves each of its lists on the document it matched
+	for all := And(its...); all.Next(); {
+		for i, it := range its {
+			positions[i] = it.Value().Positions()
+		}
+
+		doc := filereader.DocumentId(all.Key())
+		var starts []int
+		if units == nil {
+			starts = match(positions)
+		} else {
+			starts = matchUnits(units(doc), positions, match)
+		}
+
+		if len(starts) > 0 {
+			entry := matched.EntryFactory(doc)
+			for _, start := range starts {
+				entry.AddPosition(start)
+			}
+			matched.InsertCompleteEntry(entry)
+		}
+	}
+	return matched, nil
+}
+
+/* Run match over each unit holding a position of every term. The
+ * units are found from the first term's positions, and the others
+ * are cut down to the same unit. */
+func matchUnits(bounds []int, positions [][]int,
+	match func(positions [][]int) []int) []int {
+
+	starts := make([]int, 0)
+	inUnit := make([][]int, len(positions))
+	last := -1
+
+	for _, pos := range positions[0] {
+		unit := sort.SearchInts(bounds, pos+1)
+		if unit == last {
+			continue
+		}
+		last = unit
+
+		begin, end := 0, math.MaxInt32
+		if unit > 0 {
+			begin = bounds[unit-1]
+		}
+		if unit < len(bounds) {
+			end = bounds[unit]
+		}
+
+		found := true
+		for i, list := range positions {
+			inUnit[i] = list[sort.SearchInts(list, begin):sort.SearchInts(list, end)]
+			found = found && len(inUnit[i]) > 0
+		}
+		if found {
+			starts = append(starts, match(inUnit)...)
+		}
+	}
+	return starts
+}
+
+/* The starts of the ordered matches in a document. Going from one
+ * term to the next, keep every position of the next term that some
+ * position reached so far is at most k before. A match from start
+ * ends at the first position left for the last term. */
+func orderedMatches(k int, positions [][]int) []int {
+	starts := make([]int, 0)
+	end := -1
+
+	for _, start := range positions[0] {
+		if start <= end {
+			continue
+		}
+
+		reached := []int{start}
+		for _, term := range positions[1:] {
+			next := make([]int, 0)
+			j := 0
+			for _, pos := range term {
+				for j < len(reached) && reached[j] < pos-k {
+					j++
+				}
+				if j < len(reached) && reached[j] < pos {
+					next = append(next, pos)
+				}
+			}
+
+			if reached = next; len(reached) == 0 {
+				break
+			}
+		}
+
+		if len(reached) > 0 {
+			starts = append(starts, start)
+			end = reached[0]
+		}
+	}
+	return starts
+}
+
+type term_position struct {
+	pos, term int
+}
+
+type byPosition []term_position
+
+func (p byPosition) Len() int {
+	return len(p)
+}
+
+func (p byPosition) Less(i, j int) bool {
+	return p[i].pos < p[j].pos
+}
+
+func (p byPosition) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+/* The starts of the unordered matches in a document. Positions are
+ * visited in order, keeping the latest one for each term. Once
+ * they're all inside the window, that's a match, and the next one
+ * has to start after it. */
+func unorderedMatches(k int, positions [][]int) []int {
+	all := make(byPosition, 0)
+	for term, list := range positions {
+		for _, pos := range list {
+			all = append(all, term_position{pos, term})
+		}
+	}
+	sort.Sort(all)
+
+	starts := make([]int, 0)
+	latest := make([]int, len(positions))
+	seen := 0
+	for i := range latest {
+		latest[i] = -1
+	}
+
+	for _, tp := range all {
+		if latest[tp.term] < 0 {
+			seen++
+		}
+		latest[tp.term] = tp.pos
+
+		if seen < len(positions) {
+			continue
+		}
+
+		first := minInt(latest...)
+		if tp.pos-first+1 <= k {
+			starts = append(starts, first)
+			for i := range latest {
+				latest[i] = -1
+			}
+			seen = 0
+		}
+	}
+	return starts
+}
@@ -1,7 +1,11 @@
 package indexer
 
+import "encoding"
+import "fmt"
+import "io"
 import "sort"
 import "math"
+import "github.com/cwacek/irengine/scanner/filereader"
 import log "github.com/cihub/seelog"
 
 type PostingListPruner interface {
@@ -94,12 +98,233 @@ func (p *TFPruner) Prune(term LexiconTerm) {
 	log.Infof("Calculated threshold for %s as %0.2f + %0.2f = %0.2f. Removing all PL with lower frequency.",
 		term.Text(), mean, std_dev, threshold)
 
+	/* Find what to remove before removing any of it, since removing
+	 * entries while iterating over the list skips some. The entry
+	 * with the highest frequency is always kept. */
+	var best PostingListEntry
+	remove := make([]filereader.DocumentId, 0)
 	for it := pl.Iterator(); it.Next(); {
 		entry = it.Value()
-		if float64(entry.Frequency()) < threshold && pl.Len() > 1 {
-			log.Infof("Removed %d from %s because it's TF was %d < %0.2f",
-				entry.DocId(), term.Text(), entry.Frequency(), threshold)
-			pl.Remove(entry.DocId())
+		if best == nil || entry.Frequency() > best.Frequency() {
+			best = entry
+		}
+		if float64(entry.Frequency()) < threshold {
+			remove = append(remove, entry.DocId())
+		}
+	}
+
+	if len(remove) == pl.Len() {
+		remove = withoutId(remove, best.DocId())
+	}
+
+	for _, id := range remove {
+		log.Debugf("Removed %d from %s because it's TF was < %0.2f",
+			id, term.Text(), threshold)
+	}
+	pl.Remove(remove...)
+}
+
+func withoutId(ids []filereader.DocumentId, id filereader.DocumentId) []filereader.DocumentId {
+	for i := range ids {
+		if ids[i] == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+/* Scores a posting by what it adds to its document's score for a
+ * query containing its term. The query engine's rankers supply
+ * these, so pruning agrees with the ranking. */
+type PostingScorer interface {
+	Score(term LexiconTerm, entry PostingListEntry) float64
+}
+
+/* Removes the postings which add least to their documents' scores,
+ * as in Carmel et al., "Static Index Pruning for Information
+ * Retrieval Systems" (SIGIR 2001).
+ *
+ * Uniform pruning removes every posting scoring below Threshold,
+ * though each term keeps its best posting. Term-centric pruning
+ * gives each term its own threshold, Epsilon times the score of its
+ * K-th best posting, so every term keeps at least K postings and
+ * rare terms aren't pruned away. */
+type ScorePruner struct {
+	Scorer      PostingScorer
+	TermCentric bool
+
+	// For uniform pruning
+	Threshold float64
+
+	// For term-centric pruning
+	K       int
+	Epsilon float64
+}
+
+func NewUniformScorePruner(scorer PostingScorer, threshold float64) *ScorePruner {
+	return &ScorePruner{Scorer: scorer, Threshold: threshold}
+}
+
+func NewTermCentricScorePruner(scorer PostingScorer, k int, epsilon float64) *ScorePruner {
+	return &ScorePruner{Scorer: scorer, TermCentric: true, K: k, Epsilon: epsilon}
+}
+
+func (p *ScorePruner) Prune(term LexiconTerm) {
+	pl := term.PostingList()
+	if pl.Len() == 0 {
+		return
+	}
+
+	ids := make([]filereader.DocumentId, 0, pl.Len())
+	scores := make([]float64, 0, pl.Len())
+	best := 0
+	for it := pl.Iterator(); it.Next(); {
+		score := p.Scorer.Score(term, it.Value())
+		if len(scores) > 0 && score > scores[best] {
+			best = len(scores)
+		}
+		ids = append(ids, it.Value().DocId())
+		scores = append(scores, score)
+	}
+
+	threshold := p.threshold(scores)
+
+	remove := make([]filereader.DocumentId, 0)
+	for i, score := range scores {
+		if score < threshold && i != best {
+			remove = append(remove, ids[i])
+		}
+	}
+
+	log.Debugf("Pruning %d of %d postings for '%s' scoring below %0.4f",
+		len(remove), len(ids), term.Text(), threshold)
+	pl.Remove(remove...)
+}
+
+// The score postings of a term need to be kept
+func (p *ScorePruner) threshold(scores []float64) float64 {
+	if !p.TermCentric {
+		return p.Threshold
+	}
+	k := p.K
+	if k < 1 {
+		k = 1
+	}
+	if len(scores) <= k {
+		return math.Inf(-1)
+	}
+
+	sorted := append([]float64(nil), scores...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	return p.Epsilon * sorted[k-1]
+}
+
+// What pruning did to one term
+type TermPruning struct {
+	Text          string
+	Before, After int
+	BytesBefore   int
+	BytesAfter    int
+}
+
+func (t *TermPruning) Removed() int {
+	return t.Before - t.After
+}
+
+/* What a pruner removed from the index. Sizes are of the posting
+ * lists compressed as they are in a compiled index. */
+type PruningReport struct {
+	PostingsBefore, PostingsAfter int
+	BytesBefore, BytesAfter       int64
+	Terms                         []*TermPruning
+}
+
+func (r *PruningReport) Add(term *TermPruning) {
+	r.PostingsBefore += term.Before
+	r.PostingsAfter += term.After
+	r.BytesBefore += int64(term.BytesBefore)
+	r.BytesAfter += int64(term.BytesAfter)
+	r.Terms = append(r.Terms, term)
+}
+
+type termsByRemoved []*TermPruning
+
+func (s termsByRemoved) Len() int {
+	return len(s)
+}
+
+func (s termsByRemoved) Less(i, j int) bool {
+	if s[i].Removed() != s[j].Removed() {
+		return s[i].Removed() > s[j].Removed()
+	}
+	return s[i].Text < s[j].Text
+}
+
+func (s termsByRemoved) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+/* Print the totals, and the limit terms which lost the most
+ * postings. A limit below 0 prints every term. */
+func (r *PruningReport) Print(w io.Writer, limit int) {
+	percent := func(after, before int64) float64 {
+		if before == 0 {
+			return 100
 		}
+		return 100 * float64(after) / float64(before)
+	}
+
+	fmt.Fprintf(w, "Pruned %d of %d postings from %d terms. %d postings remain (%0.1f%%)\n",
+		r.PostingsBefore-r.PostingsAfter, r.PostingsBefore, len(r.Terms),
+		r.PostingsAfter, percent(int64(r.PostingsAfter), int64(r.PostingsBefore)))
+	fmt.Fprintf(w, "Posting lists went from %d to %d bytes (%0.1f%%)\n",
+		r.BytesBefore, r.BytesAfter, percent(r.BytesAfter, r.BytesBefore))
+
+	terms := append(termsByRemoved(nil), r.Terms...)
+	sort.Sort(terms)
+	if limit >= 0 && limit < len(terms) {
+		terms = terms[:limit]
+	}
+
+	for _, term := range terms {
+		fmt.Fprintf(w, "  %-24s %6d -> %6d postings  %8d -> %8d bytes\n",
+			term.Text, term.Before, term.After, term.BytesBefore, term.BytesAfter)
+	}
+}
+
+/* Wraps another pruner, adding what it does to each term to
+ * Report. */
+type ReportingPruner struct {
+	Pruner PostingListPruner
+	Report *PruningReport
+}
+
+func NewReportingPruner(pruner PostingListPruner) *ReportingPruner {
+	return &ReportingPruner{Pruner: pruner, Report: new(PruningReport)}
+}
+
+func (p *ReportingPruner) Prune(term LexiconTerm) {
+	stats := &TermPruning{Text: term.Text()}
+	stats.Before, stats.BytesBefore = pruningSize(term.PostingList())
+
+	p.Pruner.Prune(term)
+
+	stats.After, stats.BytesAfter = pruningSize(term.PostingList())
+	p.Report.Add(stats)
+}
+
+// The length of pl, and its size compressed with VByte
+func pruningSize(pl PostingList) (int, int) {
+	if marshaler, ok := pl.(encoding.BinaryMarshaler); ok {
+		if data, err := marshaler.MarshalBinary(); err == nil {
+			return pl.Len(), len(data)
+		}
+	}
+
+	compressed := NewCompressedPostingListInitializer(VByteCodec{}, pl.IsPositional()).Create()
+	for it := pl.Iterator(); it.Next(); {
+		compressed.InsertCompleteEntry(it.Value())
 	}
+	data, _ := compressed.(encoding.BinaryMarshaler).MarshalBinary()
+	return pl.Len(), len(data)
 }
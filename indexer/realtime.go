@@ -0,0 +1,250 @@
+package indexer
+
+import "fmt"
+import "sync"
+import "time"
+import "github.com/cwacek/irengine/indexer/filters"
+import "github.com/cwacek/irengine/scanner/filereader"
+import log "github.com/cihub/seelog"
+
+const DefaultRefreshInterval = time.Second
+
+const DefaultSegmentsPerTier = 10
+
+/* An index the query engine can search. Snapshot gives a view of
+ * it which doesn't change while a query runs, and FilterTokens
+ * runs query tokens through the same filters as its documents. */
+type Searchable interface {
+	Snapshot() *SingleTermIndex
+	FilterTokens(input, output chan *filereader.Token)
+	String() string
+}
+
+/* Build an empty lexicon for a segment of a RealtimeIndex. A
+ * TrieLexicon is given the index's term table, so its terms have
+ * the same ids in every segment. */
+type SegmentLexiconFunc func() Lexicon
+
+/* A RealtimeIndex can be searched while documents are inserted
+ * into it. Documents go into a buffer with its own lexicon. Each
+ * refresh takes the buffered documents out as a segment, finalizes
+ * it, and publishes a view of it and the segments before it as the
+ * new snapshot. Nothing already published is copied or changed, so
+ * a refresh costs as much as the documents it adds.
+ *
+ * Once a tier has SegmentsPerTier segments they're merged into one,
+ * as a segmented index on disk does, so searches only have to look
+ * in a few segments however many refreshes there have been.
+ *
+ * A published snapshot is never changed, so readers can search it
+ * without locking, and never see half-inserted documents. Inserted
+ * documents can be found once the next refresh is done. */
+type RealtimeIndex struct {
+	// How often Start refreshes the snapshot
+	RefreshInterval time.Duration
+
+	// The WildcardLimit of every snapshot
+	WildcardLimit int
+
+	// How many segments of about the same size are merged
+	SegmentsPerTier int
+
+	newLexicon SegmentLexiconFunc
+	terms      *TermList
+	buffer     *SingleTermIndex
+
+	// Held while a snapshot is built, so refreshes take turns
+	refreshLock *sync.Mutex
+
+	snapshotLock *sync.RWMutex
+	segments     []*SingleTermIndex
+	snapshot     *SingleTermIndex
+	refreshes    int
+
+	stop    chan bool
+	stopped chan bool
+}
+
+func NewRealtimeIndex(newLexicon SegmentLexiconFunc) *RealtimeIndex {
+	r := new(RealtimeIndex)
+	r.RefreshInterval = DefaultRefreshInterval
+	r.WildcardLimit = DefaultWildcardLimit
+	r.SegmentsPerTier = DefaultSegmentsPerTier
+	r.newLexicon = newLexicon
+	r.terms = NewTermList()
+	r.refreshLock = new(sync.Mutex)
+	r.snapshotLock = new(sync.RWMutex)
+
+	r.buffer = new(SingleTermIndex)
+	r.buffer.Init(r.segmentLexicon())
+
+	r.snapshot = NewSegmentView(r.terms)
+	return r
+}
+
+func (r *RealtimeIndex) segmentLexicon() Lexicon {
+	lexicon := r.newLexicon()
+	if trie, ok := lexicon.(*TrieLexicon); ok {
+		trie.Terms = r.terms
+		trie.TermIds = r.terms.Number
+	}
+	return lexicon
+}
+
+func (r *RealtimeIndex) AddFilter(f filters.Filter) {
+	r.buffer.AddFilter(f)
+}
+
+func (r *RealtimeIndex) Insert(d filereader.Document) {
+	r.buffer.Insert(d)
+}
+
+// The number of documents in the current snapshot
+func (r *RealtimeIndex) Len() int {
+	return r.Snapshot().Len()
+}
+
+func (r *RealtimeIndex) String() string {
+	r.snapshotLock.RLock()
+	defer r.snapshotLock.RUnlock()
+	return fmt.Sprintf("{RealtimeIndex refreshes:%d %s}",
+		r.refreshes, r.snapshot.String())
+}
+
+// The most recently published snapshot
+func (r *RealtimeIndex) Snapshot() *SingleTermIndex {
+	r.snapshotLock.RLock()
+	defer r.snapshotLock.RUnlock()
+	return r.snapshot
+}
+
+/* Publish a snapshot holding every document inserted so far.
+ * Inserts carry on into a fresh buffer while it's built. Returns
+ * false if there was nothing new to publish. */
+func (r *RealtimeIndex) Refresh() bool {
+	r.refreshLock.Lock()
+	defer r.refreshLock.Unlock()
+
+	segment := r.buffer.Detach(r.segmentLexicon())
+	if segment.Len() == 0 {
+		return false
+	}
+
+	// Snapshots hold on to the published list, so change a copy
+	published := make(map[*SingleTermIndex]bool)
+	segments := make([]*SingleTermIndex, 0, len(r.segments)+1)
+	for _, old := range r.segments {
+		published[old] = true
+		segments = append(segments, old)
+	}
+	segments = r.mergeTiers(append(segments, segment))
+
+	/* New segments are finalized with the statistics of the whole
+	 * snapshot. Older ones keep the norms they were given. */
+	next := NewSegmentView(r.terms, segments...)
+	next.WildcardLimit = r.WildcardLimit
+	for _, added := range segments {
+		if !published[added] {
+			added.FinalizeIn(next)
+		}
+	}
+
+	r.snapshotLock.Lock()
+	r.segments = segments
+	r.snapshot = next
+	r.refreshes++
+	r.snapshotLock.Unlock()
+
+	log.Infof("Published snapshot %d with %d new documents in %d segments",
+		r.refreshes, segment.Len(), len(segments))
+	return true
+}
+
+// The tier of a segment, which is the log of its size
+func (r *RealtimeIndex) tier(segment *SingleTermIndex) int {
+	tier := 0
+	for size := segment.Len(); size >= r.SegmentsPerTier; size /= r.SegmentsPerTier {
+		tier++
+	}
+	return tier
+}
+
+/* Merge segments SegmentsPerTier at a time, while a tier has that
+ * many. Each merge moves its documents up a tier, so a document is
+ * merged about once per tier. */
+func (r *RealtimeIndex) mergeTiers(segments []*SingleTermIndex) []*SingleTermIndex {
+	if r.SegmentsPerTier < 2 {
+		return segments
+	}
+
+	for {
+		tiers := make(map[int][]*SingleTermIndex)
+		var group []*SingleTermIndex
+		for _, segment := range segments {
+			tier := r.tier(segment)
+			if tiers[tier] = append(tiers[tier], segment); len(tiers[tier]) == r.SegmentsPerTier {
+				group = tiers[tier]
+				break
+			}
+		}
+		if group == nil {
+			return segments
+		}
+
+		merged := new(SingleTermIndex)
+		merged.Init(r.segmentLexicon())
+		merged.Merge(group...)
+
+		inGroup := make(map[*SingleTermIndex]bool)
+		for _, segment := range group {
+			inGroup[segment] = true
+		}
+		kept := make([]*SingleTermIndex, 0, len(segments)-len(group)+1)
+		for _, segment := range segments {
+			if !inGroup[segment] {
+				kept = append(kept, segment)
+			}
+		}
+		segments = append(kept, merged)
+	}
+}
+
+// Refresh every RefreshInterval until Stop is called
+func (r *RealtimeIndex) Start() {
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan bool)
+	r.stopped = make(chan bool)
+
+	go func(stop, stopped chan bool) {
+		ticker := time.NewTicker(r.RefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.Refresh()
+			case <-stop:
+				close(stopped)
+				return
+			}
+		}
+	}(r.stop, r.stopped)
+}
+
+// Stop refreshing, and publish anything still buffered
+func (r *RealtimeIndex) Stop() {
+	if r.stop != nil {
+		r.stop <- true
+		<-r.stopped
+		r.stop = nil
+	}
+	r.Refresh()
+}
+
+/* Filter query tokens with a copy of the buffer's filter chain,
+ * since the buffer's own chain is busy with documents. */
+func (r *RealtimeIndex) FilterTokens(input, output chan *filereader.Token) {
+	r.buffer.CopyFilters().FilterTokens(input, output)
+}
@@ -5,6 +5,10 @@ import "io"
 import "math"
 import "os"
 import "bytes"
+import "bufio"
+import "errors"
+import "sort"
+import "strings"
 import "encoding/json"
 import "github.com/cwacek/irengine/indexer/filters"
 import "github.com/cwacek/irengine/scanner/filereader"
@@ -16,13 +20,26 @@ type StoredDocInfo struct {
 	HumanId   string
 	TermCount int
 	MaxTf     int
-	// Store the term frequency for every term
-	// in this document. This is heinous, but
-	// Cosine doesn't work without it, and no
-	// one can adequately explain how that makes
-	// any fucking sense. You have to iterate
-	// over all the terms *in a document*........
-	TermTfIdf map[string]float64
+	// The length of the document's tf-idf vector. Set by Finalize.
+	Norm float64
+
+	// The positions where each sentence and paragraph after the
+	// first one starts
+	Sentences  []int `json:",omitempty"`
+	Paragraphs []int `json:",omitempty"`
+}
+
+// Note where token starts a new sentence or paragraph
+func (info *StoredDocInfo) addBoundary(token *filereader.Token) {
+	if token.Type == filereader.NullToken || token.Position <= 1 {
+		return
+	}
+	if token.Boundary >= filereader.SentenceBoundary {
+		info.Sentences = append(info.Sentences, token.Position)
+	}
+	if token.Boundary == filereader.ParagraphBoundary {
+		info.Paragraphs = append(info.Paragraphs, token.Position)
+	}
 }
 
 func (info *StoredDocInfo) MarshalJSON() ([]byte, error) {
@@ -35,7 +52,9 @@ func (info *StoredDocInfo) Clone() (new_info *StoredDocInfo) {
 	new_info.TermCount = info.TermCount
 	new_info.Id = info.Id
 	new_info.MaxTf = info.MaxTf
-	new_info.TermTfIdf = info.TermTfIdf
+	new_info.Norm = info.Norm
+	new_info.Sentences = append([]int(nil), info.Sentences...)
+	new_info.Paragraphs = append([]int(nil), info.Paragraphs...)
 
 	return
 }
@@ -88,6 +107,129 @@ func (m DocInfoMap) UnmarshalJSON(input []byte) (e error) {
 	return nil
 }
 
+// The header of a document map written by WriteBinary
+var BinaryDocMapMagic = []byte("IRDOCS\x01\n")
+
+var ErrNotBinaryDocMap = errors.New("Not a binary document map")
+
+/* Write the document map in a compact binary format. Documents
+ * are written in DocumentId order, each as its id, its human id,
+ * its length and max tf, its norm, and the gap encoded starts of
+ * its sentences and paragraphs. */
+func (m DocInfoMap) WriteBinary(w io.Writer) error {
+	var buf []byte
+
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	writer := bufio.NewWriter(w)
+	writer.Write(BinaryDocMapMagic)
+
+	buf = AppendVByte(buf[:0], uint64(len(ids)))
+	writer.Write(buf)
+
+	for _, id := range ids {
+		info := m[filereader.DocumentId(id)]
+
+		buf = AppendVByte(buf[:0], uint64(info.Id))
+		buf = AppendVByte(buf, uint64(len(info.HumanId)))
+		buf = append(buf, info.HumanId...)
+		buf = AppendVByte(buf, uint64(info.TermCount))
+		buf = AppendVByte(buf, uint64(info.MaxTf))
+		buf = appendUint64(buf, math.Float64bits(info.Norm))
+		buf = appendGaps(buf, info.Sentences)
+		buf = appendGaps(buf, info.Paragraphs)
+
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// Append the count of a sorted list, then the gaps between its values
+func appendGaps(buf []byte, values []int) []byte {
+	buf = AppendVByte(buf, uint64(len(values)))
+	last := 0
+	for _, v := range values {
+		buf = AppendVByte(buf, uint64(v-last))
+		last = v
+	}
+	return buf
+}
+
+// Read a document map written by WriteBinary into m
+func (m DocInfoMap) ReadBinary(r io.Reader) error {
+	reader := bufio.NewReader(r)
+
+	magic := make([]byte, len(BinaryDocMapMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return ErrNotBinaryDocMap
+	}
+
+	if !bytes.Equal(magic, BinaryDocMapMagic) {
+		return ErrNotBinaryDocMap
+	}
+
+	var err error
+	readInt := func() uint64 {
+		var v uint64
+		if err == nil {
+			v, err = ReadVByteFrom(reader)
+		}
+		return v
+	}
+	readString := func() string {
+		buf := make([]byte, readInt())
+		if err == nil {
+			_, err = io.ReadFull(reader, buf)
+		}
+		return string(buf)
+	}
+	readFloat := func() float64 {
+		raw := make([]byte, 8)
+		if err == nil {
+			_, err = io.ReadFull(reader, raw)
+		}
+		return math.Float64frombits(readUint64(raw))
+	}
+	readGaps := func() []int {
+		n := readInt()
+		if err != nil || n == 0 {
+			return nil
+		}
+		values := make([]int, n)
+		last := 0
+		for i := range values {
+			last += int(readInt())
+			values[i] = last
+		}
+		return values
+	}
+
+	count := readInt()
+	for i := uint64(0); i < count && err == nil; i++ {
+		info := new(StoredDocInfo)
+		info.Id = filereader.DocumentId(readInt())
+		info.HumanId = readString()
+		info.TermCount = int(readInt())
+		info.MaxTf = int(readInt())
+		info.Norm = readFloat()
+		info.Sentences = readGaps()
+		info.Paragraphs = readGaps()
+
+		m[info.Id] = info
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 type SingleTermIndex struct {
 	dataDir string
 
@@ -99,6 +241,35 @@ type SingleTermIndex struct {
 
 	DocumentMap DocInfoMap
 
+	stats CollectionStats
+
+	// Document vectors, if the forward index is enabled
+	forward *ForwardIndex
+
+	// Expands wildcard query terms
+	wildcards *WildcardIndex
+
+	// The term table, for lexicons which don't keep one
+	terms *TermList
+
+	// The indexes a view searches. See NewSegmentView.
+	segments []*SingleTermIndex
+
+	// Documents deleted from a segment. See WithDeleted.
+	deleted map[filereader.DocumentId]bool
+
+	// The most terms a wildcard pattern or fuzzy term expands to
+	WildcardLimit int
+
+	// Recorded in the manifest when the index is saved
+	IndexType string
+	Sources   []string
+
+	// The text of documents, written as they're inserted and
+	// read back once the index is loaded
+	storeWriter *DocumentStoreWriter
+	documents   *DocumentStore
+
 	// utility vars
 	inserterRunning bool
 	insertLock      *sync.RWMutex
@@ -116,6 +287,18 @@ func (t *SingleTermIndex) Prune(pruner PostingListPruner) {
 		term LexiconTerm
 	)
 
+	if deferred, ok := t.lexicon.(DeferredPruner); ok {
+		if needsObserving(pruner) {
+			log.Errorf("Can't prune while saving with %T, which needs every "+
+				"posting list first. Prune the saved index instead", pruner)
+			return
+		}
+		log.Debug("Deferring pruning until the index is saved")
+		deferred.PruneOnSave(pruner)
+		return
+	}
+
+	PreparePruner(pruner, t.lexicon)
 	log.Debug("Pruning index")
 
 	for _, entry := range t.lexicon.Walk() {
@@ -129,14 +312,407 @@ func (t *SingleTermIndex) IsPositional() bool {
 	return t.lexicon.IsPositional()
 }
 
+func (t *SingleTermIndex) Lexicon() Lexicon {
+	return t.lexicon
+}
+
 func (t *SingleTermIndex) TermCount() int {
 	return t.lexicon.Len()
 }
 
+func (t *SingleTermIndex) Stats() *CollectionStats {
+	return &t.stats
+}
+
+/* Keep a forward index of document vectors. It's built when the
+ * index is finalized and saved alongside it. */
+func (t *SingleTermIndex) EnableForwardIndex() {
+	if t.forward == nil {
+		t.forward = NewForwardIndex()
+	}
+}
+
+func (t *SingleTermIndex) SetForwardIndex(forward *ForwardIndex) {
+	forward.SetTermTable(t.TermTable())
+	t.forward = forward
+}
+
+func (t *SingleTermIndex) ForwardIndex() *ForwardIndex {
+	return t.forward
+}
+
+/* The terms in document id, in term id order. Only available
+ * if the index has a forward index. */
+func (t *SingleTermIndex) DocumentVector(id filereader.DocumentId) ([]DocumentTerm, bool) {
+	if t.forward == nil {
+		return nil, false
+	}
+	return t.forward.Vector(id)
+}
+
+/* Write the text of every document inserted from now on to a
+ * document store in the index's directory. */
+func (t *SingleTermIndex) EnableDocumentStore() error {
+	if t.dataDir == "" {
+		return errors.New("Document store needs a persistent lexicon")
+	}
+
+	writer, err := NewDocumentStoreWriter(t.dataDir)
+	if err != nil {
+		return err
+	}
+	t.storeWriter = writer
+	return nil
+}
+
+func (t *SingleTermIndex) SetDocumentStore(store *DocumentStore) {
+	t.documents = store
+}
+
+// Whether the text of the index's documents can be fetched
+func (t *SingleTermIndex) HasDocumentStore() bool {
+	return t.documents != nil
+}
+
+/* Add text to the document store being written, for a document
+ * that isn't inserted, like one copied from another index. */
+func (t *SingleTermIndex) StoreText(humanId, text string) error {
+	if t.storeWriter == nil {
+		return ErrNoDocumentStore
+	}
+	return t.storeWriter.Add(humanId, text)
+}
+
+// Add the text of d to the document store, if there is one
+func (t *SingleTermIndex) storeDocument(d filereader.Document) {
+	if t.storeWriter == nil {
+		return
+	}
+
+	if doc, ok := d.(filereader.TextDocument); ok {
+		if err := t.storeWriter.Add(d.OrigIdent(), doc.Text()); err != nil {
+			log.Criticalf("Error storing %s: %v", d.OrigIdent(), err)
+			panic(err)
+		}
+	} else {
+		log.Warnf("Can't store %s, since it has no text", d.OrigIdent())
+	}
+}
+
+// Return the full text of the document with humanId
+func (t *SingleTermIndex) GetDocument(humanId string) (string, error) {
+	if t.documents == nil {
+		return "", ErrNoDocumentStore
+	}
+	return t.documents.Get(humanId)
+}
+
+/* The stored information for document id, or nil if the index
+ * doesn't have it. A view finds it in its segments. */
+func (t *SingleTermIndex) DocInfo(id filereader.DocumentId) *StoredDocInfo {
+	if t.deleted[id] {
+		return nil
+	}
+	if info, ok := t.DocumentMap[id]; ok {
+		return info
+	}
+	for _, segment := range t.segments {
+		if info := segment.DocInfo(id); info != nil {
+			return info
+		}
+	}
+	return nil
+}
+
+/* Find the term for text. Wildcard patterns and fuzzy terms are
+ * expanded, and the matching terms combined into a single term.
+ * Proximity operators become a term for their matches. */
 func (t *SingleTermIndex) Retrieve(text string) (LexiconTerm, bool) {
+	if p, ok := ParseProximity(text); ok {
+		return t.retrieveProximity(p)
+	}
+	if IsWildcard(text) {
+		return t.retrieveWildcard(text)
+	}
+	if IsFuzzy(text) {
+		return t.retrieveFuzzy(text)
+	}
 	return t.lexicon.FindTerm([]byte(text))
 }
 
+/* The table of the lexicon's term ids. Lexicons which don't
+ * number their terms are numbered in sorted order, which holds
+ * until they change. */
+func (t *SingleTermIndex) TermTable() TermTable {
+	if numbered, ok := t.lexicon.(NumberedLexicon); ok {
+		return numbered.TermTable()
+	}
+
+	if t.terms == nil {
+		t.terms = NewTermList()
+		for _, term := range sortedTerms(t.lexicon) {
+			t.terms.Add(term.Text())
+		}
+	}
+	return t.terms
+}
+
+// The id of the term with text
+func (t *SingleTermIndex) TermId(text string) (TermId, bool) {
+	term, ok := t.lexicon.FindTerm([]byte(text))
+	if !ok {
+		return 0, false
+	}
+	if identified, ok := term.(TermIdentifier); ok {
+		return identified.Id(), true
+	}
+
+	terms := t.TermTable().(*TermList)
+	i := sort.Search(terms.Len(), func(i int) bool {
+		found, _ := terms.TermText(TermId(i))
+		return found >= text
+	})
+	return TermId(i), true
+}
+
+// The text of the term with id
+func (t *SingleTermIndex) TermText(id TermId) (string, bool) {
+	return t.TermTable().TermText(id)
+}
+
+func (t *SingleTermIndex) SetWildcardIndex(wildcards *WildcardIndex) {
+	wildcards.SetTermTable(t.TermTable())
+	t.wildcards = wildcards
+}
+
+func (t *SingleTermIndex) WildcardIndex() *WildcardIndex {
+	if t.wildcards == nil {
+		log.Infof("Building wildcard index for %s", t)
+		t.wildcards = NewWildcardIndex()
+		t.wildcards.Build(t.lexicon, t.TermTable())
+	}
+	return t.wildcards
+}
+
+/* The terms matching pattern. If there are more than limit, the
+ * ones in the most documents are kept. Only those are looked up,
+ * and the others' document frequencies come from the collection
+ * statistics, so their posting lists aren't fetched. */
+func (t *SingleTermIndex) ExpandWildcard(pattern string, limit int) []LexiconTerm {
+	matches := make(termsByDf, 0)
+	for _, text := range t.wildcardMatches(pattern) {
+		df, _ := t.termDf(text)
+		matches = append(matches, term_df{text, df})
+	}
+
+	if limit > 0 && len(matches) > limit {
+		sort.Stable(matches)
+		log.Infof("Expanded '%s' to %d terms. Keeping %d", pattern, len(matches), limit)
+		matches = matches[:limit]
+	}
+
+	terms := make([]LexiconTerm, 0, len(matches))
+	for _, match := range matches {
+		if term, ok := t.lexicon.FindTerm([]byte(match.text)); ok {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+/* The text of every term matching pattern. The terms starting with
+ * its prefix are walked if the lexicon can, and the wildcard index
+ * used if not. A view asks each of its segments. */
+func (t *SingleTermIndex) wildcardMatches(pattern string) []string {
+	matches := make([]string, 0)
+	add := func(text string) bool {
+		if MatchWildcard(pattern, text) {
+			matches = append(matches, text)
+		}
+		return true
+	}
+
+	prefix := pattern[:strings.Index(pattern+"*", "*")]
+	walker, canWalk := t.lexicon.(PrefixLexicon)
+
+	switch {
+	case t.segments != nil:
+		seen := make(map[string]bool)
+		for _, segment := range t.segments {
+			for _, text := range segment.wildcardMatches(pattern) {
+				if !seen[text] {
+					seen[text] = true
+					matches = append(matches, text)
+				}
+			}
+		}
+		sort.Strings(matches)
+
+	case canWalk && prefix != "":
+		walker.WalkPrefix(prefix, add)
+
+	default:
+		for _, text := range t.WildcardIndex().Expand(pattern) {
+			add(text)
+		}
+	}
+	return matches
+}
+
+/* The number of documents containing text, from the collection
+ * statistics if they have it, and its posting list if not. */
+func (t *SingleTermIndex) termDf(text string) (int, bool) {
+	if counted, ok := t.stats.Term(text); ok {
+		return counted.Df, true
+	}
+	if term, ok := t.lexicon.FindTerm([]byte(text)); ok {
+		return Df(term), true
+	}
+	return 0, false
+}
+
+type term_df struct {
+	text string
+	df   int
+}
+
+type termsByDf []term_df
+
+func (t termsByDf) Len() int {
+	return len(t)
+}
+
+func (t termsByDf) Less(i, j int) bool {
+	return t[i].df > t[j].df
+}
+
+func (t termsByDf) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// Expand pattern, and combine the expansions into one term
+func (t *SingleTermIndex) retrieveWildcard(pattern string) (LexiconTerm, bool) {
+	return t.synonymTerm(pattern, t.ExpandWildcard(pattern, t.WildcardLimit))
+}
+
+/* The terms within some edit distance of text, closest first and
+ * then those in the most documents. */
+func (t *SingleTermIndex) FuzzyLookup(text string, distance int) []FuzzyMatch {
+	matches := t.fuzzyMatches(text, distance)
+	for i := range matches {
+		matches[i].Df, _ = t.termDf(matches[i].Text)
+	}
+	sort.Sort(fuzzyMatches(matches))
+	return matches
+}
+
+// The terms within distance of text. A view asks each of its segments.
+func (t *SingleTermIndex) fuzzyMatches(text string, distance int) []FuzzyMatch {
+	if t.segments == nil {
+		return t.WildcardIndex().Fuzzy(text, distance)
+	}
+
+	seen := make(map[string]bool)
+	matches := make([]FuzzyMatch, 0)
+	for _, segment := range t.segments {
+		for _, match := range segment.fuzzyMatches(text, distance) {
+			if !seen[match.Text] {
+				seen[match.Text] = true
+				matches = append(matches, match)
+			}
+		}
+	}
+	return matches
+}
+
+// Look up a fuzzy term like 'term~1', combining the matches into one term
+func (t *SingleTermIndex) retrieveFuzzy(text string) (LexiconTerm, bool) {
+	word, distance, _ := ParseFuzzy(text)
+
+	matches := t.FuzzyLookup(word, distance)
+	if t.WildcardLimit > 0 && len(matches) > t.WildcardLimit {
+		matches = matches[:t.WildcardLimit]
+	}
+
+	terms := make([]LexiconTerm, 0, len(matches))
+	for _, match := range matches {
+		if term, ok := t.lexicon.FindTerm([]byte(match.Text)); ok {
+			terms = append(terms, term)
+		}
+	}
+	return t.synonymTerm(text, terms)
+}
+
+/* Match a proximity operator. Its terms can be patterns, but if
+ * any of them isn't found, or nothing matches, neither is the
+ * operator. */
+func (t *SingleTermIndex) retrieveProximity(p *Proximity) (LexiconTerm, bool) {
+	pls := make([]PostingList, len(p.Terms))
+	for i, text := range p.Terms {
+		term, ok := t.Retrieve(text)
+		if !ok {
+			return nil, false
+		}
+		pls[i] = term.PostingList()
+	}
+
+	matched, err := p.MatchWithin(t.Boundaries, pls...)
+	if err != nil {
+		log.Warnf("Can't match '%s': %v", p, err)
+		return nil, false
+	}
+	if matched.Len() == 0 {
+		return nil, false
+	}
+
+	cf := 0
+	for it := matched.Iterator(); it.Next(); {
+		cf += it.Value().Frequency()
+	}
+	return &Term{Text_: p.String(), Tf_: cf, Pl: matched}, true
+}
+
+/* Where the sentences or paragraphs of doc after the first start.
+ * Documents indexed before boundaries were kept are one unit. */
+func (t *SingleTermIndex) Boundaries(doc filereader.DocumentId,
+	scope filereader.Boundary) []int {
+
+	info := t.DocInfo(doc)
+	switch {
+	case info == nil:
+		return nil
+	case scope == filereader.ParagraphBoundary:
+		return info.Paragraphs
+	default:
+		return info.Sentences
+	}
+}
+
+/* Treat terms as synonyms, merging them into one term whose tf
+ * in a document is the sum of theirs, so the df is the number of
+ * documents containing any of them. This keeps a pattern with many
+ * expansions from swamping the score of the rest of the query. */
+func (t *SingleTermIndex) synonymTerm(text string, terms []LexiconTerm) (LexiconTerm, bool) {
+	if len(terms) == 0 {
+		return nil, false
+	}
+
+	plInit := BasicPostingListInitializer
+	if t.IsPositional() {
+		plInit = PositionalPostingListInitializer
+	}
+
+	tf := 0
+	its := make([]PostingListIterator, len(terms))
+	for i, term := range terms {
+		tf += term.Tf()
+		its[i] = term.PostingList().Iterator()
+	}
+
+	synonyms := &Term{Text_: text, Tf_: tf, Pl: Collect(Or(its...), plInit)}
+	return synonyms, true
+}
+
 func (t *SingleTermIndex) Save() {
 	var persist PersistentLexicon
 
@@ -144,42 +720,73 @@ func (t *SingleTermIndex) Save() {
 	case PersistentLexicon:
 		persist = t.lexicon.(PersistentLexicon)
 		persist.SaveToDisk()
+		t.Finalize()
 
-		if file, err := os.Create(persist.Location() + "docmap.txt"); err != nil {
-			log.Critical("Error opening document map file: %v", err)
+		if file, err := os.Create(persist.Location() + "docmap.bin"); err != nil {
+			log.Criticalf("Error opening document map file: %v", err)
 			panic(err)
 		} else {
-			if bytes, err := json.MarshalIndent(t.DocumentMap, "", "  "); err != nil {
+			if err = t.DocumentMap.WriteBinary(file); err != nil {
 				panic(err)
-			} else {
-				file.Write(bytes)
 			}
 			file.Close()
 		}
 
-		if file, err := os.Create(persist.Location() + "filters.mdt"); err != nil {
-			log.Criticalf("Error opening filter file: %v", err)
+		if file, err := os.Create(persist.Location() + CollectionStatsFile); err != nil {
+			log.Criticalf("Error opening collection statistics file: %v", err)
 			panic(err)
 		} else {
+			if _, err = t.stats.WriteTo(file); err != nil {
+				panic(err)
+			}
+			file.Close()
+		}
+
+		if file, err := os.Create(persist.Location() + WildcardIndexFile); err != nil {
+			log.Criticalf("Error opening wildcard index file: %v", err)
+			panic(err)
+		} else {
+			if _, err = t.wildcards.WriteTo(file); err != nil {
+				panic(err)
+			}
+			file.Close()
+		}
 
-			var filterFactory filters.FilterFactory
-			var e error
-			var out string
-
-			log.Warnf("filterchain Ids: %v", t.filterChain.Ids())
-			for _, filter := range t.filterChain.Ids() {
-				log.Infof("Writing '%s' to filter metadata", filter)
-				if filterFactory, e = filters.GetFactory(filter); e == nil {
-					out = filter + " " + filterFactory.Serialize()
-					fmt.Fprintln(file, out)
-				} else {
-					log.Warnf("Couldn't save %s because don't know how.", filter)
+		if t.storeWriter != nil {
+			if err := t.storeWriter.Close(); err != nil {
+				log.Criticalf("Error writing document store: %v", err)
+				panic(err)
+			}
+			log.Infof("Stored the text of %d documents", t.storeWriter.Len())
+			t.storeWriter = nil
+		}
+
+		if t.forward != nil {
+			if file, err := os.Create(persist.Location() + ForwardIndexFile); err != nil {
+				log.Criticalf("Error opening forward index file: %v", err)
+				panic(err)
+			} else {
+				if _, err = t.forward.WriteTo(file); err != nil {
+					panic(err)
 				}
+				file.Close()
 			}
+		}
 
+		if file, err := os.Create(persist.Location() + "filters.mdt"); err != nil {
+			log.Criticalf("Error opening filter file: %v", err)
+			panic(err)
+		} else {
+			t.WriteFilters(file)
 			file.Close()
 		}
 
+		// Last, so it checksums everything else
+		if err := t.WriteManifest(persist.Location()); err != nil {
+			log.Criticalf("Error writing index manifest: %v", err)
+			panic(err)
+		}
+
 	default:
 		panic("Save to disk not supported")
 		log.Critical("Save to disk not supported")
@@ -187,6 +794,27 @@ func (t *SingleTermIndex) Save() {
 
 }
 
+/* Write the filter chain as filters.mdt has it, a filter id and
+ * its serialized arguments on each line. */
+func (t *SingleTermIndex) WriteFilters(w io.Writer) {
+	var filterFactory filters.FilterFactory
+	var e error
+
+	if t.filterChain == nil {
+		return
+	}
+
+	log.Warnf("filterchain Ids: %v", t.filterChain.Ids())
+	for _, filter := range t.filterChain.Ids() {
+		log.Infof("Writing '%s' to filter metadata", filter)
+		if filterFactory, e = filters.GetFactory(filter); e == nil {
+			fmt.Fprintln(w, filter+" "+filterFactory.Serialize())
+		} else {
+			log.Warnf("Couldn't save %s because don't know how.", filter)
+		}
+	}
+}
+
 func (t *SingleTermIndex) String() string {
 	return fmt.Sprintf("{SingleTermIndex terms:%d docs:%d}",
 		t.lexicon.Len(),
@@ -199,10 +827,15 @@ func (t *SingleTermIndex) Init(lexicon Lexicon) error {
 	t.filterChain = nil
 
 	t.lexicon = lexicon
+	if persist, ok := lexicon.(PersistentLexicon); ok {
+		t.dataDir = persist.Location()
+	}
 
 	t.DocumentCount = 0
 
 	t.DocumentMap = make(DocInfoMap)
+	t.stats = CollectionStats{}
+	t.WildcardLimit = DefaultWildcardLimit
 
 	t.inserterRunning = false
 	t.shutdown = make(chan bool)
@@ -240,6 +873,22 @@ func (t *SingleTermIndex) PrintLexicon(w io.Writer) {
 	return
 }
 
+/* An empty index with a fresh copy of the filter chain, so query
+ * tokens can be filtered while this chain is busy with documents. */
+func (t *SingleTermIndex) CopyFilters() *SingleTermIndex {
+	copied := new(SingleTermIndex)
+	copied.Init(NewTrieLexicon())
+
+	if t.filterChain != nil {
+		if chain, err := filters.InstantiateChain(t.filterChain.Ids()); err != nil {
+			panic(err)
+		} else if chain != nil {
+			copied.AddFilter(chain)
+		}
+	}
+	return copied
+}
+
 /* Connect the filter chain to the input and output channels and translate between them. */
 func (t *SingleTermIndex) FilterTokens(input, output chan *filereader.Token) {
 
@@ -290,7 +939,10 @@ func (t *SingleTermIndex) Insert(d filereader.Document) {
 	}
 
 	if !t.inserterRunning {
-		go t.inserter()
+		// Grab the output before anything is pushed, otherwise
+		// the chain drops tokens on the floor.
+		t.inserterRunning = true
+		go t.inserter(t.filterChain.Output())
 	}
 
 	//Print this if things go south
@@ -300,35 +952,34 @@ func (t *SingleTermIndex) Insert(d filereader.Document) {
 		}
 	}()
 
+	// Filters can change tokens, so take the text first
+	t.storeDocument(d)
+
 	info := new(StoredDocInfo)
-	info.TermTfIdf = make(map[string]float64)
 	info.HumanId = d.OrigIdent()
 	info.Id = d.Identifier()
-	t.DocumentMap[info.Id] = info
 
+	// The inserter reads the document map, so don't touch it
+	// until the previous document is done.
 	t.insertLock.Lock()
+	t.DocumentMap[info.Id] = info
+
 	for token := range d.Tokens() {
 		log.Debugf("Inserting %s into index input", token)
+		info.addBoundary(token)
 		input.Push(token)
 	}
-
-	t.lexicon.(PersistentLexicon).PrintDiskStats(os.Stdout)
-	log.Infof("Inserted %d tokens from %s. Have %d documents with %d terms",
-		d.Len(), d.OrigIdent(), t.Len(), t.lexicon.Len())
 }
 
 // Read tokens from tokenStream and insert it into the
 // index
-func (t *SingleTermIndex) inserter() {
+func (t *SingleTermIndex) inserter(filterChainOut *filters.FilterPipe) {
 
-	t.inserterRunning = true
-
-	filterChainOut := t.filterChain.Output()
 	log.Debugf("inserter process started listening on %v", filterChainOut)
 
 	var termcounter = 0
 	var info *StoredDocInfo
-	var term LexiconTerm
+	var docTerms = make(map[string]int)
 
 	for {
 		var token *filereader.Token
@@ -337,6 +988,7 @@ func (t *SingleTermIndex) inserter() {
 			break
 		case <-t.shutdown:
 			log.Debugf("Got shutdown signal")
+			t.inserterRunning = false
 			return
 		}
 
@@ -344,42 +996,274 @@ func (t *SingleTermIndex) inserter() {
 		if token.Type == filereader.NullToken {
 			t.DocumentCount += 1
 			info.TermCount = termcounter
+			t.stats.AddDocument(termcounter)
+			for text, tf := range docTerms {
+				t.stats.AddTerm(text, tf)
+				delete(docTerms, text)
+			}
 			termcounter = 0
+
+			// Report while the document is still ours, since
+			// the index can change as soon as it's unlocked
+			if persist, ok := t.lexicon.(PersistentLexicon); ok {
+				persist.PrintDiskStats(os.Stdout)
+			}
+			log.Infof("Inserted %d terms from %s. Have %d documents with %d terms",
+				info.TermCount, info.HumanId, t.DocumentCount, t.lexicon.Len())
 			t.insertLock.Unlock()
 			continue
 		}
 
-		term = t.lexicon.InsertToken(token)
+		t.lexicon.InsertToken(token)
+		docTerms[token.Text]++
+		termcounter++
+	}
 
-		/* Update document-indexed statistics */
+	log.Criticalf("Filter chain %s closed")
+	t.inserterRunning = false
+}
 
-		// Add 1 to the document count to make sure we count this one
-		weight := Tf_d(term, info.Id) * Idf(term, t.DocumentCount+1)
+func (t *SingleTermIndex) Delete() {
+	if err := os.RemoveAll(t.dataDir); err != nil {
+		panic(err)
+	}
+	if t.inserterRunning {
+		log.Debugf("sending shutdown signal")
+		t.shutdown <- true
+	}
+}
+
+/* Merge the terms and documents of others into this index. The
+ * indexes must not contain any of the same documents. Each term's
+ * postings from all of them are combined and merged in one go, so
+ * a lexicon which swaps posting lists to disk fetches each list
+ * once, rather than once per index. Others are read in parallel,
+ * and are left as they were, so they can still be searched. */
+func (t *SingleTermIndex) Merge(others ...*SingleTermIndex) {
+	streams := make([]chan partial_term, len(others))
+	heads := make([]*partial_term, len(others))
+	for i, other := range others {
+		other.WaitInsert()
+		log.Infof("Merging %s into %s", other, t)
+
+		streams[i] = make(chan partial_term, mergeReadAhead)
+		go readTerms(other.lexicon, streams[i])
+		heads[i] = nextTerm(streams[i])
+	}
 
-		log.Debugf("Setting weight for %s in %s to %0.4f * %0.4f = %f",
-			token.Text, info.HumanId, Tf_d(term, info.Id), Idf(term, t.DocumentCount+1), weight)
-		if math.IsInf(weight, 0) {
-			panic("TO INFINITY AND BEYOND!")
+	t.insertLock.Lock()
+	defer t.insertLock.Unlock()
+
+	typed, canCombine := t.lexicon.(PostingListTyped)
+	lists := make([]PostingList, 0, len(others))
+	for {
+		var text string
+		found := false
+		for _, head := range heads {
+			if head != nil && (!found || head.text < text) {
+				text, found = head.text, true
+			}
+		}
+		if !found {
+			break
 		}
 
-		info.TermTfIdf[term.Text()] = weight
+		lists = lists[:0]
+		for i, head := range heads {
+			if head != nil && head.text == text {
+				lists = append(lists, head.pl)
+				heads[i] = nextTerm(streams[i])
+			}
+		}
 
-		if term.Tf() > info.MaxTf {
-			info.MaxTf = term.Tf()
+		if len(lists) == 1 || !canCombine {
+			for _, pl := range lists {
+				t.lexicon.MergePostingList(text, pl)
+			}
+		} else {
+			t.lexicon.MergePostingList(text,
+				combinePostingLists(typed.PLInitializer(), lists))
 		}
-		termcounter++
 	}
 
-	log.Criticalf("Filter chain %s closed")
-	t.inserterRunning = false
+	for _, other := range others {
+		// Finalize changes the documents' norms, so copy them
+		for id, info := range other.DocumentMap {
+			t.DocumentMap[id] = info.Clone()
+		}
+		t.DocumentCount += other.DocumentCount
+		t.stats.Merge(&other.stats)
+	}
 }
 
-func (t *SingleTermIndex) Delete() {
-	if err := os.RemoveAll(t.dataDir); err != nil {
-		panic(err)
+// How many terms Merge reads ahead of the merge from each index
+const mergeReadAhead = 64
+
+// A term read from an index being merged
+type partial_term struct {
+	text string
+	pl   PostingList
+}
+
+// Send the terms of lexicon on terms, in order, then close it
+func readTerms(lexicon Lexicon, terms chan<- partial_term) {
+	entries := lexicon.Walk()
+	sorted := make(termsByText, len(entries))
+	for i, entry := range entries {
+		sorted[i] = entry.(LexiconTerm)
+	}
+	sort.Sort(sorted)
+
+	for _, term := range sorted {
+		terms <- partial_term{term.Text(), term.PostingList()}
+	}
+	close(terms)
+}
+
+func nextTerm(terms <-chan partial_term) *partial_term {
+	if term, ok := <-terms; ok {
+		return &term
+	}
+	return nil
+}
+
+// One posting list with the entries of lists, which are disjoint
+func combinePostingLists(plInit PostingListInitializer,
+	lists []PostingList) PostingList {
+
+	combined := plInit.Create()
+	for _, pl := range lists {
+		for it := pl.Iterator(); it.Next(); {
+			combined.InsertCompleteEntry(it.Value())
+		}
+	}
+	return combined
+}
+
+/* Compute the exact norm of every document's tf-idf vector, and
+ * its largest term frequency, from the final posting lists and
+ * collection statistics. Weights are (1 + log tf) * idf, the same
+ * as CosineVSM uses. Every norm depends on the whole collection,
+ * so this is done once indexing is finished. The wildcard and
+ * forward indexes are rebuilt at the same time. */
+func (t *SingleTermIndex) Finalize() {
+	t.finalize(t.stats.Idf)
+}
+
+/* Finalize the index as a segment of view, which it's in or about
+ * to be added to, so its documents' norms use the statistics of
+ * the whole view rather than its own. */
+func (t *SingleTermIndex) FinalizeIn(view *SingleTermIndex) {
+	t.finalize(view.viewIdf)
+}
+
+// Finalize, weighting terms by idf
+func (t *SingleTermIndex) finalize(idf func(LexiconTerm) float64) {
+	var (
+		term     LexiconTerm
+		pl_entry PostingListEntry
+		info     *StoredDocInfo
+		ok       bool
+	)
+
+	t.insertLock.Lock()
+	defer t.insertLock.Unlock()
+
+	for _, info = range t.DocumentMap {
+		info.Norm = 0
+		info.MaxTf = 0
+	}
+
+	for _, entry := range t.lexicon.Walk() {
+		term = entry.(LexiconTerm)
+		termIdf := idf(term)
+
+		// Writing is done, so apply buffered writes for the readers
+		if buffered, ok := term.PostingList().(BufferedPostingList); ok {
+			buffered.Flush()
+		}
+
+		for it := term.PostingList().Iterator(); it.Next(); {
+			pl_entry = it.Value()
+			if info, ok = t.DocumentMap[pl_entry.DocId()]; !ok {
+				continue
+			}
+
+			// Sum the squares now, and take the root at the end
+			weight := (1 + math.Log(float64(pl_entry.Frequency()))) * termIdf
+			info.Norm += weight * weight
+
+			if pl_entry.Frequency() > info.MaxTf {
+				info.MaxTf = pl_entry.Frequency()
+			}
+		}
+	}
+
+	for _, info = range t.DocumentMap {
+		info.Norm = math.Sqrt(info.Norm)
+	}
+	log.Infof("Computed norms for %d documents", len(t.DocumentMap))
+
+	// The lexicon may have changed since it was numbered
+	t.terms = nil
+	terms := t.TermTable()
+
+	t.wildcards = NewWildcardIndex()
+	t.wildcards.Build(t.lexicon, terms)
+
+	if t.forward != nil {
+		if err := t.forward.Build(t.lexicon, terms); err != nil {
+			log.Criticalf("Failed to build the forward index: %v", err)
+		} else {
+			log.Infof("Built forward index for %d documents", t.forward.Len())
+		}
+	}
+}
+
+/* Whether the documents have norms from Finalize. A document
+ * can have none if all of its postings were pruned, so this only
+ * checks that some of them do. */
+func (t *SingleTermIndex) IsFinalized() bool {
+	for _, segment := range t.segments {
+		if !segment.IsFinalized() {
+			return false
+		}
 	}
-	log.Debugf("sending shutdown signal")
-	t.shutdown <- true
+
+	finalized := true
+	for _, info := range t.DocumentMap {
+		if info.Norm > 0 {
+			return true
+		} else if info.TermCount > 0 {
+			finalized = false
+		}
+	}
+	return finalized
+}
+
+/* Take the documents inserted so far out of the index, as an
+ * index of their own, and carry on inserting into lexicon. The
+ * filter chain and the inserter stay with this index. */
+func (t *SingleTermIndex) Detach(lexicon Lexicon) *SingleTermIndex {
+	t.insertLock.Lock()
+	defer t.insertLock.Unlock()
+
+	detached := new(SingleTermIndex)
+	detached.Init(t.lexicon)
+	detached.DocumentMap = t.DocumentMap
+	detached.DocumentCount = t.DocumentCount
+	detached.stats = t.stats
+
+	t.lexicon = lexicon
+	t.DocumentMap = make(DocInfoMap)
+	t.DocumentCount = 0
+	t.stats = CollectionStats{}
+	return detached
+}
+
+// An index which isn't being inserted into is its own snapshot
+func (t *SingleTermIndex) Snapshot() *SingleTermIndex {
+	return t
 }
 
 //Forces a block until insertion threads are done
@@ -401,11 +1285,16 @@ func Tf_d(t LexiconTerm, d filereader.DocumentId) float64 {
 	return float64(pl_entry.Frequency())
 }
 
+// Terms which know their document frequency without
+// loading their posting list
+type DfCounter interface {
+	Df() int
+}
+
 func Df(t LexiconTerm) int {
+	if counter, ok := t.(DfCounter); ok {
+		return counter.Df()
+	}
 	return t.PostingList().Len()
 }
 
-func Idf(t LexiconTerm, totalDocCount int) float64 {
-	plLen := float64(Df(t))
-	return math.Log((float64(totalDocCount) - plLen + 0.5) / (plLen + 0.5))
-}
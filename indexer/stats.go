@@ -0,0 +1,215 @@
+package indexer
+
+import "bufio"
+import "fmt"
+import "io"
+import "math"
+import "sort"
+import "strings"
+
+const CollectionStatsFile = "stats.mdt"
+
+/* Statistics about the whole collection which the rankers need.
+ * They're kept up to date as documents are inserted, and saved
+ * alongside the document map. Per-term document and collection
+ * frequencies are kept here too, so rankers don't need the term's
+ * posting list for them. Terms without them (like phrases made up
+ * while answering a query) are counted from their posting lists. */
+type CollectionStats struct {
+	Documents   int
+	TotalTokens int64
+
+	terms map[string]TermStats
+}
+
+type TermStats struct {
+	// The number of documents containing the term
+	Df int
+	// The number of times the term occurs in the collection
+	Cf int
+}
+
+// Count a document with length tokens
+func (s *CollectionStats) AddDocument(length int) {
+	s.Documents++
+	s.TotalTokens += int64(length)
+}
+
+// Count a document which contains text tf times
+func (s *CollectionStats) AddTerm(text string, tf int) {
+	s.addTermStats(text, TermStats{Df: 1, Cf: tf})
+}
+
+// Count the documents in pl as containing text
+func (s *CollectionStats) AddPostingList(text string, pl PostingList) {
+	counted := TermStats{Df: pl.Len()}
+	for it := pl.Iterator(); it.Next(); {
+		counted.Cf += it.Value().Frequency()
+	}
+	s.addTermStats(text, counted)
+}
+
+func (s *CollectionStats) addTermStats(text string, add TermStats) {
+	if s.terms == nil {
+		s.terms = make(map[string]TermStats)
+	}
+	counted := s.terms[text]
+	counted.Df += add.Df
+	counted.Cf += add.Cf
+	s.terms[text] = counted
+}
+
+// Forget text, once it's no longer in the index
+func (s *CollectionStats) RemoveTerm(text string) {
+	delete(s.terms, text)
+}
+
+// The statistics kept for text, if there are any
+func (s *CollectionStats) Term(text string) (TermStats, bool) {
+	counted, ok := s.terms[text]
+	return counted, ok
+}
+
+func (s *CollectionStats) Merge(other *CollectionStats) {
+	s.Documents += other.Documents
+	s.TotalTokens += other.TotalTokens
+	for text, counted := range other.terms {
+		s.addTermStats(text, counted)
+	}
+}
+
+func (s *CollectionStats) AvgDocLen() float64 {
+	if s.Documents == 0 {
+		return 0
+	}
+	return float64(s.TotalTokens) / float64(s.Documents)
+}
+
+// The number of documents containing t
+func (s *CollectionStats) Df(t LexiconTerm) int {
+	if counted, ok := s.terms[t.Text()]; ok {
+		return counted.Df
+	}
+	return Df(t)
+}
+
+// The number of times t occurs in the collection
+func (s *CollectionStats) Cf(t LexiconTerm) int {
+	if counted, ok := s.terms[t.Text()]; ok {
+		return counted.Cf
+	}
+	if t.Tf() >= 0 {
+		return t.Tf()
+	}
+
+	cf := 0
+	for it := t.PostingList().Iterator(); it.Next(); {
+		cf += it.Value().Frequency()
+	}
+	return cf
+}
+
+func (s *CollectionStats) Idf(t LexiconTerm) float64 {
+	return idf(s.Df(t), s.Documents)
+}
+
+// The probability of a token in the collection being t
+func (s *CollectionStats) Prob(t LexiconTerm) float64 {
+	if s.TotalTokens == 0 {
+		return 0
+	}
+	return float64(s.Cf(t)) / float64(s.TotalTokens)
+}
+
+func (s *CollectionStats) String() string {
+	return fmt.Sprintf("{CollectionStats docs:%d tokens:%d avglen:%0.2f}",
+		s.Documents, s.TotalTokens, s.AvgDocLen())
+}
+
+// Work the statistics out from a document map
+func (s *CollectionStats) FromDocuments(docs DocInfoMap) {
+	s.Documents = 0
+	s.TotalTokens = 0
+	for _, info := range docs {
+		s.AddDocument(info.TermCount)
+	}
+}
+
+/* The statistics are written one per line, as a name and a
+ * value. Each term's are written as "term", its df and cf, and
+ * then its text, which runs to the end of the line since phrases
+ * have spaces in them. */
+func (s *CollectionStats) WriteTo(w io.Writer) (int64, error) {
+	writer := bufio.NewWriter(w)
+	n, _ := fmt.Fprintf(writer, "documents %d\ntokens %d\n", s.Documents, s.TotalTokens)
+	written := int64(n)
+
+	texts := make([]string, 0, len(s.terms))
+	for text := range s.terms {
+		texts = append(texts, text)
+	}
+	sort.Strings(texts)
+
+	for _, text := range texts {
+		counted := s.terms[text]
+		n, _ = fmt.Fprintf(writer, "term %d %d %s\n", counted.Df, counted.Cf, text)
+		written += int64(n)
+	}
+	return written, writer.Flush()
+}
+
+func (s *CollectionStats) ReadFrom(r io.Reader) (int64, error) {
+	var (
+		name    string
+		value   int64
+		counted TermStats
+		read    int64
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		read += int64(len(scanner.Bytes())) + 1
+
+		if fields := strings.SplitN(scanner.Text(), " ", 4); fields[0] == "term" {
+			if len(fields) < 4 {
+				return read, fmt.Errorf("Bad term statistic '%s'", scanner.Text())
+			}
+			if _, err := fmt.Sscanf(fields[1]+" "+fields[2], "%d %d",
+				&counted.Df, &counted.Cf); err != nil {
+
+				return read, fmt.Errorf("Bad term statistic '%s': %v",
+					scanner.Text(), err)
+			}
+			s.addTermStats(fields[3], counted)
+			continue
+		}
+
+		if _, err := fmt.Sscanf(scanner.Text(), "%s %d", &name, &value); err != nil {
+			return read, fmt.Errorf("Bad collection statistic '%s': %v",
+				scanner.Text(), err)
+		}
+
+		switch name {
+		case "documents":
+			s.Documents = int(value)
+		case "tokens":
+			s.TotalTokens = value
+		default:
+			return read, fmt.Errorf("Unknown collection statistic '%s'", name)
+		}
+	}
+	return read, scanner.Err()
+}
+
+/* Inverse document frequency of t in a collection of
+ * totalDocCount documents. The BM25 (Robertson-Sparck Jones)
+ * weight goes negative for terms in more than half of the
+ * documents, so one is added inside the log to keep it positive. */
+func Idf(t LexiconTerm, totalDocCount int) float64 {
+	return idf(Df(t), totalDocCount)
+}
+
+func idf(df, totalDocCount int) float64 {
+	plLen := float64(df)
+	return math.Log(1 + (float64(totalDocCount)-plLen+0.5)/(plLen+0.5))
+}
@@ -0,0 +1,158 @@
+package indexer
+
+import "bufio"
+import "bytes"
+import "errors"
+import "io"
+import "sync"
+
+/* Lexicons which number their terms as they're inserted keep the
+ * text of each in a TermList, saved alongside them in this file. */
+const TermListFile = "terms.list"
+
+var (
+	TermListMagic = []byte("IRTERM\x01\n")
+
+	ErrNotTermList = errors.New("Not a term list")
+)
+
+/* The text of every term a lexicon has numbered, indexed by id.
+ * Terms are only ever added, so an id never changes once it's
+ * given out. It can be read while terms are added to it. */
+type TermList struct {
+	lock  sync.RWMutex
+	texts []string
+
+	// The id of each text, once Number has been used
+	ids map[string]TermId
+}
+
+func NewTermList() *TermList {
+	return new(TermList)
+}
+
+// Number text, which mustn't already be in the list
+func (l *TermList) Add(text string) TermId {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.add(text)
+}
+
+/* The id of text, numbering it if it isn't in the list yet. This
+ * lets several lexicons share a list, so a term has the same id in
+ * each of them. */
+func (l *TermList) Number(text string) TermId {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.ids == nil {
+		l.ids = make(map[string]TermId, len(l.texts))
+		for id, known := range l.texts {
+			l.ids[known] = TermId(id)
+		}
+	}
+	if id, ok := l.ids[text]; ok {
+		return id
+	}
+	return l.add(text)
+}
+
+// Called with the lock held
+func (l *TermList) add(text string) TermId {
+	id := TermId(len(l.texts))
+	l.texts = append(l.texts, text)
+	if l.ids != nil {
+		l.ids[text] = id
+	}
+	return id
+}
+
+func (l *TermList) TermText(id TermId) (string, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if int(id) < len(l.texts) {
+		return l.texts[id], true
+	}
+	return "", false
+}
+
+// The number of ids given out
+func (l *TermList) Len() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return len(l.texts)
+}
+
+// Write the number of terms, then each term's text in id order
+func (l *TermList) WriteTo(w io.Writer) (int64, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	var buf []byte
+	writer := bufio.NewWriter(w)
+
+	buf = append(buf, TermListMagic...)
+	buf = AppendVByte(buf, uint64(len(l.texts)))
+	written, err := writer.Write(buf)
+	total := int64(written)
+
+	for _, text := range l.texts {
+		if err != nil {
+			return total, err
+		}
+		buf = AppendVByte(buf[:0], uint64(len(text)))
+		buf = append(buf, text...)
+
+		written, err = writer.Write(buf)
+		total += int64(written)
+	}
+
+	if err != nil {
+		return total, err
+	}
+	return total, writer.Flush()
+}
+
+// Read a term list written by WriteTo, replacing l's terms
+func (l *TermList) ReadFrom(r io.Reader) (int64, error) {
+	var err error
+
+	counter := &countingReader{r: r}
+	reader := bufio.NewReader(counter)
+
+	magic := make([]byte, len(TermListMagic))
+	if _, err = io.ReadFull(reader, magic); err != nil ||
+		!bytes.Equal(magic, TermListMagic) {
+		return counter.n, ErrNotTermList
+	}
+
+	readInt := func() uint64 {
+		var v uint64
+		if err == nil {
+			v, err = ReadVByteFrom(reader)
+		}
+		return v
+	}
+
+	texts := make([]string, readInt())
+	for i := range texts {
+		buf := make([]byte, readInt())
+		if err == nil {
+			_, err = io.ReadFull(reader, buf)
+		}
+		texts[i] = string(buf)
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		l.lock.Lock()
+		l.texts = texts
+		l.ids = nil
+		l.lock.Unlock()
+	}
+	return counter.n, err
+}
@@ -0,0 +1,292 @@
+package indexer
+
+import "github.com/cwacek/irengine/scanner/filereader"
+import radix "github.com/cwacek/radix-go"
+import "fmt"
+import "io"
+import "sort"
+import "sync"
+
+/* A view searches several finalized indexes, its segments, as one
+ * index. Nothing is copied out of the segments to build it: a term
+ * is looked up in each of them and its posting lists combined when
+ * they're asked for, a document is found in whichever segment has
+ * it, and the collection statistics are the sums of theirs. So a
+ * view costs the same to build however big its segments are.
+ * Documents deleted from a segment are left out as it's searched.
+ *
+ * Segments mustn't change once they're in a view, or have any
+ * documents in common. Their lexicons number terms in terms. */
+func NewSegmentView(terms TermTable, segments ...*SingleTermIndex) *SingleTermIndex {
+	view := new(SingleTermIndex)
+	view.Init(&view_lexicon{segments: segments, terms: terms})
+	view.segments = segments
+
+	for _, segment := range segments {
+		view.DocumentCount += segment.DocumentCount
+		view.stats.Documents += segment.stats.Documents
+		view.stats.TotalTokens += segment.stats.TotalTokens
+	}
+	return view
+}
+
+// The idf of term across the view. See FinalizeIn.
+func (t *SingleTermIndex) viewIdf(term LexiconTerm) float64 {
+	if found, ok := t.lexicon.FindTerm([]byte(term.Text())); ok {
+		return t.stats.Idf(found)
+	}
+	return t.stats.Idf(term)
+}
+
+/* A copy of a finalized index to search as a segment of a view,
+ * leaving out the documents in deleted, which mustn't change. The
+ * copy shares everything else with t, so it costs as much to make
+ * as deleted is big. The per-term statistics would count deleted
+ * documents, so the copy's are counted from its posting lists. */
+func (t *SingleTermIndex) WithDeleted(deleted map[filereader.DocumentId]bool) *SingleTermIndex {
+	copied := new(SingleTermIndex)
+	*copied = *t
+	if len(deleted) == 0 {
+		return copied
+	}
+
+	copied.deleted = deleted
+	copied.stats.terms = nil
+	for id := range deleted {
+		if info, ok := t.DocumentMap[id]; ok {
+			copied.DocumentCount--
+			copied.stats.Documents--
+			copied.stats.TotalTokens -= int64(info.TermCount)
+		}
+	}
+	return copied
+}
+
+/* Find a term in a segment. Its posting list leaves out deleted
+ * documents, and it isn't found if they're all it's in. */
+func (t *SingleTermIndex) findLive(key []byte) (LexiconTerm, bool) {
+	term, ok := t.lexicon.FindTerm(key)
+	if !ok || len(t.deleted) == 0 {
+		return term, ok
+	}
+
+	plInit := BasicPostingListInitializer
+	if t.IsPositional() {
+		plInit = PositionalPostingListInitializer
+	}
+
+	live := &Term{Text_: term.Text(), Pl: plInit.Create()}
+	if identified, ok := term.(TermIdentifier); ok {
+		live.Id_ = identified.Id()
+	}
+	for it := term.PostingList().Iterator(); it.Next(); {
+		if entry := it.Value(); !t.deleted[entry.DocId()] {
+			live.Pl.InsertCompleteEntry(entry)
+			live.Tf_ += entry.Frequency()
+		}
+	}
+
+	if live.Pl.Len() == 0 {
+		return nil, false
+	}
+	return live, true
+}
+
+/* The lexicon of a view. It has a term if any of the segments do,
+ * and is never changed. */
+type view_lexicon struct {
+	// Never populated. The methods below take its place.
+	radix.Trie
+
+	segments []*SingleTermIndex
+	terms    TermTable
+
+	// The number of distinct terms, counted when it's first asked for
+	counted  sync.Once
+	distinct int
+}
+
+/* A term found in one segment is that segment's. Otherwise it's
+ * a term whose postings are combined from each that has it. */
+func (lex *view_lexicon) FindTerm(key []byte) (LexiconTerm, bool) {
+	var found *view_term
+
+	for _, segment := range lex.segments {
+		part, ok := segment.findLive(key)
+		if !ok {
+			continue
+		}
+		if found == nil {
+			found = &view_term{text: string(key), lex: lex}
+		}
+		found.parts = append(found.parts, part)
+		found.segments = append(found.segments, segment)
+	}
+
+	switch {
+	case found == nil:
+		return nil, false
+	case len(found.parts) == 1:
+		return found.parts[0], true
+	}
+	return found, true
+}
+
+func (lex *view_lexicon) Find(key []byte) (radix.RadixTreeEntry, bool) {
+	if term, ok := lex.FindTerm(key); ok {
+		return term.(radix.RadixTreeEntry), true
+	}
+	return nil, false
+}
+
+// Every term in any segment, in order
+func (lex *view_lexicon) Walk() []radix.RadixTreeEntry {
+	texts := lex.texts()
+
+	entries := make([]radix.RadixTreeEntry, 0, len(texts))
+	for _, text := range texts {
+		if entry, ok := lex.Find([]byte(text)); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (lex *view_lexicon) texts() []string {
+	seen := make(map[string]bool)
+	texts := make([]string, 0)
+
+	for _, segment := range lex.segments {
+		for _, entry := range segment.lexicon.Walk() {
+			text := entry.(LexiconTerm).Text()
+			if !seen[text] {
+				seen[text] = true
+				texts = append(texts, text)
+			}
+		}
+	}
+	sort.Strings(texts)
+	return texts
+}
+
+func (lex *view_lexicon) Len() int {
+	lex.counted.Do(func() {
+		lex.distinct = len(lex.texts())
+	})
+	return lex.distinct
+}
+
+func (lex *view_lexicon) TermTable() TermTable {
+	return lex.terms
+}
+
+func (lex *view_lexicon) Init() {}
+
+func (lex *view_lexicon) Insert(entry radix.RadixTreeEntry) {
+	panic("Cannot insert into a view")
+}
+
+func (lex *view_lexicon) InsertToken(token *filereader.Token) LexiconTerm {
+	panic("Cannot insert into a view")
+}
+
+func (lex *view_lexicon) MergePostingList(text string, pl PostingList) LexiconTerm {
+	panic("Cannot merge into a view")
+}
+
+func (lex *view_lexicon) Print(w io.Writer) {
+	PrintTerms(w, lex)
+}
+
+func (lex *view_lexicon) PLInitializer() PostingListInitializer {
+	for _, segment := range lex.segments {
+		if typed, ok := segment.lexicon.(PostingListTyped); ok {
+			return typed.PLInitializer()
+		}
+	}
+	if lex.IsPositional() {
+		return PositionalPostingListInitializer
+	}
+	return BasicPostingListInitializer
+}
+
+func (lex *view_lexicon) SetPLInitializer(pl_init PostingListInitializer) {
+	if pl_init.Name != lex.PLInitializer().Name {
+		panic("Cannot change the posting list type of a view")
+	}
+}
+
+func (lex *view_lexicon) IsPositional() bool {
+	return len(lex.segments) > 0 && lex.segments[0].IsPositional()
+}
+
+/* A term in more than one segment of a view. Its frequencies are
+ * the sums of its parts', and its posting list their union, which
+ * is only built if it's asked for. */
+type view_term struct {
+	text     string
+	lex      *view_lexicon
+	parts    []LexiconTerm
+	segments []*SingleTermIndex
+	pl       PostingList
+}
+
+// The segments number terms in the same table
+func (t *view_term) Id() TermId {
+	return t.parts[0].(TermIdentifier).Id()
+}
+
+func (t *view_term) Text() string {
+	return t.text
+}
+
+func (t *view_term) RadixKey() []byte {
+	return []byte(t.text)
+}
+
+func (t *view_term) Df() int {
+	df := 0
+	for i, segment := range t.segments {
+		if counted, ok := segment.stats.Term(t.text); ok {
+			df += counted.Df
+		} else {
+			df += Df(t.parts[i])
+		}
+	}
+	return df
+}
+
+func (t *view_term) Tf() int {
+	tf := 0
+	for i, segment := range t.segments {
+		if counted, ok := segment.stats.Term(t.text); ok {
+			tf += counted.Cf
+		} else {
+			tf += t.parts[i].Tf()
+		}
+	}
+	return tf
+}
+
+func (t *view_term) PostingList() PostingList {
+	if t.pl == nil {
+		its := make([]PostingListIterator, len(t.parts))
+		for i, part := range t.parts {
+			its[i] = part.PostingList().Iterator()
+		}
+		t.pl = Collect(Or(its...), t.lex.PLInitializer())
+	}
+	return t.pl
+}
+
+func (t *view_term) Register(token *filereader.Token) {
+	panic("Cannot register tokens with a term in a view")
+}
+
+func (t *view_term) RegisterEntry(entry PostingListEntry) {
+	panic("Cannot register entries with a term in a view")
+}
+
+func (t *view_term) String() string {
+	return fmt.Sprintf("{%s tf:%d}", t.text, t.Tf())
+}
@@ -0,0 +1,311 @@
+package indexer
+
+import "bufio"
+import "bytes"
+import "errors"
+import "io"
+import "sort"
+import "strings"
+
+/* Wildcard queries like 'environ*' and '*ization' are expanded
+ * against the lexicon using a k-gram index. Every term is padded
+ * with '$' at both ends and broken into k-grams, each of which
+ * lists the ids of the terms containing it. A pattern's k-grams
+ * give a list of candidates, which are checked against the
+ * pattern itself. The pattern's prefix is padded too, so prefix
+ * queries use the k-grams like any other, but lexicons which can
+ * walk their terms by prefix find those without the index. */
+const (
+	WildcardIndexFile = "wildcard.idx"
+
+	KGramLength = 3
+
+	// The most terms a wildcard is expanded to by default
+	DefaultWildcardLimit = 50
+)
+
+var (
+	WildcardIndexMagic = []byte("IRKGRM\x01\n")
+
+	ErrNotWildcardIndex = errors.New("Not a wildcard index")
+)
+
+// Whether text is a wildcard pattern rather than a term
+func IsWildcard(text string) bool {
+	return strings.Contains(text, "*")
+}
+
+// Whether text matches pattern, where '*' matches any characters
+func MatchWildcard(pattern, text string) bool {
+	pieces := strings.Split(pattern, "*")
+
+	if !strings.HasPrefix(text, pieces[0]) {
+		return false
+	}
+	text = text[len(pieces[0]):]
+
+	last := len(pieces) - 1
+	if last == 0 {
+		return text == ""
+	}
+
+	for _, piece := range pieces[1:last] {
+		if i := strings.Index(text, piece); i < 0 {
+			return false
+		} else {
+			text = text[i+len(piece):]
+		}
+	}
+	return strings.HasSuffix(text, pieces[last])
+}
+
+// The k-grams of text, which should already be padded
+func kgrams(text string) []string {
+	grams := make([]string, 0, len(text))
+	for i := 0; i+KGramLength <= len(text); i++ {
+		grams = append(grams, text[i:i+KGramLength])
+	}
+	return grams
+}
+
+/* The k-gram lists hold term ids, and the terms' text is found in
+ * the lexicon's term table, which the index doesn't keep a copy of.
+ * The ids are also kept in the order of their terms' text, which
+ * fuzzy matching walks. */
+type WildcardIndex struct {
+	terms  TermTable
+	sorted []uint32
+
+	grams map[string][]uint32
+}
+
+func NewWildcardIndex() *WildcardIndex {
+	return &WildcardIndex{grams: make(map[string][]uint32)}
+}
+
+/* The id of term, the i'th of the lexicon's terms in sorted
+ * order. Lexicons which don't number their terms number them by
+ * their position. */
+func lexiconTermId(term LexiconTerm, i int) TermId {
+	if identified, ok := term.(TermIdentifier); ok {
+		return identified.Id()
+	}
+	return TermId(i)
+}
+
+type idList []uint32
+
+func (l idList) Len() int {
+	return len(l)
+}
+
+func (l idList) Less(i, j int) bool {
+	return l[i] < l[j]
+}
+
+func (l idList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Index the terms in lexicon, whose text is in terms
+func (w *WildcardIndex) Build(lexicon Lexicon, terms TermTable) {
+	w.terms = terms
+	w.sorted = make([]uint32, 0, lexicon.Len())
+	w.grams = make(map[string][]uint32)
+
+	for i, term := range sortedTerms(lexicon) {
+		id := uint32(lexiconTermId(term, i))
+		w.sorted = append(w.sorted, id)
+
+		seen := make(map[string]bool)
+		for _, gram := range kgrams("$" + term.Text() + "$") {
+			if !seen[gram] {
+				seen[gram] = true
+				w.grams[gram] = append(w.grams[gram], id)
+			}
+		}
+	}
+
+	// Ids don't follow the terms' order, but intersecting needs them sorted
+	for _, ids := range w.grams {
+		sort.Sort(idList(ids))
+	}
+}
+
+// Use terms to find the text of the terms in a wildcard index read from disk
+func (w *WildcardIndex) SetTermTable(terms TermTable) {
+	w.terms = terms
+}
+
+// The number of terms indexed
+func (w *WildcardIndex) Len() int {
+	return len(w.sorted)
+}
+
+func (w *WildcardIndex) text(id uint32) string {
+	text, _ := w.terms.TermText(TermId(id))
+	return text
+}
+
+// The text of the i'th term in sorted order
+func (w *WildcardIndex) sortedText(i int) string {
+	return w.text(w.sorted[i])
+}
+
+// Intersect two sorted lists of term ids
+func intersectIds(a, b []uint32) []uint32 {
+	out := make([]uint32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// Every term matching pattern, in sorted order
+func (w *WildcardIndex) Expand(pattern string) []string {
+	var (
+		matches    = make([]string, 0)
+		candidates []uint32
+		filtered   bool
+	)
+
+	for _, piece := range strings.Split("$"+pattern+"$", "*") {
+		for _, gram := range kgrams(piece) {
+			if !filtered {
+				candidates = w.grams[gram]
+				filtered = true
+			} else {
+				candidates = intersectIds(candidates, w.grams[gram])
+			}
+		}
+	}
+
+	// Too short for any k-grams, so every term is a candidate
+	if !filtered {
+		for i := range w.sorted {
+			if text := w.sortedText(i); MatchWildcard(pattern, text) {
+				matches = append(matches, text)
+			}
+		}
+		return matches
+	}
+
+	for _, id := range candidates {
+		if text := w.text(id); MatchWildcard(pattern, text) {
+			matches = append(matches, text)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+/* Write the wildcard index: the term ids in the order of their
+ * text, then each k-gram with the gaps between the ids of the terms
+ * containing it. The text is saved with the lexicon's term table. */
+func (w *WildcardIndex) WriteTo(out io.Writer) (int64, error) {
+	var buf []byte
+
+	writer := bufio.NewWriter(out)
+	buf = append(buf, WildcardIndexMagic...)
+
+	buf = AppendVByte(buf, uint64(len(w.sorted)))
+	for _, id := range w.sorted {
+		buf = AppendVByte(buf, uint64(id))
+	}
+
+	grams := make([]string, 0, len(w.grams))
+	for gram := range w.grams {
+		grams = append(grams, gram)
+	}
+	sort.Strings(grams)
+
+	buf = AppendVByte(buf, uint64(len(grams)))
+	written, err := writer.Write(buf)
+	total := int64(written)
+
+	for _, gram := range grams {
+		if err != nil {
+			return total, err
+		}
+		ids := w.grams[gram]
+
+		buf = AppendVByte(buf[:0], uint64(len(gram)))
+		buf = append(buf, gram...)
+		buf = AppendVByte(buf, uint64(len(ids)))
+		last := uint32(0)
+		for _, id := range ids {
+			buf = AppendVByte(buf, uint64(id-last))
+			last = id
+		}
+
+		written, err = writer.Write(buf)
+		total += int64(written)
+	}
+
+	if err != nil {
+		return total, err
+	}
+	return total, writer.Flush()
+}
+
+/* Read a wildcard index written by WriteTo. It can't expand
+ * anything until it's given the lexicon's term table. */
+func (w *WildcardIndex) ReadFrom(r io.Reader) (int64, error) {
+	var err error
+
+	counter := &countingReader{r: r}
+	reader := bufio.NewReader(counter)
+
+	magic := make([]byte, len(WildcardIndexMagic))
+	if _, err = io.ReadFull(reader, magic); err != nil ||
+		!bytes.Equal(magic, WildcardIndexMagic) {
+		return counter.n, ErrNotWildcardIndex
+	}
+
+	readInt := func() uint64 {
+		var v uint64
+		if err == nil {
+			v, err = ReadVByteFrom(reader)
+		}
+		return v
+	}
+	readString := func() string {
+		buf := make([]byte, readInt())
+		if err == nil {
+			_, err = io.ReadFull(reader, buf)
+		}
+		return string(buf)
+	}
+
+	w.sorted = make([]uint32, readInt())
+	for i := range w.sorted {
+		w.sorted[i] = uint32(readInt())
+	}
+
+	count := readInt()
+	w.grams = make(map[string][]uint32, count)
+	for i := uint64(0); i < count && err == nil; i++ {
+		gram := readString()
+		ids := make([]uint32, readInt())
+		last := uint32(0)
+		for j := range ids {
+			last += uint32(readInt())
+			ids[j] = last
+		}
+		w.grams[gram] = ids
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return counter.n, err
+}
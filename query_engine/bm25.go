@@ -71,14 +71,14 @@ func (bm *BM25) ProcessPositional(
 ) *Response {
 
 	var (
-		pl                  indexer.PostingList
-		term                indexer.LexiconTerm
-		partial_score, tf_d float64
-		pl_entry            indexer.PostingListEntry
-		doc_info            *indexer.StoredDocInfo
+		pl       indexer.PostingList
+		term     indexer.LexiconTerm
+		pl_entry indexer.PostingListEntry
+		doc_info *indexer.StoredDocInfo
 	)
 
-	avgDocLen := float64(index.TermCount()) / float64(index.DocumentCount)
+	stats := index.Stats()
+	avgDocLen := stats.AvgDocLen()
 
 	pl = FilterPositional(query_terms, index)
 
@@ -92,35 +92,27 @@ func (bm *BM25) ProcessPositional(
 	docScores := make(map[filereader.DocumentId]float64)
 
 	//pl holds hte filtered posting list
-	if !force && pl.Len() < int(0.01*float64(index.DocumentCount)) {
+	if !force && pl.Len() < int(0.01*float64(stats.Documents)) {
 		return ErrorResponse(fmt.Sprintf("Insufficient DF [%d/%d] for positional index",
-			pl.Len(), index.DocumentCount))
+			pl.Len(), stats.Documents))
 	}
-	term = &indexer.Term{"<phrase>", -1, pl}
+	term = &indexer.Term{Text_: "<phrase>", Tf_: -1, Pl: pl}
+	idf := stats.Idf(term)
 
 	for pl_iter := pl.Iterator(); pl_iter.Next(); {
 		pl_entry = pl_iter.Value()
-		tf_d = float64(1 + math.Log(float64(pl_entry.Frequency())))
-		doc_info = index.DocumentMap[pl_entry.DocId()]
+		doc_info = index.DocInfo(pl_entry.DocId())
 
-		log.Debugf("Obtained PL Entry %s with frequency %f", pl_entry.Serialize(), tf_d)
-		/* Add to the numerator for each document. We'll divide later */
-		partial_score = tf_d * (bm.k1 + 1)
-		partial_score /= tf_d +
-			bm.k1*((1.0-bm.b)+(bm.b*(float64(doc_info.TermCount)/avgDocLen)))
+		log.Debugf("Obtained PL Entry %s. Doc TermCount: %d, avgDocLen: %f",
+			pl_entry.Serialize(), doc_info.TermCount, avgDocLen)
 
-		log.Debugf("Doc TermCount: %d, avgDocLen: %f", doc_info.TermCount, avgDocLen)
-
-		partial_score *=
-			(float64((bm.k2+1)*q_term_tf) / float64(bm.k2*q_term_tf))
-
-		docScores[pl_entry.DocId()] +=
-			indexer.Idf(term, index.DocumentCount) * partial_score
+		docScores[pl_entry.DocId()] += bm.termScore(pl_entry.Frequency(),
+			doc_info.TermCount, avgDocLen, q_term_tf, idf)
 	}
 
 	responseSet := NewResponse()
 	for id, score := range docScores {
-		doc_info = index.DocumentMap[id]
+		doc_info = index.DocInfo(id)
 
 		log.Debugf("Doc: %s, Score: %0.4f", doc_info.HumanId, score)
 		responseSet.Append(&Result{doc_info.HumanId, score, ""})
@@ -157,8 +149,8 @@ func (bm *BM25) ProcessQuery(
 		log.Infof("Processing token %s. Have %d", q_term, query_tf[q_term.Text])
 	}
 
-	var partial_score, tf_d float64
-	avgDocLen := float64(index.TermCount()) / float64(index.DocumentCount)
+	stats := index.Stats()
+	avgDocLen := stats.AvgDocLen()
 	var avgDf float64
 
 	/* For each term in the query */
@@ -170,7 +162,7 @@ func (bm *BM25) ProcessQuery(
 			continue
 		}
 
-		avgDf += float64(indexer.Df(term))
+		avgDf += float64(stats.Df(term))
 
 		log.Debugf("Calculating score for query term %d: %s [%d]",
 			i, q_term.Text, q_term_tf)
@@ -179,32 +171,23 @@ func (bm *BM25) ProcessQuery(
 		pl = term.PostingList()
 		for pl_iter = pl.Iterator(); pl_iter.Next(); {
 			pl_entry = pl_iter.Value()
-			tf_d = float64(1 + math.Log(float64(pl_entry.Frequency())))
-			doc_info = index.DocumentMap[pl_entry.DocId()]
-
-			log.Debugf("Obtained PL Entry %v with frequency %f", pl_entry, tf_d)
-			/* Add to the numerator for each document. We'll divide later */
-			partial_score = tf_d * (bm.k1 + 1)
-			partial_score /= tf_d +
-				bm.k1*((1.0-bm.b)+(bm.b*(float64(doc_info.TermCount)/avgDocLen)))
+			doc_info = index.DocInfo(pl_entry.DocId())
 
-			log.Debugf("Doc TermCount: %d, avgDocLen: %f", doc_info.TermCount, avgDocLen)
+			log.Debugf("Obtained PL Entry %v. Doc TermCount: %d, avgDocLen: %f",
+				pl_entry, doc_info.TermCount, avgDocLen)
 
-			partial_score *=
-				(float64((bm.k2+1)*q_term_tf) / float64(bm.k2*q_term_tf))
-
-			docScores[pl_entry.DocId()] +=
-				indexer.Idf(term, index.DocumentCount) * partial_score
+			docScores[pl_entry.DocId()] += bm.termScore(pl_entry.Frequency(),
+				doc_info.TermCount, avgDocLen, q_term_tf, stats.Idf(term))
 		}
 	}
 
-	if !force && avgDf < float64(index.DocumentCount)*0.01 {
+	if !force && avgDf < float64(stats.Documents)*0.01 {
 		return ErrorResponse(fmt.Sprintf("Avg DF %0.4f too low for index", avgDf))
 	}
 
 	responseSet := NewResponse()
 	for id, score := range docScores {
-		doc_info = index.DocumentMap[id]
+		doc_info = index.DocInfo(id)
 
 		log.Debugf("Doc: %s, Score: %0.4f", doc_info.HumanId, score)
 		responseSet.Append(&Result{doc_info.HumanId, score, ""})
@@ -213,3 +196,81 @@ func (bm *BM25) ProcessQuery(
 	sort.Sort(responseSet)
 	return responseSet
 }
+
+// The score a query term contributes to a document
+func (bm *BM25) termScore(tf, docLen int, avgDocLen float64,
+	q_term_tf int, idf float64) float64 {
+
+	tf_d := float64(1 + math.Log(float64(tf)))
+
+	/* Add to the numerator for each document. We'll divide later */
+	partial_score := tf_d * (bm.k1 + 1)
+	partial_score /= tf_d +
+		bm.k1*((1.0-bm.b)+(bm.b*(float64(docLen)/avgDocLen)))
+
+	partial_score *=
+		(float64((bm.k2+1)*q_term_tf) / float64(bm.k2*q_term_tf))
+
+	return idf * partial_score
+}
+
+func (bm *BM25) ProcessTopK(
+	query_terms []*filereader.Token,
+	index *indexer.SingleTermIndex,
+	force bool,
+	k int,
+	mode RetrievalMode,
+) *Response {
+
+	if index.IsPositional() || mode == ExhaustiveRetrieval || k <= 0 {
+		response := bm.ProcessQuery(query_terms, index, force)
+		if k > 0 {
+			response.Truncate(k)
+		}
+		return response
+	}
+
+	var (
+		query_tf = make(map[string]int)
+		cursors  = make([]*term_cursor, 0, len(query_terms))
+		avgDf    float64
+	)
+
+	for _, q_term := range query_terms {
+		query_tf[q_term.Text]++
+	}
+
+	stats := index.Stats()
+	avgDocLen := stats.AvgDocLen()
+
+	for i, q_term := range query_terms {
+		term, ok := index.Retrieve(q_term.Text)
+		if !ok {
+			continue
+		}
+
+		avgDf += float64(stats.Df(term))
+
+		q_term_tf := query_tf[q_term.Text]
+		idf := stats.Idf(term)
+
+		score := func(entry indexer.PostingListEntry) float64 {
+			return bm.termScore(entry.Frequency(),
+				index.DocInfo(entry.DocId()).TermCount,
+				avgDocLen, q_term_tf, idf)
+		}
+
+		// Scores are highest in the shortest documents
+		bound := func(tf int) float64 {
+			return bm.termScore(tf, 0, avgDocLen, q_term_tf, idf)
+		}
+
+		cursors = append(cursors, newTermCursor(term.PostingList(), i, score, bound))
+	}
+
+	if !force && avgDf < float64(stats.Documents)*0.01 {
+		return ErrorResponse(fmt.Sprintf("Avg DF %0.4f too low for index", avgDf))
+	}
+
+	return topKResponse(topKDocuments(cursors, k, mode), index)
+}
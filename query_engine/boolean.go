@@ -0,0 +1,271 @@
+package query_engine
+
+import "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import "fmt"
+import "strings"
+
+/* Boolean queries, like 'cat AND (dog OR mouse) NOT bird'. The
+ * operators must be in capitals, and words without one between
+ * them are ANDed. NOT excludes documents from whatever comes before
+ * it in the same group, so a query can't only exclude documents.
+ * AND binds more tightly than OR. */
+type BooleanOp int
+
+const (
+	TermOp BooleanOp = iota
+	AndOp
+	OrOp
+	NotOp
+)
+
+type BooleanExpr struct {
+	Op BooleanOp
+
+	// The query word, for a TermOp
+	Term     string
+	Children []*BooleanExpr
+}
+
+type boolean_parser struct {
+	tokens []string
+	pos    int
+}
+
+func ParseBoolean(text string) (*BooleanExpr, error) {
+	text = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(text)
+	parser := &boolean_parser{tokens: strings.Fields(text)}
+
+	expr, err := parser.parseOr()
+	if err == nil && parser.peek() != "" {
+		err = fmt.Errorf("Unexpected '%s' in boolean query", parser.peek())
+	}
+	return expr, err
+}
+
+func (p *boolean_parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *boolean_parser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *boolean_parser) parseOr() (*BooleanExpr, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() != "OR" {
+		return expr, nil
+	}
+
+	or := &BooleanExpr{Op: OrOp, Children: []*BooleanExpr{expr}}
+	for p.peek() == "OR" {
+		p.next()
+		if expr, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		or.Children = append(or.Children, expr)
+	}
+	return or, nil
+}
+
+func (p *boolean_parser) parseAnd() (*BooleanExpr, error) {
+	and := &BooleanExpr{Op: AndOp}
+	positive := 0
+
+	for {
+		switch p.peek() {
+		case "", ")", "OR":
+			switch {
+			case len(and.Children) == 0:
+				return nil, fmt.Errorf("Expected a term in boolean query")
+			case positive == 0:
+				return nil, fmt.Errorf("NOT needs something to exclude documents from")
+			case len(and.Children) == 1:
+				return and.Children[0], nil
+			}
+			return and, nil
+
+		case "AND":
+			p.next()
+			if expr, err := p.parsePrimary(); err != nil {
+				return nil, err
+			} else {
+				and.Children = append(and.Children, expr)
+				positive++
+			}
+
+		case "NOT":
+			p.next()
+			if expr, err := p.parsePrimary(); err != nil {
+				return nil, err
+			} else {
+				and.Children = append(and.Children,
+					&BooleanExpr{Op: NotOp, Children: []*BooleanExpr{expr}})
+			}
+
+		default:
+			if expr, err := p.parsePrimary(); err != nil {
+				return nil, err
+			} else {
+				and.Children = append(and.Children, expr)
+				positive++
+			}
+		}
+	}
+}
+
+func (p *boolean_parser) parsePrimary() (*BooleanExpr, error) {
+	switch token := p.next(); token {
+	case "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("Unbalanced '(' in boolean query")
+		}
+		return expr, nil
+
+	case "", ")", "AND", "OR", "NOT":
+		return nil, fmt.Errorf("Expected a term in boolean query, not '%s'", token)
+
+	default:
+		return &BooleanExpr{Op: TermOp, Term: token}, nil
+	}
+}
+
+/* The words a query term becomes in the index. Wildcards and
+ * fuzzy terms are used as they are, and everything else goes
+ * through analyze, which may drop it or split it up. */
+func booleanTermTexts(term string, analyze func(string) []string) []string {
+	if indexer.IsWildcard(term) || indexer.IsFuzzy(term) {
+		return []string{strings.ToLower(term)}
+	}
+	return analyze(term)
+}
+
+// The terms documents are scored on: those which aren't excluded
+func (e *BooleanExpr) Terms() []string {
+	switch e.Op {
+	case TermOp:
+		return []string{e.Term}
+	case NotOp:
+		return nil
+	}
+
+	terms := make([]string, 0)
+	for _, child := range e.Children {
+		terms = append(terms, child.Terms()...)
+	}
+	return terms
+}
+
+/* An iterator over the documents matching the expression. Terms
+ * that analyze drops, like stopwords, are left out of it, and it's
+ * false if that leaves nothing to match. */
+func (e *BooleanExpr) Iterator(index *indexer.SingleTermIndex,
+	analyze func(string) []string) (indexer.PostingListIterator, bool) {
+
+	var included, excluded []indexer.PostingListIterator
+
+	switch e.Op {
+	case TermOp:
+		for _, text := range booleanTermTexts(e.Term, analyze) {
+			if term, ok := index.Retrieve(text); ok {
+				included = append(included, term.PostingList().Iterator())
+			} else {
+				included = append(included,
+					indexer.BasicPostingListInitializer.Create().Iterator())
+			}
+		}
+		if len(included) == 0 {
+			return nil, false
+		}
+		return indexer.And(included...), true
+
+	case OrOp:
+		for _, child := range e.Children {
+			if it, ok := child.Iterator(index, analyze); ok {
+				included = append(included, it)
+			}
+		}
+		if len(included) == 0 {
+			return nil, false
+		}
+		return indexer.Or(included...), true
+	}
+
+	for _, child := range e.Children {
+		if child.Op == NotOp {
+			if it, ok := child.Children[0].Iterator(index, analyze); ok {
+				excluded = append(excluded, it)
+			}
+		} else if it, ok := child.Iterator(index, analyze); ok {
+			included = append(included, it)
+		}
+	}
+
+	if len(included) == 0 {
+		return nil, false
+	}
+
+	it := indexer.And(included...)
+	if len(excluded) > 0 {
+		it = indexer.AndNot(it, indexer.Or(excluded...))
+	}
+	return it, true
+}
+
+/* Find the documents matching expr. They're ordered by the score
+ * ranker gives them for the terms which aren't excluded, and the
+ * ones it doesn't score, like those without a phrase on a
+ * positional index, follow in the order they were indexed with a
+ * score of zero. */
+func ProcessBoolean(expr *BooleanExpr, ranker RelevanceRanker,
+	index *indexer.SingleTermIndex, analyze func(string) []string) *Response {
+
+	it, ok := expr.Iterator(index, analyze)
+	if !ok {
+		return ErrorResponse("Boolean query has no terms to match")
+	}
+
+	matches := make(map[string]bool)
+	unscored := make([]string, 0)
+	for it.Next() {
+		humanId := index.DocInfo(filereader.DocumentId(it.Key())).HumanId
+		matches[humanId] = true
+		unscored = append(unscored, humanId)
+	}
+
+	query_terms := make([]*filereader.Token, 0)
+	for _, term := range expr.Terms() {
+		for _, text := range booleanTermTexts(term, analyze) {
+			query_terms = append(query_terms, filereader.NewToken(text, filereader.TextToken))
+		}
+	}
+
+	response := NewResponse()
+	ranked := ranker.ProcessQuery(query_terms, index, true)
+	for _, result := range ranked.Results {
+		if matches[result.Document] {
+			response.Append(result)
+			delete(matches, result.Document)
+		}
+	}
+
+	for _, humanId := range unscored {
+		if matches[humanId] {
+			response.Append(&Result{humanId, 0.0, ""})
+		}
+	}
+	return response
+}
@@ -42,6 +42,7 @@ func (vsm *CosineVSM) ProcessQuery(
 		log.Infof("Processing token %s. Have %d", q_term, query_tf[q_term.Text])
 	}
 
+	stats := index.Stats()
 	query_weight := 0.0
 
 	/* For each term in the query */
@@ -52,7 +53,7 @@ func (vsm *CosineVSM) ProcessQuery(
 			continue
 		}
 
-		avgDf += float64(indexer.Df(term))
+		avgDf += float64(stats.Df(term))
 
 		pl = term.PostingList()
 		log.Debugf("Retrieved Posting list for %s: %s", term.Text(), pl.String())
@@ -61,7 +62,7 @@ func (vsm *CosineVSM) ProcessQuery(
 
 			/* Add to the numerator for each document. We'll divide later */
 			partial = float64(1+math.Log(float64(pl_entry.Frequency()))) *
-				indexer.Idf(term, index.DocumentCount) *
+				stats.Idf(term) *
 				float64(query_tf[q_term.Text])
 			log.Debugf("Computed dot-product partial for %s in %d: %0.4f", term.Text, pl_entry.DocId(), partial)
 			docScores[pl_entry.DocId()] += partial
@@ -70,36 +71,27 @@ func (vsm *CosineVSM) ProcessQuery(
 		query_weight += math.Pow(float64(query_tf[q_term.Text])*1, 2.0)
 	}
 
-	if !force && avgDf < float64(index.DocumentCount)*0.01 {
+	if !force && avgDf < float64(stats.Documents)*0.01 {
 		return ErrorResponse(fmt.Sprintf("Avg DF %0.4f too low for index", avgDf))
 	}
 
 	log.Debugf("Computed a query weight of %0.4f", query_weight)
 
-	/* Now we need to sum the square of the document weights for every term
-	 * *in the document*. We'll use the list of documents we obtained as
-	 * partial scores. */
+	/* Now divide by the length of each document's vector, which
+	 * was computed when the index was finalized. */
 
 	responseSet := NewResponse()
-	var doc_weight, term_tfidf float64
 	var doc_info *indexer.StoredDocInfo
 
 	for id, numerator := range docScores {
 
-		doc_info = index.DocumentMap[id]
+		doc_info = index.DocInfo(id)
 
-		for _, term_tfidf = range doc_info.TermTfIdf {
-			doc_weight += math.Pow(term_tfidf, 2.0)
-		}
-
-		log.Debugf("Document weight for %s is %0.4f", doc_info.HumanId, doc_weight)
+		log.Debugf("Document norm for %s is %0.4f", doc_info.HumanId, doc_info.Norm)
 
 		responseSet.Append(&Result{
 			doc_info.HumanId,
-			numerator / math.Sqrt(doc_weight*query_weight), ""})
-
-		// Reset document weight back to zero....!!>!>
-		doc_weight = 0
+			numerator / (doc_info.Norm * math.Sqrt(query_weight)), ""})
 	}
 
 	sort.Sort(responseSet)
@@ -121,6 +113,7 @@ func (cosine *CosineVSM) ProcessPositional(
 	)
 
 	docScores := make(map[filereader.DocumentId]float64)
+	stats := index.Stats()
 
 	pl = FilterPositional(query_terms, index)
 	//pl holds hte filtered posting list
@@ -129,13 +122,13 @@ func (cosine *CosineVSM) ProcessPositional(
 		return ErrorResponse("Could not find phrase using positional posting list")
 	}
 
-	if !force && pl.Len() < int(0.01*float64(index.DocumentCount)) {
+	if !force && pl.Len() < int(0.01*float64(stats.Documents)) {
 		return ErrorResponse(fmt.Sprintf("Insufficient DF [%d/%d] for positional index",
-			pl.Len(), index.DocumentCount))
+			pl.Len(), stats.Documents))
 	}
 
 	//Make a fake term with the posting list
-	term = &indexer.Term{"<phrase>", -1, pl}
+	term = &indexer.Term{Text_: "<phrase>", Tf_: -1, Pl: pl}
 
 	//Calculate the scores
 	var partial float64
@@ -144,28 +137,23 @@ func (cosine *CosineVSM) ProcessPositional(
 
 		/* Add to the numerator for each document. We'll divide later */
 		partial = float64(1+math.Log(float64(pl_entry.Frequency()))) *
-			indexer.Idf(term, index.DocumentCount)
+			stats.Idf(term)
 
 		log.Debugf("Computed dot-product partial: %0.4f", partial)
 		docScores[pl_entry.DocId()] += partial
 	}
 
 	responseSet := NewResponse()
-	var doc_weight, term_tfidf float64
 
 	for id, numerator := range docScores {
 
-		doc_info = index.DocumentMap[id]
-
-		for _, term_tfidf = range doc_info.TermTfIdf {
-			doc_weight += math.Pow(term_tfidf, 2.0)
-		}
+		doc_info = index.DocInfo(id)
 
-		log.Debugf("Document weight for %s is %0.4f", doc_info.HumanId, doc_weight)
+		log.Debugf("Document norm for %s is %0.4f", doc_info.HumanId, doc_info.Norm)
 
 		responseSet.Append(&Result{
 			doc_info.HumanId,
-			numerator / math.Sqrt(doc_weight), ""})
+			numerator / doc_info.Norm, ""})
 	}
 
 	sort.Sort(responseSet)
@@ -8,6 +8,8 @@ import "fmt"
 import "encoding/json"
 
 type ZeroMQEngine struct {
+	source indexer.Searchable
+	// The snapshot of source the current query searches
 	index  *indexer.SingleTermIndex
 	ranker RelevanceRanker
 
@@ -73,6 +75,9 @@ func (engine *ZeroMQEngine) Start() error {
 		}
 		log.Infof("Decoded %v", query)
 
+		// Documents inserted while the query runs wait for the next one
+		engine.index = engine.source.Snapshot()
+
 		switch query.Type {
 		case PhraseQuery:
 			if ranker, ok = RankingEngines[query.Engine]; !ok {
@@ -89,6 +94,7 @@ func (engine *ZeroMQEngine) Start() error {
 			query.TokenizeToChan(engine.filterStart)
 
 			filteredTokens = engine.getDocTokens(engine.filterEnd)
+			filteredTokens = append(filteredTokens, engine.patternTokens(&query)...)
 
 			if query.QueryThresh < 1.0 {
 				thresholdedQueryTokens = ThresholdQueryTerms(
@@ -104,8 +110,7 @@ func (engine *ZeroMQEngine) Start() error {
 			resultSet = new(Response)
 			for _, queryTermSet := range thresholdedQueryTokens {
 				log.Infof("Querying with %v", queryTermSet)
-				results := ranker.ProcessQuery(
-					queryTermSet, engine.index, query.Force)
+				results := engine.rank(ranker, queryTermSet, &query)
 				log.Infof("Adding %d results to response", len(results.Results))
 				resultSet.ExtendUnique(results)
 				log.Infof("Response now had %d docs", len(resultSet.Results))
@@ -119,8 +124,22 @@ func (engine *ZeroMQEngine) Start() error {
 
 			}
 
+			resultSet.Suggestion = Suggest(filteredTokens, engine.index)
+
+		case BooleanQuery:
+			if ranker, ok = RankingEngines[query.Engine]; !ok {
+				resultSet = ErrorResponse("Unsupported ranking engine: " + query.Engine)
+			} else if expr, err := ParseBoolean(query.Text); err != nil {
+				resultSet = ErrorResponse(err.Error())
+			} else {
+				resultSet = ProcessBoolean(expr, ranker, engine.index, engine.analyze)
+			}
+
 		case StatsQuery:
 			resultSet = engine.LookupStats(query)
+
+		case DocumentQuery:
+			resultSet = engine.LookupDocument(query)
 		}
 
 		if msg, e = json.Marshal(resultSet); e != nil {
@@ -132,18 +151,70 @@ func (engine *ZeroMQEngine) Start() error {
 	}
 }
 
+/* Tokens for the wildcard, fuzzy and proximity patterns in query,
+ * which the index expands. The terms of a proximity operator are
+ * filtered like the rest of the query, so they match the index. */
+func (engine *ZeroMQEngine) patternTokens(query *Query) []*filereader.Token {
+	_, patterns := query.Patterns()
+
+	tokens := make([]*filereader.Token, len(patterns))
+	for i, pattern := range patterns {
+		if p, ok := indexer.ParseProximity(pattern); ok {
+			for j, term := range p.Terms {
+				if indexer.IsWildcard(term) || indexer.IsFuzzy(term) {
+					continue
+				}
+				if texts := engine.analyze(term); len(texts) == 1 {
+					p.Terms[j] = texts[0]
+				}
+			}
+			pattern = p.String()
+		}
+		tokens[i] = filereader.NewToken(pattern, filereader.TextToken)
+	}
+	return tokens
+}
+
+// Run text through the index's filters, like the words of a query
+func (engine *ZeroMQEngine) analyze(text string) []string {
+	query := &Query{Text: text}
+	query.TokenizeToChan(engine.filterStart)
+
+	tokens := engine.getDocTokens(engine.filterEnd)
+	texts := make([]string, len(tokens))
+	for i, token := range tokens {
+		texts[i] = token.Text
+	}
+	return texts
+}
+
+/* Score the query terms with ranker, only keeping the top
+ * results if the query asks for it and the ranker can. */
+func (engine *ZeroMQEngine) rank(ranker RelevanceRanker,
+	query_terms []*filereader.Token, query *Query) *Response {
+
+	if topk, ok := ranker.(TopKRanker); ok &&
+		query.Retrieval != ExhaustiveRetrieval && query.Limit > 0 {
+
+		return topk.ProcessTopK(query_terms, engine.index, query.Force,
+			query.Limit, query.Retrieval)
+	}
+	return ranker.ProcessQuery(query_terms, engine.index, query.Force)
+}
+
 func (engine *ZeroMQEngine) LookupStats(query Query) *Response {
 	if term, ok := engine.index.Retrieve(query.Text); !ok {
 		return ErrorResponse(query.Text + " does not exist in index.")
 	} else {
 
+		stats := engine.index.Stats()
 		response := NewResponse()
 		response.Append(
-			&Result{"IDF", indexer.Idf(term, engine.index.DocumentCount), ""})
+			&Result{"IDF", stats.Idf(term), ""})
 		response.Append(
-			&Result{"DF", float64(indexer.Df(term)), ""})
+			&Result{"DF", float64(stats.Df(term)), ""})
 		response.Append(
-			&Result{"Aggregate Tf", float64(term.Tf()), ""})
+			&Result{"Aggregate Tf", float64(stats.Cf(term)), ""})
 		response.Append(
 			&Result{"PostingList", 0.0, term.PostingList().String()})
 
@@ -151,9 +222,25 @@ func (engine *ZeroMQEngine) LookupStats(query Query) *Response {
 	}
 }
 
-func (engine *ZeroMQEngine) Init(index *indexer.SingleTermIndex, port int) error {
+/* Return the text of the document named by the query as the
+ * Info of a single result. */
+func (engine *ZeroMQEngine) LookupDocument(query Query) *Response {
+	if text, err := engine.index.GetDocument(query.Text); err != nil {
+		return ErrorResponse(err.Error())
+	} else {
+		response := NewResponse()
+		response.Append(&Result{query.Text, 0.0, text})
+		return response
+	}
+}
+
+/* Serve queries against source. A RealtimeIndex can be inserted
+ * into while it's served, and each query searches the snapshot
+ * that was current when it arrived. */
+func (engine *ZeroMQEngine) Init(source indexer.Searchable, port int) error {
 
-	engine.index = index
+	engine.source = source
+	engine.index = source.Snapshot()
 	engine.port = port
 	engine.control = make(chan int)
 
@@ -162,7 +249,7 @@ func (engine *ZeroMQEngine) Init(index *indexer.SingleTermIndex, port int) error
 	engine.filterStart = make(chan *filereader.Token, 100)
 	engine.filterEnd = make(chan *filereader.Token, 100)
 
-	go engine.index.FilterTokens(engine.filterStart, engine.filterEnd)
+	go engine.source.FilterTokens(engine.filterStart, engine.filterEnd)
 
 	return nil
 }
@@ -15,6 +15,14 @@ func init() {
 	RegisterRankingEngine("LM", &DirichletQL{0})
 }
 
+// The Dirichlet prior. Defaults to the root of the average document length
+func (lm *DirichletQL) smoothing(stats *indexer.CollectionStats) float64 {
+	if lm.mu == 0 {
+		return math.Sqrt(stats.AvgDocLen())
+	}
+	return lm.mu
+}
+
 func (lm *DirichletQL) ProcessPositional(
 	query_terms []*filereader.Token,
 	index *indexer.SingleTermIndex,
@@ -22,57 +30,46 @@ func (lm *DirichletQL) ProcessPositional(
 ) *Response {
 
 	var (
-		pl                  indexer.PostingList
-		partial_score, tf_d float64
-		pl_entry            indexer.PostingListEntry
-		term                indexer.LexiconTerm
-		doc_info            *indexer.StoredDocInfo
+		pl            indexer.PostingList
+		partial_score float64
+		pl_entry      indexer.PostingListEntry
+		term          indexer.LexiconTerm
+		doc_info      *indexer.StoredDocInfo
 	)
 
+	stats := index.Stats()
 	pl = FilterPositional(query_terms, index)
 
 	if pl == nil {
 		return ErrorResponse("Could not find phrase using positional posting list")
 	}
 
-	if !force && pl.Len() < int(0.01*float64(index.DocumentCount)) {
+	if !force && pl.Len() < int(0.01*float64(stats.Documents)) {
 		return ErrorResponse(fmt.Sprintf("Insufficient DF [%d/%d] for positional index",
-			pl.Len(), index.DocumentCount))
+			pl.Len(), stats.Documents))
 	}
 
-	avgDocLen := float64(index.TermCount()) / float64(index.DocumentCount)
-	if lm.mu == 0 {
-		lm.mu = math.Sqrt(avgDocLen)
-	}
+	mu := lm.smoothing(stats)
 
 	//Make a fake term with the posting list
-	term = &indexer.Term{"<phrase>", -1, pl}
+	term = &indexer.Term{Text_: "<phrase>", Tf_: -1, Pl: pl}
+	prob := stats.Prob(term)
 
 	docScores := make(map[filereader.DocumentId]float64)
 
-	pl = term.PostingList()
 	for pl_iter := pl.Iterator(); pl_iter.Next(); {
 		pl_entry = pl_iter.Value()
-		tf_d = float64(pl_entry.Frequency())
-		doc_info = index.DocumentMap[pl_entry.DocId()]
+		doc_info = index.DocInfo(pl_entry.DocId())
 
-		log.Debugf("Obtained PL Entry %s with frequency %f", pl_entry.Serialize(), tf_d)
+		partial_score = lm.termScore(pl_entry.Frequency(), doc_info.TermCount, prob, mu)
+		log.Debugf("Obtained PL Entry %s. Score %f", pl_entry.Serialize(), partial_score)
 
-		partial_score = tf_d
-		log.Debugf("Tf_d %f", tf_d)
-		partial_score += lm.mu *
-			(float64(term.Tf()) / float64(index.TermCount()))
-		log.Debugf("numerator: %f", partial_score)
-		partial_score /= float64(doc_info.TermCount) + lm.mu
-		log.Debugf("after division: %f. Log %f",
-			partial_score, math.Log(partial_score*1000.0))
-
-		docScores[pl_entry.DocId()] += math.Log(partial_score * 1000)
+		docScores[pl_entry.DocId()] += partial_score
 	}
 
 	responseSet := NewResponse()
 	for id, score := range docScores {
-		doc_info = index.DocumentMap[id]
+		doc_info = index.DocInfo(id)
 
 		log.Debugf("Doc: %s, Score: %0.4f", doc_info.HumanId, score)
 		responseSet.Append(&Result{doc_info.HumanId, score, ""})
@@ -104,12 +101,10 @@ func (lm *DirichletQL) ProcessQuery(
 		avgDf     float64
 	)
 
-	avgDocLen := float64(index.TermCount()) / float64(index.DocumentCount)
-	if lm.mu == 0 {
-		lm.mu = math.Sqrt(avgDocLen)
-	}
+	stats := index.Stats()
+	mu := lm.smoothing(stats)
 
-	var partial_score, tf_d float64
+	var partial_score, prob float64
 
 	var i int
 	for i, q_term = range query_terms {
@@ -118,7 +113,8 @@ func (lm *DirichletQL) ProcessQuery(
 			continue
 		}
 
-		avgDf += float64(indexer.Df(term))
+		avgDf += float64(stats.Df(term))
+		prob = stats.Prob(term)
 
 		log.Debugf("Calculating score for query term %d: %s ",
 			i, q_term.Text)
@@ -127,40 +123,27 @@ func (lm *DirichletQL) ProcessQuery(
 		pl = term.PostingList()
 		for pl_iter = pl.Iterator(); pl_iter.Next(); {
 			pl_entry = pl_iter.Value()
-			doc_info = index.DocumentMap[pl_entry.DocId()]
-
-			tf_d = float64(pl_entry.Frequency())
-
-			log.Debugf("Obtained PL Entry %v with frequency %f", pl_entry, tf_d)
+			doc_info = index.DocInfo(pl_entry.DocId())
 
-			partial_score = tf_d
-			log.Debugf("Tf_d %f", tf_d)
-			partial_score += lm.mu *
-				(float64(term.Tf()) / float64(index.TermCount()))
-			log.Debugf("numerator: %f", partial_score)
-			log.Debugf("TermCount:%d, DocCount: %d", doc_info.TermCount, index.DocumentCount)
-			partial_score /= float64(doc_info.TermCount) + lm.mu
-			log.Debugf("after division: %f. Log %f",
-				partial_score, math.Log(partial_score))
+			log.Debugf("Obtained PL Entry %v. TermCount:%d, DocCount: %d",
+				pl_entry, doc_info.TermCount, stats.Documents)
 
-			//When we take the logarithm, our numbers are so small that it ends up
-			// being negative. This has a pathological result because documents with *more*
-			// of the query terms end up worse off than docs with fewer because they add
-			// more negative numbers. Solution: multiply by 1000 before taking the log.
+			partial_score = lm.termScore(pl_entry.Frequency(), doc_info.TermCount,
+				prob, mu)
 
-			docScores[pl_entry.DocId()] += math.Log(partial_score * 1000.0)
+			docScores[pl_entry.DocId()] += partial_score
 			log.Debugf("Added %f to docScore for %s. Total: %f",
-				math.Log(partial_score*1000.0), pl_entry.DocId(), docScores[pl_entry.DocId()])
+				partial_score, pl_entry.DocId(), docScores[pl_entry.DocId()])
 		}
 	}
 
-	if !force && avgDf < float64(index.DocumentCount)*0.01 {
+	if !force && avgDf < float64(stats.Documents)*0.01 {
 		return ErrorResponse(fmt.Sprintf("Avg DF %0.4f too low for index", avgDf))
 	}
 
 	responseSet := NewResponse()
 	for id, score := range docScores {
-		doc_info = index.DocumentMap[id]
+		doc_info = index.DocInfo(id)
 
 		log.Debugf("Doc: %s, Score: %0.4f", doc_info.HumanId, score)
 		responseSet.Append(&Result{doc_info.HumanId, score, ""})
@@ -169,3 +152,74 @@ func (lm *DirichletQL) ProcessQuery(
 	sort.Sort(responseSet)
 	return responseSet
 }
+
+/* The score a query term contributes to a document, given the
+ * probability of the term in the collection (prob) and the
+ * Dirichlet prior (mu). */
+func (lm *DirichletQL) termScore(tf, docLen int, prob, mu float64) float64 {
+	partial_score := float64(tf)
+	partial_score += mu * prob
+	partial_score /= float64(docLen) + mu
+
+	//When we take the logarithm, our numbers are so small that it ends up
+	// being negative. This has a pathological result because documents with *more*
+	// of the query terms end up worse off than docs with fewer because they add
+	// more negative numbers. Solution: multiply by 1000 before taking the log.
+	return math.Log(partial_score * 1000.0)
+}
+
+func (lm *DirichletQL) ProcessTopK(
+	query_terms []*filereader.Token,
+	index *indexer.SingleTermIndex,
+	force bool,
+	k int,
+	mode RetrievalMode,
+) *Response {
+
+	if index.IsPositional() || mode == ExhaustiveRetrieval || k <= 0 {
+		response := lm.ProcessQuery(query_terms, index, force)
+		if k > 0 {
+			response.Truncate(k)
+		}
+		return response
+	}
+
+	var (
+		cursors = make([]*term_cursor, 0, len(query_terms))
+		avgDf   float64
+	)
+
+	stats := index.Stats()
+	mu := lm.smoothing(stats)
+
+	for i, q_term := range query_terms {
+		term, ok := index.Retrieve(q_term.Text)
+		if !ok {
+			continue
+		}
+
+		avgDf += float64(stats.Df(term))
+		prob := stats.Prob(term)
+
+		score := func(entry indexer.PostingListEntry) float64 {
+			return lm.termScore(entry.Frequency(),
+				index.DocInfo(entry.DocId()).TermCount, prob, mu)
+		}
+
+		// A document is at least as long as the term frequency,
+		// and the score is highest when it's no longer than that.
+		// Scores can be negative, but WAND needs every term to add
+		// to a document's bound, so the bound is at least zero.
+		bound := func(tf int) float64 {
+			return math.Max(0, lm.termScore(tf, tf, prob, mu))
+		}
+
+		cursors = append(cursors, newTermCursor(term.PostingList(), i, score, bound))
+	}
+
+	if !force && avgDf < float64(stats.Documents)*0.01 {
+		return ErrorResponse(fmt.Sprintf("Avg DF %0.4f too low for index", avgDf))
+	}
+
+	return topKResponse(topKDocuments(cursors, k, mode), index)
+}
@@ -0,0 +1,47 @@
+package query_engine
+
+import "math"
+import "github.com/cwacek/irengine/indexer"
+
+// Rankers which can score a posting on its own, for static pruning
+type PostingScoring interface {
+	PostingScorer(index *indexer.SingleTermIndex) indexer.PostingScorer
+}
+
+type bm25_scorer struct {
+	bm    *BM25
+	index *indexer.SingleTermIndex
+}
+
+// Score postings with what they add to a one term BM25 query
+func (bm *BM25) PostingScorer(index *indexer.SingleTermIndex) indexer.PostingScorer {
+	return &bm25_scorer{bm, index}
+}
+
+func (s *bm25_scorer) Score(term indexer.LexiconTerm, entry indexer.PostingListEntry) float64 {
+	stats := s.index.Stats()
+	return s.bm.termScore(entry.Frequency(), s.index.DocInfo(entry.DocId()).TermCount,
+		stats.AvgDocLen(), 1, stats.Idf(term))
+}
+
+type lm_scorer struct {
+	lm    *DirichletQL
+	index *indexer.SingleTermIndex
+}
+
+/* Score postings with how much they raise the likelihood of a one
+ * term query, over that of the document without the term. Unlike
+ * the likelihood itself this is never negative, so term-centric
+ * thresholds keep the best postings. */
+func (lm *DirichletQL) PostingScorer(index *indexer.SingleTermIndex) indexer.PostingScorer {
+	return &lm_scorer{lm, index}
+}
+
+func (s *lm_scorer) Score(term indexer.LexiconTerm, entry indexer.PostingListEntry) float64 {
+	stats := s.index.Stats()
+	background := s.lm.smoothing(stats) * stats.Prob(term)
+	if background == 0 {
+		return math.Inf(1)
+	}
+	return math.Log((float64(entry.Frequency()) + background) / background)
+}
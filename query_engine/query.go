@@ -2,8 +2,11 @@ package query_engine
 
 import log "github.com/cihub/seelog"
 import zmq "github.com/pebbe/zmq3"
+import "regexp"
 import "strings"
+import "fmt"
 import "encoding/json"
+import "github.com/cwacek/irengine/indexer"
 import "github.com/cwacek/irengine/scanner/filereader"
 
 type QueryType int
@@ -11,6 +14,10 @@ type QueryType int
 const (
 	StatsQuery QueryType = iota
 	PhraseQuery
+	// Fetch the text of the document named by Text
+	DocumentQuery
+	// Find the documents matching a query like 'a AND b NOT c'
+	BooleanQuery
 )
 
 type ThresholdRankerType int
@@ -20,6 +27,37 @@ const (
 	TfIdfThreshold
 )
 
+/* How documents are scored. Exhaustive retrieval scores every
+ * document containing a query term. The other modes evaluate
+ * a document at a time and only keep the best Limit documents,
+ * skipping those which can't make it into them. */
+type RetrievalMode int
+
+const (
+	ExhaustiveRetrieval RetrievalMode = iota
+	WANDRetrieval
+	BlockMaxWANDRetrieval
+)
+
+var retrievalModeNames = map[RetrievalMode]string{
+	ExhaustiveRetrieval:   "exhaustive",
+	WANDRetrieval:         "wand",
+	BlockMaxWANDRetrieval: "bmw",
+}
+
+func (m RetrievalMode) String() string {
+	return retrievalModeNames[m]
+}
+
+func ParseRetrievalMode(name string) (RetrievalMode, error) {
+	for mode, modeName := range retrievalModeNames {
+		if strings.ToLower(name) == modeName {
+			return mode, nil
+		}
+	}
+	return ExhaustiveRetrieval, fmt.Errorf("Unknown retrieval mode '%s'", name)
+}
+
 type Query struct {
 	Id                string
 	Text              string
@@ -29,6 +67,9 @@ type Query struct {
 	QueryThresh       float64
 	QueryThreshRanker ThresholdRankerType
 	Type              QueryType
+	Retrieval         RetrievalMode
+	// The number of results wanted. Zero means all of them.
+	Limit int
 }
 
 func (q *Query) Send(s *zmq.Socket) {
@@ -57,6 +98,38 @@ func ReceiveQuery(s *zmq.Socket, q *Query) {
 	}
 }
 
+// Proximity operators, which can have spaces in them
+var proximityOperators = regexp.MustCompile(`#(od|uw):\d+(/(sent|para))?\([^()]*\)|#(sent|para)\([^()]*\)|\S+(\s+NEAR/\d+\s+\S+)+`)
+
+/* Split the wildcard patterns like 'environ*', fuzzy terms like
+ * 'colour~1' and proximity operators like '#od:2(a b)' out of the
+ * query text. They're matched against the lexicon as they are, so
+ * they don't go through the tokenizer or filters. Proximity
+ * operators are rewritten in the form ParseProximity reads. */
+func (q *Query) Patterns() (text string, patterns []string) {
+	text = proximityOperators.ReplaceAllStringFunc(q.Text, func(op string) string {
+		if p, ok := indexer.ParseProximity(op); ok {
+			for i, term := range p.Terms {
+				p.Terms[i] = strings.ToLower(term)
+			}
+			patterns = append(patterns, p.String())
+			return " "
+		}
+		return op
+	})
+
+	words := make([]string, 0)
+	for _, word := range strings.Fields(text) {
+		if indexer.IsWildcard(word) || indexer.IsFuzzy(word) {
+			patterns = append(patterns, strings.ToLower(word))
+		} else {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " "), patterns
+}
+
+// Tokenize the text of the query, leaving out the patterns
 func (q *Query) TokenizeToChan(out chan *filereader.Token) {
 
 	var (
@@ -64,7 +137,8 @@ func (q *Query) TokenizeToChan(out chan *filereader.Token) {
 		ok    error
 	)
 
-	tokenizer := filereader.BadXMLTokenizer_FromReader(strings.NewReader(q.Text))
+	text, _ := q.Patterns()
+	tokenizer := filereader.BadXMLTokenizer_FromReader(strings.NewReader(text))
 	log.Debugf("Created tokenizer")
 
 	i := 1
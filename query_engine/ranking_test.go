@@ -0,0 +1,328 @@
+package query_engine
+
+import "fmt"
+import "math"
+import "sort"
+import "strings"
+import "testing"
+import "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import "github.com/cwacek/irengine/indexer/filters"
+import "github.com/cwacek/irengine/logging"
+
+/* Three documents, 9 tokens, average length 3.
+ *   a: df 1, cf 2   b: df 2, cf 2   c: df 2, cf 4   d: df 1, cf 1 */
+func smallIndex(plInit indexer.PostingListInitializer) *indexer.SingleTermIndex {
+	return textIndex(plInit, "a b a", "b c", "c c c d")
+}
+
+// Build a finalized index with documents D1, D2... holding texts
+func textIndex(plInit indexer.PostingListInitializer,
+	texts ...string) *indexer.SingleTermIndex {
+
+	lexicon := indexer.NewTrieLexicon()
+	lexicon.SetPLInitializer(plInit)
+
+	index := new(indexer.SingleTermIndex)
+	index.Init(lexicon)
+	index.AddFilter(filters.NewLowerCaseFilter())
+
+	for i, text := range texts {
+		index.Insert(filters.LoadTestDocument(fmt.Sprintf("D%d", i+1), text))
+	}
+	index.WaitInsert()
+	index.Finalize()
+
+	return index
+}
+
+func checkScores(t *testing.T, label string, response *Response,
+	expected map[string]float64) {
+
+	if msg, isErr := response.IsError(); isErr {
+		t.Errorf("%s: query failed: %s", label, msg)
+		return
+	}
+
+	if len(response.Results) != len(expected) {
+		t.Errorf("%s: got %d results, expected %d", label,
+			len(response.Results), len(expected))
+	}
+
+	for _, result := range response.Results {
+		if score, ok := expected[result.Document]; !ok {
+			t.Errorf("%s: unexpected result %s", label, result.Document)
+		} else if math.Abs(result.Score-score) > 1e-9 {
+			t.Errorf("%s: %s scored %f, expected %f", label,
+				result.Document, result.Score, score)
+		}
+	}
+}
+
+func TestRankerScores(t *testing.T) {
+	logging.SetupTestLogging()
+
+	index := smallIndex(indexer.BasicPostingListInitializer)
+
+	if stats := index.Stats(); stats.TotalTokens != 9 || stats.AvgDocLen() != 3 {
+		t.Fatalf("Expected 9 tokens in 3 documents. Got %s", stats)
+	}
+
+	bm25 := &BM25{1.2, 1, 0.75}
+	idf_a := math.Log(1 + 2.5/1.5)
+	idf_bc := math.Log(1 + 1.5/2.5)
+
+	// tf 2 in a document of average length, so K = k1
+	checkScores(t, "BM25 'a'", bm25.ProcessQuery(queryTokens("a"), index, true),
+		map[string]float64{
+			"D1": idf_a * (1 + math.Log(2)) * 2.2 / (1 + math.Log(2) + 1.2) * 2,
+		})
+
+	// K = 1.2 * (0.25 + 0.75 * len / 3)
+	checkScores(t, "BM25 'b c'", bm25.ProcessQuery(queryTokens("b c"), index, true),
+		map[string]float64{
+			"D1": idf_bc * 2.2 / (1 + 1.2) * 2,
+			"D2": 2 * idf_bc * 2.2 / (1 + 0.9) * 2,
+			"D3": idf_bc * (1 + math.Log(3)) * 2.2 / (1 + math.Log(3) + 1.5) * 2,
+		})
+
+	// mu is the root of the average length, and P(c) = 4/9
+	lm := &DirichletQL{0}
+	mu := math.Sqrt(3)
+	checkScores(t, "LM 'c'", lm.ProcessQuery(queryTokens("c"), index, true),
+		map[string]float64{
+			"D2": math.Log(1000 * (1 + mu*4/9) / (2 + mu)),
+			"D3": math.Log(1000 * (3 + mu*4/9) / (4 + mu)),
+		})
+
+	// The phrase 'b c' is only in D2, once
+	positional := smallIndex(indexer.PositionalPostingListInitializer)
+
+	checkScores(t, "Positional BM25 'b c'",
+		bm25.ProcessQuery(queryTokens("b c"), positional, true),
+		map[string]float64{
+			"D2": idf_a * 2.2 / (1 + 0.9) * 2,
+		})
+
+	checkScores(t, "Positional LM 'b c'",
+		lm.ProcessQuery(queryTokens("b c"), positional, true),
+		map[string]float64{
+			"D2": math.Log(1000 * (1 + mu/9) / (2 + mu)),
+		})
+
+	// Document weights are (1 + log tf) * idf
+	norm1 := math.Sqrt(math.Pow((1+math.Log(2))*idf_a, 2) + math.Pow(idf_bc, 2))
+	norm2 := math.Sqrt(2 * math.Pow(idf_bc, 2))
+	norm3 := math.Sqrt(math.Pow((1+math.Log(3))*idf_bc, 2) + math.Pow(idf_a, 2))
+
+	for id, expected := range map[string]float64{"D1": norm1, "D2": norm2, "D3": norm3} {
+		for _, info := range index.DocumentMap {
+			if info.HumanId == id && math.Abs(info.Norm-expected) > 1e-9 {
+				t.Errorf("Norm for %s is %f, expected %f", id, info.Norm, expected)
+			}
+		}
+	}
+
+	cosine := &CosineVSM{}
+	checkScores(t, "Cosine 'b c'", cosine.ProcessQuery(queryTokens("b c"), index, true),
+		map[string]float64{
+			"D1": idf_bc / (norm1 * math.Sqrt(2)),
+			"D2": 1,
+			"D3": (1 + math.Log(3)) * idf_bc / (norm3 * math.Sqrt(2)),
+		})
+
+	checkScores(t, "Positional Cosine 'b c'",
+		cosine.ProcessQuery(queryTokens("b c"), positional, true),
+		map[string]float64{
+			"D2": idf_a / norm2,
+		})
+}
+
+func TestSuggest(t *testing.T) {
+	logging.SetupTestLogging()
+
+	index := textIndex(indexer.BasicPostingListInitializer,
+		"the quick brown fox", "the quick red fox bears", "a brown bear")
+
+	for query, expected := range map[string]string{
+		"quick brown fox": "",
+		"quikc brwn fox":  "quick brown fox",
+		"qiuck zzzzzzz":   "quick zzzzzzz",
+		"bown":            "brown",
+		"fo* quik~1":      "",
+	} {
+		if suggestion := Suggest(queryTokens(query), index); suggestion != expected {
+			t.Errorf("Expected '%s' for '%s'. Got '%s'", expected, query, suggestion)
+		}
+	}
+
+	// A fuzzy term is scored as all of its matches together
+	bm25 := &BM25{1.2, 1, 0.75}
+	fuzzy := bm25.ProcessQuery(queryTokens("bear~1"), index, true)
+	if msg, isErr := fuzzy.IsError(); isErr {
+		t.Fatalf("Fuzzy query failed: %s", msg)
+	}
+
+	documents := make(map[string]bool)
+	for _, result := range fuzzy.Results {
+		documents[result.Document] = true
+	}
+
+	// 'bear' is in D3, and 'bears' is in D2
+	if len(documents) != 2 || !documents["D2"] || !documents["D3"] {
+		t.Errorf("Expected 'bear~1' to match D2 and D3. Got %v", documents)
+	}
+}
+
+func TestBooleanQuery(t *testing.T) {
+	logging.SetupTestLogging()
+
+	analyze := func(text string) []string {
+		return []string{strings.ToLower(text)}
+	}
+
+	bm25 := &BM25{1.2, 1, 0.75}
+	for _, plInit := range []indexer.PostingListInitializer{
+		indexer.BasicPostingListInitializer,
+		indexer.PositionalPostingListInitializer,
+	} {
+		index := textIndex(plInit, "the quick brown fox", "the quick red fox bears",
+			"a brown bear", "a lazy dog")
+
+		for query, expected := range map[string]string{
+			"quick AND fox":                "D1 D2",
+			"brown NOT fox":                "D3",
+			"(red OR Brown) fox":           "D1 D2",
+			"brown OR dog NOT lazy":        "D1 D3",
+			"bear* NOT quick":              "D3",
+			"a NOT (bear OR dog) OR quick": "D1 D2",
+			"zebra OR dog":                 "D4",
+			"quick AND zebra":              "",
+		} {
+			expr, err := ParseBoolean(query)
+			if err != nil {
+				t.Errorf("Failed to parse '%s': %v", query, err)
+				continue
+			}
+
+			response := ProcessBoolean(expr, bm25, index, analyze)
+			if msg, isErr := response.IsError(); isErr {
+				t.Errorf("'%s' failed: %s", query, msg)
+				continue
+			}
+
+			documents := make([]string, 0)
+			for _, result := range response.Results {
+				documents = append(documents, result.Document)
+			}
+			sort.Strings(documents)
+			if strings.Join(documents, " ") != expected {
+				t.Errorf("%s: '%s' matched %v, expected '%s'",
+					plInit.Name, query, documents, expected)
+			}
+		}
+	}
+
+	for _, query := range []string{"NOT fox", "quick AND", "(quick", "quick )", "quick OR NOT fox"} {
+		if _, err := ParseBoolean(query); err == nil {
+			t.Errorf("Expected an error parsing '%s'", query)
+		}
+	}
+}
+
+func TestProximityTerms(t *testing.T) {
+	logging.SetupTestLogging()
+
+	query := &Query{Text: "the #od:2(Quick Brown) fox a NEAR/2 b"}
+	if text, patterns := query.Patterns(); text != "the fox" ||
+		strings.Join(patterns, ",") != "#od:2(quick brown),#uw:3(a b)" {
+		t.Errorf("Split '%s' into '%s' and %v", query.Text, text, patterns)
+	}
+
+	texts := []string{"the quick brown fox", "the quick red fox bears", "a brown bear"}
+	index := textIndex(indexer.PositionalPostingListInitializer, texts...)
+	stats := index.Stats()
+
+	term, ok := index.Retrieve("#uw:3(fox quick)")
+	if !ok {
+		t.Fatalf("Couldn't retrieve a proximity operator")
+	}
+	if stats.Df(term) != 2 || stats.Cf(term) != 2 {
+		t.Errorf("Proximity term has df %d and cf %d, expected 2 and 2",
+			stats.Df(term), stats.Cf(term))
+	}
+
+	if _, ok = index.Retrieve("#od:1(brown quick)"); ok {
+		t.Errorf("Retrieved an operator which doesn't match anything")
+	}
+
+	phrase := []*filereader.Token{filereader.NewToken("#od:1(quick brown)", filereader.TextToken)}
+	for name, ranker := range RankingEngines {
+		response := ranker.ProcessQuery(phrase, index, true)
+		if msg, isErr := response.IsError(); isErr {
+			t.Errorf("%s: proximity query failed: %s", name, msg)
+		} else if len(response.Results) != 1 || response.Results[0].Document != "D1" {
+			t.Errorf("%s: expected '#od:1(quick brown)' to match D1. Got %v",
+				name, response.Results)
+		}
+	}
+
+	// Sentence operators don't reach over a full stop
+	query = &Query{Text: "#sent(Dog cat) #od:1/para(the cat)"}
+	if _, patterns := query.Patterns(); strings.Join(patterns, ",") != "#sent(dog cat),#od:1/para(the cat)" {
+		t.Errorf("Split '%s' into %v", query.Text, patterns)
+	}
+
+	sentences := textIndex(indexer.PositionalPostingListInitializer,
+		"The dog ran. The cat sat", "The dog and the cat")
+	if term, ok := sentences.Retrieve("#uw:5(dog cat)"); !ok || sentences.Stats().Df(term) != 2 {
+		t.Errorf("Expected '#uw:5(dog cat)' to match both documents")
+	}
+	if term, ok := sentences.Retrieve("#sent(dog cat)"); !ok || sentences.Stats().Df(term) != 1 {
+		t.Errorf("Expected '#sent(dog cat)' to match one document")
+	}
+
+	// Without positions, nothing can match
+	basic := textIndex(indexer.BasicPostingListInitializer, texts...)
+	if _, ok = basic.Retrieve("#uw:3(fox quick)"); ok {
+		t.Errorf("Retrieved a proximity operator from a basic index")
+	}
+}
+
+func TestPostingScorers(t *testing.T) {
+	logging.SetupTestLogging()
+
+	index := smallIndex(indexer.BasicPostingListInitializer)
+	term, _ := index.Retrieve("c")
+
+	scores := func(scorer indexer.PostingScorer) map[string]float64 {
+		result := make(map[string]float64)
+		for it := term.PostingList().Iterator(); it.Next(); {
+			result[index.DocumentMap[it.Value().DocId()].HumanId] = scorer.Score(term, it.Value())
+		}
+		return result
+	}
+
+	// A posting's BM25 score is its document's score for the term alone
+	bm25 := RankingEngines["BM25"].(PostingScoring)
+	checkScores(t, "BM25 scorer 'c'",
+		RankingEngines["BM25"].ProcessQuery(queryTokens("c"), index, true),
+		scores(bm25.PostingScorer(index)))
+
+	// log((tf + mu P(c)) / (mu P(c))), with mu the root of the average length
+	lm := RankingEngines["LM"].(PostingScoring)
+	background := math.Sqrt(3) * 4 / 9
+	expected := map[string]float64{
+		"D2": math.Log((1 + background) / background),
+		"D3": math.Log((3 + background) / background),
+	}
+	for id, score := range scores(lm.PostingScorer(index)) {
+		if math.Abs(score-expected[id]) > 1e-9 {
+			t.Errorf("LM scorer gave %s %f, expected %f", id, score, expected[id])
+		}
+	}
+
+	if _, ok := RankingEngines["COSINE"].(PostingScoring); ok {
+		t.Errorf("Cosine scores depend on the whole query, so shouldn't score postings")
+	}
+}
@@ -19,6 +19,8 @@ type Response struct {
 	Error   string
 	// The engine that actually answered
 	Source string
+	// The query with misspelled terms corrected, if any were missing
+	Suggestion string
 }
 
 func (r *Result) Equal(o *Result) bool {
@@ -58,11 +60,11 @@ func ReceiveResponse(s *zmq.Socket) (r *Response) {
 }
 
 func ErrorResponse(msg string) *Response {
-	return &Response{nil, msg, ""}
+	return &Response{nil, msg, "", ""}
 }
 
 func NewResponse() *Response {
-	return &Response{make([]*Result, 0), "", "DEFAULT"}
+	return &Response{make([]*Result, 0), "", "DEFAULT", ""}
 }
 
 func (r *Response) Send(s *zmq.Socket) {
@@ -108,6 +110,13 @@ func (r *Response) ExtendUnique(result *Response) {
 	}
 }
 
+// Keep only the first k results
+func (r *Response) Truncate(k int) {
+	if len(r.Results) > k {
+		r.Results = r.Results[:k]
+	}
+}
+
 func (r Response) Len() int {
 	return len(r.Results)
 }
@@ -14,6 +14,7 @@ var (
 		},
 		"",
 		"blah",
+		"",
 	}
 
 	ordered = []*Result{
@@ -34,6 +35,7 @@ var (
 		},
 		"",
 		"blah",
+		"",
 	}
 
 	combined_ordered = []*Result{
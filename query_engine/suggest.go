@@ -0,0 +1,43 @@
+package query_engine
+
+import "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import log "github.com/cihub/seelog"
+import "strings"
+
+// How far a missing query term can be from its correction
+const SuggestionDistance = 2
+
+/* Suggest a correction for a query with terms that aren't in the
+ * index, replacing each of them with the closest term that is.
+ * Returns an empty string if every term was found, or nothing
+ * close to the missing ones was. */
+func Suggest(query_terms []*filereader.Token, index *indexer.SingleTermIndex) string {
+	var (
+		words     = make([]string, 0, len(query_terms))
+		corrected bool
+	)
+
+	for _, q_term := range query_terms {
+		if _, ok := index.Retrieve(q_term.Text); ok || indexer.IsProximity(q_term.Text) ||
+			indexer.IsWildcard(q_term.Text) || indexer.IsFuzzy(q_term.Text) {
+
+			words = append(words, q_term.Text)
+			continue
+		}
+
+		if matches := index.FuzzyLookup(q_term.Text, SuggestionDistance); len(matches) > 0 {
+			log.Infof("'%s' isn't in the index. Suggesting '%s'",
+				q_term.Text, matches[0].Text)
+			words = append(words, matches[0].Text)
+			corrected = true
+		} else {
+			words = append(words, q_term.Text)
+		}
+	}
+
+	if !corrected {
+		return ""
+	}
+	return strings.Join(words, " ")
+}
@@ -30,8 +30,8 @@ func (s idf_sortable_tokens) Less(i, j int) bool {
 		return true
 	}
 
-	doccount := s.index.DocumentCount
-	if indexer.Idf(a, doccount) > indexer.Idf(b, doccount) {
+	stats := s.index.Stats()
+	if stats.Idf(a) > stats.Idf(b) {
 		return true
 	} else {
 		return false
@@ -0,0 +1,265 @@
+package query_engine
+
+import log "github.com/cihub/seelog"
+import "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/scanner/filereader"
+import "container/heap"
+import "math"
+import "sort"
+
+/* Rankers which can score the documents for a query a document
+ * at a time, so that only the best k need to be kept. Rankings
+ * are the same as ProcessQuery's, truncated to k results. */
+type TopKRanker interface {
+	ProcessTopK(query_terms []*filereader.Token,
+		index *indexer.SingleTermIndex, force bool,
+		k int, mode RetrievalMode) *Response
+}
+
+// The score a query term contributes to the document in entry
+type EntryScorer func(entry indexer.PostingListEntry) float64
+
+type term_cursor struct {
+	iter     indexer.PostingListIterator
+	score    EntryScorer
+	maxScore float64
+	// The position of the term in the query
+	order int
+}
+
+/* Create a cursor over a query term's posting list. bound must
+ * not decrease as the term frequency increases, and must be at
+ * least the score of any entry with that term frequency. */
+func newTermCursor(pl indexer.PostingList, order int,
+	score EntryScorer, bound indexer.TfScorer) *term_cursor {
+
+	cursor := &term_cursor{iter: pl.Iterator(), score: score, order: order}
+	cursor.iter.SetScorer(bound)
+	cursor.maxScore = cursor.iter.MaxScore()
+	return cursor
+}
+
+func (c *term_cursor) doc() filereader.DocumentId {
+	return c.iter.Value().DocId()
+}
+
+type scored_doc struct {
+	id    filereader.DocumentId
+	score float64
+}
+
+// Orders documents by score, breaking ties by document id
+func (d scored_doc) better(o scored_doc) bool {
+	if d.score != o.score {
+		return d.score > o.score
+	}
+	return d.id < o.id
+}
+
+// A min-heap of the best documents seen so far
+type topk_heap []scored_doc
+
+func (h topk_heap) Len() int {
+	return len(h)
+}
+
+func (h topk_heap) Less(i, j int) bool {
+	return h[j].better(h[i])
+}
+
+func (h topk_heap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *topk_heap) Push(x interface{}) {
+	*h = append(*h, x.(scored_doc))
+}
+
+func (h *topk_heap) Pop() interface{} {
+	old := *h
+	doc := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return doc
+}
+
+type cursors_by_doc []*term_cursor
+
+func (c cursors_by_doc) Len() int {
+	return len(c)
+}
+
+func (c cursors_by_doc) Less(i, j int) bool {
+	return c[i].doc() < c[j].doc()
+}
+
+func (c cursors_by_doc) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+type cursors_by_order []*term_cursor
+
+func (c cursors_by_order) Len() int {
+	return len(c)
+}
+
+func (c cursors_by_order) Less(i, j int) bool {
+	return c[i].order < c[j].order
+}
+
+func (c cursors_by_order) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+// Move the first n cursors with move, dropping any which run out
+func moveCursors(cursors []*term_cursor, n int,
+	move func(indexer.PostingListIterator) bool) []*term_cursor {
+
+	kept := cursors[:0]
+	for i, cursor := range cursors {
+		if i >= n || move(cursor.iter) {
+			kept = append(kept, cursor)
+		}
+	}
+	return kept
+}
+
+/* Find the k best documents for the terms in cursors using WAND,
+ * or Block-Max WAND if mode asks for it.
+ *
+ * The cursors are kept sorted by their current document. The
+ * pivot is the first document where the maximum scores of the
+ * terms up to it could beat the worst of the k documents kept so
+ * far. Nothing before the pivot can, so every cursor skips to it.
+ * Block-Max WAND first moves the terms up to the pivot to the
+ * blocks which would hold it, without reading them, and if the
+ * maximum scores of those blocks can't beat the worst document
+ * either, skips past the first of the blocks to end.
+ *
+ * A document's score is summed in query order, the same as
+ * exhaustive scoring, so the scores are identical. */
+func topKDocuments(cursors []*term_cursor, k int, mode RetrievalMode) []scored_doc {
+	var (
+		results  = make(topk_heap, 0, k)
+		active   = make([]*term_cursor, 0, len(cursors))
+		matching = make([]*term_cursor, 0, len(cursors))
+		scored   int
+	)
+
+	threshold := func() float64 {
+		if len(results) < k {
+			return math.Inf(-1)
+		}
+		return results[0].score
+	}
+
+	for _, cursor := range cursors {
+		if cursor.iter.Next() {
+			active = append(active, cursor)
+		}
+	}
+
+	for len(active) > 0 {
+		sort.Sort(cursors_by_doc(active))
+
+		pivot, bound := -1, 0.0
+		for i, cursor := range active {
+			bound += cursor.maxScore
+			if bound > threshold() {
+				pivot = i
+				break
+			}
+		}
+
+		if pivot < 0 {
+			// Nothing left can beat the threshold
+			break
+		}
+		pivotDoc := active[pivot].doc()
+
+		// The cursors after the pivot which are on pivotDoc too
+		last := pivot
+		for last+1 < len(active) && active[last+1].doc() == pivotDoc {
+			last++
+		}
+
+		if mode == BlockMaxWANDRetrieval {
+			blockBound := 0.0
+			blockEnd := uint64(math.MaxUint32)
+			for _, cursor := range active[:last+1] {
+				cursor.iter.NextShallow(pivotDoc)
+				blockBound += cursor.iter.BlockMaxScore()
+				if end := uint64(cursor.iter.BlockEnd()); end < blockEnd {
+					blockEnd = end
+				}
+			}
+
+			if blockBound <= threshold() {
+				// Until the first of the blocks ends, or another term
+				// starts, only these blocks can score documents.
+				target := blockEnd + 1
+				if last+1 < len(active) && uint64(active[last+1].doc()) < target {
+					target = uint64(active[last+1].doc())
+				}
+
+				if target > math.MaxUint32 {
+					active = active[last+1:]
+				} else {
+					active = moveCursors(active, last+1,
+						func(it indexer.PostingListIterator) bool {
+							return it.SkipTo(filereader.DocumentId(target))
+						})
+				}
+				continue
+			}
+		}
+
+		if active[0].doc() != pivotDoc {
+			active = moveCursors(active, pivot,
+				func(it indexer.PostingListIterator) bool {
+					return it.SkipTo(pivotDoc)
+				})
+			continue
+		}
+
+		matching = append(matching[:0], active[:last+1]...)
+		sort.Sort(cursors_by_order(matching))
+
+		candidate := scored_doc{id: pivotDoc}
+		for _, cursor := range matching {
+			candidate.score += cursor.score(cursor.iter.Value())
+		}
+		scored++
+
+		if len(results) < k {
+			heap.Push(&results, candidate)
+		} else if candidate.better(results[0]) {
+			results[0] = candidate
+			heap.Fix(&results, 0)
+		}
+
+		active = moveCursors(active, last+1,
+			func(it indexer.PostingListIterator) bool {
+				return it.Next()
+			})
+	}
+
+	log.Debugf("Scored %d documents to find the top %d with %s",
+		scored, k, mode)
+
+	sorted := make([]scored_doc, len(results))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(&results).(scored_doc)
+	}
+	return sorted
+}
+
+func topKResponse(docs []scored_doc, index *indexer.SingleTermIndex) *Response {
+	responseSet := NewResponse()
+	for _, doc := range docs {
+		doc_info := index.DocInfo(doc.id)
+
+		log.Debugf("Doc: %s, Score: %0.4f", doc_info.HumanId, doc.score)
+		responseSet.Append(&Result{doc_info.HumanId, doc.score, ""})
+	}
+	return responseSet
+}
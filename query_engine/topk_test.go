@@ -0,0 +1,126 @@
+package query_engine
+
+import "fmt"
+import "sort"
+import "strings"
+import "testing"
+import "math/rand"
+import "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/indexer/filters"
+import "github.com/cwacek/irengine/scanner/filereader"
+import "github.com/cwacek/irengine/logging"
+
+// Build an index of random documents drawn from a small vocabulary
+func randomIndex(plInit indexer.PostingListInitializer) *indexer.SingleTermIndex {
+	var (
+		r     = rand.New(rand.NewSource(3))
+		vocab = make([]string, 40)
+		words []string
+	)
+
+	for i := range vocab {
+		vocab[i] = fmt.Sprintf("w%d", i)
+	}
+
+	lexicon := indexer.NewTrieLexicon()
+	lexicon.SetPLInitializer(plInit)
+
+	index := new(indexer.SingleTermIndex)
+	index.Init(lexicon)
+	index.AddFilter(filters.NewLowerCaseFilter())
+
+	for doc := 0; doc < 600; doc++ {
+		words = words[:0]
+		for i := r.Intn(60) + 1; i > 0; i-- {
+			// Skew towards the start of the vocabulary
+			words = append(words, vocab[r.Intn(r.Intn(len(vocab))+1)])
+		}
+		index.Insert(filters.LoadTestDocument(
+			fmt.Sprintf("D%03d", doc), strings.Join(words, " ")))
+	}
+	index.WaitInsert()
+
+	return index
+}
+
+func queryTokens(text string) []*filereader.Token {
+	tokens := make([]*filereader.Token, 0)
+	for _, word := range strings.Fields(text) {
+		tokens = append(tokens, &filereader.Token{Text: word, Type: filereader.TextToken})
+	}
+	return tokens
+}
+
+func TestTopKMatchesExhaustive(t *testing.T) {
+	logging.SetupTestLogging()
+
+	queries := []string{
+		"w0",
+		"w3 w17",
+		"w1 w2 w3 w4 w5 w6",
+		"w38 w39 w0",
+		"w5 w5 w22 missing",
+	}
+
+	for _, plInit := range []indexer.PostingListInitializer{
+		indexer.BasicPostingListInitializer,
+		indexer.NewCompressedPostingListInitializer(indexer.VByteCodec{}, false),
+		// Positional indexes score exhaustively, but still keep k
+		indexer.PositionalPostingListInitializer,
+	} {
+		index := randomIndex(plInit)
+
+		for name, ranker := range map[string]TopKRanker{
+			"BM25": &BM25{1.2, 1, 0.75},
+			"LM":   &DirichletQL{0},
+			// Large priors make every term's score negative
+			"LM mu=5000": &DirichletQL{5000},
+		} {
+			for _, text := range queries {
+				exhaustive := ranker.(RelevanceRanker).ProcessQuery(
+					queryTokens(text), index, true)
+				sort.Sort(exhaustive)
+
+				for _, mode := range []RetrievalMode{WANDRetrieval, BlockMaxWANDRetrieval} {
+					for _, k := range []int{1, 10, 1000} {
+						response := ranker.ProcessTopK(queryTokens(text), index, true, k, mode)
+						compareTopK(t, fmt.Sprintf("%s/%s %s k=%d '%s'",
+							plInit.Name, name, mode, k, text), exhaustive, response, k)
+					}
+				}
+			}
+		}
+	}
+}
+
+func compareTopK(t *testing.T, label string, exhaustive, response *Response, k int) {
+	expected := exhaustive.Results
+	if len(expected) > k {
+		expected = expected[:k]
+	}
+
+	if len(response.Results) != len(expected) {
+		t.Errorf("%s: got %d results, expected %d", label,
+			len(response.Results), len(expected))
+		return
+	}
+
+	// Documents with tied scores can come in any order
+	ties := make(map[float64]int)
+	for _, result := range exhaustive.Results {
+		ties[result.Score]++
+	}
+
+	for i, result := range response.Results {
+		switch {
+		case result.Score != expected[i].Score:
+			t.Errorf("%s: result %d scored %f, expected %f", label, i,
+				result.Score, expected[i].Score)
+			return
+		case ties[result.Score] == 1 && result.Document != expected[i].Document:
+			t.Errorf("%s: result %d is %s, expected %s", label, i,
+				result.Document, expected[i].Document)
+			return
+		}
+	}
+}
@@ -5,6 +5,8 @@ import "os"
 import "path/filepath"
 import "regexp"
 import "fmt"
+import "strconv"
+import "strings"
 import log "github.com/cihub/seelog"
 import filereader "github.com/cwacek/irengine/scanner/filereader"
 
@@ -17,6 +19,56 @@ func (a *Args) AddDefaultArgs(fs *flag.FlagSet) {
 	a.verbosity = fs.Int("v", 0, "Be verbose [1, 2, 3]")
 }
 
+/* A flag giving a number of bytes, like 2GiB, 512MB or 1048576.
+ * KB, MB, GB and TB are powers of 1000, and KiB, MiB, GiB and TiB
+ * powers of 1024. A negative size means there's no limit. */
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"b", 1},
+}
+
+func ParseByteSize(text string) (ByteSize, error) {
+	number, unit := strings.ToLower(strings.TrimSpace(text)), 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(number, u.suffix) {
+			number, unit = strings.TrimSpace(strings.TrimSuffix(number, u.suffix)), u.size
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Can't read '%s' as a number of bytes", text)
+	}
+	if value < 0 {
+		return -1, nil
+	}
+	return ByteSize(value * unit), nil
+}
+
+func (b *ByteSize) Set(text string) (err error) {
+	*b, err = ParseByteSize(text)
+	return
+}
+
+func (b *ByteSize) String() string {
+	switch {
+	case *b < 0:
+		return "-1"
+	case *b >= 1<<30 && *b%(1<<30) == 0:
+		return fmt.Sprintf("%dGiB", *b>>30)
+	case *b >= 1<<20 && *b%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", *b>>20)
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
 type DocWalker struct {
 	output       chan filereader.Document
 	workers      chan string
@@ -0,0 +1,135 @@
+package actions
+
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strings"
+import log "github.com/cihub/seelog"
+import "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/indexer/constrained"
+import "github.com/cwacek/irengine/indexer/filters"
+import "github.com/cwacek/irengine/scanner/filereader"
+
+func EvictionBenchmark() *evictbench_action {
+	return new(evictbench_action)
+}
+
+type evictbench_action struct {
+	Args
+
+	docroot    *string
+	docpattern *string
+	maxMem     *ByteSize
+	policies   *string
+}
+
+func (a *evictbench_action) Name() string {
+	return "evictbench"
+}
+
+func (a *evictbench_action) DefineFlags(fs *flag.FlagSet) {
+	a.AddDefaultArgs(fs)
+
+	a.docroot = fs.String("doc.root", "",
+		`The root directory under which to find documents`)
+
+	a.docpattern = fs.String("doc.pattern", `^[^\.].+`,
+		`A regular expression to match document names`)
+
+	a.maxMem = new(ByteSize)
+	*a.maxMem = 8 << 20
+	fs.Var(a.maxMem, "index.memlimit",
+		`About how much memory posting lists can use while indexing.
+      Smaller limits make the policies evict more.`)
+
+	a.policies = fs.String("index.eviction",
+		strings.Join(constrained.EvictionPolicyNames(), ","),
+		`A comma separated list of the eviction policies to compare`)
+}
+
+/* Index the same documents, in the same order, once with each
+ * eviction policy, and report how often each found the posting
+ * list set it needed in memory. */
+func (a *evictbench_action) Run() {
+	SetupLogging(*a.verbosity)
+	defer log.Flush()
+
+	if *a.docroot == "" {
+		log.Critical("doc.root is required")
+		log.Flush()
+		os.Exit(1)
+	}
+
+	policies := strings.Split(*a.policies, ",")
+	for _, policy := range policies {
+		if _, err := constrained.GetEvictionPolicy(policy); err != nil {
+			log.Critical(err)
+			log.Flush()
+			os.Exit(1)
+		}
+	}
+
+	docStream := make(chan filereader.Document)
+	walker := new(DocWalker)
+	walker.WalkDocuments(*a.docroot, *a.docpattern, docStream)
+
+	documents := make([]filereader.Document, 0)
+	for doc := range docStream {
+		documents = append(documents, doc)
+	}
+	if len(documents) == 0 {
+		log.Critical("No documents matched")
+		log.Flush()
+		os.Exit(1)
+	}
+
+	fmt.Printf("Indexing %d documents with a %s memory limit\n",
+		len(documents), a.maxMem)
+	fmt.Printf("%-8s %10s %10s %10s %10s %10s %8s %12s\n", "Policy",
+		"Fetches", "Hits", "Loads", "Creates", "Dumps", "Hit rate", "Time")
+
+	for _, policy := range policies {
+		result, err := a.benchmark(policy, documents)
+		if err != nil {
+			log.Criticalf("Failed to benchmark %s: %v", policy, err)
+			log.Flush()
+			os.Exit(1)
+		}
+
+		fmt.Printf("%-8s %10d %10d %10d %10d %10d %7.2f%% %12s\n", result.Policy,
+			result.Fetches, result.Hits, result.Loads, result.Creates,
+			result.Dumps, 100*result.HitRate(), result.Elapsed)
+	}
+}
+
+func (a *evictbench_action) benchmark(policy string,
+	documents []filereader.Document) (*constrained.EvictionBenchmark, error) {
+
+	dataDir, err := ioutil.TempDir("", "evictbench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dataDir)
+
+	// Each index needs a filter chain of its own
+	chain, err := filters.InstantiateChain(filters.SingleTermFilterSequence.Ids())
+	if err != nil {
+		return nil, err
+	}
+
+	return constrained.ReplayEviction(policy, func() indexer.Lexicon {
+		lexicon := constrained.NewLexicon(int64(*a.maxMem), dataDir)
+		lexicon.SetPLInitializer(indexer.BasicPostingListInitializer)
+		return lexicon
+	}, func(lexicon indexer.Lexicon) {
+		index := new(indexer.SingleTermIndex)
+		index.Init(lexicon)
+		index.AddFilter(chain)
+
+		for _, doc := range documents {
+			index.Insert(doc)
+		}
+		index.WaitInsert()
+	})
+}
@@ -0,0 +1,73 @@
+package actions
+
+import "flag"
+import "fmt"
+import "os"
+import log "github.com/cihub/seelog"
+import "github.com/cwacek/irengine/indexer/constrained"
+
+func CheckIndex() *fsck_action {
+	return new(fsck_action)
+}
+
+type fsck_action struct {
+	Args
+
+	indexRoot *string
+	repair    *bool
+}
+
+func (a *fsck_action) Name() string {
+	return "fsck"
+}
+
+func (a *fsck_action) DefineFlags(fs *flag.FlagSet) {
+	a.AddDefaultArgs(fs)
+
+	a.indexRoot = fs.String("index.store", "",
+		"The directory containing the index to check")
+
+	a.repair = fs.Bool("repair", false,
+		`Rewrite the index without the problems found. Postings which
+      can't be read are lost. The damaged index is moved to
+      <index.store>.damaged.`)
+}
+
+func (a *fsck_action) Run() {
+	SetupLogging(*a.verbosity)
+
+	if *a.indexRoot == "" {
+		log.Critical("-index.store is required")
+		os.Exit(1)
+	}
+
+	check := constrained.CheckIndex
+	if *a.repair {
+		check = constrained.CheckIndexForRepair
+	}
+
+	report, err := check(*a.indexRoot)
+	if err != nil {
+		log.Criticalf("Failed to check %s: %v", *a.indexRoot, err)
+		log.Flush()
+		os.Exit(1)
+	}
+	report.Print(os.Stdout)
+
+	if report.OK() {
+		return
+	}
+
+	if !*a.repair {
+		log.Flush()
+		os.Exit(1)
+	}
+
+	damaged, err := constrained.RepairIndex(report)
+	if err != nil {
+		log.Criticalf("Failed to repair %s: %v", *a.indexRoot, err)
+		log.Flush()
+		os.Exit(1)
+	}
+	fmt.Printf("Repaired %s. The damaged index was moved to %s\n", *a.indexRoot, damaged)
+}
@@ -6,8 +6,6 @@ import log "github.com/cihub/seelog"
 import "github.com/cwacek/irengine/indexer"
 import "github.com/cwacek/irengine/indexer/constrained"
 import "os"
-import "strconv"
-import "strings"
 import "fmt"
 import "path/filepath"
 import "runtime/pprof"
@@ -26,13 +24,22 @@ type run_index_action struct {
 
 	stopWordList *string
 	indexRoot    *string
-	maxMem       *int
+	maxMem       *ByteSize
+	eviction     *string
+	spimiBudget  *int
+	segmentDocs  *int
 	indexType    *string
+	workers      *int
+	compression  *string
+	codecStats   *bool
+	forward      *bool
+	docstore     *bool
 
 	phraseStop *float64
 	phraseLen  *int
 
 	pruning *string
+	base    *indexer.SingleTermIndex
 
 	cpuprofile *string
 	memprofile *string
@@ -54,16 +61,57 @@ func (a *run_index_action) DefineFlags(fs *flag.FlagSet) {
 	a.indexRoot = fs.String("index.store", "/tmp/irengine",
 		"The directory in which to store the index")
 
-	a.maxMem = fs.Int("index.memlimit", -1,
-		"The maximum number of triples that can be loaded in to memory.")
+	a.maxMem = new(ByteSize)
+	*a.maxMem = -1
+	fs.Var(a.maxMem, "index.memlimit",
+		`About how much memory posting lists can use, like 2GiB or
+      512MB. Estimates include positions, and are checked against
+      the heap. Lists are swapped to disk as -index.eviction chooses.`)
+
+	a.eviction = fs.String("index.eviction", constrained.DefaultEvictionPolicy,
+		evictionUsage)
+
+	a.spimiBudget = fs.Int("index.spimi", 0,
+		`Build the index in a single pass, keeping at most this many
+      MiB of postings in memory. When the budget is reached the
+      postings are written to disk as a sorted run, and the runs
+      are merged when the index is saved. Overrides -index.memlimit.`)
+
+	a.segmentDocs = fs.Int("index.segment.docs", 0,
+		`Build a segmented index, writing every this many documents
+      as a new immutable segment. Segments of about the same size
+      are merged in the background. Overrides -index.memlimit,
+      -index.spimi and -index.workers.`)
+
+	a.workers = fs.Int("index.workers", 1,
+		`The number of workers to index documents with. Each worker builds
+      a private partial index, and the partial indexes are merged when
+      all documents have been read.`)
+
+	a.compression = fs.String("index.compression", "none",
+		`How to compress posting lists in memory and on disk. Options:
+      - none
+      - vbyte
+      - simple8b
+      - pfordelta`)
+
+	a.codecStats = fs.Bool("index.compression.stats", false,
+		`After indexing, report how large the posting lists would be,
+      and how long they take to encode and decode, with each codec.
+      Reads and re-encodes every posting list.`)
+
+	a.forward = fs.Bool("index.forward", false,
+		`Save a forward index of document vectors (each document's
+      terms, frequencies and positions) alongside the index.`)
+
+	a.docstore = fs.Bool("index.docstore", false,
+		`Save the text of every document in a compressed document
+      store, so the query engine can return it.`)
 
 	a.stopWordList = fs.String("index.stopwords", "",
 		"A file containing stopwords to use.")
 
-	a.pruning = fs.String("index.pruning", "none",
-		`The type of pruning to perform. Options:
-      - hard <p>    Trims the posting list for each word to top <p> documents .
-      - soft <p>    Trims the posting list to include only those with TF <p> std deviations above mean.`)
+	a.pruning = fs.String("index.pruning", "none", pruningUsage)
 
 	a.indexType = fs.String("index.type", "single-term",
 		`The type of index to build. Options:
@@ -82,55 +130,60 @@ func (a *run_index_action) DefineFlags(fs *flag.FlagSet) {
 	a.memprofile = fs.String("mprofile", "", "write memory profile to file")
 }
 
-func (a *run_index_action) parsePruningArg() (indexer.PostingListPruner, error) {
-
-	var pruneArgs = strings.Fields(*a.pruning)
-
-	switch pruneArgs[0] {
-	case "hard":
-		if param, err := strconv.Atoi(pruneArgs[1]); err != nil {
-			return nil, errors.New("'hard' requires integer parameter")
-		} else {
-			return &indexer.DocCountPruner{param}, nil
-		}
+func (a *run_index_action) SetupIndex() (indexer.Indexer, error) {
 
-	case "soft":
-		if param, err := strconv.ParseFloat(pruneArgs[1], 64); err != nil {
-			return nil, errors.New("'soft' requires float parameter")
-		} else {
-			return &indexer.TFPruner{param}, nil
-		}
+	var plInit indexer.PostingListInitializer
 
-	case "none":
-		return nil, nil
+	var lexicon indexer.Lexicon
 
-	default:
-		return nil, errors.New(fmt.Sprintf("Invalid pruning option '%s'", pruneArgs[0]))
+	if _, err := constrained.GetEvictionPolicy(*a.eviction); err != nil {
+		return nil, err
 	}
-}
-
-func (a *run_index_action) SetupIndex() (indexer.Indexer, error) {
 
-	lexicon := constrained.NewLexicon(*a.maxMem, *a.indexRoot)
+	if *a.segmentDocs > 0 {
+		// The buffer for each segment is kept in memory
+		lexicon = indexer.NewTrieLexicon()
+	} else if *a.spimiBudget > 0 {
+		lexicon = constrained.NewSPIMILexicon(int64(*a.spimiBudget)<<20, *a.indexRoot)
+		lexicon.(mergeReporter).SetMergeProgress(printMergeProgress)
+	} else {
+		lexicon = constrained.NewLexicon(int64(*a.maxMem), *a.indexRoot)
+		setEvictionPolicy(lexicon, *a.eviction)
+	}
 	index := new(indexer.SingleTermIndex)
 	index.Init(lexicon)
+	a.base = index
+	index.IndexType = *a.indexType
+	if root, err := filepath.Abs(*a.docroot); err == nil {
+		index.Sources = []string{root}
+	}
+
+	if *a.forward {
+		index.EnableForwardIndex()
+	}
+
+	if *a.docstore {
+		if err := index.EnableDocumentStore(); err != nil {
+			return nil, err
+		}
+	}
 
 	switch *a.indexType {
 	case "single-term":
 		index.AddFilter(filters.SingleTermFilterSequence)
-		lexicon.SetPLInitializer(indexer.BasicPostingListInitializer)
+		plInit = indexer.BasicPostingListInitializer
 
 	case "single-term-positional":
-		lexicon.SetPLInitializer(indexer.PositionalPostingListInitializer)
+		plInit = indexer.PositionalPostingListInitializer
 		index.AddFilter(filters.SingleTermFilterSequence)
 
 	case "stemmed":
-		lexicon.SetPLInitializer(indexer.BasicPostingListInitializer)
+		plInit = indexer.BasicPostingListInitializer
 		index.AddFilter(filters.SingleTermFilterSequence)
 		index.AddFilter(filters.Instantiate("porter"))
 
 	case "phrase":
-		lexicon.SetPLInitializer(indexer.BasicPostingListInitializer)
+		plInit = indexer.BasicPostingListInitializer
 		if filter, err := filters.GetFactory("phrases"); err != nil {
 			return nil, errors.New("Have no phrase filters. Cannot run phrase index")
 		} else {
@@ -144,6 +197,16 @@ func (a *run_index_action) SetupIndex() (indexer.Indexer, error) {
 		return nil, errors.New("Unknown index type: " + *a.indexType)
 	}
 
+	if *a.compression != "none" {
+		if codec, err := indexer.GetCodec(*a.compression); err != nil {
+			return nil, err
+		} else {
+			plInit = indexer.NewCompressedPostingListInitializer(codec,
+				plInit.Positional)
+		}
+	}
+	lexicon.SetPLInitializer(plInit)
+
 	// Allow anything to use the stopword list (even if it makes
 	// no sense)
 	if filter, err := filters.GetFactory("stopwords"); err != nil {
@@ -165,13 +228,95 @@ func (a *run_index_action) SetupIndex() (indexer.Indexer, error) {
 		}
 	}
 
+	if *a.segmentDocs > 0 {
+		if *a.forward || *a.docstore {
+			log.Warn("Segmented indexes don't keep a forward index or document store")
+		}
+
+		segmented, err := constrained.NewSegmentedIndex(*a.indexRoot, index, plInit)
+		if err != nil {
+			return nil, err
+		}
+		segmented.SegmentDocs = *a.segmentDocs
+		segmented.Policy = constrained.NewTieredMergePolicy(constrained.DefaultSegmentsPerTier)
+		return segmented, nil
+	}
+
+	if *a.workers > 1 {
+		return indexer.NewParallelIndexer(index, *a.workers,
+			a.workerLexicon(plInit)), nil
+	}
+
 	return index, nil
 }
 
+type mergeReporter interface {
+	SetMergeProgress(constrained.MergeProgressFunc)
+}
+
+func printMergeProgress(done, total int64) {
+	if total > 0 {
+		fmt.Printf("Merging runs: %d/%d bytes (%0.0f%%)\n", done, total,
+			100*float64(done)/float64(total))
+	}
+}
+
+const evictionUsage = `Which posting list sets a swapping lexicon writes to disk
+      when it's over its memory limit. Options:
+      - lru: the least recently used
+      - lfu: the least often used since it was read
+      - 2q: sets used once first, then the least recently used
+      - arc: adapts between recency and frequency`
+
+type evictionSetter interface {
+	SetEvictionPolicy(constrained.EvictionPolicy)
+}
+
+/* Have lexicon use the named eviction policy, if it swaps posting
+ * list sets to disk. Unknown policies are logged and ignored. */
+func setEvictionPolicy(lexicon indexer.Lexicon, name string) {
+	setter, ok := lexicon.(evictionSetter)
+	if !ok {
+		return
+	}
+
+	if policy, err := constrained.GetEvictionPolicy(name); err != nil {
+		log.Errorf("Not changing the eviction policy: %v", err)
+	} else {
+		setter.SetEvictionPolicy(policy)
+	}
+}
+
+// Build the lexicons used by parallel indexing workers. The workers
+// split the memory limit between them, and swap to their own
+// directories under the index store.
+func (a *run_index_action) workerLexicon(
+	plInit indexer.PostingListInitializer) indexer.WorkerLexiconFunc {
+
+	return func(worker int) indexer.Lexicon {
+		var lexicon indexer.Lexicon
+
+		dataDir := filepath.Join(*a.indexRoot, fmt.Sprintf("worker_%d", worker))
+
+		if *a.spimiBudget > 0 {
+			lexicon = constrained.NewSPIMILexicon(
+				(int64(*a.spimiBudget)<<20)/int64(*a.workers), dataDir)
+		} else if *a.maxMem > 0 {
+			lexicon = constrained.NewLexicon(int64(*a.maxMem)/int64(*a.workers), dataDir)
+			setEvictionPolicy(lexicon, *a.eviction)
+		} else {
+			lexicon = indexer.NewTrieLexicon()
+		}
+
+		lexicon.SetPLInitializer(plInit)
+		return lexicon
+	}
+}
+
 func (a *run_index_action) Run() {
 	var index indexer.Indexer
 	var err error
-	var pruner indexer.PostingListPruner
+	var pruner *indexer.ReportingPruner
 	defer func() {
 		log.Flush()
 	}()
@@ -196,9 +341,11 @@ func (a *run_index_action) Run() {
 		return
 	}
 
-	if pruner, err = a.parsePruningArg(); err != nil {
+	if parsed, err := ParsePruner(*a.pruning, a.base); err != nil {
 		log.Criticalf("Error creating index: %v", err)
 		return
+	} else if parsed != nil {
+		pruner = indexer.NewReportingPruner(parsed)
 	}
 
 	/*// For each document.*/
@@ -244,10 +391,21 @@ func (a *run_index_action) Run() {
 	}
 
 	// Prune the index
-	index.Prune(pruner)
+	if pruner != nil {
+		index.Prune(pruner)
+	}
 
 	log.Flush()
 	fmt.Println(index.String())
-	index.(*indexer.SingleTermIndex).Save()
+	index.Save()
+
+	// Some lexicons only prune as they're saved
+	if pruner != nil {
+		pruner.Report.Print(os.Stdout, 20)
+	}
 	index.PrintLexicon(os.Stdout)
+
+	if *a.codecStats {
+		indexer.PrintCompressionStats(os.Stdout, a.base.Lexicon())
+	}
 }
@@ -0,0 +1,60 @@
+package actions
+
+import "flag"
+import "fmt"
+import "os"
+import "strings"
+import log "github.com/cihub/seelog"
+import "github.com/cwacek/irengine/indexer/constrained"
+
+func MergeIndexes() *merge_action {
+	return new(merge_action)
+}
+
+type merge_action struct {
+	Args
+
+	inputs *string
+	output *string
+}
+
+func (a *merge_action) Name() string {
+	return "merge"
+}
+
+func (a *merge_action) DefineFlags(fs *flag.FlagSet) {
+	a.AddDefaultArgs(fs)
+
+	a.inputs = fs.String("in", "",
+		`A comma separated list of the index directories to merge.
+      They must have been built with the same filters and posting
+      list type.`)
+
+	a.output = fs.String("out", "",
+		"The directory to write the merged index to. It mustn't exist.")
+}
+
+func (a *merge_action) Run() {
+	SetupLogging(*a.verbosity)
+
+	inputs := make([]string, 0)
+	for _, input := range strings.Split(*a.inputs, ",") {
+		if input = strings.TrimSpace(input); input != "" {
+			inputs = append(inputs, input)
+		}
+	}
+
+	if len(inputs) < 2 || *a.output == "" {
+		log.Critical("-in needs at least two indexes, and -out is required")
+		log.Flush()
+		os.Exit(1)
+	}
+
+	merged, err := constrained.MergeIndexes(*a.output, inputs)
+	if err != nil {
+		log.Criticalf("Failed to merge indexes: %v", err)
+		log.Flush()
+		os.Exit(1)
+	}
+	fmt.Printf("Merged %d indexes into %s: %s\n", len(inputs), *a.output, merged)
+}
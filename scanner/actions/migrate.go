@@ -0,0 +1,50 @@
+package actions
+
+import "flag"
+import "fmt"
+import "os"
+import log "github.com/cihub/seelog"
+import "github.com/cwacek/irengine/indexer/constrained"
+
+func MigrateIndex() *migrate_action {
+	return new(migrate_action)
+}
+
+type migrate_action struct {
+	Args
+
+	indexRoot *string
+}
+
+func (a *migrate_action) Name() string {
+	return "migrate"
+}
+
+func (a *migrate_action) DefineFlags(fs *flag.FlagSet) {
+	a.AddDefaultArgs(fs)
+
+	a.indexRoot = fs.String("index.store", "",
+		`An index written in the old text format. The compiled
+      term dictionary, postings and document map are added
+      alongside it.`)
+}
+
+func (a *migrate_action) Run() {
+	SetupLogging(*a.verbosity)
+
+	if *a.indexRoot == "" {
+		log.Critical("-index.store is required")
+		os.Exit(1)
+	}
+
+	if constrained.HasCompiledIndex(*a.indexRoot + "/") {
+		fmt.Printf("%s already has a compiled index\n", *a.indexRoot)
+		return
+	}
+
+	if err := constrained.MigrateIndex(*a.indexRoot + "/"); err != nil {
+		log.Criticalf("Failed to migrate %s: %v", *a.indexRoot, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote compiled index to %s\n", *a.indexRoot)
+}
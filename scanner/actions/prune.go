@@ -0,0 +1,211 @@
+package actions
+
+import "errors"
+import "flag"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import log "github.com/cihub/seelog"
+import "github.com/cwacek/irengine/indexer"
+import "github.com/cwacek/irengine/indexer/constrained"
+import "github.com/cwacek/irengine/query_engine"
+
+const pruningUsage = `The type of pruning to perform. Options:
+      - hard <p>    Trims the posting list for each word to top <p> documents .
+      - soft <p>    Trims the posting list to include only those with TF <p> std deviations above mean.
+      - score <ranker> <t>
+                    Removes postings the ranker (BM25 or LM) scores below <t>.
+      - term-score <ranker> <k> <e>
+                    Removes postings the ranker scores below <e> times the
+                    score of each term's <k>th best posting.
+      - doc <weight> <p>
+                    Keeps the <p> percent of each document's terms with the
+                    highest weight (tfidf or kl), and removes its other postings.`
+
+/* Build the pruner described by spec. Score-based pruners score
+ * postings with the statistics of index, which needn't be complete
+ * until the pruner is used. */
+func ParsePruner(spec string, index *indexer.SingleTermIndex) (indexer.PostingListPruner, error) {
+
+	var pruneArgs = strings.Fields(spec)
+	if len(pruneArgs) == 0 {
+		return nil, nil
+	}
+
+	needs := func(count int, usage string) error {
+		if len(pruneArgs) != count+1 {
+			return fmt.Errorf("'%s' requires %s", pruneArgs[0], usage)
+		}
+		return nil
+	}
+
+	switch pruneArgs[0] {
+	case "hard":
+		if err := needs(1, "integer parameter"); err != nil {
+			return nil, err
+		}
+		if param, err := strconv.Atoi(pruneArgs[1]); err != nil {
+			return nil, errors.New("'hard' requires integer parameter")
+		} else {
+			return &indexer.DocCountPruner{Count: param}, nil
+		}
+
+	case "soft":
+		if err := needs(1, "float parameter"); err != nil {
+			return nil, err
+		}
+		if param, err := strconv.ParseFloat(pruneArgs[1], 64); err != nil {
+			return nil, errors.New("'soft' requires float parameter")
+		} else {
+			return &indexer.TFPruner{Multiplier: param}, nil
+		}
+
+	case "score":
+		if err := needs(2, "a ranker and a float threshold"); err != nil {
+			return nil, err
+		}
+		scorer, err := postingScorer(pruneArgs[1], index)
+		if err != nil {
+			return nil, err
+		}
+		if threshold, err := strconv.ParseFloat(pruneArgs[2], 64); err != nil {
+			return nil, errors.New("'score' requires float threshold")
+		} else {
+			return indexer.NewUniformScorePruner(scorer, threshold), nil
+		}
+
+	case "term-score":
+		if err := needs(3, "a ranker, an integer k and a float epsilon"); err != nil {
+			return nil, err
+		}
+		scorer, err := postingScorer(pruneArgs[1], index)
+		if err != nil {
+			return nil, err
+		}
+		k, err := strconv.Atoi(pruneArgs[2])
+		if err != nil || k < 1 {
+			return nil, errors.New("'term-score' requires a positive integer k")
+		}
+		if epsilon, err := strconv.ParseFloat(pruneArgs[3], 64); err != nil {
+			return nil, errors.New("'term-score' requires float epsilon")
+		} else {
+			return indexer.NewTermCentricScorePruner(scorer, k, epsilon), nil
+		}
+
+	case "doc":
+		if err := needs(2, "a weight and a float percentage"); err != nil {
+			return nil, err
+		}
+		var scorer indexer.PostingScorer
+		switch pruneArgs[1] {
+		case "tfidf":
+			scorer = indexer.NewTfIdfScorer(index)
+		case "kl":
+			scorer = indexer.NewKLScorer(index)
+		default:
+			return nil, fmt.Errorf("Unknown document term weight '%s'", pruneArgs[1])
+		}
+		if percent, err := strconv.ParseFloat(pruneArgs[2], 64); err != nil || percent <= 0 {
+			return nil, errors.New("'doc' requires a positive float percentage")
+		} else {
+			return indexer.NewDocumentPruner(scorer, percent), nil
+		}
+
+	case "none":
+		return nil, nil
+
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid pruning option '%s'", pruneArgs[0]))
+	}
+}
+
+func postingScorer(name string, index *indexer.SingleTermIndex) (indexer.PostingScorer, error) {
+	ranker, ok := query_engine.RankingEngines[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown ranker '%s'", name)
+	}
+	if scoring, ok := ranker.(query_engine.PostingScoring); ok {
+		return scoring.PostingScorer(index), nil
+	}
+	return nil, fmt.Errorf("%s can't score postings for pruning", name)
+}
+
+// The total size of the files under dir
+func diskUsage(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func PruneIndex() *prune_action {
+	return new(prune_action)
+}
+
+type prune_action struct {
+	Args
+
+	input   *string
+	output  *string
+	pruning *string
+	terms   *int
+}
+
+func (a *prune_action) Name() string {
+	return "prune"
+}
+
+func (a *prune_action) DefineFlags(fs *flag.FlagSet) {
+	a.AddDefaultArgs(fs)
+
+	a.input = fs.String("index.store", "/tmp/irengine",
+		"The directory of the index to prune")
+
+	a.output = fs.String("out", "",
+		"The directory to write the pruned index to. It mustn't exist.")
+
+	a.pruning = fs.String("index.pruning", "none", pruningUsage)
+
+	a.terms = fs.Int("report.terms", 20,
+		"How many of the most pruned terms to report on. -1 reports all of them.")
+}
+
+func (a *prune_action) Run() {
+	SetupLogging(*a.verbosity)
+
+	if *a.output == "" {
+		log.Critical("-out is required")
+		log.Flush()
+		os.Exit(1)
+	}
+
+	var reporter *indexer.ReportingPruner
+	pruned, err := constrained.PruneIndex(*a.input, *a.output,
+		func(source *indexer.SingleTermIndex) (indexer.PostingListPruner, error) {
+			pruner, err := ParsePruner(*a.pruning, source)
+			if err != nil {
+				return nil, err
+			} else if pruner == nil {
+				return nil, errors.New("-index.pruning is required")
+			}
+			reporter = indexer.NewReportingPruner(pruner)
+			return reporter, nil
+		})
+
+	if err != nil {
+		log.Criticalf("Failed to prune index: %v", err)
+		log.Flush()
+		os.Exit(1)
+	}
+
+	reporter.Report.Print(os.Stdout, *a.terms)
+	fmt.Printf("Index on disk went from %d to %d bytes\n",
+		diskUsage(*a.input), diskUsage(*a.output))
+	fmt.Printf("Pruned %s into %s: %s\n", *a.input, *a.output, pruned)
+}
@@ -22,10 +22,13 @@ type query_action struct {
 	engine     *string
 	indexPref  *string
 	statistics *string
+	document   *string
 
 	queryThreshold  *float64
 	thresholdRanker *string
 	limit           *int
+	retrieval       *string
+	boolean         *bool
 
 	host *string
 	port *int
@@ -43,6 +46,9 @@ func (a *query_action) DefineFlags(fs *flag.FlagSet) {
 	a.statistics = fs.String("term.statistics", "",
 		"Look up statistics for the given term. ")
 
+	a.document = fs.String("document", "",
+		"Fetch the text of the document with this id from the document store.")
+
 	a.queryFile = fs.String("queryfile", "",
 		"A file containing a bunch of queries to run in bulk")
 
@@ -55,6 +61,16 @@ func (a *query_action) DefineFlags(fs *flag.FlagSet) {
 	a.limit = fs.Int("limit", 100,
 		"Limit the results to this many results")
 
+	a.retrieval = fs.String("retrieval", "exhaustive", `
+  How to find the top results. Options are:
+    exhaustive  Score every document containing a query term
+    wand        Skip documents which can't make the top -limit
+    bmw         Block-Max WAND, which skips whole blocks of postings`)
+
+	a.boolean = fs.Bool("boolean", false, `
+  Treat the queries as boolean queries, like 'a AND (b OR c) NOT d',
+  returning every document that matches ordered by -ranking.`)
+
 	a.host = fs.String("index.host", "localhost",
 		"The host running the query engine")
 
@@ -121,19 +137,16 @@ func ZMQConnect(host string, port int) (sock *zmq.Socket, err error) {
 
 func (a *query_action) Run() {
 	defer log.Flush()
-	var (
-		err       error
-		requester *zmq.Socket
-	)
+	var requester *zmq.Socket
 
 	SetupLogging(*a.verbosity)
 
 	switch {
-	case *a.queryFile == "":
+	case *a.queryFile == "" && *a.document == "":
 		log.Criticalf("queryfile is required argument")
 		os.Exit(1)
 
-	case *a.engine == "":
+	case *a.engine == "" && *a.document == "":
 		log.Criticalf("ranking is required argument")
 		os.Exit(1)
 
@@ -142,6 +155,12 @@ func (a *query_action) Run() {
 		os.Exit(1)
 	}
 
+	retrieval, err := query_engine.ParseRetrievalMode(*a.retrieval)
+	if err != nil {
+		log.Criticalf("%v", err)
+		os.Exit(1)
+	}
+
 	if requester, err = ZMQConnect(*a.host, *a.port); err != nil {
 		log.Criticalf("Failed to connect socket: %v", err)
 		return
@@ -150,12 +169,14 @@ func (a *query_action) Run() {
 
 	if *a.statistics != "" {
 		a.lookupStatistics(requester, *a.statistics)
+	} else if *a.document != "" {
+		a.fetchDocument(requester, *a.document)
 	} else {
 
 		if file, err := os.Open(*a.queryFile); err == nil {
 			a.BufferQueriesFromFile(file)
 
-			a.runBufferedQueries(requester)
+			a.runBufferedQueries(requester, retrieval)
 
 		} else {
 			log.Criticalf("Failed to open query file: %v", err)
@@ -207,7 +228,51 @@ func (a *query_action) lookupStatistics(requester *zmq.Socket, term string) {
 	}
 }
 
-func (a *query_action) runBufferedQueries(requester *zmq.Socket) {
+// Results go to stdout in TREC format, so suggestions are logged
+func (a *query_action) printSuggestion(query *query_engine.Query,
+	response *query_engine.Response) {
+
+	if response.Suggestion != "" {
+		log.Warnf("Query %s: did you mean '%s'?", query.Id, response.Suggestion)
+	}
+}
+
+func (a *query_action) fetchDocument(requester *zmq.Socket, humanId string) {
+	query := new(query_engine.Query)
+	query.Id = "document"
+	query.Text = humanId
+	query.IndexPref = *a.indexPref
+	query.Type = query_engine.DocumentQuery
+
+	if asJSON, err := json.Marshal(query); err == nil {
+		log.Debugf("Sending %s", asJSON)
+		requester.SendBytes(asJSON, 0)
+	} else {
+		panic(err)
+	}
+
+	var response query_engine.Response
+
+	if reply, err := requester.RecvBytes(0); err == nil {
+		err = json.Unmarshal(reply, &response)
+		switch {
+		case err != nil:
+			panic(err)
+
+		case response.Error != "":
+			log.Criticalf("Fetching %s failed: %s", humanId, response.Error)
+
+		default:
+			for _, result := range response.Results {
+				fmt.Printf("%s\n%s\n", result.Document, result.Info)
+			}
+		}
+	}
+}
+
+func (a *query_action) runBufferedQueries(requester *zmq.Socket,
+	retrieval query_engine.RetrievalMode) {
+
 	var asJSON []byte
 	var err error
 	var response query_engine.Response
@@ -216,6 +281,11 @@ func (a *query_action) runBufferedQueries(requester *zmq.Socket) {
 		query.Engine = *a.engine
 		query.IndexPref = *a.indexPref
 		query.QueryThresh = *a.queryThreshold
+		query.Retrieval = retrieval
+		query.Limit = *a.limit
+		if *a.boolean {
+			query.Type = query_engine.BooleanQuery
+		}
 
 		/*switch strings.ToLower(*a.thresholdRanker) {*/
 		/*case "tf-idf": */
@@ -246,8 +316,10 @@ func (a *query_action) runBufferedQueries(requester *zmq.Socket) {
 
 			case response.Error != "":
 				log.Criticalf("Query failed: %s", response.Error)
+				a.printSuggestion(query, &response)
 
 			default:
+				a.printSuggestion(query, &response)
 				for i, result := range response.Results {
 					if best == 0.0 {
 						best = result.Score
@@ -6,8 +6,12 @@ import "fmt"
 import zmq "github.com/pebbe/zmq3"
 import "os"
 import "strings"
+import "time"
+import "github.com/cwacek/irengine/indexer"
 import "github.com/cwacek/irengine/indexer/constrained"
+import "github.com/cwacek/irengine/indexer/filters"
 import "github.com/cwacek/irengine/query_engine"
+import "github.com/cwacek/irengine/scanner/filereader"
 
 func QueryEngineRunner() *query_engine_action {
 	return new(query_engine_action)
@@ -27,6 +31,14 @@ type query_engine_action struct {
 	phraseRoot *string
 	engineMap  map[string]deployed_engine
 
+	wildcardLimit *int
+	eviction      *string
+
+	liveRoot    *string
+	livePattern *string
+	liveType    *string
+	refresh     *time.Duration
+
 	port *int
 }
 
@@ -49,6 +61,31 @@ func (a *query_engine_action) DefineFlags(fs *flag.FlagSet) {
 	a.phraseRoot = fs.String("index.store.phrase", "",
 		"A directory containing a phrase index")
 
+	a.wildcardLimit = fs.Int("wildcard.limit", indexer.DefaultWildcardLimit,
+		`The most terms a wildcard query term like 'environ*' is
+      expanded to. The terms in the most documents are kept.`)
+
+	a.eviction = fs.String("index.eviction", constrained.DefaultEvictionPolicy,
+		evictionUsage+`
+      Only used for indexes without a compiled form.`)
+
+	a.liveRoot = fs.String("index.live", "",
+		`A directory of documents to index while serving queries on
+      them as the 'live' index. Queries see the documents indexed
+      up to the last refresh.`)
+
+	a.livePattern = fs.String("index.live.pattern", `^[^\.].+`,
+		"A regular expression to match the names of live documents")
+
+	a.liveType = fs.String("index.live.type", "single-term",
+		`The type of the live index. Options:
+      - single-term
+      - single-term-positional
+      - stemmed`)
+
+	a.refresh = fs.Duration("index.refresh", indexer.DefaultRefreshInterval,
+		"How often documents indexed into the live index become searchable")
+
 	a.port = fs.Int("engine.port", 10800,
 		"The port on which to listen for incoming queries")
 
@@ -62,12 +99,83 @@ func (a *query_engine_action) LoadEngine(tag, path string, port int) {
 		return
 	}
 
+	if constrained.IsSegmentedIndex(path) {
+		segmented, err := constrained.OpenSegmentedIndex(path)
+		if err != nil {
+			log.Criticalf("Error loading index %s from disk: %v", tag, err)
+			log.Flush()
+			os.Exit(1)
+		}
+
+		segmented.SetWildcardLimit(*a.wildcardLimit)
+		a.deploy(tag, segmented, port)
+		return
+	}
+
 	index, err := constrained.SingleTermIndexFromDisk(path)
 
 	if err != nil {
 		log.Criticalf("Error loading index %s from disk: %v", tag, err)
+		log.Flush()
+		os.Exit(1)
+	}
+
+	index.WildcardLimit = *a.wildcardLimit
+	setEvictionPolicy(index.Lexicon(), *a.eviction)
+	a.deploy(tag, index, port)
+}
+
+/* Index the documents under root while serving queries on them as
+ * tag. The index publishes what it has every refresh interval. */
+func (a *query_engine_action) LoadLiveEngine(tag, root string, port int) {
+
+	if root == "" {
+		return
+	}
+
+	plInit := indexer.BasicPostingListInitializer
+	if *a.liveType == "single-term-positional" {
+		plInit = indexer.PositionalPostingListInitializer
+	}
+
+	index := indexer.NewRealtimeIndex(func() indexer.Lexicon {
+		lexicon := indexer.NewTrieLexicon()
+		lexicon.SetPLInitializer(plInit)
+		return lexicon
+	})
+	index.RefreshInterval = *a.refresh
+	index.WildcardLimit = *a.wildcardLimit
+
+	switch *a.liveType {
+	case "single-term", "single-term-positional":
+		index.AddFilter(filters.SingleTermFilterSequence)
+	case "stemmed":
+		index.AddFilter(filters.SingleTermFilterSequence)
+		index.AddFilter(filters.Instantiate("porter"))
+	default:
+		log.Criticalf("Unknown live index type: %s", *a.liveType)
+		os.Exit(1)
 	}
 
+	docStream := make(chan filereader.Document)
+	walker := new(DocWalker)
+	walker.WalkDocuments(root, *a.livePattern, docStream)
+
+	index.Start()
+	go func() {
+		for doc := range docStream {
+			index.Insert(doc)
+		}
+		index.Stop()
+		log.Infof("Finished indexing '%s' [%s]", tag, index.String())
+	}()
+
+	a.deploy(tag, index, port)
+}
+
+// Start an engine serving index on port, and connect to it
+func (a *query_engine_action) deploy(tag string, index indexer.Searchable, port int) {
+
 	engine := &query_engine.ZeroMQEngine{}
 	engine.Init(index, port)
 
@@ -98,9 +206,10 @@ func (a *query_engine_action) Run() {
 	a.LoadEngine("positional", *a.posRoot, *a.port+2)
 	a.LoadEngine("stem", *a.stemRoot, *a.port+3)
 	a.LoadEngine("phrase", *a.phraseRoot, *a.port+4)
+	a.LoadLiveEngine("live", *a.liveRoot, *a.port+5)
 
 	if len(a.engineMap) == 0 {
-		log.Critical("One of the index.store arguments must be supplied")
+		log.Critical("One of the index.store arguments or index.live must be supplied")
 		os.Exit(1)
 	}
 
@@ -20,6 +20,13 @@ type Document interface {
 	Add(*Token) /* Add a token, setting the DocId and position if necessary */
 }
 
+/* Documents which can give back their text, so that it can be
+ * shown to users later. */
+type TextDocument interface {
+	Document
+	Text() string
+}
+
 type FileReader interface {
 	Init(string)
 	ReadAll() <-chan Document
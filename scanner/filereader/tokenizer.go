@@ -2,7 +2,6 @@ package filereader
 
 import "text/scanner"
 import "io"
-import "math/rand"
 import log "github.com/cihub/seelog"
 import "fmt"
 import "bytes"
@@ -18,17 +17,35 @@ const (
 	SymbolToken
 )
 
+/* Whether a token starts a new sentence or paragraph. Sentences
+ * end at '.', '!' and '?', and paragraphs at blank lines and XML
+ * tags. A new paragraph is also a new sentence. */
+type Boundary int
+
+const (
+	NoBoundary Boundary = iota
+	SentenceBoundary
+	ParagraphBoundary
+)
+
 type Token struct {
 	Text     string
 	Type     TokenType
 	DocId    DocumentId
 	Position int
 	Final    bool
-	// An unique identifier to denote phrases which do not cross
-	// a punctuation barrier.
+	// An identifier to denote phrases which do not cross
+	// a punctuation barrier. It counts the barriers seen by
+	// the tokenizer, so it's the same every time a file is read.
 	// This allows indexers to identify phrases without having to
 	// process punctuation itself
 	PhraseId int
+
+	Boundary Boundary
+	// The sentence and paragraph in the document holding the
+	// token, counted from zero. Set when it's added to a document.
+	Sentence  int
+	Paragraph int
 }
 
 func (t *Token) Clone() *Token {
@@ -37,6 +54,9 @@ func (t *Token) Clone() *Token {
 	newtok.Position = t.Position
 	newtok.Final = t.Final
 	newtok.PhraseId = t.PhraseId
+	newtok.Boundary = t.Boundary
+	newtok.Sentence = t.Sentence
+	newtok.Paragraph = t.Paragraph
 	return newtok
 }
 
@@ -85,6 +105,13 @@ type Tokenizer interface {
 	Reset()
 }
 
+/* Tokenizers which can say where in their input the last XML tag
+ * returned by Next was, as byte offsets of its '<' and just past
+ * its '>'. */
+type TagLocator interface {
+	TagSpan() (start, end int64)
+}
+
 func (t TokenType) String() string {
 	switch t {
 	case TextToken:
@@ -109,6 +136,11 @@ type BadXMLTokenizer struct {
 	scanner            *scanner.Scanner
 	rd                 io.ReadSeeker
 	current_phrase_id  int
+
+	// The boundary before the next text token, and the number of
+	// newlines since the last thing that wasn't whitespace
+	boundary Boundary
+	newlines int
 }
 
 func BadXMLTokenizer_FromReader(rd io.ReadSeeker) Tokenizer {
@@ -118,7 +150,7 @@ func BadXMLTokenizer_FromReader(rd io.ReadSeeker) Tokenizer {
 	t.scanner.Whitespace = 0
 	t.scanner.Error = func(s *scanner.Scanner, msg string) { panic(msg) }
 	t.scanner.Mode = scanner.ScanStrings
-	t.current_phrase_id = rand.Intn(1000)
+	t.current_phrase_id = 1
 	return t
 }
 
@@ -131,7 +163,26 @@ func (tz *BadXMLTokenizer) Reset() {
 	tz.scanner.Whitespace = 0
 	tz.scanner.Error = func(s *scanner.Scanner, msg string) { panic(msg) }
 	tz.scanner.Mode = scanner.ScanStrings
-	tz.current_phrase_id = rand.Intn(1000)
+	tz.current_phrase_id = 1
+	tz.boundary = NoBoundary
+	tz.newlines = 0
+}
+
+func (tz *BadXMLTokenizer) TagSpan() (start, end int64) {
+	return int64(tz.tok_start), int64(tz.tok_end)
+}
+
+// Start a new phrase, and note a boundary before the next token
+func (tz *BadXMLTokenizer) endPhrase(boundary Boundary) {
+	tz.current_phrase_id++
+	if boundary > tz.boundary {
+		tz.boundary = boundary
+	}
+}
+
+// Whether r ends a sentence
+func endsSentence(r rune) bool {
+	return r == '.' || r == '!' || r == '?'
 }
 
 var alnum = []*unicode.RangeTable{unicode.Digit, unicode.Letter,
@@ -150,6 +201,14 @@ func (tz *BadXMLTokenizer) Next() (*Token, error) {
 			return nil, io.EOF
 		}
 
+		if tok == '\n' {
+			if tz.newlines++; tz.newlines == 2 {
+				tz.endPhrase(ParagraphBoundary)
+			}
+		} else if !unicode.IsSpace(tok) {
+			tz.newlines = 0
+		}
+
 		switch {
 		case unicode.IsPrint(tok) == false:
 			log.Tracef("Skipping unprintable character")
@@ -160,10 +219,12 @@ func (tz *BadXMLTokenizer) Next() (*Token, error) {
 
 		case tok == '<':
 			log.Tracef("parsing XML")
+			tz.tok_start = tz.scanner.Pos().Offset
 			token, ok := parseXML(tz.scanner)
+			tz.tok_end = tz.scanner.Pos().Offset
 			// We actually bump the phrase no matter what. It's
 			// either a comment, an xml token, or something weird
-			tz.current_phrase_id = rand.Intn(1000)
+			tz.endPhrase(ParagraphBoundary)
 			if ok {
 				log.Tracef("Returning XML Token: %s", token)
 				return token, nil
@@ -172,7 +233,7 @@ func (tz *BadXMLTokenizer) Next() (*Token, error) {
 		case tok == '&':
 			log.Tracef("parsing HTML")
 			if token := parseHTMLEntity(tz.scanner); token != nil {
-				tz.current_phrase_id = rand.Intn(1000)
+				tz.endPhrase(NoBoundary)
 				return token, nil
 			}
 
@@ -180,17 +241,30 @@ func (tz *BadXMLTokenizer) Next() (*Token, error) {
 			fallthrough
 		case unicode.Is(unicode.Punct, tok):
 			log.Tracef("Ignoring punctuation: %v", tok)
-			tz.current_phrase_id = rand.Intn(1000)
+			if endsSentence(tok) {
+				tz.endPhrase(SentenceBoundary)
+			} else {
+				tz.endPhrase(NoBoundary)
+			}
 			tok = tz.scanner.Scan()
 
 		default:
 			/* Catch special things in words */
 			log.Tracef("Found '%s' . Parsing Text", string(tok))
+
+			// Punctuation ending the word applies to the next one
+			boundary := tz.boundary
+			tz.boundary = NoBoundary
+
 			token, ok := tz.parseCompound()
 			if ok {
+				token.Boundary = boundary
 				log.Debugf("Returing Text Token: %s", token)
 				return token, nil
 			} else {
+				if boundary > tz.boundary {
+					tz.boundary = boundary
+				}
 				tz.scanner.Scan()
 			}
 		}
@@ -265,8 +339,11 @@ func (t *BadXMLTokenizer) parseCompound() (*Token, bool) {
 			case next == '\'':
 				// Trailing single punctuation should not make a new phrase
 
+			case endsSentence(next):
+				t.endPhrase(SentenceBoundary)
+
 			default:
-				t.current_phrase_id = rand.Intn(1000)
+				t.endPhrase(NoBoundary)
 			}
 
 		default:
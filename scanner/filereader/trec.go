@@ -11,6 +11,8 @@ type TrecDocument struct {
 	tokens []*Token
 	id     DocumentId
 	origId string
+	// The raw text of the document, if the reader kept it
+	text []byte
 }
 
 func (T *TrecDocument) OrigIdent() string {
@@ -39,9 +41,49 @@ func (d *TrecDocument) Len() int {
 func (d *TrecDocument) Add(token *Token) {
 	token.Position = len(d.tokens) + 1
 	token.DocId = d.id
+
+	// Number the sentences and paragraphs from the document's start
+	if len(d.tokens) > 0 {
+		last := d.tokens[len(d.tokens)-1]
+		token.Sentence = last.Sentence
+		token.Paragraph = last.Paragraph
+		if token.Boundary >= SentenceBoundary {
+			token.Sentence++
+		}
+		if token.Boundary == ParagraphBoundary {
+			token.Paragraph++
+		}
+	} else {
+		token.Sentence = 0
+		token.Paragraph = 0
+	}
 	d.tokens = append(d.tokens, token)
 }
 
+// Add raw text from the file to the document's text
+func (d *TrecDocument) AppendText(raw []byte) {
+	d.text = append(d.text, raw...)
+}
+
+/* The text of the document, as it was in the file. Documents
+ * which weren't read from a file have it rebuilt from their
+ * tokens instead, with words separated by spaces and symbols
+ * attached to the word before them. */
+func (d *TrecDocument) Text() string {
+	if d.text != nil {
+		return string(d.text)
+	}
+
+	text := new(bytes.Buffer)
+	for _, token := range d.tokens {
+		if text.Len() > 0 && token.Type != SymbolToken {
+			text.WriteByte(' ')
+		}
+		text.WriteString(token.Text)
+	}
+	return text.String()
+}
+
 func (d *TrecDocument) Tokens() <-chan *Token {
 
 	c := make(chan *Token)
@@ -66,6 +108,9 @@ type TrecFileReader struct {
 	docCounter int
 	scanner    Tokenizer
 	documents  chan Document
+
+	// Read separately from the scanner, for the raw text
+	file *os.File
 }
 
 func (fr *TrecFileReader) Path() string {
@@ -80,6 +125,7 @@ func (fr *TrecFileReader) Init(filename string) {
 		panic(fmt.Sprintf("Unable to open file %s", filename))
 	} else {
 		log.Debugf("Reading XML from %s\n", file)
+		fr.file = file
 		fr.scanner = BadXMLTokenizer_FromReader(file)
 	}
 
@@ -95,6 +141,7 @@ func (fr *TrecFileReader) read_next_doc() (Document, error) {
 	var doc *TrecDocument
 	var in_text, in_title bool
 	var titlebuf = new(bytes.Buffer)
+	var text_start int64
 
 	for {
 		token, ok := fr.scanner.Next()
@@ -120,10 +167,23 @@ func (fr *TrecFileReader) read_next_doc() (Document, error) {
 			if doc == nil {
 				panic(fmt.Sprintf("Found %s before DOC beginning", token))
 			}
+			if locator, ok := fr.scanner.(TagLocator); ok {
+				_, text_start = locator.TagSpan()
+			}
 		case token.Type == XMLEndToken && token.Text == "TEXT":
 			log.Debugf("End TEXT section")
 			in_text = false
 
+			// Keep the text as it is in the file, markup and all
+			if locator, ok := fr.scanner.(TagLocator); ok && doc != nil {
+				text_end, _ := locator.TagSpan()
+				raw := make([]byte, text_end-text_start)
+				if _, err := fr.file.ReadAt(raw, text_start); err != nil {
+					return nil, err
+				}
+				doc.AppendText(raw)
+			}
+
 			/* Read document identifiers */
 		case token.Type == XMLStartToken && token.Text == "DOCNO":
 			in_title = true
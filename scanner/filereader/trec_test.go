@@ -1,6 +1,8 @@
 package filereader
 
 import "testing"
+import "bytes"
+import "io/ioutil"
 import "strings"
 import log "github.com/cihub/seelog"
 import "github.com/cwacek/irengine/logging"
@@ -20,6 +22,14 @@ func TestTrecFileReader(t *testing.T) {
 		t.Error("Failed to parse document id")
 	}
 
+	// The text is kept exactly as it is in the file
+	raw, _ := ioutil.ReadFile("test/testfile1.txt")
+	start := bytes.Index(raw, []byte("<TEXT>")) + len("<TEXT>")
+	end := bytes.Index(raw, []byte("</TEXT>"))
+	if text := doc.(TextDocument).Text(); text != string(raw[start:end]) {
+		t.Errorf("Expected the raw text of the document. Got '%s'", text)
+	}
+
 	tokens := doc.Tokens()
 	exp_tokens := expected()
 	i := 0
@@ -145,3 +155,53 @@ BILLING CODE 3410-02-P
 
 	return c
 }
+
+func TestSentenceBoundaries(t *testing.T) {
+	logging.SetupTestLogging()
+
+	text := "The dog ran. It was fast, very fast!\n\nNew para here? Yes\n<P>tagged U.S. para"
+	expected := []struct {
+		text                string
+		sentence, paragraph int
+	}{
+		{"The", 0, 0}, {"dog", 0, 0}, {"ran", 0, 0},
+		{"It", 1, 0}, {"was", 1, 0}, {"fast", 1, 0}, {"very", 1, 0}, {"fast", 1, 0},
+		{"New", 2, 1}, {"para", 2, 1}, {"here", 2, 1},
+		{"Yes", 3, 1},
+		{"tagged", 4, 2}, {"U.S", 4, 2}, {"para", 5, 2},
+	}
+
+	// Reading the text twice gives the same phrases
+	phrases := make([][]int, 2)
+	for run := range phrases {
+		doc := NewTrecDocument("boundaries")
+		tz := BadXMLTokenizer_FromReader(strings.NewReader(text))
+		for tok, err := tz.Next(); err == nil; tok, err = tz.Next() {
+			if tok.Type == TextToken {
+				doc.Add(tok)
+				phrases[run] = append(phrases[run], tok.PhraseId)
+			}
+		}
+
+		if doc.Len() != len(expected) {
+			t.Fatalf("Expected %d tokens. Got %d", len(expected), doc.Len())
+		}
+
+		for i, tok := range doc.tokens {
+			if tok.Text != expected[i].text || tok.Sentence != expected[i].sentence ||
+				tok.Paragraph != expected[i].paragraph {
+				t.Errorf("Token %d is '%s' in sentence %d, paragraph %d. Expected %v",
+					i, tok.Text, tok.Sentence, tok.Paragraph, expected[i])
+			}
+		}
+	}
+
+	for i := range phrases[0] {
+		if phrases[0][i] != phrases[1][i] {
+			t.Errorf("Token %d had phrase %d, then %d", i, phrases[0][i], phrases[1][i])
+		}
+	}
+	if phrases[0][5] == phrases[0][6] {
+		t.Errorf("A comma didn't end a phrase")
+	}
+}
@@ -17,5 +17,10 @@ func Run() {
 		actions.RunIndexer(),
 		actions.QueryEngineRunner(),
 		actions.QueryRunner(),
+		actions.MigrateIndex(),
+		actions.CheckIndex(),
+		actions.MergeIndexes(),
+		actions.PruneIndex(),
+		actions.EvictionBenchmark(),
 	)
 }